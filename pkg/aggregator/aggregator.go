@@ -21,6 +21,7 @@ import (
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
+	"golang.org/x/time/rate"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/util/retry"
 	"k8s.io/utils/clock"
@@ -28,10 +29,12 @@ import (
 	"github.com/kubewharf/kelemetry/pkg/aggregator/linker"
 	"github.com/kubewharf/kelemetry/pkg/aggregator/spancache"
 	"github.com/kubewharf/kelemetry/pkg/aggregator/tracer"
+	"github.com/kubewharf/kelemetry/pkg/aggregator/window"
 	"github.com/kubewharf/kelemetry/pkg/manager"
 	"github.com/kubewharf/kelemetry/pkg/metrics"
 	"github.com/kubewharf/kelemetry/pkg/util"
 	"github.com/kubewharf/kelemetry/pkg/util/errors"
+	"github.com/kubewharf/kelemetry/pkg/util/shutdown"
 	"github.com/kubewharf/kelemetry/pkg/util/zconstants"
 )
 
@@ -43,13 +46,14 @@ const ObjectField = "object"
 
 type options struct {
 	reserveTtl                   time.Duration
-	spanTtl                      time.Duration
-	spanFollowTtl                time.Duration
-	spanExtraTtl                 time.Duration
 	globalPseudoTags             map[string]string
 	globalEventTags              map[string]string
 	subObjectPrimaryPollInterval time.Duration
 	subObjectPrimaryPollTimeout  time.Duration
+	objectRateLimit              float64
+	objectRateBurst              int
+	objectRateLimitByUserAgent   bool
+	objectRateSummaryInterval    time.Duration
 }
 
 func (options *options) Setup(fs *pflag.FlagSet) {
@@ -60,21 +64,6 @@ func (options *options) Setup(fs *pflag.FlagSet) {
 		"if an object span has not been created after this duration, "+
 			"another goroutine/process will try to create it",
 	)
-	fs.DurationVar(&options.spanTtl,
-		"aggregator-span-ttl",
-		time.Minute*30,
-		"duration of each span",
-	)
-	fs.DurationVar(&options.spanFollowTtl,
-		"aggregator-span-follow-ttl",
-		0,
-		"duration after expiry of previous span within which new spans are considered FollowsFrom",
-	)
-	fs.DurationVar(&options.spanExtraTtl,
-		"aggregator-span-extra-ttl",
-		0,
-		"duration for which an object span is retained after the FollowsFrom period has ended",
-	)
 	fs.StringToStringVar(&options.globalPseudoTags,
 		"aggregator-pseudo-span-global-tags",
 		map[string]string{},
@@ -96,6 +85,27 @@ func (options *options) Setup(fs *pflag.FlagSet) {
 		"timeout to wait for primary event before promoting non-primary events "+
 			"(increasing this timeout may lead to indefinite consumer lag",
 	)
+	fs.Float64Var(&options.objectRateLimit,
+		"aggregator-object-rate-limit",
+		0,
+		"maximum sustained number of events per second sent for each object (0 to disable rate limiting); "+
+			"events exceeding the limit are collapsed into a periodic summary span",
+	)
+	fs.IntVar(&options.objectRateBurst,
+		"aggregator-object-rate-burst",
+		100,
+		"maximum number of events sent for each object in a burst",
+	)
+	fs.BoolVar(&options.objectRateLimitByUserAgent,
+		"aggregator-object-rate-limit-by-user-agent",
+		false,
+		"maintain separate rate limits for each user agent on the same object",
+	)
+	fs.DurationVar(&options.objectRateSummaryInterval,
+		"aggregator-object-rate-summary-interval",
+		time.Minute,
+		"interval to send summary spans for events suppressed by the object rate limit",
+	)
 }
 
 func (options *options) EnableFlag() *bool { return nil }
@@ -109,7 +119,23 @@ type Aggregator interface {
 	// it waits for the primary event to be created and takes it as the parent.
 	// If the primary event does not get created after options.subObjectPrimaryBackoff, this event is promoted as primary.
 	// If multiple primary events are sent, the slower one (by SpanCache-authoritative timing) is demoted.
+	// If the object rate limit is enabled, events exceeding the limit are not sent immediately
+	// but reported in a periodic summary span, and nil is returned for them.
 	Send(ctx context.Context, object util.ObjectRef, event *Event, subObjectId *SubObjectId) error
+
+	// SendBatch sends multiple events to the tracer backend.
+	// Events are grouped by object and field window,
+	// and the pseudo-span hierarchy is only resolved once for each group.
+	// Events are sent in the order of the slice.
+	// The returned slice contains the error of each item with the same index.
+	SendBatch(ctx context.Context, items []BatchItem) []error
+}
+
+// BatchItem is an event to be sent with SendBatch.
+type BatchItem struct {
+	Object      util.ObjectRef
+	Event       *Event
+	SubObjectId *SubObjectId
 }
 
 type SubObjectId struct {
@@ -124,12 +150,16 @@ type aggregator struct {
 	logger    logrus.FieldLogger
 	spanCache spancache.Cache
 	tracer    tracer.Tracer
+	windows   window.Config
 	metrics   metrics.Client
 
+	rateLimiter rateLimiter
+
 	sendMetric               metrics.Metric
 	sinceEventMetric         metrics.Metric
 	lazySpanMetric           metrics.Metric
 	lazySpanRetryCountMetric metrics.Metric
+	suppressedEventMetric    metrics.Metric
 }
 
 func New(
@@ -138,6 +168,7 @@ func New(
 	spanCache spancache.Cache,
 	linkers linker.LinkerList,
 	tracer tracer.Tracer,
+	windows window.Config,
 	metrics metrics.Client,
 ) Aggregator {
 	return &aggregator{
@@ -146,6 +177,7 @@ func New(
 		logger:    logger,
 		spanCache: spanCache,
 		tracer:    tracer,
+		windows:   windows,
 		metrics:   metrics,
 	}
 }
@@ -176,23 +208,87 @@ func (aggregator *aggregator) Options() manager.Options {
 }
 
 func (aggregator *aggregator) Init(ctx context.Context) error {
-	if aggregator.options.spanFollowTtl > aggregator.options.spanTtl {
-		return fmt.Errorf("invalid option: --span-ttl must not be shorter than --span-follow-ttl")
-	}
-
 	aggregator.sendMetric = aggregator.metrics.New("aggregator_send", &sendMetric{})
 	aggregator.sinceEventMetric = aggregator.metrics.New("aggregator_send_since_event", &sinceEventMetric{})
 	aggregator.lazySpanMetric = aggregator.metrics.New("aggregator_lazy_span", &lazySpanMetric{})
 	aggregator.lazySpanRetryCountMetric = aggregator.metrics.New("aggregator_lazy_span_retry_count", &lazySpanMetric{})
+	aggregator.suppressedEventMetric = aggregator.metrics.New("aggregator_suppressed_event", &suppressedEventMetric{})
+
+	if aggregator.rateLimitEnabled() {
+		if aggregator.options.objectRateBurst < 1 {
+			return fmt.Errorf("invalid option: --aggregator-object-rate-burst must be positive")
+		}
+		if aggregator.options.objectRateSummaryInterval <= 0 {
+			return fmt.Errorf("invalid option: --aggregator-object-rate-summary-interval must be positive")
+		}
+	}
+
+	aggregator.rateLimiter.buckets = map[rateLimitKey]*rate.Limiter{}
+	aggregator.rateLimiter.suppressed = map[suppressedKey]*suppressedEvents{}
 
 	return nil
 }
 
-func (aggregator *aggregator) Start(stopCh <-chan struct{}) error { return nil }
+func (aggregator *aggregator) Start(stopCh <-chan struct{}) error {
+	if aggregator.rateLimitEnabled() {
+		go func() {
+			defer shutdown.RecoverPanic(aggregator.logger)
+			aggregator.runSuppressedFlushLoop(stopCh)
+		}()
+	}
+
+	return nil
+}
 
 func (aggregator *aggregator) Close() error { return nil }
 
-func (aggregator *aggregator) Send(ctx context.Context, object util.ObjectRef, event *Event, subObjectId *SubObjectId) (err error) {
+func (aggregator *aggregator) Send(ctx context.Context, object util.ObjectRef, event *Event, subObjectId *SubObjectId) error {
+	if !aggregator.allowEvent(object, event) {
+		return nil
+	}
+
+	return aggregator.send(ctx, object, event, subObjectId, func() (tracer.SpanContext, error) {
+		return aggregator.ensureFieldSpan(ctx, object, event.Field, event.Time)
+	})
+}
+
+func (aggregator *aggregator) SendBatch(ctx context.Context, items []BatchItem) []error {
+	type fieldSpanResult struct {
+		span tracer.SpanContext
+		err  error
+	}
+	fieldSpans := map[string]*fieldSpanResult{}
+
+	errs := make([]error, len(items))
+	for i, item := range items {
+		item := item
+		if !aggregator.allowEvent(item.Object, item.Event) {
+			continue
+		}
+
+		groupKey := aggregator.expiringSpanCacheKey(item.Object, item.Event.Field, item.Event.Time)
+
+		errs[i] = aggregator.send(ctx, item.Object, item.Event, item.SubObjectId, func() (tracer.SpanContext, error) {
+			if result, exists := fieldSpans[groupKey]; exists {
+				return result.span, result.err
+			}
+
+			span, err := aggregator.ensureFieldSpan(ctx, item.Object, item.Event.Field, item.Event.Time)
+			fieldSpans[groupKey] = &fieldSpanResult{span: span, err: err}
+			return span, err
+		})
+	}
+
+	return errs
+}
+
+func (aggregator *aggregator) send(
+	ctx context.Context,
+	object util.ObjectRef,
+	event *Event,
+	subObjectId *SubObjectId,
+	fieldSpanGetter func() (tracer.SpanContext, error),
+) (err error) {
 	sendMetric := &sendMetric{Cluster: object.Cluster, TraceSource: event.TraceSource}
 	defer aggregator.sendMetric.DeferCount(aggregator.clock.Now(), sendMetric)
 
@@ -299,7 +395,7 @@ func (aggregator *aggregator) Send(ctx context.Context, object util.ObjectRef, e
 
 	if parentSpan == nil {
 		// there is no primary span to fallback to, so we are the primary
-		parentSpan, err = aggregator.ensureFieldSpan(ctx, object, event.Field, event.Time)
+		parentSpan, err = fieldSpanGetter()
 		if err != nil {
 			sendMetric.Error = metrics.LabelError(err, "EnsureFieldSpan")
 			return fmt.Errorf("%w during fetching field span for primary span", err)
@@ -348,7 +444,7 @@ func (aggregator *aggregator) Send(ctx context.Context, object util.ObjectRef, e
 			reservedPrimary.cacheKey,
 			sentSpanRaw,
 			reservedPrimary.uid,
-			aggregator.options.spanTtl,
+			aggregator.windows.Get(object.GroupResource()).SpanTtl,
 		); err != nil {
 			sendMetric.Error = metrics.LabelError(err, "SetReserved")
 			return fmt.Errorf("%w during persisting primary span ID", err)
@@ -371,8 +467,9 @@ func (aggregator *aggregator) ensureFieldSpan(
 	field string,
 	eventTime time.Time,
 ) (tracer.SpanContext, error) {
-	return aggregator.getOrCreateSpan(ctx, object, field, eventTime, func() (tracer.SpanContext, error) {
-		return aggregator.ensureObjectSpan(ctx, object, eventTime)
+	return aggregator.getOrCreateSpan(ctx, object, field, eventTime, func() (tracer.SpanContext, []tracer.Link, error) {
+		span, err := aggregator.ensureObjectSpan(ctx, object, eventTime)
+		return span, nil, err
 	})
 }
 
@@ -381,25 +478,81 @@ func (aggregator *aggregator) ensureObjectSpan(
 	object util.ObjectRef,
 	eventTime time.Time,
 ) (tracer.SpanContext, error) {
-	return aggregator.getOrCreateSpan(ctx, object, "object", eventTime, func() (_ tracer.SpanContext, err error) {
-		// try to associate a parent object
-		parent := aggregator.linkers.Lookup(ctx, object)
-		if parent == nil {
-			return nil, nil
+	return aggregator.getOrCreateSpan(ctx, object, "object", eventTime, func() (_ tracer.SpanContext, _ []tracer.Link, err error) {
+		// try to associate related objects
+		primary, secondary := linker.SplitPrimary(aggregator.linkers.Lookup(ctx, object))
+
+		links := aggregator.fetchLinks(ctx, object, secondary, eventTime)
+
+		if primary == nil {
+			return nil, links, nil
 		}
 
 		// ensure parent object has a span
-		return aggregator.ensureChildrenSpan(ctx, *parent, eventTime)
+		parent, err := aggregator.ensureChildrenSpan(ctx, primary.Object, eventTime)
+		return parent, links, err
 	})
 }
 
+// fetchLinks returns links to the existing object spans of the related objects.
+// Spans are not created for related objects that do not have one yet,
+// because secondary relations may form cycles and are not necessarily observed by kelemetry.
+func (aggregator *aggregator) fetchLinks(
+	ctx context.Context,
+	object util.ObjectRef,
+	relations []linker.Relation,
+	eventTime time.Time,
+) []tracer.Link {
+	links := []tracer.Link{}
+
+	for _, relation := range relations {
+		logger := aggregator.logger.
+			WithField("step", "fetchLinks").
+			WithField("object", object).
+			WithField("related", relation.Object)
+
+		entry, err := aggregator.spanCache.Fetch(ctx, aggregator.expiringSpanCacheKey(relation.Object, "object", eventTime))
+		if err != nil {
+			logger.WithError(err).Warn("cannot fetch span of related object")
+			continue
+		}
+
+		if entry == nil || entry.Value == nil {
+			// related object has no span yet, or it is still pending
+			continue
+		}
+
+		spanContext, err := aggregator.tracer.ExtractCarrier(entry.Value)
+		if err != nil {
+			logger.WithError(err).Warn("persisted span of related object contains invalid data")
+			continue
+		}
+
+		links = append(links, tracer.Link{
+			SpanContext: spanContext,
+			Tags: map[string]string{
+				zconstants.LinkRole: string(relation.Role),
+				zconstants.LinkType: relation.Type,
+				"cluster":           relation.Object.Cluster,
+				"group":             relation.Object.Group,
+				"resource":          relation.Object.Resource,
+				"namespace":         relation.Object.Namespace,
+				"name":              relation.Object.Name,
+			},
+		})
+	}
+
+	return links
+}
+
 func (aggregator *aggregator) ensureChildrenSpan(
 	ctx context.Context,
 	object util.ObjectRef,
 	eventTime time.Time,
 ) (tracer.SpanContext, error) {
-	return aggregator.getOrCreateSpan(ctx, object, "children", eventTime, func() (tracer.SpanContext, error) {
-		return aggregator.ensureObjectSpan(ctx, object, eventTime)
+	return aggregator.getOrCreateSpan(ctx, object, "children", eventTime, func() (tracer.SpanContext, []tracer.Link, error) {
+		span, err := aggregator.ensureObjectSpan(ctx, object, eventTime)
+		return span, nil, err
 	})
 }
 
@@ -408,7 +561,7 @@ func (aggregator *aggregator) getOrCreateSpan(
 	object util.ObjectRef,
 	field string,
 	eventTime time.Time,
-	parentGetter func() (tracer.SpanContext, error),
+	parentGetter func() (tracer.SpanContext, []tracer.Link, error),
 ) (tracer.SpanContext, error) {
 	lazySpanMetric := &lazySpanMetric{
 		Cluster: object.Cluster,
@@ -417,6 +570,7 @@ func (aggregator *aggregator) getOrCreateSpan(
 	}
 	defer aggregator.lazySpanMetric.DeferCount(aggregator.clock.Now(), lazySpanMetric)
 
+	spanWindow := aggregator.windows.Get(object.GroupResource())
 	cacheKey := aggregator.expiringSpanCacheKey(object, field, eventTime)
 
 	logger := aggregator.logger.
@@ -458,7 +612,7 @@ func (aggregator *aggregator) getOrCreateSpan(
 		followsFrom = nil
 
 		// check if this new span is a follower of the previous one
-		followsTime := eventTime.Add(-aggregator.options.spanFollowTtl)
+		followsTime := eventTime.Add(-spanWindow.FollowTtl)
 		followsKey := aggregator.expiringSpanCacheKey(object, field, followsTime)
 
 		if followsKey == cacheKey {
@@ -506,12 +660,12 @@ func (aggregator *aggregator) getOrCreateSpan(
 	// we have a new reservation, need to initialize it now
 	startTime := aggregator.clock.Now()
 
-	parent, err := parentGetter()
+	parent, links, err := parentGetter()
 	if err != nil {
 		return nil, fmt.Errorf("cannot fetch parent object: %w", err)
 	}
 
-	span, err := aggregator.createSpan(object, field, eventTime, parent, followsFrom)
+	span, err := aggregator.createSpan(object, field, eventTime, parent, followsFrom, links)
 	if err != nil {
 		return nil, metrics.LabelError(fmt.Errorf("cannot create span: %w", err), "CreateSpan")
 	}
@@ -521,8 +675,7 @@ func (aggregator *aggregator) getOrCreateSpan(
 		return nil, metrics.LabelError(fmt.Errorf("cannot serialize span context: %w", err), "InjectCarrier")
 	}
 
-	totalTtl := aggregator.options.spanTtl + aggregator.options.spanFollowTtl + aggregator.options.spanExtraTtl
-	err = aggregator.spanCache.SetReserved(ctx, cacheKey, entryValue, reserveUid, totalTtl)
+	err = aggregator.spanCache.SetReserved(ctx, cacheKey, entryValue, reserveUid, spanWindow.CacheTtl())
 	if err != nil {
 		return nil, metrics.LabelError(fmt.Errorf("cannot persist reserved value: %w", err), "PersistCarrier")
 	}
@@ -544,16 +697,18 @@ func (aggregator *aggregator) createSpan(
 	eventTime time.Time,
 	parent tracer.SpanContext,
 	followsFrom tracer.SpanContext,
+	links []tracer.Link,
 ) (tracer.SpanContext, error) {
-	remainderSeconds := eventTime.Unix() % int64(aggregator.options.spanTtl.Seconds())
-	startTime := eventTime.Add(-time.Duration(remainderSeconds) * time.Second)
+	spanWindow := aggregator.windows.Get(object.GroupResource())
+	startTime := spanWindow.Start(eventTime)
 	span := tracer.Span{
 		Type:       field,
 		Name:       fmt.Sprintf("%s/%s %s", object.Resource, object.Name, field),
 		StartTime:  startTime,
-		FinishTime: startTime.Add(aggregator.options.spanTtl),
+		FinishTime: startTime.Add(spanWindow.SpanTtl),
 		Parent:     parent,
 		Follows:    followsFrom,
+		Links:      links,
 		Tags: map[string]string{
 			"cluster":              object.Cluster,
 			"namespace":            object.Namespace,
@@ -580,7 +735,7 @@ func (aggregator *aggregator) createSpan(
 }
 
 func (aggregator *aggregator) expiringSpanCacheKey(object util.ObjectRef, field string, timestamp time.Time) string {
-	expiringWindow := timestamp.Unix() / int64(aggregator.options.spanTtl.Seconds())
+	expiringWindow := aggregator.windows.Get(object.GroupResource()).Index(timestamp)
 	return aggregator.spanCacheKey(object, fmt.Sprintf("field=%s,window=%d", field, expiringWindow))
 }
 
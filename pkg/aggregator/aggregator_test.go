@@ -0,0 +1,296 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregator_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"github.com/kubewharf/kelemetry/pkg/aggregator"
+	"github.com/kubewharf/kelemetry/pkg/aggregator/linker"
+	"github.com/kubewharf/kelemetry/pkg/aggregator/spancache"
+	"github.com/kubewharf/kelemetry/pkg/aggregator/spancache/local"
+	"github.com/kubewharf/kelemetry/pkg/aggregator/tracer"
+	"github.com/kubewharf/kelemetry/pkg/aggregator/tracer/memory"
+	"github.com/kubewharf/kelemetry/pkg/aggregator/window"
+	"github.com/kubewharf/kelemetry/pkg/manager"
+	"github.com/kubewharf/kelemetry/pkg/metrics"
+	"github.com/kubewharf/kelemetry/pkg/util"
+	"github.com/kubewharf/kelemetry/pkg/util/zconstants"
+)
+
+var (
+	pod = util.ObjectRef{
+		Cluster:              "test",
+		GroupVersionResource: schema.GroupVersionResource{Version: "v1", Resource: "pods"},
+		Namespace:            "default",
+		Name:                 "foo-abcde",
+	}
+	replicaSet = util.ObjectRef{
+		Cluster:              "test",
+		GroupVersionResource: schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "replicasets"},
+		Namespace:            "default",
+		Name:                 "foo",
+	}
+	node = util.ObjectRef{
+		Cluster:              "test",
+		GroupVersionResource: schema.GroupVersionResource{Version: "v1", Resource: "nodes"},
+		Name:                 "worker-1",
+	}
+)
+
+type staticLinker map[util.ObjectRef][]linker.Relation
+
+func (staticLinker staticLinker) Lookup(ctx context.Context, object util.ObjectRef) []linker.Relation {
+	return staticLinker[object]
+}
+
+func parentOf(object util.ObjectRef) []linker.Relation {
+	return []linker.Relation{{Object: object, Role: linker.RoleParent, Type: "owner"}}
+}
+
+func TestSendLinksParent(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := clocktesting.NewFakeClock(time.Unix(1600000000, 0))
+	agg, mem := newTestAggregator(t, clock, staticLinker{pod: parentOf(replicaSet)})
+
+	event := aggregator.NewEvent("spec", "create", clock.Now(), "audit").
+		Log(zconstants.LogTypeRealVerbose, "created by replicaset-controller")
+	assert.Nil(agg.Send(context.Background(), pod, event, nil))
+
+	eventSpans := mem.FindByTags(map[string]string{zconstants.TraceSource: "audit"})
+	assert.Len(eventSpans, 1)
+	eventSpan := eventSpans[0]
+	assert.True(eventSpan.IsObject(pod))
+	assert.Equal("create", eventSpan.Name)
+	assert.True(eventSpan.HasLog(zconstants.LogTypeRealVerbose, "replicaset-controller"))
+
+	ancestors := mem.Ancestors(eventSpan)
+	assert.Len(ancestors, 4)
+	for i, expected := range []struct {
+		object util.ObjectRef
+		field  string
+	}{
+		{pod, "spec"},
+		{pod, aggregator.ObjectField},
+		{replicaSet, "children"},
+		{replicaSet, aggregator.ObjectField},
+	} {
+		assert.True(ancestors[i].IsObject(expected.object), "ancestor %d is %s", i, ancestors[i].Name)
+		assert.Equal(expected.field, ancestors[i].Tags[zconstants.NestLevel])
+	}
+
+	root := ancestors[len(ancestors)-1]
+	assert.Nil(mem.Parent(root))
+	assert.Len(mem.Trace(root), len(mem.Spans()))
+}
+
+func TestSendLinksSecondaryRelations(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := clocktesting.NewFakeClock(time.Unix(1600000000, 0))
+	agg, mem := newTestAggregator(t, clock, staticLinker{
+		pod: append(parentOf(replicaSet), linker.Relation{Object: node, Role: linker.RoleLink, Type: "scheduled"}),
+	})
+
+	assert.Nil(agg.Send(context.Background(), node, aggregator.NewEvent("spec", "create", clock.Now(), "audit"), nil))
+	assert.Nil(agg.Send(context.Background(), pod, aggregator.NewEvent("spec", "create", clock.Now(), "audit"), nil))
+
+	podSpans := mem.FindByTags(map[string]string{"resource": "pods", zconstants.NestLevel: aggregator.ObjectField})
+	assert.Len(podSpans, 1)
+	podSpan := podSpans[0]
+
+	parent := mem.Parent(podSpan)
+	assert.NotNil(parent)
+	assert.True(parent.IsObject(replicaSet))
+
+	links := mem.Links(podSpan)
+	assert.Len(links, 1)
+	assert.True(links[0].IsObject(node))
+	assert.Equal(aggregator.ObjectField, links[0].Tags[zconstants.NestLevel])
+	assert.NotEqual(podSpan.TraceId, links[0].TraceId)
+	assert.Equal("scheduled", podSpan.Links[0].Tags[zconstants.LinkType])
+	assert.Equal(string(linker.RoleLink), podSpan.Links[0].Tags[zconstants.LinkRole])
+}
+
+func TestSendSkipsLinksWithoutSpan(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := clocktesting.NewFakeClock(time.Unix(1600000000, 0))
+	agg, mem := newTestAggregator(t, clock, staticLinker{
+		pod: {{Object: node, Role: linker.RoleLink, Type: "scheduled"}},
+	})
+
+	assert.Nil(agg.Send(context.Background(), pod, aggregator.NewEvent("spec", "create", clock.Now(), "audit"), nil))
+
+	assert.Empty(mem.FindByObject(node))
+	for _, span := range mem.FindByObject(pod) {
+		assert.Empty(span.Links)
+	}
+}
+
+func TestSendReusesFieldSpan(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := clocktesting.NewFakeClock(time.Unix(1600000000, 0))
+	agg, mem := newTestAggregator(t, clock, staticLinker{})
+
+	for _, title := range []string{"create", "update"} {
+		event := aggregator.NewEvent("spec", title, clock.Now(), "audit")
+		assert.Nil(agg.Send(context.Background(), pod, event, nil))
+		clock.Step(time.Second)
+	}
+
+	specSpans := mem.FindByTags(map[string]string{zconstants.NestLevel: "spec"})
+	assert.Len(specSpans, 1)
+
+	children := mem.Children(specSpans[0])
+	assert.Len(children, 2)
+	assert.Equal("create", children[0].Name)
+	assert.Equal("update", children[1].Name)
+}
+
+func TestSendBatchResolvesFieldSpanOnce(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := clocktesting.NewFakeClock(time.Unix(1600000000, 0))
+
+	single, singleCache := newCountingAggregator(t, clock)
+	assert.Nil(single.Send(context.Background(), pod, aggregator.NewEvent("spec", "create", clock.Now(), "audit"), nil))
+
+	batch, batchCache := newCountingAggregator(t, clock)
+	items := []aggregator.BatchItem{}
+	for _, title := range []string{"create", "update", "patch"} {
+		items = append(items, aggregator.BatchItem{
+			Object: pod,
+			Event:  aggregator.NewEvent("spec", title, clock.Now(), "audit"),
+		})
+	}
+	items = append(items, aggregator.BatchItem{
+		Object: replicaSet,
+		Event:  aggregator.NewEvent("spec", "update", clock.Now(), "audit"),
+	})
+
+	errs := batch.SendBatch(context.Background(), items)
+	assert.Equal([]error{nil, nil, nil, nil}, errs)
+	assert.Equal(singleCache.fetchOrReserveCount*2, batchCache.fetchOrReserveCount)
+}
+
+func TestSendRateLimitSummarizesSuppressed(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := clocktesting.NewFakeClock(time.Unix(1600000000, 0))
+	agg, mem := newTestAggregator(t, clock, staticLinker{},
+		"--aggregator-object-rate-limit=0.1",
+		"--aggregator-object-rate-burst=2",
+		"--aggregator-object-rate-limit-by-user-agent",
+		"--aggregator-object-rate-summary-interval=1m",
+	)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	assert.Nil(agg.Start(stopCh))
+
+	for i := 0; i < 5; i++ {
+		event := aggregator.NewEvent("spec", "update", clock.Now(), "audit").WithTag(aggregator.UserAgentTag, "hot-controller")
+		assert.Nil(agg.Send(context.Background(), pod, event, nil))
+	}
+	event := aggregator.NewEvent("spec", "update", clock.Now(), "audit").WithTag(aggregator.UserAgentTag, "kubectl")
+	assert.Nil(agg.Send(context.Background(), pod, event, nil))
+
+	assert.Len(mem.FindByTags(map[string]string{zconstants.TraceSource: "audit"}), 3)
+
+	assert.Eventually(clock.HasWaiters, time.Second, time.Millisecond)
+	clock.Step(time.Minute)
+
+	assert.Eventually(func() bool {
+		return len(mem.FindByTags(map[string]string{zconstants.TraceSource: "audit"})) == 4
+	}, time.Second, time.Millisecond)
+
+	summaries := mem.FindByTags(map[string]string{"suppressedCount": "3"})
+	assert.Len(summaries, 1)
+	assert.Equal("3 events suppressed by hot-controller", summaries[0].Name)
+	assert.Equal("hot-controller", summaries[0].Tags[aggregator.UserAgentTag])
+	assert.Len(summaries[0].LogsOfType(zconstants.LogTypeKelemetryError), 1)
+	assert.Equal("spec", mem.Parent(summaries[0]).Tags[zconstants.NestLevel])
+}
+
+type countingCache struct {
+	spancache.Cache
+	fetchOrReserveCount int
+}
+
+func (cache *countingCache) FetchOrReserve(ctx context.Context, key string, ttl time.Duration) (*spancache.Entry, error) {
+	cache.fetchOrReserveCount++
+	return cache.Cache.FetchOrReserve(ctx, key, ttl)
+}
+
+func newCountingAggregator(t *testing.T, clock *clocktesting.FakeClock) (aggregator.Aggregator, *countingCache) {
+	cache := &countingCache{Cache: local.NewMockLocal(clock)}
+	tracer, _ := memory.NewMockMemory()
+	agg := newAggregatorWith(t, clock, cache, staticLinker{}, tracer)
+	return agg, cache
+}
+
+func newTestAggregator(
+	t *testing.T,
+	clock *clocktesting.FakeClock,
+	linkerImpl linker.Linker,
+	args ...string,
+) (aggregator.Aggregator, *memory.Memory) {
+	tracer, mem := memory.NewMockMemory()
+	agg := newAggregatorWith(t, clock, local.NewMockLocal(clock), linkerImpl, tracer, args...)
+	return agg, mem
+}
+
+func newAggregatorWith(
+	t *testing.T,
+	clock *clocktesting.FakeClock,
+	cache spancache.Cache,
+	linkerImpl linker.Linker,
+	tracer tracer.Tracer,
+	args ...string,
+) aggregator.Aggregator {
+	linkers := linker.NewLinkerList()
+	linkers.AddLinker(linkerImpl)
+
+	metricsClient, _ := metrics.NewMock(clock)
+	windows := window.New()
+
+	agg := aggregator.New(logrus.New(), clock, cache, linkers, tracer, windows, metricsClient)
+
+	fs := pflag.NewFlagSet("test", pflag.PanicOnError)
+	windows.Options().Setup(fs)
+	agg.Options().Setup(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, comp := range []manager.Component{windows, agg} {
+		if err := comp.Init(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return agg
+}
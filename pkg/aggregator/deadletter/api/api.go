@@ -0,0 +1,160 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"k8s.io/utils/clock"
+
+	"github.com/kubewharf/kelemetry/pkg/aggregator/deadletter"
+	"github.com/kubewharf/kelemetry/pkg/http"
+	"github.com/kubewharf/kelemetry/pkg/manager"
+	"github.com/kubewharf/kelemetry/pkg/metrics"
+	"github.com/kubewharf/kelemetry/pkg/util/shutdown"
+)
+
+func init() {
+	manager.Global.Provide("aggregator-dead-letter-api", NewApi)
+}
+
+type apiOptions struct {
+	enable bool
+}
+
+func (options *apiOptions) Setup(fs *pflag.FlagSet) {
+	fs.BoolVar(&options.enable, "aggregator-dead-letter-api-enable", false, "enable API to inspect and purge dead-letter entries")
+}
+
+func (options *apiOptions) EnableFlag() *bool { return &options.enable }
+
+type api struct {
+	options apiOptions
+	logger  logrus.FieldLogger
+	clock   clock.Clock
+	store   deadletter.Store
+	metrics metrics.Client
+	server  http.Server
+
+	requestMetric metrics.Metric
+}
+
+type requestMetric struct {
+	Method string
+}
+
+func NewApi(
+	logger logrus.FieldLogger,
+	clock clock.Clock,
+	store deadletter.Store,
+	metrics metrics.Client,
+	server http.Server,
+) *api {
+	return &api{
+		logger:  logger,
+		clock:   clock,
+		store:   store,
+		metrics: metrics,
+		server:  server,
+	}
+}
+
+func (api *api) Options() manager.Options {
+	return &api.options
+}
+
+func (api *api) Init(ctx context.Context) error {
+	api.requestMetric = api.metrics.New("aggregator_dead_letter_api_request", &requestMetric{})
+
+	api.server.Routes().GET("/dead-letter", api.handle(api.handleList))
+	api.server.Routes().DELETE("/dead-letter", api.handle(api.handlePurge))
+	api.server.Routes().DELETE("/dead-letter/:id", api.handle(api.handleDelete))
+
+	return nil
+}
+
+func (api *api) Start(stopCh <-chan struct{}) error { return nil }
+
+func (api *api) Close() error { return nil }
+
+func (api *api) handle(handler func(ctx *gin.Context) error) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		logger := api.logger.WithField("source", ctx.Request.RemoteAddr)
+		defer shutdown.RecoverPanic(logger)
+		metric := &requestMetric{Method: ctx.Request.Method}
+		defer api.requestMetric.DeferCount(api.clock.Now(), metric)
+
+		if err := handler(ctx); err != nil {
+			logger.WithError(err).Error()
+		}
+	}
+}
+
+// handleList returns the total number of entries and up to `limit` (default 100) entries.
+func (api *api) handleList(ctx *gin.Context) error {
+	limit := 100
+	if limitString := ctx.Query("limit"); limitString != "" {
+		parsedLimit, err := strconv.Atoi(limitString)
+		if err != nil {
+			return ctx.AbortWithError(400, fmt.Errorf("invalid limit: %w", err))
+		}
+		limit = parsedLimit
+	}
+
+	count, err := api.store.Count(ctx)
+	if err != nil {
+		return ctx.AbortWithError(500, err)
+	}
+
+	entries, err := api.store.List(ctx, limit)
+	if err != nil {
+		return ctx.AbortWithError(500, err)
+	}
+
+	ctx.JSON(200, gin.H{"count": count, "entries": entries})
+	return nil
+}
+
+// handlePurge deletes all entries.
+func (api *api) handlePurge(ctx *gin.Context) error {
+	entries, err := api.store.List(ctx, 0)
+	if err != nil {
+		return ctx.AbortWithError(500, err)
+	}
+
+	for _, entry := range entries {
+		if err := api.store.Delete(ctx, entry.Id); err != nil {
+			return ctx.AbortWithError(500, err)
+		}
+	}
+
+	ctx.JSON(200, gin.H{"deleted": len(entries)})
+	return nil
+}
+
+// handleDelete deletes a single entry.
+func (api *api) handleDelete(ctx *gin.Context) error {
+	if err := api.store.Delete(ctx, ctx.Param("id")); err != nil {
+		return ctx.AbortWithError(500, err)
+	}
+
+	ctx.Status(204)
+	return nil
+}
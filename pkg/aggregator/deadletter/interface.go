@@ -0,0 +1,92 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package deadletter persists aggregator events that failed to be sent
+// and retries them in the background.
+package deadletter
+
+import (
+	"context"
+	"time"
+
+	"github.com/kubewharf/kelemetry/pkg/aggregator"
+	"github.com/kubewharf/kelemetry/pkg/manager"
+	"github.com/kubewharf/kelemetry/pkg/util"
+)
+
+func init() {
+	manager.Global.Provide("dead-letter-store", newMux)
+}
+
+// Entry is an aggregator event that failed to be sent.
+type Entry struct {
+	// Id uniquely identifies the entry. Entries are ordered by Id in the order of first failure.
+	Id          string                  `json:"id"`
+	Object      util.ObjectRef          `json:"object"`
+	Event       *aggregator.Event       `json:"event"`
+	SubObjectId *aggregator.SubObjectId `json:"subObjectId,omitempty"`
+	// RawObject is the content of Object.Raw, which is not serialized as part of Object.
+	// It is null if Object.Raw is nil, and linkers fetch the object again upon retry.
+	RawObject map[string]any `json:"rawObject"`
+
+	// LastError is the error message of the last failed attempt.
+	LastError string `json:"lastError"`
+	// Attempts is the number of failed attempts, including the original send.
+	Attempts     int       `json:"attempts"`
+	FirstFailure time.Time `json:"firstFailure"`
+	NextRetry    time.Time `json:"nextRetry"`
+}
+
+// Store persists dead-letter entries.
+type Store interface {
+	// Put inserts the entry, or replaces the existing entry with the same Id.
+	Put(ctx context.Context, entry *Entry) error
+
+	// List returns up to limit entries ordered by Id.
+	// All entries are returned if limit is not positive.
+	List(ctx context.Context, limit int) ([]*Entry, error)
+
+	// Delete deletes the entry with the specified Id.
+	// Deleting a nonexistent entry is not an error.
+	Delete(ctx context.Context, id string) error
+
+	// Count returns the number of entries in the store.
+	Count(ctx context.Context) (int, error)
+}
+
+type mux struct {
+	*manager.Mux
+}
+
+func newMux() Store {
+	return &mux{
+		Mux: manager.NewMux("aggregator-dead-letter-store", false),
+	}
+}
+
+func (mux *mux) Put(ctx context.Context, entry *Entry) error {
+	return mux.Impl().(Store).Put(ctx, entry)
+}
+
+func (mux *mux) List(ctx context.Context, limit int) ([]*Entry, error) {
+	return mux.Impl().(Store).List(ctx, limit)
+}
+
+func (mux *mux) Delete(ctx context.Context, id string) error {
+	return mux.Impl().(Store).Delete(ctx, id)
+}
+
+func (mux *mux) Count(ctx context.Context) (int, error) {
+	return mux.Impl().(Store).Count(ctx)
+}
@@ -0,0 +1,211 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+
+	"github.com/kubewharf/kelemetry/pkg/aggregator/deadletter"
+	"github.com/kubewharf/kelemetry/pkg/manager"
+)
+
+func init() {
+	manager.Global.ProvideMuxImpl("dead-letter-store/local", NewLocal, deadletter.Store.Put)
+}
+
+const fileSuffix = ".json"
+
+type options struct {
+	dir string
+}
+
+func (options *options) Setup(fs *pflag.FlagSet) {
+	fs.StringVar(&options.dir,
+		"aggregator-dead-letter-local-dir",
+		"dead-letter",
+		"directory to store dead-letter entries in, one file per entry",
+	)
+}
+
+func (options *options) EnableFlag() *bool { return nil }
+
+// Local stores each dead-letter entry as a JSON file in a local directory.
+// All entries are also indexed in memory, so the directory should not be shared between processes.
+type Local struct {
+	manager.MuxImplBase
+	options options
+	logger  logrus.FieldLogger
+
+	lock    sync.Mutex
+	entries map[string]*deadletter.Entry
+}
+
+var _ deadletter.Store = &Local{}
+
+func NewLocal(logger logrus.FieldLogger) *Local {
+	return &Local{
+		logger:  logger,
+		entries: map[string]*deadletter.Entry{},
+	}
+}
+
+func (_ *Local) MuxImplName() (name string, isDefault bool) { return "local", true }
+
+func (store *Local) Options() manager.Options { return &store.options }
+
+func (store *Local) Init(ctx context.Context) error {
+	files, err := os.ReadDir(store.options.dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			// the directory is created upon the first Put
+			return nil
+		}
+
+		return fmt.Errorf("cannot read dead-letter directory: %w", err)
+	}
+
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), fileSuffix) {
+			continue
+		}
+
+		logger := store.logger.WithField("file", file.Name())
+
+		data, err := os.ReadFile(filepath.Join(store.options.dir, file.Name()))
+		if err != nil {
+			return fmt.Errorf("cannot read dead-letter entry %q: %w", file.Name(), err)
+		}
+
+		// integers in tags and raw objects are decoded as int64 instead of float64
+		entry := &deadletter.Entry{}
+		if err := utiljson.Unmarshal(data, entry); err != nil {
+			logger.WithError(err).Warn("Skipping corrupted dead-letter entry")
+			continue
+		}
+
+		if entry.Id+fileSuffix != file.Name() {
+			logger.WithField("id", entry.Id).Warn("Skipping dead-letter entry with mismatched ID")
+			continue
+		}
+
+		store.entries[entry.Id] = entry
+	}
+
+	store.logger.WithField("count", len(store.entries)).Info("Loaded dead-letter entries")
+
+	return nil
+}
+
+func (store *Local) Start(stopCh <-chan struct{}) error { return nil }
+
+func (store *Local) Close() error { return nil }
+
+func (store *Local) Put(ctx context.Context, entry *deadletter.Entry) error {
+	if entry.Id == "" || strings.ContainsAny(entry.Id, `/\`) || strings.HasPrefix(entry.Id, ".") {
+		return fmt.Errorf("invalid dead-letter entry ID %q", entry.Id)
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("cannot marshal dead-letter entry: %w", err)
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if err := os.MkdirAll(store.options.dir, 0o700); err != nil {
+		return fmt.Errorf("cannot create dead-letter directory: %w", err)
+	}
+
+	// write to a temporary file first so that a crash never leaves a truncated entry
+	path := store.path(entry.Id)
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o600); err != nil {
+		return fmt.Errorf("cannot write dead-letter entry: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("cannot rename dead-letter entry: %w", err)
+	}
+
+	copied := *entry
+	store.entries[entry.Id] = &copied
+
+	return nil
+}
+
+func (store *Local) List(ctx context.Context, limit int) ([]*deadletter.Entry, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	ids := make([]string, 0, len(store.entries))
+	for id := range store.entries {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	if limit > 0 && len(ids) > limit {
+		ids = ids[:limit]
+	}
+
+	entries := make([]*deadletter.Entry, len(ids))
+	for i, id := range ids {
+		copied := *store.entries[id]
+		entries[i] = &copied
+	}
+
+	return entries, nil
+}
+
+func (store *Local) Delete(ctx context.Context, id string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	// only delete known entries, so that arbitrary IDs cannot refer to other files
+	if _, exists := store.entries[id]; !exists {
+		return nil
+	}
+
+	if err := os.Remove(store.path(id)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("cannot delete dead-letter entry: %w", err)
+	}
+
+	delete(store.entries, id)
+
+	return nil
+}
+
+func (store *Local) Count(ctx context.Context) (int, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	return len(store.entries), nil
+}
+
+func (store *Local) path(id string) string {
+	return filepath.Join(store.options.dir, id+fileSuffix)
+}
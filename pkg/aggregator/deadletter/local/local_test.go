@@ -0,0 +1,167 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/kubewharf/kelemetry/pkg/aggregator"
+	"github.com/kubewharf/kelemetry/pkg/aggregator/deadletter"
+	"github.com/kubewharf/kelemetry/pkg/aggregator/deadletter/local"
+	"github.com/kubewharf/kelemetry/pkg/util"
+	"github.com/kubewharf/kelemetry/pkg/util/zconstants"
+)
+
+func newEntry(id string) *deadletter.Entry {
+	eventTime := time.Unix(1600000000, 0).UTC()
+	return &deadletter.Entry{
+		Id: id,
+		Object: util.ObjectRef{
+			Cluster:              "test",
+			GroupVersionResource: schema.GroupVersionResource{Version: "v1", Resource: "pods"},
+			Namespace:            "default",
+			Name:                 "foo",
+		},
+		Event: aggregator.NewEvent("spec", "update", eventTime, "audit").
+			WithTag("userAgent", "kubectl").
+			Log(zconstants.LogTypeRealVerbose, "updated"),
+		SubObjectId:  &aggregator.SubObjectId{Id: "rv=1", Primary: true},
+		LastError:    "span cache unavailable",
+		Attempts:     1,
+		FirstFailure: eventTime,
+		NextRetry:    eventTime.Add(time.Second * 10),
+	}
+}
+
+func newStore(t *testing.T, dir string) deadletter.Store {
+	store := local.NewLocal(logrus.New())
+
+	fs := pflag.NewFlagSet("test", pflag.PanicOnError)
+	store.Options().Setup(fs)
+	if err := fs.Parse([]string{"--aggregator-dead-letter-local-dir=" + dir}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	return store
+}
+
+func TestPersistAcrossRestart(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	dir := filepath.Join(t.TempDir(), "dead-letter")
+	store := newStore(t, dir)
+
+	for _, id := range []string{"b", "a", "c"} {
+		assert.Nil(store.Put(ctx, newEntry(id)))
+	}
+	assert.Nil(store.Delete(ctx, "c"))
+
+	reloaded := newStore(t, dir)
+	count, err := reloaded.Count(ctx)
+	assert.Nil(err)
+	assert.Equal(2, count)
+
+	entries, err := reloaded.List(ctx, 0)
+	assert.Nil(err)
+	assert.Len(entries, 2)
+	assert.Equal("a", entries[0].Id)
+	assert.Equal("b", entries[1].Id)
+	assert.Equal(newEntry("a").Object, entries[0].Object)
+	assert.Equal("update", entries[0].Event.Title)
+	assert.Equal("kubectl", entries[0].Event.Tags["userAgent"])
+	assert.Equal("updated", entries[0].Event.Logs[0].Message)
+	assert.Equal("rv=1", entries[0].SubObjectId.Id)
+}
+
+func TestListLimit(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	store := newStore(t, t.TempDir())
+	for _, id := range []string{"c", "b", "a"} {
+		assert.Nil(store.Put(ctx, newEntry(id)))
+	}
+
+	entries, err := store.List(ctx, 2)
+	assert.Nil(err)
+	assert.Len(entries, 2)
+	assert.Equal("a", entries[0].Id)
+	assert.Equal("b", entries[1].Id)
+}
+
+func TestDeleteUnknownId(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	outside := filepath.Join(dir, "outside.json")
+	assert.Nil(os.WriteFile(outside, []byte("{}"), 0o600))
+
+	store := newStore(t, filepath.Join(dir, "dead-letter"))
+	assert.Nil(store.Delete(ctx, "../outside"))
+
+	_, err := os.Stat(outside)
+	assert.Nil(err)
+
+	assert.NotNil(store.Put(ctx, newEntry("../outside")))
+}
+
+func TestPersistTypes(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	store := newStore(t, dir)
+
+	withRaw := newEntry("a")
+	withRaw.Event.WithTag("code", 200).WithTag("ratio", 0.5)
+	withRaw.RawObject = map[string]any{"metadata": map[string]any{"generation": int64(3)}}
+	assert.Nil(store.Put(ctx, withRaw))
+
+	emptyRaw := newEntry("b")
+	emptyRaw.RawObject = map[string]any{}
+	assert.Nil(store.Put(ctx, emptyRaw))
+
+	assert.Nil(store.Put(ctx, newEntry("c")))
+
+	entries, err := newStore(t, dir).List(ctx, 0)
+	assert.Nil(err)
+	if !assert.Len(entries, 3) {
+		return
+	}
+
+	assert.Equal(int64(200), entries[0].Event.Tags["code"])
+	assert.Equal(0.5, entries[0].Event.Tags["ratio"])
+	assert.Equal(withRaw.RawObject, entries[0].RawObject)
+
+	// an empty raw object is distinct from the absence of a raw object
+	assert.NotNil(entries[1].RawObject)
+	assert.Empty(entries[1].RawObject)
+	assert.Nil(entries[2].RawObject)
+}
@@ -0,0 +1,338 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deadletter
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/utils/clock"
+
+	"github.com/kubewharf/kelemetry/pkg/aggregator"
+	"github.com/kubewharf/kelemetry/pkg/manager"
+	"github.com/kubewharf/kelemetry/pkg/metrics"
+	"github.com/kubewharf/kelemetry/pkg/util/shutdown"
+)
+
+func init() {
+	manager.Global.Provide("aggregator-dead-letter", NewQueue)
+}
+
+type queueOptions struct {
+	enable         bool
+	maxEntries     int
+	retryInterval  time.Duration
+	retryBatchSize int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	maxAttempts    int
+}
+
+func (options *queueOptions) Setup(fs *pflag.FlagSet) {
+	fs.BoolVar(&options.enable,
+		"aggregator-dead-letter-enable",
+		false,
+		"persist events that failed to be sent to the aggregator and retry them later",
+	)
+	fs.IntVar(&options.maxEntries,
+		"aggregator-dead-letter-max-entries",
+		100000,
+		"maximum number of entries in the dead-letter store; new failures are dropped when the store is full",
+	)
+	fs.DurationVar(&options.retryInterval,
+		"aggregator-dead-letter-retry-interval",
+		time.Second*10,
+		"interval to scan the dead-letter store for entries due for retry",
+	)
+	fs.IntVar(&options.retryBatchSize,
+		"aggregator-dead-letter-retry-batch-size",
+		100,
+		"maximum number of entries retried in each scan",
+	)
+	fs.DurationVar(&options.initialBackoff,
+		"aggregator-dead-letter-initial-backoff",
+		time.Second*10,
+		"delay before the first retry of a failed event, doubled after each failed retry",
+	)
+	fs.DurationVar(&options.maxBackoff,
+		"aggregator-dead-letter-max-backoff",
+		time.Minute*10,
+		"maximum delay between retries of a failed event",
+	)
+	fs.IntVar(&options.maxAttempts,
+		"aggregator-dead-letter-max-attempts",
+		10,
+		"number of failed attempts after which an entry is discarded (0 to retry indefinitely)",
+	)
+}
+
+func (options *queueOptions) EnableFlag() *bool { return nil }
+
+// Queue collects events that failed to be sent and retries them in the background.
+type Queue interface {
+	manager.Component
+
+	// Push persists an event that failed to be sent with the specified error.
+	// Push is a no-op if the dead-letter queue is disabled.
+	Push(ctx context.Context, item aggregator.BatchItem, sendErr error) error
+}
+
+type queue struct {
+	options    queueOptions
+	logger     logrus.FieldLogger
+	clock      clock.Clock
+	aggregator aggregator.Aggregator
+	store      Store
+	metrics    metrics.Client
+
+	ctx context.Context
+	// count is the number of entries in the store, maintained by Push and retry
+	// so that the store is not counted on every push.
+	count       atomic.Int64
+	randLock    sync.Mutex
+	rand        *rand.Rand
+	pushMetric  metrics.Metric
+	retryMetric metrics.Metric
+}
+
+type pushMetric struct {
+	Cluster     string
+	TraceSource string
+	Result      string
+	Error       metrics.LabeledError
+}
+
+type retryMetric struct {
+	Cluster     string
+	TraceSource string
+	Result      string
+}
+
+type sizeMetric struct{}
+
+func NewQueue(
+	logger logrus.FieldLogger,
+	clock clock.Clock,
+	aggregator aggregator.Aggregator,
+	store Store,
+	metrics metrics.Client,
+) Queue {
+	return &queue{
+		logger:     logger,
+		clock:      clock,
+		aggregator: aggregator,
+		store:      store,
+		metrics:    metrics,
+		rand:       rand.New(rand.NewSource(clock.Now().UnixNano())),
+	}
+}
+
+func (queue *queue) Options() manager.Options { return &queue.options }
+
+func (queue *queue) Init(ctx context.Context) error {
+	queue.ctx = ctx
+	queue.pushMetric = queue.metrics.New("aggregator_dead_letter_push", &pushMetric{})
+	queue.retryMetric = queue.metrics.New("aggregator_dead_letter_retry", &retryMetric{})
+
+	if !queue.options.enable {
+		return nil
+	}
+
+	if queue.options.retryInterval <= 0 {
+		return fmt.Errorf("--aggregator-dead-letter-retry-interval must be positive")
+	}
+	if queue.options.retryBatchSize < 1 {
+		return fmt.Errorf("--aggregator-dead-letter-retry-batch-size must be positive")
+	}
+	if queue.options.initialBackoff <= 0 {
+		return fmt.Errorf("--aggregator-dead-letter-initial-backoff must be positive")
+	}
+	if queue.options.maxBackoff < queue.options.initialBackoff {
+		return fmt.Errorf("--aggregator-dead-letter-max-backoff must not be shorter than --aggregator-dead-letter-initial-backoff")
+	}
+
+	count, err := queue.store.Count(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot count dead-letter entries: %w", err)
+	}
+	queue.count.Store(int64(count))
+
+	queue.metrics.NewMonitor("aggregator_dead_letter_size", &sizeMetric{}, queue.count.Load)
+
+	return nil
+}
+
+func (queue *queue) Start(stopCh <-chan struct{}) error {
+	if !queue.options.enable {
+		return nil
+	}
+
+	go func() {
+		defer shutdown.RecoverPanic(queue.logger)
+		for {
+			select {
+			case <-queue.clock.After(queue.options.retryInterval):
+				if err := queue.retryDue(queue.ctx); err != nil {
+					queue.logger.WithError(err).Error("cannot retry dead-letter entries")
+				}
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (queue *queue) Close() error { return nil }
+
+func (queue *queue) Push(ctx context.Context, item aggregator.BatchItem, sendErr error) error {
+	if !queue.options.enable {
+		return nil
+	}
+
+	metric := &pushMetric{Cluster: item.Object.Cluster, TraceSource: item.Event.TraceSource, Result: "error"}
+	defer queue.pushMetric.DeferCount(queue.clock.Now(), metric)
+
+	// reserve a slot first so that concurrent pushes cannot exceed maxEntries
+	if queue.count.Add(1) > int64(queue.options.maxEntries) {
+		queue.count.Add(-1)
+		metric.Result = "full"
+		return fmt.Errorf("dead-letter store is full, dropping event: %w", sendErr)
+	}
+
+	now := queue.clock.Now()
+	entry := &Entry{
+		Id:           queue.newId(now),
+		Object:       item.Object,
+		Event:        item.Event,
+		SubObjectId:  item.SubObjectId,
+		LastError:    sendErr.Error(),
+		Attempts:     1,
+		FirstFailure: now,
+		NextRetry:    now.Add(queue.backoff(1)),
+	}
+	if item.Object.Raw != nil {
+		entry.RawObject = item.Object.Raw.Object
+	}
+
+	if err := queue.store.Put(ctx, entry); err != nil {
+		queue.count.Add(-1)
+		metric.Error = metrics.LabelError(err, "Put")
+		return fmt.Errorf("cannot persist dead-letter entry: %w", err)
+	}
+
+	metric.Result = "stored"
+	return nil
+}
+
+// retryDue resends the entries whose retry time has passed.
+// Entries are deleted upon success or after too many failed attempts.
+func (queue *queue) retryDue(ctx context.Context) error {
+	entries, err := queue.store.List(ctx, 0)
+	if err != nil {
+		return fmt.Errorf("cannot list dead-letter entries: %w", err)
+	}
+
+	now := queue.clock.Now()
+	retried := 0
+
+	for _, entry := range entries {
+		if retried >= queue.options.retryBatchSize {
+			break
+		}
+
+		if entry.NextRetry.After(now) {
+			continue
+		}
+
+		retried += 1
+		if err := queue.retry(ctx, entry); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (queue *queue) retry(ctx context.Context, entry *Entry) error {
+	logger := queue.logger.WithField("id", entry.Id).WithField("object", entry.Object)
+
+	metric := &retryMetric{Cluster: entry.Object.Cluster, TraceSource: entry.Event.TraceSource}
+	defer queue.retryMetric.DeferCount(queue.clock.Now(), metric)
+
+	object := entry.Object
+	if entry.RawObject != nil {
+		// collection pseudo-objects have an empty raw object so that linkers do not fetch them
+		object.Raw = &unstructured.Unstructured{Object: entry.RawObject}
+	}
+
+	sendErr := queue.aggregator.Send(ctx, object, entry.Event, entry.SubObjectId)
+	if sendErr == nil {
+		metric.Result = "success"
+		logger.WithField("attempts", entry.Attempts).Debug("Resent dead-letter entry")
+		return queue.delete(ctx, entry.Id)
+	}
+
+	entry.Attempts += 1
+	entry.LastError = sendErr.Error()
+
+	if queue.options.maxAttempts > 0 && entry.Attempts >= queue.options.maxAttempts {
+		metric.Result = "drop"
+		logger.WithError(sendErr).WithField("attempts", entry.Attempts).Warn("Discarding dead-letter entry after too many attempts")
+		return queue.delete(ctx, entry.Id)
+	}
+
+	metric.Result = "retry"
+	entry.NextRetry = queue.clock.Now().Add(queue.backoff(entry.Attempts))
+	return queue.store.Put(ctx, entry)
+}
+
+func (queue *queue) delete(ctx context.Context, id string) error {
+	if err := queue.store.Delete(ctx, id); err != nil {
+		return err
+	}
+
+	queue.count.Add(-1)
+	return nil
+}
+
+// backoff returns the delay after the specified number of failed attempts.
+func (queue *queue) backoff(attempts int) time.Duration {
+	backoff := queue.options.initialBackoff
+	for i := 1; i < attempts && backoff < queue.options.maxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > queue.options.maxBackoff {
+		backoff = queue.options.maxBackoff
+	}
+
+	return backoff
+}
+
+func (queue *queue) newId(now time.Time) string {
+	queue.randLock.Lock()
+	defer queue.randLock.Unlock()
+
+	return fmt.Sprintf("%016x-%08x", now.UnixNano(), queue.rand.Uint32())
+}
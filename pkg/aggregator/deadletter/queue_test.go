@@ -0,0 +1,236 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deadletter_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"github.com/kubewharf/kelemetry/pkg/aggregator"
+	"github.com/kubewharf/kelemetry/pkg/aggregator/deadletter"
+	"github.com/kubewharf/kelemetry/pkg/aggregator/deadletter/local"
+	"github.com/kubewharf/kelemetry/pkg/manager"
+	"github.com/kubewharf/kelemetry/pkg/metrics"
+	"github.com/kubewharf/kelemetry/pkg/util"
+)
+
+var pod = util.ObjectRef{
+	Cluster:              "test",
+	GroupVersionResource: schema.GroupVersionResource{Version: "v1", Resource: "pods"},
+	Namespace:            "default",
+	Name:                 "foo",
+}
+
+// flakyAggregator fails the first `failures` sends.
+type flakyAggregator struct {
+	manager.BaseComponent
+
+	lock     sync.Mutex
+	failures int
+	sent     []string
+	objects  []util.ObjectRef
+}
+
+func (agg *flakyAggregator) Send(
+	ctx context.Context,
+	object util.ObjectRef,
+	event *aggregator.Event,
+	subObjectId *aggregator.SubObjectId,
+) error {
+	agg.lock.Lock()
+	defer agg.lock.Unlock()
+
+	if agg.failures > 0 {
+		agg.failures -= 1
+		return errors.New("tracer unavailable")
+	}
+
+	agg.sent = append(agg.sent, event.Title)
+	agg.objects = append(agg.objects, object)
+	return nil
+}
+
+func (agg *flakyAggregator) SendBatch(ctx context.Context, items []aggregator.BatchItem) []error {
+	errs := make([]error, len(items))
+	for i, item := range items {
+		errs[i] = agg.Send(ctx, item.Object, item.Event, item.SubObjectId)
+	}
+	return errs
+}
+
+func (agg *flakyAggregator) sentTitles() []string {
+	agg.lock.Lock()
+	defer agg.lock.Unlock()
+
+	return append([]string(nil), agg.sent...)
+}
+
+func newQueue(
+	t *testing.T,
+	clock *clocktesting.FakeClock,
+	agg aggregator.Aggregator,
+	args ...string,
+) (deadletter.Queue, deadletter.Store) {
+	store := local.NewLocal(logrus.New())
+	metricsClient, _ := metrics.NewMock(clock)
+	queue := deadletter.NewQueue(logrus.New(), clock, agg, store, metricsClient)
+
+	fs := pflag.NewFlagSet("test", pflag.PanicOnError)
+	store.Options().Setup(fs)
+	queue.Options().Setup(fs)
+	args = append([]string{
+		"--aggregator-dead-letter-enable",
+		"--aggregator-dead-letter-local-dir=" + t.TempDir(),
+		"--aggregator-dead-letter-retry-interval=1s",
+		"--aggregator-dead-letter-initial-backoff=10s",
+		"--aggregator-dead-letter-max-backoff=20s",
+	}, args...)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, comp := range []manager.Component{store, queue} {
+		if err := comp.Init(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return queue, store
+}
+
+func countEntries(store deadletter.Store) int {
+	count, err := store.Count(context.Background())
+	if err != nil {
+		panic(err)
+	}
+	return count
+}
+
+// advance steps the fake clock after the retry loop starts waiting.
+func advance(assert *assert.Assertions, clock *clocktesting.FakeClock, duration time.Duration) {
+	assert.Eventually(clock.HasWaiters, time.Second, time.Millisecond)
+	clock.Step(duration)
+}
+
+func TestRetryWithBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := clocktesting.NewFakeClock(time.Unix(1600000000, 0))
+	agg := &flakyAggregator{failures: 1}
+	queue, store := newQueue(t, clock, agg)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	assert.Nil(queue.Start(stopCh))
+
+	item := aggregator.BatchItem{Object: pod, Event: aggregator.NewEvent("spec", "update", clock.Now(), "audit")}
+	assert.Nil(queue.Push(context.Background(), item, errors.New("span cache unavailable")))
+	assert.Equal(1, countEntries(store))
+
+	// not due yet
+	advance(assert, clock, time.Second*5)
+	// first retry fails, next retry is after 20s
+	advance(assert, clock, time.Second*5)
+	assert.Eventually(func() bool {
+		entries, err := store.List(context.Background(), 0)
+		return err == nil && len(entries) == 1 && entries[0].Attempts == 2
+	}, time.Second, time.Millisecond)
+
+	entries, err := store.List(context.Background(), 0)
+	assert.Nil(err)
+	assert.Equal("tracer unavailable", entries[0].LastError)
+	assert.Equal(clock.Now().Add(time.Second*20), entries[0].NextRetry)
+	assert.Empty(agg.sentTitles())
+
+	advance(assert, clock, time.Second*20)
+	assert.Eventually(func() bool { return countEntries(store) == 0 }, time.Second, time.Millisecond)
+	assert.Equal([]string{"update"}, agg.sentTitles())
+}
+
+func TestDiscardAfterMaxAttempts(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := clocktesting.NewFakeClock(time.Unix(1600000000, 0))
+	agg := &flakyAggregator{failures: 100}
+	queue, store := newQueue(t, clock, agg, "--aggregator-dead-letter-max-attempts=2")
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	assert.Nil(queue.Start(stopCh))
+
+	item := aggregator.BatchItem{Object: pod, Event: aggregator.NewEvent("spec", "update", clock.Now(), "audit")}
+	assert.Nil(queue.Push(context.Background(), item, errors.New("span cache unavailable")))
+
+	advance(assert, clock, time.Second*10)
+	assert.Eventually(func() bool { return countEntries(store) == 0 }, time.Second, time.Millisecond)
+	assert.Empty(agg.sentTitles())
+}
+
+func TestPushFull(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := clocktesting.NewFakeClock(time.Unix(1600000000, 0))
+	queue, store := newQueue(t, clock, &flakyAggregator{}, "--aggregator-dead-letter-max-entries=1")
+
+	item := aggregator.BatchItem{Object: pod, Event: aggregator.NewEvent("spec", "update", clock.Now(), "audit")}
+	assert.Nil(queue.Push(context.Background(), item, errors.New("span cache unavailable")))
+	assert.NotNil(queue.Push(context.Background(), item, errors.New("span cache unavailable")))
+	assert.Equal(1, countEntries(store))
+}
+
+func TestRetryCollection(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := clocktesting.NewFakeClock(time.Unix(1600000000, 0))
+	agg := &flakyAggregator{}
+	queue, store := newQueue(t, clock, agg, "--aggregator-dead-letter-max-entries=1")
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	assert.Nil(queue.Start(stopCh))
+
+	collection := pod
+	collection.Name = util.CollectionName
+	collection.Raw = &unstructured.Unstructured{Object: map[string]any{}}
+
+	item := aggregator.BatchItem{Object: collection, Event: aggregator.NewEvent("read", "list", clock.Now(), "audit")}
+	assert.Nil(queue.Push(context.Background(), item, errors.New("span cache unavailable")))
+
+	advance(assert, clock, time.Second*10)
+	assert.Eventually(func() bool { return countEntries(store) == 0 }, time.Second, time.Millisecond)
+
+	// the pseudo-object is resent with its empty raw object so that linkers do not fetch it
+	agg.lock.Lock()
+	objects := agg.objects
+	agg.lock.Unlock()
+	if assert.Len(objects, 1) {
+		assert.Equal(util.CollectionName, objects[0].Name)
+		assert.NotNil(objects[0].Raw)
+	}
+
+	// the resent entry no longer counts towards the limit
+	assert.Nil(queue.Push(context.Background(), item, errors.New("span cache unavailable")))
+	assert.Equal(1, countEntries(store))
+}
@@ -42,6 +42,21 @@ func NewEvent(field string, title string, when time.Time, traceSource string) *E
 	}
 }
 
+// Clone returns a copy of the event that can be modified independently.
+func (event *Event) Clone() *Event {
+	clone := *event
+
+	clone.Tags = make(map[string]any, len(event.Tags))
+	for key, value := range event.Tags {
+		clone.Tags[key] = value
+	}
+
+	clone.Logs = make([]tracer.Log, len(event.Logs))
+	copy(clone.Logs, event.Logs)
+
+	return &clone
+}
+
 func (event *Event) getEndTime() time.Time {
 	if event.EndTime != nil {
 		return *event.EndTime
@@ -25,8 +25,31 @@ func init() {
 	manager.Global.Provide("aggregator-linker-list", NewLinkerList)
 }
 
+// Role describes how a related object is represented in the trace of an object.
+type Role string
+
+const (
+	// RoleParent indicates that the related object is a parent of the object.
+	// The first parent returned from a LinkerList is the primary parent,
+	// under whose trace the object span is placed.
+	// All other parents are treated the same as RoleLink.
+	RoleParent Role = "parent"
+	// RoleLink indicates that the related object is associated with the object
+	// without being its parent, e.g. a volume used by a pod.
+	RoleLink Role = "link"
+)
+
+// Relation is an object related to the looked up object.
+type Relation struct {
+	Object util.ObjectRef
+	Role   Role
+	// Type is a short description of the relation, e.g. "owner".
+	Type string
+}
+
 type Linker interface {
-	Lookup(ctx context.Context, object util.ObjectRef) *util.ObjectRef
+	// Lookup returns the objects related to the object.
+	Lookup(ctx context.Context, object util.ObjectRef) []Relation
 }
 
 type LinkerList interface {
@@ -34,7 +57,22 @@ type LinkerList interface {
 
 	AddLinker(linker Linker)
 
-	Lookup(ctx context.Context, object util.ObjectRef) *util.ObjectRef
+	// Lookup returns the relations from all linkers in the order of AddLinker calls.
+	Lookup(ctx context.Context, object util.ObjectRef) []Relation
+}
+
+// SplitPrimary returns the primary parent and the other relations.
+// Returns nil as the primary parent if there are no parent relations.
+func SplitPrimary(relations []Relation) (primary *Relation, secondary []Relation) {
+	for i := range relations {
+		if primary == nil && relations[i].Role == RoleParent {
+			primary = &relations[i]
+		} else {
+			secondary = append(secondary, relations[i])
+		}
+	}
+
+	return primary, secondary
 }
 
 type linkerList struct {
@@ -52,14 +90,11 @@ func (list *linkerList) AddLinker(linker Linker) {
 	list.linkers = append(list.linkers, linker)
 }
 
-func (list *linkerList) Lookup(ctx context.Context, object util.ObjectRef) *util.ObjectRef {
+func (list *linkerList) Lookup(ctx context.Context, object util.ObjectRef) []Relation {
+	relations := []Relation{}
 	for _, linker := range list.linkers {
-		parent := linker.Lookup(ctx, object)
-
-		if parent != nil {
-			return parent
-		}
+		relations = append(relations, linker.Lookup(ctx, object)...)
 	}
 
-	return nil
+	return relations
 }
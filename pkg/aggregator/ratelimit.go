@@ -0,0 +1,186 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregator
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/kubewharf/kelemetry/pkg/aggregator/tracer"
+	"github.com/kubewharf/kelemetry/pkg/util"
+	"github.com/kubewharf/kelemetry/pkg/util/shutdown"
+	"github.com/kubewharf/kelemetry/pkg/util/zconstants"
+)
+
+// UserAgentTag is the event tag used to identify the client that caused an event.
+const UserAgentTag = "userAgent"
+
+type rateLimitKey struct {
+	object    util.ObjectRef
+	userAgent string
+}
+
+type suppressedKey struct {
+	rateLimitKey
+	field       string
+	traceSource string
+}
+
+type suppressedEvents struct {
+	count     int
+	firstTime time.Time
+	lastTime  time.Time
+}
+
+// rateLimiter maintains a token bucket for each object (and user agent if enabled).
+// Events exceeding the limit are counted and reported as a summary span periodically.
+type rateLimiter struct {
+	lock       sync.Mutex
+	buckets    map[rateLimitKey]*rate.Limiter
+	suppressed map[suppressedKey]*suppressedEvents
+}
+
+type suppressedEventMetric struct {
+	Cluster     string
+	Group       string
+	Resource    string
+	TraceSource string
+}
+
+func (aggregator *aggregator) rateLimitEnabled() bool {
+	return aggregator.options.objectRateLimit > 0
+}
+
+// allowEvent consumes a token for the event.
+// If the token bucket is exhausted, the event is recorded for the next summary span and false is returned.
+func (aggregator *aggregator) allowEvent(object util.ObjectRef, event *Event) bool {
+	if !aggregator.rateLimitEnabled() {
+		return true
+	}
+
+	key := rateLimitKey{object: object}
+	// only the object identity is relevant for the bucket
+	key.object.Raw = nil
+	key.object.Uid = ""
+	if aggregator.options.objectRateLimitByUserAgent {
+		if userAgent, exists := event.Tags[UserAgentTag]; exists {
+			key.userAgent = fmt.Sprint(userAgent)
+		}
+	}
+
+	now := aggregator.clock.Now()
+
+	aggregator.rateLimiter.lock.Lock()
+	defer aggregator.rateLimiter.lock.Unlock()
+
+	bucket, exists := aggregator.rateLimiter.buckets[key]
+	if !exists {
+		bucket = rate.NewLimiter(rate.Limit(aggregator.options.objectRateLimit), aggregator.options.objectRateBurst)
+		aggregator.rateLimiter.buckets[key] = bucket
+	}
+
+	if bucket.AllowN(now, 1) {
+		return true
+	}
+
+	aggregator.suppressedEventMetric.With(&suppressedEventMetric{
+		Cluster:     object.Cluster,
+		Group:       object.Group,
+		Resource:    object.Resource,
+		TraceSource: event.TraceSource,
+	}).Count(1)
+
+	sKey := suppressedKey{rateLimitKey: key, field: event.Field, traceSource: event.TraceSource}
+	suppressed, exists := aggregator.rateLimiter.suppressed[sKey]
+	if !exists {
+		suppressed = &suppressedEvents{firstTime: event.Time, lastTime: event.Time}
+		aggregator.rateLimiter.suppressed[sKey] = suppressed
+	}
+
+	suppressed.count += 1
+	if event.Time.Before(suppressed.firstTime) {
+		suppressed.firstTime = event.Time
+	}
+	if event.Time.After(suppressed.lastTime) {
+		suppressed.lastTime = event.Time
+	}
+
+	return false
+}
+
+// flushSuppressed sends a summary span for each group of events suppressed since the last flush,
+// and deletes the token buckets that have been idle long enough to be full.
+func (aggregator *aggregator) flushSuppressed(ctx context.Context) {
+	now := aggregator.clock.Now()
+
+	aggregator.rateLimiter.lock.Lock()
+	suppressed := aggregator.rateLimiter.suppressed
+	aggregator.rateLimiter.suppressed = map[suppressedKey]*suppressedEvents{}
+
+	for key, bucket := range aggregator.rateLimiter.buckets {
+		if bucket.TokensAt(now) >= float64(bucket.Burst()) {
+			delete(aggregator.rateLimiter.buckets, key)
+		}
+	}
+	aggregator.rateLimiter.lock.Unlock()
+
+	for key, events := range suppressed {
+		title := fmt.Sprintf("%d events suppressed", events.count)
+		if key.userAgent != "" {
+			title = fmt.Sprintf("%d events suppressed by %s", events.count, key.userAgent)
+		}
+
+		event := NewEvent(key.field, title, events.firstTime, key.traceSource).
+			WithEndTime(events.lastTime.Add(zconstants.DummyDuration)).
+			WithTag("suppressedCount", events.count).
+			Log(
+				zconstants.LogTypeKelemetryError,
+				fmt.Sprintf(
+					"Kelemetry: %d events between %s and %s exceeded the rate limit of this object and were not recorded",
+					events.count,
+					events.firstTime.Format(time.RFC3339),
+					events.lastTime.Format(time.RFC3339),
+				),
+			)
+		if key.userAgent != "" {
+			event = event.WithTag(UserAgentTag, key.userAgent)
+		}
+
+		object := key.object
+		if err := aggregator.send(ctx, object, event, nil, func() (tracer.SpanContext, error) {
+			return aggregator.ensureFieldSpan(ctx, object, event.Field, event.Time)
+		}); err != nil {
+			aggregator.logger.WithField("object", object).WithError(err).Error("cannot send suppressed event summary")
+		}
+	}
+}
+
+func (aggregator *aggregator) runSuppressedFlushLoop(stopCh <-chan struct{}) {
+	// summaries still being sent are canceled on shutdown
+	ctx := shutdown.ContextWithStopCh(context.Background(), stopCh)
+
+	for {
+		select {
+		case <-aggregator.clock.After(aggregator.options.objectRateSummaryInterval):
+			aggregator.flushSuppressed(ctx)
+		case <-stopCh:
+			return
+		}
+	}
+}
@@ -0,0 +1,358 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	bbolt "go.etcd.io/bbolt"
+	"k8s.io/utils/clock"
+
+	"github.com/kubewharf/kelemetry/pkg/aggregator/spancache"
+	"github.com/kubewharf/kelemetry/pkg/manager"
+	"github.com/kubewharf/kelemetry/pkg/util/shutdown"
+)
+
+func init() {
+	manager.Global.ProvideMuxImpl("spancache/bolt", NewBolt, spancache.Cache.Fetch)
+}
+
+var bucketName = []byte("spans")
+
+type options struct {
+	path          string
+	openTimeout   time.Duration
+	trimFrequency time.Duration
+	noSync        bool
+}
+
+func (options *options) Setup(fs *pflag.FlagSet) {
+	fs.StringVar(&options.path, "span-cache-bolt-path", "spancache.db", "path to the span cache database file")
+	fs.DurationVar(
+		&options.openTimeout,
+		"span-cache-bolt-open-timeout",
+		time.Second*10,
+		"timeout for acquiring the file lock on the span cache database",
+	)
+	fs.DurationVar(
+		&options.trimFrequency,
+		"span-cache-bolt-cleanup-frequency",
+		time.Minute*30,
+		"frequency to delete expired entries from span cache",
+	)
+	fs.BoolVar(
+		&options.noSync,
+		"span-cache-bolt-no-sync",
+		false,
+		"skip fsync after each write (faster, but recent entries may be lost on system crash)",
+	)
+}
+
+func (options *options) EnableFlag() *bool { return nil }
+
+// Bolt is an implementation of Cache persisted in an embedded bbolt database.
+// Used for single-replica installations that want stable traces across restarts without an external database.
+type Bolt struct {
+	manager.MuxImplBase
+	options options
+
+	logger    logrus.FieldLogger
+	clock     clock.Clock
+	db        *bbolt.DB
+	deferList *shutdown.DeferList
+}
+
+var _ spancache.Cache = &Bolt{}
+
+func NewBolt(
+	logger logrus.FieldLogger,
+	clock clock.Clock,
+) *Bolt {
+	return &Bolt{
+		logger:    logger,
+		clock:     clock,
+		deferList: shutdown.NewDeferList(),
+	}
+}
+
+func (_ *Bolt) MuxImplName() (name string, isDefault bool) { return "bolt", false }
+
+func (cache *Bolt) Options() manager.Options { return &cache.options }
+
+func (cache *Bolt) Init(ctx context.Context) error {
+	db, err := bbolt.Open(cache.options.path, 0o600, &bbolt.Options{
+		Timeout: cache.options.openTimeout,
+		NoSync:  cache.options.noSync,
+	})
+	if err != nil {
+		return fmt.Errorf("cannot open span cache database: %w", err)
+	}
+
+	cache.deferList.Defer("closing bolt database", db.Close)
+
+	if err := db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketName)
+		return err
+	}); err != nil {
+		return fmt.Errorf("cannot initialize span cache bucket: %w", err)
+	}
+
+	cache.db = db
+
+	return nil
+}
+
+func (cache *Bolt) Start(stopCh <-chan struct{}) error {
+	go func() {
+		defer shutdown.RecoverPanic(cache.logger)
+		for {
+			select {
+			case <-cache.clock.After(cache.options.trimFrequency):
+				if err := cache.Trim(); err != nil {
+					cache.logger.WithError(err).Error("cannot trim span cache")
+				}
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (cache *Bolt) Close() error {
+	if name, err := cache.deferList.Run(cache.logger); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	return nil
+}
+
+// Trim deletes all expired entries.
+// Pages freed by the deleted entries are reused by subsequent writes.
+func (cache *Bolt) Trim() error {
+	now := cache.clock.Now()
+	deleted := 0
+
+	if err := cache.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(bucketName)
+
+		// collect keys first, since deleting during cursor iteration may skip items
+		expiredKeys := [][]byte{}
+		if err := bucket.ForEach(func(key, value []byte) error {
+			ent, err := decodeEntry(value)
+			if err != nil || ent.expired(now) {
+				expiredKeys = append(expiredKeys, append([]byte(nil), key...))
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, key := range expiredKeys {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+
+		deleted = len(expiredKeys)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	cache.logger.WithField("deleted", deleted).Debug("Trimmed span cache")
+
+	return nil
+}
+
+// Stored entries are encoded as
+// expiry (8 bytes) + initialized (1 byte) + uid (16 bytes) + creation (8 bytes) + value.
+const (
+	uidLength    = 16
+	headerLength = 8 + 1 + uidLength + 8
+)
+
+type boltEntry struct {
+	expiry      time.Time
+	initialized bool
+	uid         spancache.Uid
+	creation    time.Time // for debug only
+	value       []byte
+}
+
+func (entry *boltEntry) expired(now time.Time) bool {
+	return entry.expiry.Before(now)
+}
+
+func (entry *boltEntry) encode() []byte {
+	buf := make([]byte, headerLength, headerLength+len(entry.value))
+	binary.LittleEndian.PutUint64(buf[0:8], uint64(entry.expiry.UnixNano()))
+	if entry.initialized {
+		buf[8] = 1
+	}
+	copy(buf[9:9+uidLength], entry.uid)
+	binary.LittleEndian.PutUint64(buf[9+uidLength:headerLength], uint64(entry.creation.UnixNano()))
+	return append(buf, entry.value...)
+}
+
+func decodeEntry(buf []byte) (*boltEntry, error) {
+	if len(buf) < headerLength {
+		return nil, fmt.Errorf("span cache database contains truncated entry")
+	}
+
+	entry := &boltEntry{
+		expiry:      time.Unix(0, int64(binary.LittleEndian.Uint64(buf[0:8]))),
+		initialized: buf[8] != 0,
+		uid:         append(spancache.Uid(nil), buf[9:9+uidLength]...),
+		creation:    time.Unix(0, int64(binary.LittleEndian.Uint64(buf[9+uidLength:headerLength]))),
+	}
+
+	if entry.initialized {
+		// bbolt values are only valid within the transaction, so we must copy it out.
+		entry.value = append([]byte{}, buf[headerLength:]...)
+	}
+
+	return entry, nil
+}
+
+func (cache *Bolt) FetchOrReserve(ctx context.Context, key string, ttl time.Duration) (*spancache.Entry, error) {
+	now := cache.clock.Now()
+
+	var ret *spancache.Entry
+
+	err := cache.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(bucketName)
+
+		if existing := bucket.Get([]byte(key)); existing != nil {
+			ent, err := decodeEntry(existing)
+			if err != nil {
+				return err
+			}
+
+			if !ent.expired(now) {
+				// already initialized
+				if ent.initialized {
+					ret = &spancache.Entry{
+						Value:   ent.value,
+						LastUid: ent.uid,
+					}
+					return nil
+				}
+
+				return fmt.Errorf("%w for %s", spancache.ErrAlreadyReserved, now.Sub(ent.creation))
+			}
+		}
+
+		ent := &boltEntry{
+			expiry:   now.Add(ttl),
+			uid:      randUid(),
+			creation: now,
+		}
+		if err := bucket.Put([]byte(key), ent.encode()); err != nil {
+			return fmt.Errorf("cannot write reservation: %w", err)
+		}
+
+		ret = &spancache.Entry{
+			Value:   nil,
+			LastUid: ent.uid,
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+func (cache *Bolt) Fetch(ctx context.Context, key string) (*spancache.Entry, error) {
+	now := cache.clock.Now()
+
+	var ret *spancache.Entry
+
+	err := cache.db.View(func(tx *bbolt.Tx) error {
+		existing := tx.Bucket(bucketName).Get([]byte(key))
+		if existing == nil {
+			return nil
+		}
+
+		ent, err := decodeEntry(existing)
+		if err != nil {
+			return err
+		}
+
+		if ent.expired(now) {
+			return nil
+		}
+
+		ret = &spancache.Entry{
+			Value:   ent.value,
+			LastUid: ent.uid,
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+func (cache *Bolt) SetReserved(ctx context.Context, key string, value []byte, lastUid spancache.Uid, ttl time.Duration) error {
+	now := cache.clock.Now()
+
+	return cache.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(bucketName)
+
+		existing := bucket.Get([]byte(key))
+		if existing == nil {
+			return spancache.ErrInvalidKey
+		}
+
+		ent, err := decodeEntry(existing)
+		if err != nil {
+			return err
+		}
+
+		if ent.initialized || ent.expired(now) {
+			return spancache.ErrInvalidKey
+		}
+
+		if !bytes.Equal(ent.uid, lastUid) {
+			return spancache.ErrUidMismatch
+		}
+
+		ent.expiry = now.Add(ttl)
+		ent.initialized = true
+		ent.value = value
+		ent.uid = randUid() // new version
+
+		return bucket.Put([]byte(key), ent.encode())
+	})
+}
+
+func randUid() spancache.Uid {
+	entropy := make([]byte, uidLength)
+	_, _ = rand.Read(entropy)
+
+	return spancache.Uid(entropy)
+}
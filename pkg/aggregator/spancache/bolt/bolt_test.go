@@ -0,0 +1,160 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bolt_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"github.com/kubewharf/kelemetry/pkg/aggregator/spancache"
+	"github.com/kubewharf/kelemetry/pkg/aggregator/spancache/bolt"
+)
+
+func TestBoltReserve(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := clocktesting.NewFakeClock(time.Unix(1600000000, 0))
+	cache := testCache(t, clock, filepath.Join(t.TempDir(), "spancache.db"))
+
+	entry1, err := cache.FetchOrReserve(context.Background(), "foo", 10)
+	assert.Nil(err)
+	assert.NotNil(entry1)
+	assert.Nil(entry1.Value)
+
+	clock.Step(5)
+
+	_, err = cache.FetchOrReserve(context.Background(), "foo", 10)
+	assert.NotNil(err)
+	assert.ErrorIs(err, spancache.ErrAlreadyReserved)
+
+	err = cache.SetReserved(context.Background(), "foo", []byte("bar"), spancache.Uid("no such uid"), 10)
+	assert.NotNil(err)
+	assert.ErrorIs(err, spancache.ErrUidMismatch)
+
+	_, err = cache.FetchOrReserve(context.Background(), "foo", 10)
+	assert.NotNil(err)
+	assert.ErrorIs(err, spancache.ErrAlreadyReserved)
+
+	err = cache.SetReserved(context.Background(), "foo", []byte("bar"), entry1.LastUid, 10)
+	assert.Nil(err)
+
+	entry2, err := cache.FetchOrReserve(context.Background(), "foo", 10)
+	assert.Nil(err)
+	assert.Equal([]byte("bar"), entry2.Value)
+	assert.NotEqual(entry1.LastUid, entry2.LastUid)
+}
+
+func TestBoltReserveExpired(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := clocktesting.NewFakeClock(time.Unix(1600000000, 0))
+	cache := testCache(t, clock, filepath.Join(t.TempDir(), "spancache.db"))
+
+	entry1, err := cache.FetchOrReserve(context.Background(), "foo", 10)
+	assert.Nil(err)
+	assert.NotNil(entry1)
+	assert.Nil(entry1.Value)
+
+	clock.Step(15)
+
+	err = cache.SetReserved(context.Background(), "foo", []byte("bar"), entry1.LastUid, 10)
+	assert.NotNil(err)
+	assert.ErrorIs(err, spancache.ErrInvalidKey)
+
+	entry2, err := cache.FetchOrReserve(context.Background(), "foo", 10)
+	assert.Nil(err)
+	assert.Nil(entry2.Value)
+}
+
+func TestBoltPersistAcrossRestart(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := clocktesting.NewFakeClock(time.Unix(1600000000, 0))
+	path := filepath.Join(t.TempDir(), "spancache.db")
+
+	cache := testCache(t, clock, path)
+
+	entry, err := cache.FetchOrReserve(context.Background(), "foo", time.Minute)
+	assert.Nil(err)
+	err = cache.SetReserved(context.Background(), "foo", []byte("bar"), entry.LastUid, time.Minute)
+	assert.Nil(err)
+	assert.Nil(cache.Close())
+
+	cache = testCache(t, clock, path)
+
+	entry, err = cache.Fetch(context.Background(), "foo")
+	assert.Nil(err)
+	assert.NotNil(entry)
+	assert.Equal([]byte("bar"), entry.Value)
+}
+
+func TestBoltTrim(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := clocktesting.NewFakeClock(time.Unix(1600000000, 0))
+	cache := testCache(t, clock, filepath.Join(t.TempDir(), "spancache.db"))
+
+	for _, key := range []string{"short", "long"} {
+		ttl := time.Minute
+		if key == "long" {
+			ttl = time.Hour
+		}
+
+		entry, err := cache.FetchOrReserve(context.Background(), key, time.Second)
+		assert.Nil(err)
+		err = cache.SetReserved(context.Background(), key, []byte(key), entry.LastUid, ttl)
+		assert.Nil(err)
+	}
+
+	clock.Step(time.Minute * 2)
+	assert.Nil(cache.Trim())
+
+	// step back to ensure the entry is really deleted rather than filtered by expiry
+	clock.Step(-time.Minute * 2)
+
+	entry, err := cache.Fetch(context.Background(), "short")
+	assert.Nil(err)
+	assert.Nil(entry)
+
+	entry, err = cache.Fetch(context.Background(), "long")
+	assert.Nil(err)
+	assert.NotNil(entry)
+	assert.Equal([]byte("long"), entry.Value)
+}
+
+func testCache(t *testing.T, clock *clocktesting.FakeClock, path string) *bolt.Bolt {
+	cache := bolt.NewBolt(logrus.New(), clock)
+
+	fs := pflag.NewFlagSet("test", pflag.PanicOnError)
+	cache.Options().Setup(fs)
+	if err := fs.Parse([]string{"--span-cache-bolt-path=" + path}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cache.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = cache.Close() })
+
+	return cache
+}
@@ -23,126 +23,41 @@ import (
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
-	"github.com/stretchr/testify/assert"
-	"k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/utils/clock"
 
 	"github.com/kubewharf/kelemetry/pkg/aggregator/spancache"
 	"github.com/kubewharf/kelemetry/pkg/aggregator/spancache/etcd"
+	"github.com/kubewharf/kelemetry/pkg/aggregator/spancache/spancachetest"
 )
 
-func TestFetchOrReserveReserved(t *testing.T) {
-	assert := assert.New(t)
-	ctx, client := testClient(t)
-	key := randomKey()
-
-	_, err := client.FetchOrReserve(ctx, key, time.Second*10)
-	assert.Nil(err)
+func TestEtcd(t *testing.T) {
+	spancachetest.RunScenarios(t, func(t *testing.T) (context.Context, spancachetest.Harness) {
+		ctx, client := testClient(t)
+		return ctx, &harness{Etcd: client}
+	})
 }
 
-func TestFetchOrReservePending(t *testing.T) {
-	assert := assert.New(t)
-	ctx, client := testClient(t)
-	key := randomKey()
-
-	_, err := client.Client().Put(ctx, key, string(etcd.ReservedVarintTime()))
-	assert.Nil(err)
-
-	_, err = client.FetchOrReserve(ctx, key, time.Second*10)
-	assert.ErrorIs(err, spancache.ErrAlreadyReserved, "%#v, %#v", err, spancache.ErrAlreadyReserved)
+type harness struct {
+	*etcd.Etcd
 }
 
-func TestFetchOrReserveFetched(t *testing.T) {
-	assert := assert.New(t)
-	ctx, client := testClient(t)
-	key := randomKey()
-
-	putResp, err := client.Client().Put(ctx, key, string([]byte{1, 'o', 'k'}))
-	assert.Nil(err)
-	putRev := etcd.EncodeInt64(putResp.Header.Revision)
-
-	entry, err := client.FetchOrReserve(ctx, key, time.Second*10)
-	assert.Nil(err)
-	assert.NotNil(entry)
-	assert.Equal("ok", string(entry.Value))
-	assert.Equal(spancache.Uid(putRev[:]), entry.LastUid[:])
+func (h *harness) PutReserved(ctx context.Context, key string) error {
+	_, err := h.Client().Put(ctx, key, string(h.ReservedVarintTime()))
+	return err
 }
 
-func TestFetchSucceed(t *testing.T) {
-	assert := assert.New(t)
-	ctx, client := testClient(t)
-	key := randomKey()
+func (h *harness) PutInitialized(ctx context.Context, key string, value []byte) (spancache.Uid, error) {
+	putResp, err := h.Client().Put(ctx, key, string(append([]byte{1}, value...)))
+	if err != nil {
+		return nil, err
+	}
 
-	putResp, err := client.Client().Put(ctx, key, string([]byte{1, 'o', 'k'}))
-	assert.Nil(err)
 	putRev := etcd.EncodeInt64(putResp.Header.Revision)
-
-	entry, err := client.Fetch(ctx, key)
-	assert.Nil(err)
-	assert.NotNil(entry)
-	assert.Equal("ok", string(entry.Value))
-	assert.Equal(spancache.Uid(putRev[:]), entry.LastUid)
-}
-
-func TestFetchNotFound(t *testing.T) {
-	assert := assert.New(t)
-	ctx, client := testClient(t)
-	key := randomKey()
-
-	entry, err := client.Fetch(ctx, key)
-	assert.Nil(err)
-	assert.Nil(entry)
-}
-
-func TestSetReservedSucceed(t *testing.T) {
-	assert := assert.New(t)
-	ctx, client := testClient(t)
-	key := randomKey()
-
-	entry, err := client.FetchOrReserve(ctx, key, time.Second*10)
-	assert.Nil(err)
-	assert.NotNil(entry)
-	assert.Nil(entry.Value)
-
-	value := []byte(randomKey())
-	err = client.SetReserved(ctx, key, value, entry.LastUid, time.Second*10)
-	assert.Nil(err)
-
-	entry, err = client.Fetch(ctx, key)
-	assert.Nil(err)
-	assert.NotNil(entry)
-	assert.Equal(value, entry.Value)
-}
-
-func TestSetReservedNotFound(t *testing.T) {
-	assert := assert.New(t)
-	ctx, client := testClient(t)
-	key := randomKey()
-
-	entry, err := client.Fetch(ctx, key)
-	assert.Nil(err)
-	assert.Nil(entry)
-
-	value := []byte(randomKey())
-	err = client.SetReserved(ctx, key, value, []byte("abcdefgh"), time.Second*10)
-	assert.ErrorIs(err, spancache.ErrInvalidKey)
-}
-
-func TestSetReservedCasFailed(t *testing.T) {
-	assert := assert.New(t)
-	ctx, client := testClient(t)
-	key := randomKey()
-
-	entry, err := client.FetchOrReserve(ctx, key, time.Second*10)
-	assert.Nil(err)
-	assert.Nil(entry.Value)
-
-	value := []byte(randomKey())
-	err = client.SetReserved(ctx, key, value, []byte("abcdefgh"), time.Second*10)
-	assert.ErrorIs(err, spancache.ErrUidMismatch)
+	return putRev[:], nil
 }
 
 func testClient(t *testing.T) (context.Context, *etcd.Etcd) {
-	comp := etcd.NewEtcd(logrus.New())
+	comp := etcd.NewEtcd(logrus.New(), clock.RealClock{})
 
 	fs := pflag.NewFlagSet("test", pflag.PanicOnError)
 	comp.Options().Setup(fs)
@@ -166,7 +81,3 @@ func testClient(t *testing.T) (context.Context, *etcd.Etcd) {
 
 	return ctx, comp
 }
-
-func randomKey() string {
-	return rand.String(16)
-}
@@ -0,0 +1,300 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redis
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"k8s.io/utils/clock"
+
+	"github.com/kubewharf/kelemetry/pkg/aggregator/spancache"
+	"github.com/kubewharf/kelemetry/pkg/manager"
+	"github.com/kubewharf/kelemetry/pkg/util/errors"
+	"github.com/kubewharf/kelemetry/pkg/util/shutdown"
+)
+
+func init() {
+	manager.Global.ProvideMuxImpl("spancache/redis", NewRedis, spancache.Cache.Fetch)
+}
+
+type redisOptions struct {
+	address     string
+	username    string
+	password    string
+	db          int
+	prefix      string
+	dialTimeout time.Duration
+}
+
+func (options *redisOptions) Setup(fs *pflag.FlagSet) {
+	fs.StringVar(&options.address, "span-cache-redis-address", "", "redis address in host:port format")
+	fs.StringVar(&options.username, "span-cache-redis-username", "", "redis ACL username")
+	fs.StringVar(&options.password, "span-cache-redis-password", "", "redis password")
+	fs.IntVar(&options.db, "span-cache-redis-db", 0, "redis logical database number")
+	fs.StringVar(&options.prefix, "span-cache-redis-prefix", "/span/", "redis key prefix")
+	fs.DurationVar(&options.dialTimeout, "span-cache-redis-dial-timeout", time.Second*10, "dial timeout for span cache redis connection")
+}
+
+func (options *redisOptions) EnableFlag() *bool { return nil }
+
+// Stored values are encoded as a header byte, followed by a fixed-length UID,
+// followed by the reservation timestamp (if reserved) or the entry value (if initialized).
+const (
+	headerReserved    byte = 0
+	headerInitialized byte = 1
+
+	uidLength = 16
+)
+
+// fetchOrReserveScript returns the current value if the key exists,
+// otherwise stores ARGV[1] with a TTL of ARGV[2] milliseconds and returns nil.
+var fetchOrReserveScript = goredis.NewScript(`
+local value = redis.call("GET", KEYS[1])
+if value then
+	return value
+end
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+return false
+`)
+
+// setReservedScript replaces a reserved value whose UID (bytes 2 to 17) equals ARGV[1]
+// with ARGV[2] and a TTL of ARGV[3] milliseconds.
+var setReservedScript = goredis.NewScript(`
+local value = redis.call("GET", KEYS[1])
+if not value then
+	return 0
+end
+if string.byte(value, 1) ~= 0 then
+	return 1
+end
+if string.sub(value, 2, 17) ~= ARGV[1] then
+	return 2
+end
+redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+return 3
+`)
+
+const (
+	setReservedNotFound int64 = iota
+	setReservedNotReserved
+	setReservedUidMismatch
+	setReservedSuccess
+)
+
+type Redis struct {
+	manager.MuxImplBase
+
+	options   redisOptions
+	logger    logrus.FieldLogger
+	clock     clock.Clock
+	client    *goredis.Client
+	deferList *shutdown.DeferList
+}
+
+var _ spancache.Cache = &Redis{}
+
+func NewRedis(
+	logger logrus.FieldLogger,
+	clock clock.Clock,
+) *Redis {
+	return &Redis{
+		logger:    logger,
+		clock:     clock,
+		deferList: shutdown.NewDeferList(),
+	}
+}
+
+func (_ *Redis) MuxImplName() (name string, isDefault bool) { return "redis", false }
+
+func (cache *Redis) Options() manager.Options { return &cache.options }
+
+func (cache *Redis) Init(ctx context.Context) error {
+	if cache.options.address == "" {
+		return fmt.Errorf("No redis address provided")
+	}
+
+	client := goredis.NewClient(&goredis.Options{
+		Addr:        cache.options.address,
+		Username:    cache.options.username,
+		Password:    cache.options.password,
+		DB:          cache.options.db,
+		DialTimeout: cache.options.dialTimeout,
+	})
+
+	pingCtx, cancelFunc := context.WithTimeout(ctx, cache.options.dialTimeout)
+	defer cancelFunc()
+
+	if err := client.Ping(pingCtx).Err(); err != nil {
+		_ = client.Close()
+		return fmt.Errorf("cannot connect to redis: %w", err)
+	}
+
+	cache.deferList.Defer("closing redis client", client.Close)
+	cache.client = client
+
+	return nil
+}
+
+func (cache *Redis) Start(stopCh <-chan struct{}) error {
+	return nil
+}
+
+func (cache *Redis) Close() error {
+	if name, err := cache.deferList.Run(cache.logger); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	return nil
+}
+
+func (cache *Redis) FetchOrReserve(ctx context.Context, key string, ttl time.Duration) (*spancache.Entry, error) {
+	key = cache.options.prefix + key
+
+	uid := randUid()
+	buf := cache.ReservedValue(uid)
+
+	result, err := fetchOrReserveScript.Run(ctx, cache.client, []string{key}, buf, ttl.Milliseconds()).Text()
+	if errors.Is(err, goredis.Nil) {
+		// new reservation created
+		return &spancache.Entry{
+			Value:   nil,
+			LastUid: uid,
+		}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot create-or-get key: %w", err)
+	}
+
+	header, lastUid, payload, err := decodeValue([]byte(result))
+	if err != nil {
+		return nil, err
+	}
+
+	switch header {
+	case headerReserved:
+		// reserved by another request
+
+		if len(payload) < 8 {
+			return nil, fmt.Errorf("redis returned value with invalid reserve timestamp")
+		}
+		reserveTime := time.UnixMilli(int64(binary.LittleEndian.Uint64(payload)))
+
+		return nil, fmt.Errorf("%w for %s", spancache.ErrAlreadyReserved, cache.clock.Since(reserveTime))
+	case headerInitialized:
+		// already initialized
+
+		return &spancache.Entry{
+			Value:   payload,
+			LastUid: lastUid,
+		}, nil
+	default:
+		return nil, fmt.Errorf("redis returned value with invalid header")
+	}
+}
+
+func (cache *Redis) Fetch(ctx context.Context, key string) (*spancache.Entry, error) {
+	key = cache.options.prefix + key
+
+	result, err := cache.client.Get(ctx, key).Bytes()
+	if errors.Is(err, goredis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("redis request error: %w", err)
+	}
+
+	header, lastUid, payload, err := decodeValue(result)
+	if err != nil {
+		return nil, err
+	}
+
+	var value []byte
+
+	switch header {
+	case headerReserved:
+		value = nil
+	case headerInitialized:
+		value = payload
+	default:
+		return nil, fmt.Errorf("redis returned value with invalid header")
+	}
+
+	return &spancache.Entry{
+		Value:   value,
+		LastUid: lastUid,
+	}, nil
+}
+
+func (cache *Redis) SetReserved(ctx context.Context, key string, value []byte, lastUid spancache.Uid, ttl time.Duration) error {
+	key = cache.options.prefix + key
+
+	buf := InitializedValue(randUid(), value)
+
+	code, err := setReservedScript.Run(ctx, cache.client, []string{key}, []byte(lastUid), buf, ttl.Milliseconds()).Int64()
+	if err != nil {
+		return fmt.Errorf("cannot compare-and-swap key: %w", err)
+	}
+
+	switch code {
+	case setReservedSuccess:
+		return nil
+	case setReservedNotFound, setReservedNotReserved:
+		return spancache.ErrInvalidKey
+	case setReservedUidMismatch:
+		return fmt.Errorf("%w (expect %s)", spancache.ErrUidMismatch, lastUid)
+	default:
+		return fmt.Errorf("redis script returned unexpected code %d", code)
+	}
+}
+
+func (cache *Redis) Client() *goredis.Client { return cache.client }
+
+// ReservedValue encodes a reserved entry with the current time as the reservation timestamp.
+func (cache *Redis) ReservedValue(uid spancache.Uid) []byte {
+	buf := make([]byte, 1+uidLength+8)
+	buf[0] = headerReserved
+	copy(buf[1:1+uidLength], uid)
+	binary.LittleEndian.PutUint64(buf[1+uidLength:], uint64(cache.clock.Now().UnixMilli()))
+	return buf
+}
+
+// InitializedValue encodes an initialized entry.
+func InitializedValue(uid spancache.Uid, value []byte) []byte {
+	buf := make([]byte, 1+uidLength, 1+uidLength+len(value))
+	buf[0] = headerInitialized
+	copy(buf[1:1+uidLength], uid)
+	return append(buf, value...)
+}
+
+func decodeValue(buf []byte) (header byte, uid spancache.Uid, payload []byte, err error) {
+	if len(buf) < 1+uidLength {
+		return 0, nil, nil, fmt.Errorf("redis returned value with truncated header")
+	}
+
+	return buf[0], spancache.Uid(buf[1 : 1+uidLength]), buf[1+uidLength:], nil
+}
+
+func randUid() spancache.Uid {
+	uid := make([]byte, uidLength)
+	_, _ = rand.Read(uid)
+	return uid
+}
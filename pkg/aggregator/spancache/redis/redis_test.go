@@ -0,0 +1,131 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redis_test
+
+import (
+	"context"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/utils/clock"
+
+	"github.com/kubewharf/kelemetry/pkg/aggregator/spancache"
+	"github.com/kubewharf/kelemetry/pkg/aggregator/spancache/redis"
+	"github.com/kubewharf/kelemetry/pkg/aggregator/spancache/spancachetest"
+)
+
+func TestRedis(t *testing.T) {
+	spancachetest.RunScenarios(t, func(t *testing.T) (context.Context, spancachetest.Harness) {
+		ctx, client, _ := testClient(t)
+		return ctx, &harness{Redis: client}
+	})
+}
+
+func TestReservationExpiry(t *testing.T) {
+	assert := assert.New(t)
+	ctx, client, server := testClient(t)
+	key := spancachetest.RandomKey()
+
+	entry, err := client.FetchOrReserve(ctx, key, time.Second*10)
+	assert.Nil(err)
+	assert.Nil(entry.Value)
+
+	server.FastForward(time.Second * 15)
+
+	err = client.SetReserved(ctx, key, []byte("value"), entry.LastUid, time.Second*10)
+	assert.ErrorIs(err, spancache.ErrInvalidKey)
+
+	entry, err = client.FetchOrReserve(ctx, key, time.Second*10)
+	assert.Nil(err)
+	assert.Nil(entry.Value)
+}
+
+func TestSetReservedTwice(t *testing.T) {
+	assert := assert.New(t)
+	ctx, client, _ := testClient(t)
+	key := spancachetest.RandomKey()
+
+	entry, err := client.FetchOrReserve(ctx, key, time.Second*10)
+	assert.Nil(err)
+
+	err = client.SetReserved(ctx, key, []byte("first"), entry.LastUid, time.Second*10)
+	assert.Nil(err)
+
+	err = client.SetReserved(ctx, key, []byte("second"), entry.LastUid, time.Second*10)
+	assert.ErrorIs(err, spancache.ErrInvalidKey)
+
+	entry, err = client.Fetch(ctx, key)
+	assert.Nil(err)
+	assert.Equal("first", string(entry.Value))
+}
+
+type harness struct {
+	*redis.Redis
+}
+
+func (h *harness) PutReserved(ctx context.Context, key string) error {
+	uid := make([]byte, 16)
+	_, _ = rand.Read(uid)
+	return h.Client().Set(ctx, key, h.ReservedValue(uid), 0).Err()
+}
+
+func (h *harness) PutInitialized(ctx context.Context, key string, value []byte) (spancache.Uid, error) {
+	uid := make([]byte, 16)
+	_, _ = rand.Read(uid)
+	if err := h.Client().Set(ctx, key, redis.InitializedValue(uid, value), 0).Err(); err != nil {
+		return nil, err
+	}
+
+	return uid, nil
+}
+
+func testClient(t *testing.T) (context.Context, *redis.Redis, *miniredis.Miniredis) {
+	server := miniredis.RunT(t)
+
+	comp := redis.NewRedis(logrus.New(), clock.RealClock{})
+
+	fs := pflag.NewFlagSet("test", pflag.PanicOnError)
+	comp.Options().Setup(fs)
+	if err := fs.Parse([]string{
+		"--span-cache-redis-address=" + server.Addr(),
+		"--span-cache-redis-prefix=", // to allow reusing the same key in direct ops
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Second*10)
+	ch := make(chan struct{})
+
+	if err := comp.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		cancelFunc()
+		close(ch)
+		_ = comp.Close()
+	})
+
+	if err := comp.Start(ch); err != nil {
+		t.Fatal(err)
+	}
+
+	return ctx, comp, server
+}
@@ -0,0 +1,178 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// spancachetest provides test scenarios shared by all spancache.Cache implementations
+// that persist entries in an external store.
+package spancachetest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/util/rand"
+
+	"github.com/kubewharf/kelemetry/pkg/aggregator/spancache"
+)
+
+// Harness is a spancache.Cache with direct access to its underlying store.
+type Harness interface {
+	spancache.Cache
+
+	// PutReserved writes a reserved entry into the underlying store directly.
+	PutReserved(ctx context.Context, key string) error
+	// PutInitialized writes an initialized entry into the underlying store directly,
+	// returning the UID that the cache is expected to report for this entry.
+	PutInitialized(ctx context.Context, key string, value []byte) (spancache.Uid, error)
+}
+
+// HarnessFactory creates a new Harness for a test.
+// The returned context is valid until the test completes.
+type HarnessFactory func(t *testing.T) (context.Context, Harness)
+
+// RunScenarios runs all common scenarios against the Harness returned by newHarness.
+func RunScenarios(t *testing.T, newHarness HarnessFactory) {
+	t.Helper()
+
+	for _, scenario := range []struct {
+		name string
+		fn   func(*testing.T, HarnessFactory)
+	}{
+		{"FetchOrReserveReserved", testFetchOrReserveReserved},
+		{"FetchOrReservePending", testFetchOrReservePending},
+		{"FetchOrReserveFetched", testFetchOrReserveFetched},
+		{"FetchSucceed", testFetchSucceed},
+		{"FetchNotFound", testFetchNotFound},
+		{"SetReservedSucceed", testSetReservedSucceed},
+		{"SetReservedNotFound", testSetReservedNotFound},
+		{"SetReservedCasFailed", testSetReservedCasFailed},
+	} {
+		scenario := scenario
+		t.Run(scenario.name, func(t *testing.T) { scenario.fn(t, newHarness) })
+	}
+}
+
+func testFetchOrReserveReserved(t *testing.T, newHarness HarnessFactory) {
+	assert := assert.New(t)
+	ctx, client := newHarness(t)
+	key := RandomKey()
+
+	_, err := client.FetchOrReserve(ctx, key, time.Second*10)
+	assert.Nil(err)
+}
+
+func testFetchOrReservePending(t *testing.T, newHarness HarnessFactory) {
+	assert := assert.New(t)
+	ctx, client := newHarness(t)
+	key := RandomKey()
+
+	err := client.PutReserved(ctx, key)
+	assert.Nil(err)
+
+	_, err = client.FetchOrReserve(ctx, key, time.Second*10)
+	assert.ErrorIs(err, spancache.ErrAlreadyReserved, "%#v, %#v", err, spancache.ErrAlreadyReserved)
+}
+
+func testFetchOrReserveFetched(t *testing.T, newHarness HarnessFactory) {
+	assert := assert.New(t)
+	ctx, client := newHarness(t)
+	key := RandomKey()
+
+	putUid, err := client.PutInitialized(ctx, key, []byte("ok"))
+	assert.Nil(err)
+
+	entry, err := client.FetchOrReserve(ctx, key, time.Second*10)
+	assert.Nil(err)
+	assert.NotNil(entry)
+	assert.Equal("ok", string(entry.Value))
+	assert.Equal(putUid, entry.LastUid)
+}
+
+func testFetchSucceed(t *testing.T, newHarness HarnessFactory) {
+	assert := assert.New(t)
+	ctx, client := newHarness(t)
+	key := RandomKey()
+
+	putUid, err := client.PutInitialized(ctx, key, []byte("ok"))
+	assert.Nil(err)
+
+	entry, err := client.Fetch(ctx, key)
+	assert.Nil(err)
+	assert.NotNil(entry)
+	assert.Equal("ok", string(entry.Value))
+	assert.Equal(putUid, entry.LastUid)
+}
+
+func testFetchNotFound(t *testing.T, newHarness HarnessFactory) {
+	assert := assert.New(t)
+	ctx, client := newHarness(t)
+	key := RandomKey()
+
+	entry, err := client.Fetch(ctx, key)
+	assert.Nil(err)
+	assert.Nil(entry)
+}
+
+func testSetReservedSucceed(t *testing.T, newHarness HarnessFactory) {
+	assert := assert.New(t)
+	ctx, client := newHarness(t)
+	key := RandomKey()
+
+	entry, err := client.FetchOrReserve(ctx, key, time.Second*10)
+	assert.Nil(err)
+	assert.NotNil(entry)
+	assert.Nil(entry.Value)
+
+	value := []byte(RandomKey())
+	err = client.SetReserved(ctx, key, value, entry.LastUid, time.Second*10)
+	assert.Nil(err)
+
+	entry, err = client.Fetch(ctx, key)
+	assert.Nil(err)
+	assert.NotNil(entry)
+	assert.Equal(value, entry.Value)
+}
+
+func testSetReservedNotFound(t *testing.T, newHarness HarnessFactory) {
+	assert := assert.New(t)
+	ctx, client := newHarness(t)
+	key := RandomKey()
+
+	entry, err := client.Fetch(ctx, key)
+	assert.Nil(err)
+	assert.Nil(entry)
+
+	value := []byte(RandomKey())
+	err = client.SetReserved(ctx, key, value, []byte("abcdefgh"), time.Second*10)
+	assert.ErrorIs(err, spancache.ErrInvalidKey)
+}
+
+func testSetReservedCasFailed(t *testing.T, newHarness HarnessFactory) {
+	assert := assert.New(t)
+	ctx, client := newHarness(t)
+	key := RandomKey()
+
+	entry, err := client.FetchOrReserve(ctx, key, time.Second*10)
+	assert.Nil(err)
+	assert.Nil(entry.Value)
+
+	value := []byte(RandomKey())
+	err = client.SetReserved(ctx, key, value, []byte("abcdefgh"), time.Second*10)
+	assert.ErrorIs(err, spancache.ErrUidMismatch)
+}
+
+func RandomKey() string {
+	return rand.String(16)
+}
@@ -0,0 +1,286 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package file provides a tracer that writes spans as OTLP-JSON lines to a file,
+// for offline debugging and golden tests without a running collector.
+package file
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+
+	"github.com/kubewharf/kelemetry/pkg/aggregator/tracer"
+	"github.com/kubewharf/kelemetry/pkg/manager"
+	"github.com/kubewharf/kelemetry/pkg/util/shutdown"
+	"github.com/kubewharf/kelemetry/pkg/util/zconstants"
+)
+
+func init() {
+	manager.Global.ProvideMuxImpl("tracer/file", NewFile, tracer.Tracer.CreateSpan)
+}
+
+type options struct {
+	path          string
+	sequentialIds bool
+	attributes    map[string]string
+}
+
+func (options *options) Setup(fs *pflag.FlagSet) {
+	fs.StringVar(&options.path, "tracer-file-path", "-", "path to write OTLP-JSON spans to, or \"-\" for stdout")
+	fs.BoolVar(
+		&options.sequentialIds,
+		"tracer-file-sequential-ids",
+		false,
+		"generate trace and span IDs from a counter instead of randomly, useful for reproducible output",
+	)
+	fs.StringToStringVar(&options.attributes, "tracer-file-resource-attributes", map[string]string{}, "additional resource attributes")
+}
+
+func (options *options) EnableFlag() *bool { return nil }
+
+// SpanContext is the tracer.SpanContext type used by the file tracer.
+type SpanContext struct {
+	TraceId string `json:"traceId"`
+	SpanId  string `json:"spanId"`
+}
+
+// File is a tracer that writes each span as a single line of OTLP-JSON.
+type File struct {
+	manager.MuxImplBase
+
+	options   options
+	logger    logrus.FieldLogger
+	deferList *shutdown.DeferList
+
+	writeLock sync.Mutex
+	writer    io.Writer
+
+	idCounter uint64
+	randLock  sync.Mutex
+	rand      *rand.Rand
+}
+
+var _ tracer.Tracer = &File{}
+
+func NewFile(logger logrus.FieldLogger) *File {
+	return &File{
+		logger:    logger,
+		deferList: shutdown.NewDeferList(),
+	}
+}
+
+func (_ *File) MuxImplName() (name string, isDefault bool) { return "file", false }
+
+func (file *File) Options() manager.Options { return &file.options }
+
+func (file *File) Init(ctx context.Context) error {
+	if file.options.path == "-" {
+		file.writer = os.Stdout
+	} else {
+		fd, err := os.OpenFile(file.options.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return fmt.Errorf("cannot open trace output file: %w", err)
+		}
+
+		file.deferList.Defer("closing trace output file", fd.Close)
+		file.writer = fd
+	}
+
+	file.rand = rand.New(rand.NewSource(rand.Int63()))
+
+	return nil
+}
+
+func (file *File) Start(stopCh <-chan struct{}) error { return nil }
+
+func (file *File) Close() error {
+	if name, err := file.deferList.Run(file.logger); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	return nil
+}
+
+func (file *File) CreateSpan(span tracer.Span) (tracer.SpanContext, error) {
+	spanContext := SpanContext{SpanId: file.newId(8)}
+
+	var parentSpanId string
+	if span.Parent != nil {
+		parent, ok := span.Parent.(SpanContext)
+		if !ok {
+			return nil, fmt.Errorf("parent span context %T was not created by the file tracer", span.Parent)
+		}
+
+		spanContext.TraceId = parent.TraceId
+		parentSpanId = parent.SpanId
+	} else {
+		spanContext.TraceId = file.newId(16)
+	}
+
+	outSpan := otlpSpan{
+		TraceId:           spanContext.TraceId,
+		SpanId:            spanContext.SpanId,
+		ParentSpanId:      parentSpanId,
+		Name:              span.Name,
+		Kind:              spanKindInternal,
+		StartTimeUnixNano: strconv.FormatInt(span.StartTime.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.FinishTime.UnixNano(), 10),
+		Attributes:        mapToAttributes(span.Tags),
+	}
+
+	if span.Follows != nil {
+		follows, ok := span.Follows.(SpanContext)
+		if !ok {
+			return nil, fmt.Errorf("follows span context %T was not created by the file tracer", span.Follows)
+		}
+
+		outSpan.Links = []otlpLink{{TraceId: follows.TraceId, SpanId: follows.SpanId}}
+	}
+
+	for _, link := range span.Links {
+		linked, ok := link.SpanContext.(SpanContext)
+		if !ok {
+			return nil, fmt.Errorf("linked span context %T was not created by the file tracer", link.SpanContext)
+		}
+
+		outSpan.Links = append(outSpan.Links, otlpLink{
+			TraceId:    linked.TraceId,
+			SpanId:     linked.SpanId,
+			Attributes: mapToAttributes(link.Tags),
+		})
+	}
+
+	for _, log := range span.Logs {
+		attributes := []otlpKeyValue{stringAttribute(zconstants.LogTypeAttr, string(log.Type))}
+		for _, attr := range log.Attrs {
+			attributes = append(attributes, stringAttribute(attr[0], attr[1]))
+		}
+
+		outSpan.Events = append(outSpan.Events, otlpEvent{
+			TimeUnixNano: outSpan.StartTimeUnixNano,
+			Name:         log.Message,
+			Attributes:   attributes,
+		})
+	}
+
+	resourceAttributes := map[string]string{"service.name": span.Type}
+	for k, v := range file.options.attributes {
+		resourceAttributes[k] = v
+	}
+
+	if err := file.write(otlpTracesData{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{Attributes: mapToAttributes(resourceAttributes)},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: span.Type},
+				Spans: []otlpSpan{outSpan},
+			}},
+		}},
+	}); err != nil {
+		return nil, err
+	}
+
+	return spanContext, nil
+}
+
+func (file *File) write(data otlpTracesData) error {
+	line, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("cannot marshal span: %w", err)
+	}
+
+	line = append(line, '\n')
+
+	file.writeLock.Lock()
+	defer file.writeLock.Unlock()
+
+	if _, err := file.writer.Write(line); err != nil {
+		return fmt.Errorf("cannot write span: %w", err)
+	}
+
+	return nil
+}
+
+func (file *File) newId(length int) string {
+	id := make([]byte, length)
+
+	if file.options.sequentialIds {
+		binary.BigEndian.PutUint64(id[length-8:], atomic.AddUint64(&file.idCounter, 1))
+	} else {
+		file.randLock.Lock()
+		_, _ = file.rand.Read(id)
+		file.randLock.Unlock()
+	}
+
+	return hex.EncodeToString(id)
+}
+
+func (file *File) InjectCarrier(spanContext tracer.SpanContext) ([]byte, error) {
+	sc, ok := spanContext.(SpanContext)
+	if !ok {
+		return nil, fmt.Errorf("span context %T was not created by the file tracer", spanContext)
+	}
+
+	marshalled, err := json.Marshal(sc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal span carrier: %w", err)
+	}
+
+	return marshalled, nil
+}
+
+func (file *File) ExtractCarrier(textMap []byte) (tracer.SpanContext, error) {
+	var sc SpanContext
+	if err := json.Unmarshal(textMap, &sc); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal span carrier: %w", err)
+	}
+
+	if sc.TraceId == "" || sc.SpanId == "" {
+		return nil, fmt.Errorf("span carrier does not contain trace ID and span ID")
+	}
+
+	return sc, nil
+}
+
+func mapToAttributes(m map[string]string) []otlpKeyValue {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys) // ensure reproducible output
+
+	attributes := make([]otlpKeyValue, 0, len(keys))
+	for _, key := range keys {
+		attributes = append(attributes, stringAttribute(key, m[key]))
+	}
+
+	return attributes
+}
+
+func stringAttribute(key string, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: value}}
+}
@@ -0,0 +1,97 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/kubewharf/kelemetry/pkg/aggregator/tracer"
+	"github.com/kubewharf/kelemetry/pkg/aggregator/tracer/file"
+	"github.com/kubewharf/kelemetry/pkg/util/zconstants"
+)
+
+func TestCreateSpan(t *testing.T) {
+	assert := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "spans.jsonl")
+	fileTracer := file.NewFile(logrus.New())
+
+	fs := pflag.NewFlagSet("test", pflag.PanicOnError)
+	fileTracer.Options().Setup(fs)
+	assert.Nil(fs.Parse([]string{"--tracer-file-path=" + path, "--tracer-file-sequential-ids"}))
+	assert.Nil(fileTracer.Init(context.Background()))
+
+	startTime := time.Unix(1600000000, 0)
+
+	root, err := fileTracer.CreateSpan(tracer.Span{
+		Type:       "object",
+		Name:       "default/foo",
+		StartTime:  startTime,
+		FinishTime: startTime.Add(time.Second),
+		Tags:       map[string]string{"b": "2", "a": "1"},
+	})
+	assert.Nil(err)
+
+	carrier, err := fileTracer.InjectCarrier(root)
+	assert.Nil(err)
+	extracted, err := fileTracer.ExtractCarrier(carrier)
+	assert.Nil(err)
+	assert.Equal(root, extracted)
+
+	_, err = fileTracer.CreateSpan(tracer.Span{
+		Type:       "event",
+		Name:       "Scheduled",
+		StartTime:  startTime,
+		FinishTime: startTime,
+		Parent:     extracted,
+		Follows:    root,
+		Logs: []tracer.Log{{
+			Type:    zconstants.LogTypeEventMessage,
+			Message: "assigned",
+			Attrs:   [][2]string{{"k", "v"}},
+		}},
+	})
+	assert.Nil(err)
+
+	assert.Nil(fileTracer.Close())
+
+	output, err := os.ReadFile(path)
+	assert.Nil(err)
+
+	lines := strings.Split(strings.TrimSuffix(string(output), "\n"), "\n")
+	assert.Equal([]string{
+		`{"resourceSpans":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"object"}}]},` +
+			`"scopeSpans":[{"scope":{"name":"object"},"spans":[{"traceId":"00000000000000000000000000000002",` +
+			`"spanId":"0000000000000001","name":"default/foo","kind":1,` +
+			`"startTimeUnixNano":"1600000000000000000","endTimeUnixNano":"1600000001000000000",` +
+			`"attributes":[{"key":"a","value":{"stringValue":"1"}},{"key":"b","value":{"stringValue":"2"}}]}]}]}]}`,
+		`{"resourceSpans":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"event"}}]},` +
+			`"scopeSpans":[{"scope":{"name":"event"},"spans":[{"traceId":"00000000000000000000000000000002",` +
+			`"spanId":"0000000000000003","parentSpanId":"0000000000000001","name":"Scheduled","kind":1,` +
+			`"startTimeUnixNano":"1600000000000000000","endTimeUnixNano":"1600000000000000000",` +
+			`"events":[{"timeUnixNano":"1600000000000000000","name":"assigned","attributes":[` +
+			`{"key":"zzz-logType","value":{"stringValue":"event/message"}},{"key":"k","value":{"stringValue":"v"}}]}],` +
+			`"links":[{"traceId":"00000000000000000000000000000002","spanId":"0000000000000001"}]}]}]}]}`,
+	}, lines)
+}
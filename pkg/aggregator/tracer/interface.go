@@ -40,10 +40,17 @@ type Span struct {
 	Follows    SpanContext
 	Tags       map[string]string
 	Logs       []Log
+	Links      []Link
 }
 
 type SpanContext any
 
+// Link is a reference from a span to a span in another trace.
+type Link struct {
+	SpanContext SpanContext
+	Tags        map[string]string
+}
+
 type Log struct {
 	Type    zconstants.LogType
 	Message string
@@ -60,6 +67,19 @@ func newMux() Tracer {
 	}
 }
 
+// MockImpl is a Tracer that can be installed with NewMock.
+type MockImpl interface {
+	Tracer
+	manager.MuxImpl
+}
+
+// NewMock returns a Tracer that always dispatches to impl, for use in tests.
+func NewMock(impl MockImpl) Tracer {
+	return &mux{
+		Mux: manager.NewMockMux("tracer", "mock", impl),
+	}
+}
+
 func (mux *mux) CreateSpan(span Span) (SpanContext, error) {
 	return mux.Impl().(Tracer).CreateSpan(span)
 }
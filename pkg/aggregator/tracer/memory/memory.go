@@ -0,0 +1,297 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package memory provides a tracer that records spans in memory,
+// allowing tests to query the spans emitted by the aggregator.
+package memory
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/kubewharf/kelemetry/pkg/aggregator/tracer"
+	"github.com/kubewharf/kelemetry/pkg/manager"
+	"github.com/kubewharf/kelemetry/pkg/util"
+	"github.com/kubewharf/kelemetry/pkg/util/zconstants"
+)
+
+// SpanId is the tracer.SpanContext type used by the memory tracer.
+// IDs are assigned sequentially from 1 in the order of span creation.
+type SpanId uint64
+
+// Span is a span recorded by Memory.
+// The Parent and Follows fields of the embedded tracer.Span are either nil or a SpanId,
+// and the SpanContext of each link is a SpanId.
+type Span struct {
+	tracer.Span
+
+	Id      SpanId
+	TraceId SpanId // the ID of the root span in the same trace
+}
+
+// HasTags returns whether the span contains all the specified tags.
+func (span *Span) HasTags(tags map[string]string) bool {
+	for key, value := range tags {
+		if actual, exists := span.Tags[key]; !exists || actual != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// IsObject returns whether the span is associated with the specified object.
+// Only the cluster, group, resource, namespace and name of the object are compared.
+func (span *Span) IsObject(object util.ObjectRef) bool {
+	return span.HasTags(map[string]string{
+		"cluster":   object.Cluster,
+		"group":     object.Group,
+		"resource":  object.Resource,
+		"namespace": object.Namespace,
+		"name":      object.Name,
+	})
+}
+
+// LogsOfType returns the logs of the specified type in the span.
+func (span *Span) LogsOfType(logType zconstants.LogType) []tracer.Log {
+	logs := []tracer.Log{}
+	for _, log := range span.Logs {
+		if log.Type == logType {
+			logs = append(logs, log)
+		}
+	}
+
+	return logs
+}
+
+// HasLog returns whether the span contains a log of the specified type
+// with a message containing the specified substring.
+func (span *Span) HasLog(logType zconstants.LogType, substring string) bool {
+	for _, log := range span.LogsOfType(logType) {
+		if strings.Contains(log.Message, substring) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Memory is a tracer that records all created spans in memory.
+type Memory struct {
+	manager.MuxImplBase
+	manager.BaseComponent
+
+	mu    sync.RWMutex
+	spans []*Span // spans[i] has ID i+1
+}
+
+var _ tracer.Tracer = &Memory{}
+
+// NewMockMemory returns a tracer mux backed by a new Memory, along with the Memory for querying.
+func NewMockMemory() (tracer.Tracer, *Memory) {
+	memory := &Memory{}
+	return tracer.NewMock(memory), memory
+}
+
+func (_ *Memory) MuxImplName() (name string, isDefault bool) { return "memory", false }
+
+func (memory *Memory) CreateSpan(span tracer.Span) (tracer.SpanContext, error) {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+
+	recorded := &Span{
+		Span: span,
+		Id:   SpanId(len(memory.spans) + 1),
+	}
+	recorded.TraceId = recorded.Id
+
+	if span.Parent != nil {
+		parent, err := memory.lookupLocked(span.Parent)
+		if err != nil {
+			return nil, fmt.Errorf("invalid parent: %w", err)
+		}
+
+		recorded.TraceId = parent.TraceId
+	}
+
+	if span.Follows != nil {
+		if _, err := memory.lookupLocked(span.Follows); err != nil {
+			return nil, fmt.Errorf("invalid follows: %w", err)
+		}
+	}
+
+	for i, link := range span.Links {
+		if _, err := memory.lookupLocked(link.SpanContext); err != nil {
+			return nil, fmt.Errorf("invalid link %d: %w", i, err)
+		}
+	}
+
+	memory.spans = append(memory.spans, recorded)
+
+	return recorded.Id, nil
+}
+
+func (memory *Memory) lookupLocked(spanContext tracer.SpanContext) (*Span, error) {
+	id, ok := spanContext.(SpanId)
+	if !ok {
+		return nil, fmt.Errorf("span context %T was not created by the memory tracer", spanContext)
+	}
+
+	if id == 0 || int(id) > len(memory.spans) {
+		return nil, fmt.Errorf("unknown span ID %d", id)
+	}
+
+	return memory.spans[id-1], nil
+}
+
+type carrier struct {
+	SpanId SpanId `json:"spanId"`
+}
+
+func (memory *Memory) InjectCarrier(spanContext tracer.SpanContext) ([]byte, error) {
+	id, ok := spanContext.(SpanId)
+	if !ok {
+		return nil, fmt.Errorf("span context %T was not created by the memory tracer", spanContext)
+	}
+
+	return json.Marshal(carrier{SpanId: id})
+}
+
+func (memory *Memory) ExtractCarrier(textMap []byte) (tracer.SpanContext, error) {
+	var value carrier
+	if err := json.Unmarshal(textMap, &value); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal span carrier: %w", err)
+	}
+
+	memory.mu.RLock()
+	defer memory.mu.RUnlock()
+
+	if _, err := memory.lookupLocked(value.SpanId); err != nil {
+		return nil, err
+	}
+
+	return value.SpanId, nil
+}
+
+// Reset deletes all recorded spans.
+// Span contexts created before Reset must not be used afterwards.
+func (memory *Memory) Reset() {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+
+	memory.spans = nil
+}
+
+// Spans returns all recorded spans in the order of creation.
+func (memory *Memory) Spans() []*Span {
+	memory.mu.RLock()
+	defer memory.mu.RUnlock()
+
+	return append([]*Span(nil), memory.spans...)
+}
+
+// Get returns the span with the specified span context, or nil if it does not exist.
+func (memory *Memory) Get(spanContext tracer.SpanContext) *Span {
+	memory.mu.RLock()
+	defer memory.mu.RUnlock()
+
+	span, err := memory.lookupLocked(spanContext)
+	if err != nil {
+		return nil
+	}
+
+	return span
+}
+
+// Find returns all spans matching the filter in the order of creation.
+func (memory *Memory) Find(filter func(*Span) bool) []*Span {
+	memory.mu.RLock()
+	defer memory.mu.RUnlock()
+
+	spans := []*Span{}
+	for _, span := range memory.spans {
+		if filter(span) {
+			spans = append(spans, span)
+		}
+	}
+
+	return spans
+}
+
+// FindByTags returns all spans containing all the specified tags.
+func (memory *Memory) FindByTags(tags map[string]string) []*Span {
+	return memory.Find(func(span *Span) bool { return span.HasTags(tags) })
+}
+
+// FindByObject returns all spans associated with the specified object.
+func (memory *Memory) FindByObject(object util.ObjectRef) []*Span {
+	return memory.Find(func(span *Span) bool { return span.IsObject(object) })
+}
+
+// Parent returns the parent of the span, or nil if it is a root span.
+func (memory *Memory) Parent(span *Span) *Span {
+	if span.Parent == nil {
+		return nil
+	}
+
+	return memory.Get(span.Parent)
+}
+
+// Follows returns the span that the span follows from, or nil if there is none.
+func (memory *Memory) Follows(span *Span) *Span {
+	if span.Follows == nil {
+		return nil
+	}
+
+	return memory.Get(span.Follows)
+}
+
+// Links returns the spans linked from the span, in the same order as span.Links.
+func (memory *Memory) Links(span *Span) []*Span {
+	links := []*Span{}
+	for _, link := range span.Links {
+		if linked := memory.Get(link.SpanContext); linked != nil {
+			links = append(links, linked)
+		}
+	}
+
+	return links
+}
+
+// Ancestors returns the chain of parents of the span, starting from the direct parent.
+func (memory *Memory) Ancestors(span *Span) []*Span {
+	ancestors := []*Span{}
+	for parent := memory.Parent(span); parent != nil; parent = memory.Parent(parent) {
+		ancestors = append(ancestors, parent)
+	}
+
+	return ancestors
+}
+
+// Children returns the spans whose parent is the specified span.
+func (memory *Memory) Children(span *Span) []*Span {
+	return memory.Find(func(child *Span) bool { return child.Parent != nil && child.Parent.(SpanId) == span.Id })
+}
+
+// Followers returns the spans that follow from the specified span.
+func (memory *Memory) Followers(span *Span) []*Span {
+	return memory.Find(func(follower *Span) bool { return follower.Follows != nil && follower.Follows.(SpanId) == span.Id })
+}
+
+// Trace returns all spans in the same trace as the specified span.
+func (memory *Memory) Trace(span *Span) []*Span {
+	return memory.Find(func(other *Span) bool { return other.TraceId == span.TraceId })
+}
@@ -16,8 +16,12 @@ package otel
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
+	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -26,11 +30,14 @@ import (
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
 	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/sdk/resource"
 	otelsdktrace "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
 	oteltrace "go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/credentials"
+	_ "google.golang.org/grpc/encoding/gzip" // register gzip compressor for otlptracegrpc
 
 	"github.com/kubewharf/kelemetry/pkg/aggregator/tracer"
 	"github.com/kubewharf/kelemetry/pkg/manager"
@@ -39,21 +46,85 @@ import (
 )
 
 func init() {
-	manager.Global.ProvideMuxImpl("tracer/otel", newOtel, tracer.Tracer.CreateSpan)
+	manager.Global.ProvideMuxImpl("tracer/otel", NewOtel, tracer.Tracer.CreateSpan)
 }
 
 type options struct {
-	endpoint   string
-	insecure   bool
-	attributes map[string]string
+	protocol    string
+	endpoint    string
+	httpUrlPath string
+	insecure    bool
+	attributes  map[string]string
+
+	tlsCaFile     string
+	tlsCertFile   string
+	tlsKeyFile    string
+	tlsServerName string
+
+	headers         map[string]string
+	bearerTokenFile string
+	compression     string
+	timeout         time.Duration
+
+	batchMaxQueueSize       int
+	batchMaxExportBatchSize int
+	batchTimeout            time.Duration
+	batchExportTimeout      time.Duration
 }
 
 func (options *options) Setup(fs *pflag.FlagSet) {
+	fs.StringVar(&options.protocol, "tracer-otel-protocol", "grpc", "otel exporter protocol, one of \"grpc\", \"http\"")
 	fs.StringVar(&options.endpoint, "tracer-otel-endpoint", "127.0.0.1:4317", "otel endpoint")
+	fs.StringVar(&options.httpUrlPath, "tracer-otel-http-url-path", "/v1/traces", "URL path of the otel endpoint if protocol is http")
 	fs.BoolVar(&options.insecure, "tracer-otel-insecure", false, "allow insecure otel connections")
 	fs.StringToStringVar(&options.attributes, "tracer-otel-resource-attributes", map[string]string{
 		string(semconv.ServiceVersionKey): "dev",
 	}, "otel resource service attributes")
+
+	fs.StringVar(
+		&options.tlsCaFile,
+		"tracer-otel-tls-ca-file",
+		"",
+		"path to the CA bundle for verifying the otel endpoint (default system roots)",
+	)
+	fs.StringVar(&options.tlsCertFile, "tracer-otel-tls-cert-file", "", "path to the client certificate for otel connections")
+	fs.StringVar(&options.tlsKeyFile, "tracer-otel-tls-key-file", "", "path to the client private key for otel connections")
+	fs.StringVar(&options.tlsServerName, "tracer-otel-tls-server-name", "", "override the server name used for verifying the otel endpoint")
+
+	fs.StringToStringVar(&options.headers, "tracer-otel-headers", map[string]string{}, "additional headers sent with each export request")
+	fs.StringVar(
+		&options.bearerTokenFile,
+		"tracer-otel-bearer-token-file",
+		"",
+		"path to a file containing the bearer token sent in the Authorization header of each export request",
+	)
+	fs.StringVar(&options.compression, "tracer-otel-compression", "none", "compression for export requests, one of \"none\", \"gzip\"")
+	fs.DurationVar(&options.timeout, "tracer-otel-timeout", time.Second*10, "timeout for each export request")
+
+	fs.IntVar(
+		&options.batchMaxQueueSize,
+		"tracer-otel-batch-max-queue-size",
+		otelsdktrace.DefaultMaxQueueSize,
+		"maximum number of spans buffered for export",
+	)
+	fs.IntVar(
+		&options.batchMaxExportBatchSize,
+		"tracer-otel-batch-max-export-batch-size",
+		otelsdktrace.DefaultMaxExportBatchSize,
+		"maximum number of spans in each export batch",
+	)
+	fs.DurationVar(
+		&options.batchTimeout,
+		"tracer-otel-batch-timeout",
+		time.Millisecond*otelsdktrace.DefaultScheduleDelay,
+		"maximum delay before exporting buffered spans",
+	)
+	fs.DurationVar(
+		&options.batchExportTimeout,
+		"tracer-otel-batch-export-timeout",
+		time.Millisecond*otelsdktrace.DefaultExportTimeout,
+		"maximum duration for exporting a batch of spans",
+	)
 }
 
 func (options *options) EnableFlag() *bool { return nil }
@@ -71,7 +142,7 @@ type otelTracer struct {
 	propagator propagation.TextMapPropagator
 }
 
-func newOtel(logger logrus.FieldLogger) *otelTracer {
+func NewOtel(logger logrus.FieldLogger) *otelTracer {
 	return &otelTracer{
 		logger:    logger,
 		deferList: shutdown.NewDeferList(),
@@ -93,11 +164,25 @@ func (otel *otelTracer) Options() manager.Options {
 func (otel *otelTracer) Init(ctx context.Context) error {
 	otel.ctx = ctx
 
-	options := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(otel.options.endpoint)}
 	if otel.options.insecure {
-		options = append(options, otlptracegrpc.WithInsecure())
+		tlsFlags := [][2]string{
+			{"--tracer-otel-tls-ca-file", otel.options.tlsCaFile},
+			{"--tracer-otel-tls-cert-file", otel.options.tlsCertFile},
+			{"--tracer-otel-tls-key-file", otel.options.tlsKeyFile},
+			{"--tracer-otel-tls-server-name", otel.options.tlsServerName},
+		}
+		for _, flag := range tlsFlags {
+			if flag[1] != "" {
+				return fmt.Errorf("--tracer-otel-insecure cannot be used together with %s", flag[0])
+			}
+		}
 	}
-	client := otlptracegrpc.NewClient(options...)
+
+	client, err := otel.newClient()
+	if err != nil {
+		return err
+	}
+
 	exporter, err := otlptrace.New(ctx, client)
 	if err != nil {
 		return fmt.Errorf("cannot start trace exporter: %w", err)
@@ -109,6 +194,114 @@ func (otel *otelTracer) Init(ctx context.Context) error {
 	return nil
 }
 
+func (otel *otelTracer) newClient() (otlptrace.Client, error) {
+	headers := make(map[string]string, len(otel.options.headers)+1)
+	for k, v := range otel.options.headers {
+		headers[k] = v
+	}
+
+	if otel.options.bearerTokenFile != "" {
+		token, err := os.ReadFile(otel.options.bearerTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read otel bearer token file: %w", err)
+		}
+
+		headers["Authorization"] = "Bearer " + strings.TrimSpace(string(token))
+	}
+
+	var tlsConfig *tls.Config
+	if !otel.options.insecure {
+		var err error
+		tlsConfig, err = otel.newTlsConfig()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch otel.options.protocol {
+	case "grpc":
+		options := []otlptracegrpc.Option{
+			otlptracegrpc.WithEndpoint(otel.options.endpoint),
+			otlptracegrpc.WithHeaders(headers),
+			otlptracegrpc.WithTimeout(otel.options.timeout),
+		}
+
+		if tlsConfig != nil {
+			options = append(options, otlptracegrpc.WithTLSCredentials(credentials.NewTLS(tlsConfig)))
+		} else {
+			options = append(options, otlptracegrpc.WithInsecure())
+		}
+
+		switch otel.options.compression {
+		case "none":
+		case "gzip":
+			options = append(options, otlptracegrpc.WithCompressor("gzip"))
+		default:
+			return nil, fmt.Errorf("unsupported otel compression %q", otel.options.compression)
+		}
+
+		return otlptracegrpc.NewClient(options...), nil
+	case "http":
+		options := []otlptracehttp.Option{
+			otlptracehttp.WithEndpoint(otel.options.endpoint),
+			otlptracehttp.WithURLPath(otel.options.httpUrlPath),
+			otlptracehttp.WithHeaders(headers),
+			otlptracehttp.WithTimeout(otel.options.timeout),
+		}
+
+		if tlsConfig != nil {
+			options = append(options, otlptracehttp.WithTLSClientConfig(tlsConfig))
+		} else {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+
+		switch otel.options.compression {
+		case "none":
+			options = append(options, otlptracehttp.WithCompression(otlptracehttp.NoCompression))
+		case "gzip":
+			options = append(options, otlptracehttp.WithCompression(otlptracehttp.GzipCompression))
+		default:
+			return nil, fmt.Errorf("unsupported otel compression %q", otel.options.compression)
+		}
+
+		return otlptracehttp.NewClient(options...), nil
+	default:
+		return nil, fmt.Errorf("unsupported otel protocol %q", otel.options.protocol)
+	}
+}
+
+func (otel *otelTracer) newTlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: otel.options.tlsServerName,
+	}
+
+	if otel.options.tlsCaFile != "" {
+		caBytes, err := os.ReadFile(otel.options.tlsCaFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read otel CA file: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBytes) {
+			return nil, fmt.Errorf("otel CA file contains no valid certificates")
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if otel.options.tlsCertFile != "" || otel.options.tlsKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(otel.options.tlsCertFile, otel.options.tlsKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load otel client certificate: %w", err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
 func (otel *otelTracer) getTracer(serviceName string) (oteltrace.Tracer, error) {
 	ch := make(chan struct{})
 	defer close(ch)
@@ -146,7 +339,13 @@ func (otel *otelTracer) createTracer(serviceName string) (oteltrace.Tracer, erro
 
 	tp := otelsdktrace.NewTracerProvider(
 		otelsdktrace.WithSampler(otelsdktrace.AlwaysSample()),
-		otelsdktrace.WithBatcher(otel.exporter),
+		otelsdktrace.WithBatcher(
+			otel.exporter,
+			otelsdktrace.WithMaxQueueSize(otel.options.batchMaxQueueSize),
+			otelsdktrace.WithMaxExportBatchSize(otel.options.batchMaxExportBatchSize),
+			otelsdktrace.WithBatchTimeout(otel.options.batchTimeout),
+			otelsdktrace.WithExportTimeout(otel.options.batchExportTimeout),
+		),
 		otelsdktrace.WithResource(resource),
 	)
 	otel.deferList.LockedDefer("close otel tracer provider", func() error {
@@ -181,7 +380,20 @@ func (otel *otelTracer) CreateSpan(span tracer.Span) (tracer.SpanContext, error)
 		return nil, err
 	}
 
-	newCtx, otelSpan := tracer.Start(ctx, span.Name, oteltrace.WithTimestamp(span.StartTime))
+	links := make([]oteltrace.Link, 0, len(span.Links))
+	for _, link := range span.Links {
+		linkAttributes := []attribute.KeyValue{}
+		for tagName, tagValue := range link.Tags {
+			linkAttributes = append(linkAttributes, attribute.String(tagName, tagValue))
+		}
+
+		links = append(links, oteltrace.Link{
+			SpanContext: oteltrace.SpanContextFromContext(link.SpanContext.(context.Context)),
+			Attributes:  linkAttributes,
+		})
+	}
+
+	newCtx, otelSpan := tracer.Start(ctx, span.Name, oteltrace.WithTimestamp(span.StartTime), oteltrace.WithLinks(links...))
 	defer otelSpan.End(oteltrace.WithTimestamp(span.FinishTime))
 
 	attributes := []attribute.KeyValue{}
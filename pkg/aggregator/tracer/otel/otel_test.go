@@ -0,0 +1,390 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package otel_test
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/kubewharf/kelemetry/pkg/aggregator/tracer"
+	"github.com/kubewharf/kelemetry/pkg/aggregator/tracer/otel"
+)
+
+const testServerName = "kelemetry.test"
+
+// collector records the export requests received by a fake OTLP endpoint.
+type collector struct {
+	coltracepb.UnimplementedTraceServiceServer
+
+	lock      sync.Mutex
+	headers   map[string]string
+	urlPath   string
+	encoding  string
+	spanNames []string
+}
+
+func (collector *collector) record(headers map[string]string, req *coltracepb.ExportTraceServiceRequest) {
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+
+	collector.headers = headers
+	for _, resourceSpans := range req.ResourceSpans {
+		for _, scopeSpans := range resourceSpans.ScopeSpans {
+			for _, span := range scopeSpans.Spans {
+				collector.spanNames = append(collector.spanNames, span.Name)
+			}
+		}
+	}
+}
+
+func (collector *collector) Export(
+	ctx context.Context,
+	req *coltracepb.ExportTraceServiceRequest,
+) (*coltracepb.ExportTraceServiceResponse, error) {
+	headers := map[string]string{}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for key, values := range md {
+		headers[key] = values[0]
+	}
+
+	collector.record(headers, req)
+	return &coltracepb.ExportTraceServiceResponse{}, nil
+}
+
+func (collector *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var reader io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gzipReader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		reader = gzipReader
+	}
+
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	req := &coltracepb.ExportTraceServiceRequest{}
+	if err := proto.Unmarshal(body, req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	headers := map[string]string{}
+	for key := range r.Header {
+		headers[http.CanonicalHeaderKey(key)] = r.Header.Get(key)
+	}
+
+	collector.lock.Lock()
+	collector.urlPath = r.URL.Path
+	collector.encoding = r.Header.Get("Content-Encoding")
+	collector.lock.Unlock()
+
+	collector.record(headers, req)
+
+	resp, _ := proto.Marshal(&coltracepb.ExportTraceServiceResponse{})
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	_, _ = w.Write(resp)
+}
+
+// writeCert writes a self-signed certificate usable as the CA, server and client certificate.
+func writeCert(t *testing.T, dir string) (cert tls.Certificate, certFile string, keyFile string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: testServerName},
+		DNSNames:              []string{testServerName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	certDer, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDer})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+
+	certFile = filepath.Join(dir, "tls.crt")
+	keyFile = filepath.Join(dir, "tls.key")
+	if err := os.WriteFile(certFile, certPem, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPem, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err = tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, certFile, keyFile
+}
+
+// startCollector starts a fake OTLP endpoint and returns its address.
+func startCollector(t *testing.T, protocol string, serverTls *tls.Config, collector *collector) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	switch protocol {
+	case "grpc":
+		serverOptions := []grpc.ServerOption{}
+		if serverTls != nil {
+			serverOptions = append(serverOptions, grpc.Creds(credentials.NewTLS(serverTls)))
+		}
+		server := grpc.NewServer(serverOptions...)
+		coltracepb.RegisterTraceServiceServer(server, collector)
+		go func() { _ = server.Serve(listener) }()
+		t.Cleanup(server.Stop)
+	case "http":
+		if serverTls != nil {
+			listener = tls.NewListener(listener, serverTls)
+		}
+		server := &http.Server{Handler: collector, ReadHeaderTimeout: time.Second}
+		go func() { _ = server.Serve(listener) }()
+		t.Cleanup(func() { _ = server.Close() })
+	}
+
+	return listener.Addr().String()
+}
+
+type closableTracer interface {
+	tracer.Tracer
+	Close() error
+}
+
+func newTracer(t *testing.T, args ...string) (closableTracer, error) {
+	t.Helper()
+
+	otelTracer := otel.NewOtel(logrus.New())
+
+	fs := pflag.NewFlagSet("test", pflag.PanicOnError)
+	otelTracer.Options().Setup(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+
+	return otelTracer, otelTracer.Init(context.Background())
+}
+
+func TestExport(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		protocol    string
+		tls         bool
+		compression string
+	}{
+		{name: "grpc insecure", protocol: "grpc"},
+		{name: "grpc mtls gzip", protocol: "grpc", tls: true, compression: "gzip"},
+		{name: "http insecure", protocol: "http"},
+		{name: "http mtls gzip", protocol: "http", tls: true, compression: "gzip"},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			assert := assert.New(t)
+			dir := t.TempDir()
+
+			tokenFile := filepath.Join(dir, "token")
+			assert.NoError(os.WriteFile(tokenFile, []byte("secret\n"), 0o600))
+
+			args := []string{
+				"--tracer-otel-protocol=" + tc.protocol,
+				"--tracer-otel-http-url-path=/custom/traces",
+				"--tracer-otel-headers=x-tenant=foo,x-env=test",
+				"--tracer-otel-bearer-token-file=" + tokenFile,
+				"--tracer-otel-timeout=5s",
+			}
+			if tc.compression != "" {
+				args = append(args, "--tracer-otel-compression="+tc.compression)
+			}
+
+			var serverTls *tls.Config
+			if tc.tls {
+				cert, certFile, keyFile := writeCert(t, dir)
+				leaf, err := x509.ParseCertificate(cert.Certificate[0])
+				assert.NoError(err)
+				pool := x509.NewCertPool()
+				pool.AddCert(leaf)
+
+				serverTls = &tls.Config{
+					MinVersion:   tls.VersionTLS12,
+					Certificates: []tls.Certificate{cert},
+					ClientAuth:   tls.RequireAndVerifyClientCert,
+					ClientCAs:    pool,
+				}
+				args = append(args,
+					"--tracer-otel-tls-ca-file="+certFile,
+					"--tracer-otel-tls-cert-file="+certFile,
+					"--tracer-otel-tls-key-file="+keyFile,
+					// the certificate is not valid for 127.0.0.1
+					"--tracer-otel-tls-server-name="+testServerName,
+				)
+			} else {
+				args = append(args, "--tracer-otel-insecure")
+			}
+
+			collector := &collector{}
+			endpoint := startCollector(t, tc.protocol, serverTls, collector)
+			args = append(args, "--tracer-otel-endpoint="+endpoint)
+
+			otelTracer, err := newTracer(t, args...)
+			if !assert.NoError(err) {
+				return
+			}
+
+			startTime := time.Unix(1600000000, 0)
+			_, err = otelTracer.CreateSpan(tracer.Span{
+				Type:       "object",
+				Name:       "default/foo",
+				StartTime:  startTime,
+				FinishTime: startTime.Add(time.Second),
+			})
+			assert.NoError(err)
+
+			// spans are flushed when the tracer provider is shut down
+			assert.NoError(otelTracer.Close())
+
+			collector.lock.Lock()
+			defer collector.lock.Unlock()
+
+			assert.Equal([]string{"default/foo"}, collector.spanNames)
+
+			switch tc.protocol {
+			case "grpc":
+				assert.Equal("foo", collector.headers["x-tenant"])
+				assert.Equal("test", collector.headers["x-env"])
+				assert.Equal("Bearer secret", collector.headers["authorization"])
+			case "http":
+				assert.Equal("/custom/traces", collector.urlPath)
+				assert.Equal(tc.compression, collector.encoding)
+				assert.Equal("foo", collector.headers["X-Tenant"])
+				assert.Equal("test", collector.headers["X-Env"])
+				assert.Equal("Bearer secret", collector.headers["Authorization"])
+			}
+		})
+	}
+}
+
+func TestInitError(t *testing.T) {
+	dir := t.TempDir()
+	invalidCaFile := filepath.Join(dir, "invalid.crt")
+	if err := os.WriteFile(invalidCaFile, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, certFile, _ := writeCert(t, dir)
+	missingFile := filepath.Join(dir, "missing")
+
+	for _, tc := range []struct {
+		name string
+		args []string
+		err  string
+	}{
+		{
+			name: "unknown protocol",
+			args: []string{"--tracer-otel-protocol=thrift"},
+			err:  `unsupported otel protocol "thrift"`,
+		},
+		{
+			name: "unknown compression",
+			args: []string{"--tracer-otel-protocol=http", "--tracer-otel-compression=zstd"},
+			err:  `unsupported otel compression "zstd"`,
+		},
+		{
+			name: "insecure with ca",
+			args: []string{"--tracer-otel-insecure", "--tracer-otel-tls-ca-file=" + certFile},
+			err:  "--tracer-otel-insecure cannot be used together with --tracer-otel-tls-ca-file",
+		},
+		{
+			name: "insecure with server name",
+			args: []string{"--tracer-otel-insecure", "--tracer-otel-tls-server-name=" + testServerName},
+			err:  "--tracer-otel-insecure cannot be used together with --tracer-otel-tls-server-name",
+		},
+		{
+			name: "missing ca file",
+			args: []string{"--tracer-otel-tls-ca-file=" + missingFile},
+			err:  "cannot read otel CA file",
+		},
+		{
+			name: "invalid ca file",
+			args: []string{"--tracer-otel-tls-ca-file=" + invalidCaFile},
+			err:  "otel CA file contains no valid certificates",
+		},
+		{
+			name: "cert without key",
+			args: []string{"--tracer-otel-tls-cert-file=" + certFile},
+			err:  "cannot load otel client certificate",
+		},
+		{
+			name: "missing bearer token file",
+			args: []string{"--tracer-otel-insecure", "--tracer-otel-bearer-token-file=" + missingFile},
+			err:  "cannot read otel bearer token file",
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newTracer(t, tc.args...)
+			assert.ErrorContains(t, err, tc.err)
+		})
+	}
+}
@@ -0,0 +1,251 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package window determines the time windows of object spans.
+// It is shared by the aggregator, which creates the spans,
+// and the frontend, which needs to locate them.
+package window
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/kubewharf/kelemetry/pkg/manager"
+)
+
+func init() {
+	manager.Global.Provide("aggregator-window", New)
+}
+
+type options struct {
+	spanTtl       time.Duration
+	spanFollowTtl time.Duration
+	spanExtraTtl  time.Duration
+
+	resourceSpanTtl       map[string]string
+	resourceSpanFollowTtl map[string]string
+	resourceSpanExtraTtl  map[string]string
+}
+
+func (options *options) Setup(fs *pflag.FlagSet) {
+	fs.DurationVar(&options.spanTtl,
+		"aggregator-span-ttl",
+		time.Minute*30,
+		"duration of each span",
+	)
+	fs.DurationVar(&options.spanFollowTtl,
+		"aggregator-span-follow-ttl",
+		0,
+		"duration after expiry of previous span within which new spans are considered FollowsFrom",
+	)
+	fs.DurationVar(&options.spanExtraTtl,
+		"aggregator-span-extra-ttl",
+		0,
+		"duration for which an object span is retained after the FollowsFrom period has ended",
+	)
+	fs.StringToStringVar(&options.resourceSpanTtl,
+		"aggregator-resource-span-ttl",
+		map[string]string{},
+		"override --aggregator-span-ttl for specific resources, "+
+			"keyed by \"group/resource\", or \"resource\" to match the resource in any group",
+	)
+	fs.StringToStringVar(&options.resourceSpanFollowTtl,
+		"aggregator-resource-span-follow-ttl",
+		map[string]string{},
+		"override --aggregator-span-follow-ttl for specific resources, in the same format as --aggregator-resource-span-ttl",
+	)
+	fs.StringToStringVar(&options.resourceSpanExtraTtl,
+		"aggregator-resource-span-extra-ttl",
+		map[string]string{},
+		"override --aggregator-span-extra-ttl for specific resources, in the same format as --aggregator-resource-span-ttl",
+	)
+}
+
+func (options *options) EnableFlag() *bool { return nil }
+
+// Window describes how object spans of a resource are divided over time.
+type Window struct {
+	// SpanTtl is the duration of each object span.
+	SpanTtl time.Duration
+	// FollowTtl is the duration after the end of the previous span within which a new span follows from it.
+	FollowTtl time.Duration
+	// ExtraTtl is the duration for which a span is retained in span cache after the follow period.
+	ExtraTtl time.Duration
+}
+
+// Index returns the sequence number of the window containing the timestamp.
+func (window Window) Index(timestamp time.Time) int64 {
+	return timestamp.Unix() / int64(window.SpanTtl.Seconds())
+}
+
+// Start returns the start time of the window containing the timestamp.
+func (window Window) Start(timestamp time.Time) time.Time {
+	return time.Unix(window.Index(timestamp)*int64(window.SpanTtl.Seconds()), 0)
+}
+
+// CacheTtl returns the duration for which a span should remain in span cache.
+func (window Window) CacheTtl() time.Duration {
+	return window.SpanTtl + window.FollowTtl + window.ExtraTtl
+}
+
+func (window Window) validate() error {
+	if window.SpanTtl < time.Second || window.SpanTtl%time.Second != 0 {
+		return fmt.Errorf("span TTL must be a positive multiple of 1s")
+	}
+
+	if window.FollowTtl > window.SpanTtl {
+		return fmt.Errorf("span TTL must not be shorter than follow TTL")
+	}
+
+	return nil
+}
+
+// Config provides the window of each resource.
+type Config interface {
+	manager.Component
+
+	// Get returns the window for the specified resource.
+	Get(gr schema.GroupResource) Window
+	// GetAnyGroup returns the window for a resource when its group is unknown.
+	// Returns an error if overrides for the resource in different groups have different windows.
+	GetAnyGroup(resource string) (Window, error)
+	// Max returns a window with the longest SpanTtl among all resources.
+	Max() Window
+}
+
+type config struct {
+	manager.BaseComponent
+	options options
+
+	defaultWindow Window
+	exact         map[schema.GroupResource]Window
+	anyGroup      map[string]Window
+	// byResource contains the distinct windows of all overrides of each resource, keyed by resource.
+	byResource map[string][]Window
+	max        Window
+}
+
+func New() Config {
+	return &config{}
+}
+
+func (config *config) Options() manager.Options { return &config.options }
+
+func (config *config) Init(ctx context.Context) error {
+	config.defaultWindow = Window{
+		SpanTtl:   config.options.spanTtl,
+		FollowTtl: config.options.spanFollowTtl,
+		ExtraTtl:  config.options.spanExtraTtl,
+	}
+	if err := config.defaultWindow.validate(); err != nil {
+		return fmt.Errorf("invalid option: %w", err)
+	}
+
+	config.exact = map[schema.GroupResource]Window{}
+	config.anyGroup = map[string]Window{}
+	config.byResource = map[string][]Window{}
+	config.max = config.defaultWindow
+
+	overrides := map[string]*Window{}
+	for _, flag := range []struct {
+		values map[string]string
+		field  func(*Window) *time.Duration
+	}{
+		{config.options.resourceSpanTtl, func(window *Window) *time.Duration { return &window.SpanTtl }},
+		{config.options.resourceSpanFollowTtl, func(window *Window) *time.Duration { return &window.FollowTtl }},
+		{config.options.resourceSpanExtraTtl, func(window *Window) *time.Duration { return &window.ExtraTtl }},
+	} {
+		for key, value := range flag.values {
+			duration, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("invalid duration %q for resource %q: %w", value, key, err)
+			}
+
+			window, exists := overrides[key]
+			if !exists {
+				window = &Window{}
+				*window = config.defaultWindow
+				overrides[key] = window
+			}
+
+			*flag.field(window) = duration
+		}
+	}
+
+	for key, window := range overrides {
+		if err := window.validate(); err != nil {
+			return fmt.Errorf("invalid window for resource %q: %w", key, err)
+		}
+
+		resource := key
+		if group, groupResource, hasGroup := strings.Cut(key, "/"); hasGroup {
+			resource = groupResource
+			config.exact[schema.GroupResource{Group: group, Resource: resource}] = *window
+		} else {
+			config.anyGroup[key] = *window
+		}
+
+		if !containsWindow(config.byResource[resource], *window) {
+			config.byResource[resource] = append(config.byResource[resource], *window)
+		}
+
+		if window.SpanTtl > config.max.SpanTtl {
+			config.max = *window
+		}
+	}
+
+	return nil
+}
+
+func (config *config) Get(gr schema.GroupResource) Window {
+	if window, exists := config.exact[gr]; exists {
+		return window
+	}
+
+	if window, exists := config.anyGroup[gr.Resource]; exists {
+		return window
+	}
+
+	return config.defaultWindow
+}
+
+func (config *config) GetAnyGroup(resource string) (Window, error) {
+	windows := config.byResource[resource]
+	switch len(windows) {
+	case 0:
+		return config.defaultWindow, nil
+	case 1:
+		return windows[0], nil
+	default:
+		return Window{}, fmt.Errorf("resource %q has different windows in different groups, group must be specified", resource)
+	}
+}
+
+func containsWindow(windows []Window, window Window) bool {
+	for _, item := range windows {
+		if item == window {
+			return true
+		}
+	}
+	return false
+}
+
+func (config *config) Max() Window {
+	return config.max
+}
@@ -0,0 +1,112 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package window_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/kubewharf/kelemetry/pkg/aggregator/window"
+)
+
+func TestGet(t *testing.T) {
+	assert := assert.New(t)
+
+	config, err := newConfig(
+		"--aggregator-span-extra-ttl=1m",
+		"--aggregator-resource-span-ttl=pods=5m,batch/jobs=10m,example.com/widgets=24h",
+		"--aggregator-resource-span-follow-ttl=pods=1m",
+		"--aggregator-resource-span-extra-ttl=batch/jobs=0s",
+	)
+	assert.Nil(err)
+
+	assert.Equal(
+		window.Window{SpanTtl: time.Minute * 5, FollowTtl: time.Minute, ExtraTtl: time.Minute},
+		config.Get(schema.GroupResource{Resource: "pods"}),
+	)
+	assert.Equal(
+		window.Window{SpanTtl: time.Minute * 5, FollowTtl: time.Minute, ExtraTtl: time.Minute},
+		config.Get(schema.GroupResource{Group: "metrics.k8s.io", Resource: "pods"}),
+	)
+	assert.Equal(window.Window{SpanTtl: time.Minute * 10}, config.Get(schema.GroupResource{Group: "batch", Resource: "jobs"}))
+	assert.Equal(
+		window.Window{SpanTtl: time.Minute * 30, ExtraTtl: time.Minute},
+		config.Get(schema.GroupResource{Group: "example.com", Resource: "jobs"}),
+	)
+	assert.Equal(time.Hour*24, config.Max().SpanTtl)
+}
+
+func TestGetAnyGroup(t *testing.T) {
+	assert := assert.New(t)
+
+	config, err := newConfig(
+		"--aggregator-resource-span-ttl=batch/jobs=10m,example.com/widgets=24h,other.example.com/widgets=1h",
+		"--aggregator-resource-span-ttl=foo.com/crons=2h,bar.com/crons=2h",
+	)
+	assert.Nil(err)
+
+	spanWindow, err := config.GetAnyGroup("jobs")
+	assert.Nil(err)
+	assert.Equal(time.Minute*10, spanWindow.SpanTtl)
+
+	spanWindow, err = config.GetAnyGroup("crons")
+	assert.Nil(err, "overrides with identical windows are not ambiguous")
+	assert.Equal(time.Hour*2, spanWindow.SpanTtl)
+
+	spanWindow, err = config.GetAnyGroup("pods")
+	assert.Nil(err)
+	assert.Equal(time.Minute*30, spanWindow.SpanTtl)
+
+	_, err = config.GetAnyGroup("widgets")
+	assert.NotNil(err)
+}
+
+func TestInvalidFollowTtl(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := newConfig("--aggregator-resource-span-follow-ttl=pods=1h")
+	assert.NotNil(err)
+}
+
+func TestStart(t *testing.T) {
+	assert := assert.New(t)
+
+	spanWindow := window.Window{SpanTtl: time.Minute * 10}
+	timestamp := time.Unix(1600000000, 123)
+
+	assert.Equal(int64(1600000000/600), spanWindow.Index(timestamp))
+	assert.Equal(time.Unix(1600000000-1600000000%600, 0), spanWindow.Start(timestamp))
+}
+
+func newConfig(args ...string) (window.Config, error) {
+	config := window.New()
+
+	fs := pflag.NewFlagSet("test", pflag.PanicOnError)
+	config.Options().Setup(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if err := config.Init(context.Background()); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
@@ -92,7 +92,7 @@ func (ctrl *controller) Close() error {
 	return nil
 }
 
-func (ctrl *controller) Lookup(ctx context.Context, object util.ObjectRef) *util.ObjectRef {
+func (ctrl *controller) Lookup(ctx context.Context, object util.ObjectRef) []linker.Relation {
 	raw := object.Raw
 
 	logger := ctrl.logger.WithField("object", object)
@@ -126,7 +126,7 @@ func (ctrl *controller) Lookup(ctx context.Context, object util.ObjectRef) *util
 			ref.Cluster = object.Cluster
 		}
 
-		objectRef := &util.ObjectRef{
+		objectRef := util.ObjectRef{
 			Cluster: ref.Cluster,
 			GroupVersionResource: schema.GroupVersionResource{
 				Group:    ref.GroupVersionResource.Group,
@@ -139,7 +139,7 @@ func (ctrl *controller) Lookup(ctx context.Context, object util.ObjectRef) *util
 		}
 		logger.WithField("parent", objectRef).Debug("Resolved parent")
 
-		return objectRef
+		return []linker.Relation{{Object: objectRef, Role: linker.RoleParent, Type: "annotation"}}
 	}
 
 	return nil
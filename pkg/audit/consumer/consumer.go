@@ -18,12 +18,14 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"net/http"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/util/sets"
@@ -31,14 +33,18 @@ import (
 	"k8s.io/utils/clock"
 
 	"github.com/kubewharf/kelemetry/pkg/aggregator"
+	"github.com/kubewharf/kelemetry/pkg/aggregator/deadletter"
 	"github.com/kubewharf/kelemetry/pkg/audit"
+	"github.com/kubewharf/kelemetry/pkg/audit/dedup"
 	"github.com/kubewharf/kelemetry/pkg/audit/mq"
+	"github.com/kubewharf/kelemetry/pkg/audit/subresource"
 	"github.com/kubewharf/kelemetry/pkg/filter"
 	"github.com/kubewharf/kelemetry/pkg/k8s/discovery"
 	"github.com/kubewharf/kelemetry/pkg/manager"
 	"github.com/kubewharf/kelemetry/pkg/metrics"
 	"github.com/kubewharf/kelemetry/pkg/util"
 	"github.com/kubewharf/kelemetry/pkg/util/shutdown"
+	"github.com/kubewharf/kelemetry/pkg/util/zconstants"
 )
 
 func init() {
@@ -52,6 +58,13 @@ type options struct {
 	clusterFilter     string
 	ignoreImpersonate bool
 	enableSubObject   bool
+	batchSize         int
+	workers           int
+	dedupTtl          time.Duration
+	readVerbs         []string
+	readSampleRatio   float64
+	readRateLimit     float64
+	readRateBurst     int
 }
 
 func (options *options) Setup(fs *pflag.FlagSet) {
@@ -71,6 +84,50 @@ func (options *options) Setup(fs *pflag.FlagSet) {
 		"if set to true, direct username is always used even with impersonation",
 	)
 	fs.BoolVar(&options.enableSubObject, "audit-consumer-group-failures", false, "whether failed requests should be grouped together")
+	fs.IntVar(
+		&options.batchSize,
+		"audit-consumer-batch-size",
+		100,
+		"maximum number of pending audit events of the same worker sent to the aggregator together",
+	)
+	fs.IntVar(
+		&options.workers,
+		"audit-consumer-workers",
+		1,
+		"number of workers processing and sending the messages of each partition concurrently; "+
+			"messages on the same object are always processed by the same worker in order",
+	)
+	fs.DurationVar(
+		&options.dedupTtl,
+		"audit-consumer-dedup-ttl",
+		0,
+		"audit events with the same cluster, audit ID and stage are only traced once within this duration (0 to disable deduplication)",
+	)
+	fs.StringSliceVar(
+		&options.readVerbs,
+		"audit-consumer-read-verbs",
+		[]string{},
+		"read verbs to trace, any of \"get\", \"list\", \"watch\"; "+
+			"collection-scoped list and watch requests are traced under a pseudo object named \"*\" for each resource and namespace",
+	)
+	fs.Float64Var(
+		&options.readSampleRatio,
+		"audit-consumer-read-sample-ratio",
+		1,
+		"ratio of read audit events to trace, sampled by audit ID",
+	)
+	fs.Float64Var(
+		&options.readRateLimit,
+		"audit-consumer-read-rate-limit",
+		0,
+		"maximum sustained number of read audit events per second traced for each user agent (0 to disable throttling)",
+	)
+	fs.IntVar(
+		&options.readRateBurst,
+		"audit-consumer-read-rate-burst",
+		10,
+		"maximum number of read audit events traced for each user agent in a burst",
+	)
 }
 
 func (options *options) EnableFlag() *bool { return &options.enable }
@@ -80,16 +137,52 @@ type receiver struct {
 	logger         logrus.FieldLogger
 	clock          clock.Clock
 	aggregator     aggregator.Aggregator
+	deadLetter     deadletter.Queue
 	mq             mq.Queue
 	decoratorList  audit.DecoratorList
 	filter         filter.Filter
 	metrics        metrics.Client
 	discoveryCache discovery.DiscoveryCache
+	subresources   subresource.Registry
+	dedup          dedup.Deduplicator
 
 	ctx              context.Context
 	consumeMetric    metrics.Metric
 	e2eLatencyMetric metrics.Metric
 	consumers        map[mq.PartitionId]mq.Consumer
+	workers          map[mq.PartitionId][]*worker
+
+	readVerbs     sets.String
+	readThrottler readThrottler
+	readMetric    metrics.Metric
+	// readThrottleBucketsMetric reports the number of read throttle buckets after each GC.
+	readThrottleBucketsMetric metrics.Metric
+}
+
+// worker processes the messages dispatched to it in order,
+// and sends the resulting batch items in its own batch loop.
+type worker struct {
+	messageCh chan *queuedMessage
+	batchCh   chan *pendingItem
+}
+
+type queuedMessage struct {
+	logger  logrus.FieldLogger
+	message *audit.Message
+	metric  *consumeMetric
+	start   time.Time
+	ack     func()
+
+	// unsent is the number of batch items of this message not sent yet, accessed atomically.
+	unsent int32
+	// failed is nonzero if any batch item of this message could not be sent, accessed atomically.
+	failed int32
+}
+
+type pendingItem struct {
+	logger  logrus.FieldLogger
+	item    aggregator.BatchItem
+	message *queuedMessage
 }
 
 var _ manager.Component = &receiver{}
@@ -111,22 +204,29 @@ func New(
 	logger logrus.FieldLogger,
 	clock clock.Clock,
 	aggregator aggregator.Aggregator,
+	deadLetter deadletter.Queue,
 	queue mq.Queue,
 	decoratorList audit.DecoratorList,
 	filter filter.Filter,
 	metrics metrics.Client,
 	discoveryCache discovery.DiscoveryCache,
+	subresources subresource.Registry,
+	dedup dedup.Deduplicator,
 ) *receiver {
 	return &receiver{
 		logger:         logger,
 		clock:          clock,
 		aggregator:     aggregator,
+		deadLetter:     deadLetter,
 		mq:             queue,
 		decoratorList:  decoratorList,
 		filter:         filter,
 		metrics:        metrics,
 		discoveryCache: discoveryCache,
+		subresources:   subresources,
+		dedup:          dedup,
 		consumers:      map[mq.PartitionId]mq.Consumer{},
+		workers:        map[mq.PartitionId][]*worker{},
 	}
 }
 
@@ -139,14 +239,34 @@ func (recv *receiver) Init(ctx context.Context) error {
 	recv.consumeMetric = recv.metrics.New("audit_consumer_event", &consumeMetric{})
 	recv.e2eLatencyMetric = recv.metrics.New("audit_consumer_e2e_latency", &e2eLatencyMetric{})
 
+	if recv.options.batchSize < 1 {
+		return fmt.Errorf("--audit-consumer-batch-size must be positive")
+	}
+
+	if recv.options.workers < 1 {
+		return fmt.Errorf("--audit-consumer-workers must be positive")
+	}
+
+	if err := recv.initReadVerbs(); err != nil {
+		return err
+	}
+
 	for _, partition := range recv.options.partitions {
 		group := mq.ConsumerGroup(recv.options.consumerGroup)
 		partition := mq.PartitionId(partition)
+		workers := make([]*worker, recv.options.workers)
+		for i := range workers {
+			workers[i] = &worker{
+				messageCh: make(chan *queuedMessage, recv.options.batchSize),
+				batchCh:   make(chan *pendingItem, recv.options.batchSize),
+			}
+		}
+		recv.workers[partition] = workers
 		consumer, err := recv.mq.CreateConsumer(
 			group,
 			partition,
-			func(fieldLogger logrus.FieldLogger, msgKey []byte, msgValue []byte) {
-				recv.handleMessage(fieldLogger, msgKey, msgValue, group, partition)
+			func(fieldLogger logrus.FieldLogger, msgKey []byte, msgValue []byte, ack func()) {
+				recv.handleMessage(fieldLogger, msgKey, msgValue, group, partition, ack)
 			},
 		)
 		if err != nil {
@@ -159,9 +279,121 @@ func (recv *receiver) Init(ctx context.Context) error {
 }
 
 func (recv *receiver) Start(stopCh <-chan struct{}) error {
+	for partition, workers := range recv.workers {
+		for i, worker := range workers {
+			logger := recv.logger.WithField("partition", partition).WithField("worker", i)
+			go recv.runWorkerLoop(logger, worker, stopCh)
+			go recv.runBatchLoop(logger, worker.batchCh, stopCh)
+		}
+	}
+
+	if recv.options.readRateLimit > 0 {
+		// the timer is created before Start returns so that the first GC is always due after readThrottleInterval
+		timer := recv.clock.NewTimer(readThrottleInterval)
+		go func() {
+			defer shutdown.RecoverPanic(recv.logger)
+			recv.runReadThrottleGcLoop(timer, stopCh)
+		}()
+	}
+
 	return nil
 }
 
+func (recv *receiver) runBatchLoop(logger logrus.FieldLogger, batchCh <-chan *pendingItem, stopCh <-chan struct{}) {
+	defer shutdown.RecoverPanic(logger)
+
+	for {
+		var batch []*pendingItem
+
+		select {
+		case item := <-batchCh:
+			batch = append(batch, item)
+		case <-stopCh:
+			return
+		}
+
+		// take all items that are immediately available without waiting for more
+	drain:
+		for len(batch) < recv.options.batchSize {
+			select {
+			case item := <-batchCh:
+				batch = append(batch, item)
+			default:
+				break drain
+			}
+		}
+
+		recv.sendBatch(batch)
+	}
+}
+
+func (recv *receiver) runWorkerLoop(logger logrus.FieldLogger, worker *worker, stopCh <-chan struct{}) {
+	defer shutdown.RecoverPanic(logger)
+
+	for {
+		select {
+		case queued := <-worker.messageCh:
+			recv.processMessage(queued, worker.batchCh)
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+func (recv *receiver) sendBatch(batch []*pendingItem) {
+	ctx, cancelFunc := context.WithCancel(recv.ctx)
+	defer cancelFunc()
+
+	items := make([]aggregator.BatchItem, len(batch))
+	for i, pending := range batch {
+		items[i] = pending.item
+	}
+
+	errs := recv.aggregator.SendBatch(ctx, items)
+
+	for i, err := range errs {
+		if err != nil {
+			batch[i].logger.WithError(err).Error()
+
+			if err := recv.deadLetter.Push(ctx, items[i], err); err != nil {
+				batch[i].logger.WithError(err).Error("Cannot push to dead-letter queue")
+			}
+
+			atomic.StoreInt32(&batch[i].message.failed, 1)
+		} else {
+			batch[i].logger.Debug("Send")
+		}
+
+		if atomic.AddInt32(&batch[i].message.unsent, -1) == 0 {
+			recv.finishMessage(batch[i].message)
+		}
+	}
+}
+
+// finishMessage acknowledges a message after all its batch items have been sent or pushed to the dead-letter queue.
+// The message is only marked for deduplication if all its batch items have been sent,
+// so that a redelivery of a message that failed to send is still traced.
+func (recv *receiver) finishMessage(queued *queuedMessage) {
+	queued.metric.HasTrace = queued.metric.HasTrace && atomic.LoadInt32(&queued.failed) == 0
+
+	if queued.metric.HasTrace && recv.options.dedupTtl > 0 {
+		if err := recv.dedup.Mark(recv.ctx, dedupKey(queued.message), recv.options.dedupTtl); err != nil {
+			queued.logger.WithError(err).Warn("Cannot mark audit event for deduplication")
+		}
+	}
+
+	recv.consumeMetric.DeferCount(queued.start, queued.metric)
+	queued.ack()
+}
+
+func dedupKey(message *audit.Message) dedup.Key {
+	return dedup.Key{
+		Cluster: message.Cluster,
+		AuditId: message.AuditID,
+		Stage:   message.Stage,
+	}
+}
+
 func (recv *receiver) Close() error {
 	recv.logger.Info("receiver close")
 	return nil
@@ -173,6 +405,7 @@ func (recv *receiver) handleMessage(
 	msgValue []byte,
 	consumerGroup mq.ConsumerGroup,
 	partition mq.PartitionId,
+	ack func(),
 ) {
 	logger := fieldLogger.WithField("mod", "audit-consumer")
 
@@ -180,59 +413,143 @@ func (recv *receiver) handleMessage(
 		ConsumerGroup: consumerGroup,
 		Partition:     partition,
 	}
-	defer recv.consumeMetric.DeferCount(recv.clock.Now(), metric)
+	start := recv.clock.Now()
+
+	message := recv.decodeMessage(logger, msgKey, msgValue, metric)
+	if message == nil {
+		recv.consumeMetric.DeferCount(start, metric)
+		ack()
+		return
+	}
+
+	queued := &queuedMessage{
+		logger:  logger.WithField("auditId", message.Event.AuditID),
+		message: message,
+		metric:  metric,
+		start:   start,
+		ack:     ack,
+	}
 
+	// messages on the same object are dispatched to the same worker to preserve their order
+	workers := recv.workers[partition]
+	hasher := fnv.New32a()
+	_, _ = hasher.Write([]byte(orderingKey(message)))
+	select {
+	case workers[hasher.Sum32()%uint32(len(workers))].messageCh <- queued:
+	case <-recv.ctx.Done():
+		// the message is not acknowledged, so it is redelivered after restart
+	}
+}
+
+func (recv *receiver) decodeMessage(
+	logger logrus.FieldLogger,
+	msgKey []byte,
+	msgValue []byte,
+	metric *consumeMetric,
+) *audit.Message {
 	// The first part of the message key is always the cluster no matter what partitioning method we use.
 	cluster := strings.SplitN(string(msgKey), "/", 2)[0]
 	metric.Cluster = cluster
 
 	if recv.options.clusterFilter != "" && recv.options.clusterFilter != cluster {
-		return
+		return nil
 	}
 
 	message := &audit.Message{}
 	if err := json.Unmarshal(msgValue, message); err != nil {
 		logger.WithError(err).Error("error decoding audit data")
+		return nil
+	}
+
+	return message
+}
+
+// processMessage converts the message to batch items for the batch loop of the worker.
+// The message is acknowledged after all items have been sent.
+func (recv *receiver) processMessage(queued *queuedMessage, batchCh chan<- *pendingItem) {
+	pendings := recv.handleItem(queued.logger, queued.message)
+	if len(pendings) == 0 {
+		recv.finishMessage(queued)
 		return
 	}
 
-	recv.handleItem(logger.WithField("auditId", message.Event.AuditID), message, metric)
+	queued.metric.HasTrace = true
+	atomic.StoreInt32(&queued.unsent, int32(len(pendings)))
+
+	for _, pending := range pendings {
+		pending.message = queued
+
+		select {
+		case batchCh <- pending:
+		case <-recv.ctx.Done():
+			// the message is not acknowledged, so it is redelivered after restart
+			return
+		}
+	}
 }
 
 var supportedVerbs = sets.NewString(
 	audit.VerbCreate,
 	audit.VerbUpdate,
 	audit.VerbDelete,
+	audit.VerbDeleteCollection,
 	audit.VerbPatch,
 )
 
+// handleItem returns the batch items to send for the message, or nil if the message is not traced.
 func (recv *receiver) handleItem(
 	logger logrus.FieldLogger,
 	message *audit.Message,
-	metric *consumeMetric,
-) {
+) []*pendingItem {
 	defer shutdown.RecoverPanic(logger)
 
-	if !supportedVerbs.Has(message.Verb) {
-		return
+	subresourceHandler := recv.subresources.Lookup(message)
+
+	// reads on subresources such as pods/log are still subject to sampling and throttling
+	isRead := readVerbs.Has(message.Verb)
+	if isRead && !recv.readVerbs.Has(message.Verb) {
+		return nil
+	}
+	if !supportedVerbs.Has(message.Verb) && !isRead && subresourceHandler == nil {
+		return nil
 	}
 
 	if message.Stage != auditv1.StageResponseComplete {
-		return
+		return nil
 	}
 
+	if message.ObjectRef == nil || (message.ObjectRef.Name == "" && !isCollectionRequest(message)) {
+		// try reconstructing ObjectRef from RequestURI, ResponseObject and RequestObject
+		if err := recv.inferObjectRef(message); err != nil {
+			logger.WithError(err).Debug("Invalid objectRef, cannot infer")
+			return nil
+		}
+	}
+
+	// the filter rejects events without objectRef, so it must be applied after inference
 	if !recv.filter.TestAuditEvent(&message.Event) {
-		return
+		return nil
 	}
 
-	if message.ObjectRef == nil || message.ObjectRef.Name == "" {
-		// try reconstructing ObjectRef from ResponseObject
-		if err := recv.inferObjectRef(message); err != nil {
-			logger.WithError(err).Debug("Invalid objectRef, cannot infer")
-			return
+	if isRead && !recv.allowRead(message) {
+		return nil
+	}
+
+	if recv.options.dedupTtl > 0 {
+		seen, err := recv.dedup.Seen(recv.ctx, dedupKey(message))
+		if err != nil {
+			// prefer duplicate spans over missing spans
+			logger.WithError(err).Warn("Cannot deduplicate audit event")
+		} else if seen {
+			logger.Debug("Skipping duplicate audit event")
+			return nil
 		}
 	}
 
+	// the name is still unknown for collection requests,
+	// or if the audit level does not include the objects, e.g. creation with generateName at Metadata level
+	isCollection := message.ObjectRef.Name == ""
+
 	objectRef := util.ObjectRef{
 		Cluster: message.Cluster,
 		GroupVersionResource: schema.GroupVersionResource{
@@ -245,7 +562,14 @@ func (recv *receiver) handleItem(
 		Uid:       message.ObjectRef.UID,
 	}
 
-	if message.ResponseObject != nil {
+	if isCollection {
+		objectRef.Name = util.CollectionName
+		// a collection has no owners or annotations, so linkers should not try to fetch it
+		objectRef.Raw = &unstructured.Unstructured{
+			Object: map[string]any{},
+		}
+	} else if message.ResponseObject != nil && subresourceHandler == nil {
+		// responses of decoded subresources are not the object itself, e.g. Scale or Status
 		objectRef.Raw = &unstructured.Unstructured{
 			Object: map[string]any{},
 		}
@@ -253,15 +577,26 @@ func (recv *receiver) handleItem(
 		err := json.Unmarshal(message.ResponseObject.Raw, &objectRef.Raw.Object)
 		if err != nil {
 			logger.Errorf("cannot decode responseObject: %s", err.Error())
-			return
+			return nil
 		}
 	}
 
 	field := "spec"
 	if message.Verb == audit.VerbUpdate && message.ObjectRef.Subresource == "status" {
 		field = "status"
-	} else if message.Verb == audit.VerbDelete {
+	} else if message.Verb == audit.VerbDelete || message.Verb == audit.VerbDeleteCollection {
 		field = "deletion"
+	} else if isRead {
+		field = readField
+	}
+
+	var subresourceResult *subresource.Result
+	var subresourceErr error
+	if subresourceHandler != nil {
+		subresourceResult, subresourceErr = subresourceHandler.Handle(message)
+		if subresourceResult != nil && subresourceResult.Field != "" {
+			field = subresourceResult.Field
+		}
 	}
 
 	e2eLatency := recv.clock.Since(message.StageTimestamp.Time)
@@ -272,7 +607,6 @@ func (recv *receiver) handleItem(
 		WithField("cluster", message.Cluster).
 		WithField("resource", message.ObjectRef.Resource).
 		WithField("namespace", message.ObjectRef.Namespace).
-		WithField("name", message.ObjectRef.Name).
 		WithField("latency", e2eLatency)
 
 	username := message.User.Username
@@ -280,7 +614,9 @@ func (recv *receiver) handleItem(
 		username = message.ImpersonatedUser.Username
 	}
 	title := fmt.Sprintf("%s %s", username, message.Verb)
-	if message.ObjectRef.Subresource != "" {
+	if subresourceResult != nil && subresourceResult.Title != "" {
+		title = fmt.Sprintf("%s %s", username, subresourceResult.Title)
+	} else if message.ObjectRef.Subresource != "" {
 		title += fmt.Sprintf(" %s", message.ObjectRef.Subresource)
 	}
 	if message.ResponseStatus.Code >= 300 {
@@ -290,13 +626,32 @@ func (recv *receiver) handleItem(
 	event := aggregator.NewEvent(field, title, message.RequestReceivedTimestamp.Time, "audit").
 		WithEndTime(message.StageTimestamp.Time).
 		WithTag("username", username).
-		WithTag("userAgent", message.UserAgent).
+		WithTag(aggregator.UserAgentTag, message.UserAgent).
 		WithTag("responseCode", message.ResponseStatus.Code).
 		WithTag("resourceVersion", message.ObjectRef.ResourceVersion).
 		WithTag("apiserver", message.SourceAddr).
 		WithTag("tag", message.Verb)
+	if isRead {
+		event = withReadTags(event, message.RequestURI)
+	}
+	if subresourceResult != nil {
+		for tagKey, tagValue := range subresourceResult.Tags {
+			event = event.WithTag(tagKey, tagValue)
+		}
+	}
+	if subresourceErr != nil {
+		logger.WithError(subresourceErr).Debug("Cannot decode subresource request")
+		event = event.Log(
+			zconstants.LogTypeKelemetryError,
+			fmt.Sprintf("Cannot decode %s request: %s", message.ObjectRef.Subresource, subresourceErr.Error()),
+		)
+	}
 
-	recv.decoratorList.Decorate(message, event)
+	if isCollection && !isCollectionRequest(message) {
+		event = event.Log(zconstants.LogTypeKelemetryError, "Object name is not available in this audit event")
+	}
+
+	recv.decoratorList.Decorate(recv.ctx, message, event)
 
 	recv.e2eLatencyMetric.With(&e2eLatencyMetric{
 		Cluster:  message.Cluster,
@@ -304,9 +659,6 @@ func (recv *receiver) handleItem(
 		Resource: objectRef.Resource,
 	}).Histogram(e2eLatency.Nanoseconds())
 
-	ctx, cancelFunc := context.WithCancel(recv.ctx)
-	defer cancelFunc()
-
 	var subObjectId *aggregator.SubObjectId
 	if recv.options.enableSubObject && (message.Verb == audit.VerbUpdate || message.Verb == audit.VerbPatch) {
 		subObjectId = &aggregator.SubObjectId{
@@ -315,53 +667,33 @@ func (recv *receiver) handleItem(
 		}
 	}
 
-	err := recv.aggregator.Send(ctx, objectRef, event, subObjectId)
-	if err != nil {
-		fieldLogger.WithError(err).Error()
-	} else {
-		fieldLogger.Debug("Send")
-	}
-
-	metric.HasTrace = true
-}
-
-func (receiver *receiver) inferObjectRef(message *audit.Message) error {
-	if message.ResponseObject != nil {
-		var partial metav1.PartialObjectMetadata
-		if err := json.Unmarshal(message.ResponseObject.Raw, &partial); err != nil {
-			return fmt.Errorf("unmarshal raw object: %w", err)
-		}
-
-		gv, err := schema.ParseGroupVersion(partial.APIVersion)
-		if err != nil {
-			return fmt.Errorf("object has invalid GroupVersion: %w", err)
-		}
-
-		cdc, err := receiver.discoveryCache.ForCluster(message.Cluster)
+	objectRefs := []util.ObjectRef{objectRef}
+	if message.Verb == audit.VerbDeleteCollection {
+		deleted, err := deletedObjects(objectRef, message.ResponseObject)
 		if err != nil {
-			return fmt.Errorf("no ClusterDiscoveryCache: %w", err)
+			logger.WithError(err).Debug("Cannot decode deleted objects")
+		} else if len(deleted) > 0 {
+			// trace the deletion on each deleted object instead of the collection
+			objectRefs = deleted
 		}
+	}
 
-		gvr, ok := cdc.LookupResource(gv.WithKind(partial.Kind))
-		if !ok {
-			return fmt.Errorf("conversion of response to GVR failed")
+	pendings := make([]*pendingItem, len(objectRefs))
+	for i, object := range objectRefs {
+		itemEvent := event
+		if i > 0 {
+			itemEvent = event.Clone()
 		}
 
-		message.ObjectRef = &auditv1.ObjectReference{
-			APIGroup:   gvr.Group,
-			APIVersion: gvr.Version,
-			Resource:   gvr.Resource,
-			Namespace:  partial.Namespace,
-			Name:       partial.Name,
-			UID:        partial.UID,
-			// do not set as partial.ResourceVersion, otherwise diff decorator will think this is a no-op
-			ResourceVersion: "",
-			// TODO try to infer subresource from RequestObject
-			Subresource: "",
+		pendings[i] = &pendingItem{
+			logger: fieldLogger.WithField("name", object.Name),
+			item: aggregator.BatchItem{
+				Object:      object,
+				Event:       itemEvent,
+				SubObjectId: subObjectId,
+			},
 		}
-
-		return nil
 	}
 
-	return fmt.Errorf("no ResponseObject to infer objectRef from")
+	return pendings
 }
@@ -0,0 +1,435 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auditconsumer_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"github.com/kubewharf/kelemetry/pkg/aggregator"
+	"github.com/kubewharf/kelemetry/pkg/audit"
+	auditconsumer "github.com/kubewharf/kelemetry/pkg/audit/consumer"
+	"github.com/kubewharf/kelemetry/pkg/audit/dedup/local"
+	"github.com/kubewharf/kelemetry/pkg/audit/mq"
+	"github.com/kubewharf/kelemetry/pkg/audit/subresource"
+	"github.com/kubewharf/kelemetry/pkg/manager"
+	"github.com/kubewharf/kelemetry/pkg/metrics"
+	"github.com/kubewharf/kelemetry/pkg/util"
+)
+
+// fakeAggregator records the sent items.
+// SendBatch blocks while block is non-nil and not closed,
+// or while the channel in blockOn for the name or title of any item is not closed,
+// and fails while failures is positive.
+type fakeAggregator struct {
+	manager.BaseComponent
+
+	lock     sync.Mutex
+	block    chan struct{}
+	blockOn  map[string]chan struct{}
+	failures int
+	sent     []aggregator.BatchItem
+}
+
+func (agg *fakeAggregator) Send(
+	ctx context.Context,
+	object util.ObjectRef,
+	event *aggregator.Event,
+	subObjectId *aggregator.SubObjectId,
+) error {
+	return agg.SendBatch(ctx, []aggregator.BatchItem{{Object: object, Event: event, SubObjectId: subObjectId}})[0]
+}
+
+func (agg *fakeAggregator) SendBatch(ctx context.Context, items []aggregator.BatchItem) []error {
+	agg.lock.Lock()
+	blocks := []chan struct{}{agg.block}
+	for _, item := range items {
+		blocks = append(blocks, agg.blockOn[item.Object.Name], agg.blockOn[item.Event.Title])
+	}
+	agg.lock.Unlock()
+
+	for _, block := range blocks {
+		if block != nil {
+			<-block
+		}
+	}
+
+	agg.lock.Lock()
+	defer agg.lock.Unlock()
+
+	errs := make([]error, len(items))
+	for i, item := range items {
+		if agg.failures > 0 {
+			agg.failures -= 1
+			errs[i] = errors.New("tracer unavailable")
+			continue
+		}
+
+		agg.sent = append(agg.sent, item)
+	}
+
+	return errs
+}
+
+func (agg *fakeAggregator) sentItems() []aggregator.BatchItem {
+	agg.lock.Lock()
+	defer agg.lock.Unlock()
+
+	return append([]aggregator.BatchItem(nil), agg.sent...)
+}
+
+type fakeDeadLetter struct {
+	manager.BaseComponent
+
+	lock   sync.Mutex
+	pushed []aggregator.BatchItem
+}
+
+func (dl *fakeDeadLetter) Push(ctx context.Context, item aggregator.BatchItem, sendErr error) error {
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+
+	dl.pushed = append(dl.pushed, item)
+	return nil
+}
+
+func (dl *fakeDeadLetter) pushedItems() []aggregator.BatchItem {
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+
+	return append([]aggregator.BatchItem(nil), dl.pushed...)
+}
+
+// fakeQueue captures the message handlers so that tests can deliver messages directly.
+type fakeQueue struct {
+	handlers map[mq.PartitionId]mq.MessageHandler
+}
+
+func (q *fakeQueue) CreateProducer() (mq.Producer, error) { return nil, errors.New("not supported") }
+
+func (q *fakeQueue) CreateConsumer(group mq.ConsumerGroup, partition mq.PartitionId, handler mq.MessageHandler) (mq.Consumer, error) {
+	q.handlers[partition] = handler
+	return nil, nil
+}
+
+type allowAllFilter struct {
+	manager.BaseComponent
+}
+
+func (*allowAllFilter) TestGvk(cluster string, gvk schema.GroupVersionKind) bool { return true }
+func (*allowAllFilter) TestGvr(gvr schema.GroupVersionResource) bool             { return true }
+func (*allowAllFilter) TestAuditEvent(event *auditv1.Event) bool                 { return true }
+
+type harness struct {
+	clock      *clocktesting.FakeClock
+	metrics    *metrics.Mock
+	aggregator *fakeAggregator
+	deadLetter *fakeDeadLetter
+	queue      *fakeQueue
+}
+
+func newHarness(t *testing.T, agg *fakeAggregator, args ...string) *harness {
+	t.Helper()
+
+	logger := logrus.New()
+	clock := clocktesting.NewFakeClock(time.Unix(1600000000, 0))
+	metricsClient, metricsMock := metrics.NewMock(clock)
+
+	h := &harness{
+		clock:      clock,
+		metrics:    metricsMock,
+		aggregator: agg,
+		deadLetter: &fakeDeadLetter{},
+		queue:      &fakeQueue{handlers: map[mq.PartitionId]mq.MessageHandler{}},
+	}
+
+	decoratorList := audit.NewDecoratorList(logger, clock, metricsClient)
+	dedup := local.NewLocal(logger, clock)
+	recv := auditconsumer.New(
+		logger,
+		clock,
+		agg,
+		h.deadLetter,
+		h.queue,
+		decoratorList,
+		&allowAllFilter{},
+		metricsClient,
+		nil,
+		subresource.NewRegistry(),
+		dedup,
+	)
+
+	fs := pflag.NewFlagSet("test", pflag.PanicOnError)
+	decoratorList.Options().Setup(fs)
+	dedup.Options().Setup(fs)
+	recv.Options().Setup(fs)
+	if err := fs.Parse(append([]string{"--audit-consumer-enable", "--audit-consumer-partition=0"}, args...)); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	stopCh := make(chan struct{})
+	t.Cleanup(func() {
+		close(stopCh)
+		cancelFunc()
+	})
+
+	for _, comp := range []manager.Component{decoratorList, dedup, recv} {
+		if err := comp.Init(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, comp := range []manager.Component{decoratorList, dedup, recv} {
+		if err := comp.Start(stopCh); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return h
+}
+
+// deliver passes a message to the consumer and returns a channel closed when the message is acknowledged.
+func (h *harness) deliver(t *testing.T, message *audit.Message) <-chan struct{} {
+	t.Helper()
+
+	value, err := json.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ackCh := make(chan struct{})
+	var once sync.Once
+	h.queue.handlers[0](logrus.New(), []byte(message.Cluster), value, func() { once.Do(func() { close(ackCh) }) })
+	return ackCh
+}
+
+func (h *harness) consumeCount(hasTrace bool) int64 {
+	return h.metrics.Get("audit_consumer_event", map[string]string{
+		"cluster":       "test",
+		"consumerGroup": "kelemetry",
+		"partition":     "0",
+		"hasTrace":      fmt.Sprint(hasTrace),
+	}).Int
+}
+
+func newMessage(auditId string, verb string, name string) *audit.Message {
+	now := metav1.NewMicroTime(time.Unix(1600000000, 0))
+	return &audit.Message{
+		Cluster: "test",
+		Event: auditv1.Event{
+			AuditID:    types.UID(auditId),
+			Stage:      auditv1.StageResponseComplete,
+			Verb:       verb,
+			RequestURI: "/api/v1/namespaces/default/configmaps/" + name,
+			User:       authenticationv1.UserInfo{Username: "alice"},
+			UserAgent:  "kubectl/v1.26.0",
+			ObjectRef: &auditv1.ObjectReference{
+				Resource:   "configmaps",
+				Namespace:  "default",
+				Name:       name,
+				APIVersion: "v1",
+			},
+			ResponseStatus:           &metav1.Status{Code: 200},
+			RequestReceivedTimestamp: now,
+			StageTimestamp:           now,
+		},
+	}
+}
+
+func waitAck(t *testing.T, ackCh <-chan struct{}) {
+	t.Helper()
+
+	select {
+	case <-ackCh:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout waiting for acknowledgement")
+	}
+}
+
+func TestAckAfterSend(t *testing.T) {
+	assert := assert.New(t)
+
+	block := make(chan struct{})
+	h := newHarness(t, &fakeAggregator{block: block})
+
+	ackCh := h.deliver(t, newMessage("1", audit.VerbUpdate, "foo"))
+
+	select {
+	case <-ackCh:
+		t.Fatal("message must not be acknowledged before it is sent")
+	case <-time.After(time.Millisecond * 100):
+	}
+	assert.Equal(int64(0), h.consumeCount(true))
+
+	close(block)
+	waitAck(t, ackCh)
+
+	sent := h.aggregator.sentItems()
+	if assert.Len(sent, 1) {
+		assert.Equal("foo", sent[0].Object.Name)
+	}
+	assert.Equal(int64(1), h.consumeCount(true))
+}
+
+func TestAckAfterDeadLetter(t *testing.T) {
+	assert := assert.New(t)
+
+	h := newHarness(t, &fakeAggregator{failures: 1})
+
+	waitAck(t, h.deliver(t, newMessage("1", audit.VerbUpdate, "foo")))
+
+	assert.Empty(h.aggregator.sentItems())
+	assert.Len(h.deadLetter.pushedItems(), 1)
+	assert.Equal(int64(0), h.consumeCount(true))
+	assert.Equal(int64(1), h.consumeCount(false))
+}
+
+func TestAckUntracedMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	h := newHarness(t, &fakeAggregator{})
+
+	// get requests are not traced by default
+	waitAck(t, h.deliver(t, newMessage("1", audit.VerbGet, "foo")))
+
+	assert.Empty(h.aggregator.sentItems())
+	assert.Equal(int64(1), h.consumeCount(false))
+}
+
+func TestWorkersSendConcurrently(t *testing.T) {
+	assert := assert.New(t)
+
+	block := make(chan struct{})
+	h := newHarness(t, &fakeAggregator{blockOn: map[string]chan struct{}{"foo": block}}, "--audit-consumer-workers=2")
+
+	fooAcks := []<-chan struct{}{
+		h.deliver(t, newMessage("1", audit.VerbUpdate, "foo")),
+		h.deliver(t, newMessage("2", audit.VerbDelete, "foo")),
+	}
+
+	// some of the objects in other namespaces are dispatched to the worker not blocked by "foo"
+	for i := 0; i < 10; i++ {
+		message := newMessage(fmt.Sprintf("bar%d", i), audit.VerbUpdate, "bar")
+		message.ObjectRef.Namespace = fmt.Sprintf("ns%d", i)
+		h.deliver(t, message)
+	}
+	assert.Eventually(func() bool { return len(h.aggregator.sentItems()) > 0 }, time.Second*5, time.Millisecond)
+
+	for _, ackCh := range fooAcks {
+		select {
+		case <-ackCh:
+			t.Fatal("message must not be acknowledged before it is sent")
+		default:
+		}
+	}
+
+	close(block)
+	for _, ackCh := range fooAcks {
+		waitAck(t, ackCh)
+	}
+
+	// messages on the same object are sent in order
+	fields := []string{}
+	for _, item := range h.aggregator.sentItems() {
+		if item.Object.Name == "foo" {
+			fields = append(fields, item.Event.Field)
+		}
+	}
+	assert.Equal([]string{"spec", "deletion"}, fields)
+}
+
+func TestWorkersOrderGenerateName(t *testing.T) {
+	assert := assert.New(t)
+
+	block := make(chan struct{})
+	h := newHarness(t, &fakeAggregator{blockOn: map[string]chan struct{}{"alice create": block}}, "--audit-consumer-workers=4")
+
+	// the name is only known from the response object
+	create := newMessage("1", audit.VerbCreate, "")
+	create.RequestURI = "/api/v1/namespaces/default/configmaps"
+	create.ResponseObject = &runtime.Unknown{
+		Raw: []byte(`{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"foo-x7k2p","namespace":"default"}}`),
+	}
+	createAck := h.deliver(t, create)
+	updateAck := h.deliver(t, newMessage("2", audit.VerbUpdate, "foo-x7k2p"))
+
+	select {
+	case <-updateAck:
+		t.Fatal("update must not be sent before the creation of the same object")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	close(block)
+	waitAck(t, createAck)
+	waitAck(t, updateAck)
+
+	titles := []string{}
+	for _, item := range h.aggregator.sentItems() {
+		assert.Equal("foo-x7k2p", item.Object.Name)
+		titles = append(titles, item.Event.Title)
+	}
+	assert.Equal([]string{"alice create", "alice update"}, titles)
+}
+
+func TestDedupAfterSend(t *testing.T) {
+	assert := assert.New(t)
+
+	h := newHarness(t, &fakeAggregator{}, "--audit-consumer-dedup-ttl=1m")
+
+	waitAck(t, h.deliver(t, newMessage("1", audit.VerbUpdate, "foo")))
+	waitAck(t, h.deliver(t, newMessage("1", audit.VerbUpdate, "foo")))
+
+	assert.Len(h.aggregator.sentItems(), 1)
+	assert.Equal(int64(1), h.consumeCount(true))
+	assert.Equal(int64(1), h.consumeCount(false))
+}
+
+func TestRedeliverAfterFailedSend(t *testing.T) {
+	assert := assert.New(t)
+
+	h := newHarness(t, &fakeAggregator{failures: 1}, "--audit-consumer-dedup-ttl=1m")
+
+	waitAck(t, h.deliver(t, newMessage("1", audit.VerbUpdate, "foo")))
+	assert.Empty(h.aggregator.sentItems())
+	assert.Len(h.deadLetter.pushedItems(), 1)
+
+	// the failed event was not marked, so its redelivery is still traced
+	waitAck(t, h.deliver(t, newMessage("1", audit.VerbUpdate, "foo")))
+	sent := h.aggregator.sentItems()
+	if assert.Len(sent, 1) {
+		assert.Equal("foo", sent[0].Object.Name)
+	}
+	assert.Equal(int64(1), h.consumeCount(true))
+
+	// the event is marked after it is sent
+	waitAck(t, h.deliver(t, newMessage("1", audit.VerbUpdate, "foo")))
+	assert.Len(h.aggregator.sentItems(), 1)
+}
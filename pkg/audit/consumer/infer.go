@@ -0,0 +1,249 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auditconsumer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+
+	"github.com/kubewharf/kelemetry/pkg/audit"
+	"github.com/kubewharf/kelemetry/pkg/util"
+)
+
+// collectionVerbs are the verbs that operate on a collection if the request has no object name.
+var collectionVerbs = sets.NewString(
+	audit.VerbList,
+	audit.VerbWatch,
+	audit.VerbDeleteCollection,
+)
+
+// namespaceSubresources are the subresources of namespaces,
+// which would otherwise be parsed as namespaced resources from the request URI.
+var namespaceSubresources = sets.NewString("status", "finalize")
+
+// isCollectionRequest returns true if the request is on a collection instead of a named object.
+// List and watch requests on a single object (through a metadata.name field selector) have a nonempty name.
+func isCollectionRequest(message *audit.Message) bool {
+	return collectionVerbs.Has(message.Verb) && message.ObjectRef != nil && message.ObjectRef.Name == ""
+}
+
+// orderingKey returns a key that is identical for all messages on the same object,
+// before objectRef inference which depends on the previous messages being processed.
+// The object name is not part of the key, because it is unknown for creations with generateName
+// and for deletecollection requests, which must be ordered with the other messages on the same objects.
+func orderingKey(message *audit.Message) string {
+	ref := message.ObjectRef
+	if ref == nil {
+		ref, _ = ParseRequestUri(message.RequestURI)
+	}
+	if ref == nil {
+		return message.Cluster
+	}
+
+	return fmt.Sprintf("%s/%s/%s/%s", message.Cluster, ref.APIGroup, ref.Resource, ref.Namespace)
+}
+
+// inferObjectRef reconstructs message.ObjectRef from RequestURI, ResponseObject and RequestObject.
+// The name remains empty if the event does not contain the object name,
+// e.g. a creation with generateName at Metadata level.
+func (recv *receiver) inferObjectRef(message *audit.Message) error {
+	errs := []error{}
+
+	if message.ObjectRef == nil {
+		ref, err := ParseRequestUri(message.RequestURI)
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			message.ObjectRef = ref
+		}
+	}
+
+	if message.ObjectRef != nil && isCollectionRequest(message) {
+		return nil
+	}
+
+	for _, object := range []*runtime.Unknown{message.ResponseObject, message.RequestObject} {
+		found, err := recv.inferFromObject(message, object)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if found {
+			return nil
+		}
+	}
+
+	if message.ObjectRef == nil {
+		errs = append(errs, fmt.Errorf("no RequestURI, ResponseObject or RequestObject to infer objectRef from"))
+		return utilerrors.NewAggregate(errs)
+	}
+
+	return nil
+}
+
+// inferFromObject fills in the object identity from a request or response object.
+// Returns false if the object does not contain the name of the requested object.
+func (recv *receiver) inferFromObject(message *audit.Message, object *runtime.Unknown) (bool, error) {
+	if object == nil || len(object.Raw) == 0 {
+		return false, nil
+	}
+
+	var partial metav1.PartialObjectMetadata
+	if err := json.Unmarshal(object.Raw, &partial); err != nil {
+		return false, fmt.Errorf("unmarshal raw object: %w", err)
+	}
+
+	if partial.Kind == "Status" || partial.Name == "" {
+		// failed requests respond with a Status, and objects with generateName have no name in the request
+		return false, nil
+	}
+
+	if message.ObjectRef != nil {
+		// only take the identity from the object, since the object kind may differ from the requested resource
+		message.ObjectRef.Name = partial.Name
+		if message.ObjectRef.Namespace == "" {
+			message.ObjectRef.Namespace = partial.Namespace
+		}
+		if message.ObjectRef.UID == "" {
+			message.ObjectRef.UID = partial.UID
+		}
+		return true, nil
+	}
+
+	gv, err := schema.ParseGroupVersion(partial.APIVersion)
+	if err != nil {
+		return false, fmt.Errorf("object has invalid GroupVersion: %w", err)
+	}
+
+	cdc, err := recv.discoveryCache.ForCluster(message.Cluster)
+	if err != nil {
+		return false, fmt.Errorf("no ClusterDiscoveryCache: %w", err)
+	}
+
+	gvr, ok := cdc.LookupResource(gv.WithKind(partial.Kind))
+	if !ok {
+		return false, fmt.Errorf("conversion of object kind %s to GVR failed", partial.Kind)
+	}
+
+	message.ObjectRef = &auditv1.ObjectReference{
+		APIGroup:   gvr.Group,
+		APIVersion: gvr.Version,
+		Resource:   gvr.Resource,
+		Namespace:  partial.Namespace,
+		Name:       partial.Name,
+		UID:        partial.UID,
+		// do not set as partial.ResourceVersion, otherwise diff decorator will think this is a no-op
+		ResourceVersion: "",
+	}
+
+	return true, nil
+}
+
+// ParseRequestUri parses the object reference of a resource request URI
+// in the same way as the RequestInfo resolver of kube-apiserver.
+// The name is empty for collection requests.
+func ParseRequestUri(requestUri string) (*auditv1.ObjectReference, error) {
+	parsed, err := url.ParseRequestURI(requestUri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RequestURI: %w", err)
+	}
+
+	parts := strings.Split(strings.Trim(parsed.Path, "/"), "/")
+	ref := &auditv1.ObjectReference{}
+
+	switch {
+	case len(parts) >= 2 && parts[0] == "api":
+		ref.APIVersion = parts[1]
+		parts = parts[2:]
+	case len(parts) >= 3 && parts[0] == "apis":
+		ref.APIGroup = parts[1]
+		ref.APIVersion = parts[2]
+		parts = parts[3:]
+	default:
+		return nil, fmt.Errorf("RequestURI %q is not a resource request", parsed.Path)
+	}
+
+	// deprecated watch paths, e.g. /api/v1/watch/namespaces/default/pods
+	if len(parts) > 0 && parts[0] == "watch" {
+		parts = parts[1:]
+	}
+
+	if len(parts) >= 2 && parts[0] == "namespaces" {
+		ref.Namespace = parts[1]
+
+		// /namespaces/{name} and /namespaces/{name}/{subresource} refer to the namespace itself
+		if len(parts) > 2 && !namespaceSubresources.Has(parts[2]) {
+			parts = parts[2:]
+		}
+	}
+
+	if len(parts) == 0 || parts[0] == "" {
+		return nil, fmt.Errorf("RequestURI %q has no resource", parsed.Path)
+	}
+
+	ref.Resource = parts[0]
+	if len(parts) >= 2 {
+		ref.Name = parts[1]
+	}
+	if len(parts) >= 3 {
+		ref.Subresource = parts[2]
+	}
+
+	return ref, nil
+}
+
+// deletedObjects returns the objects deleted by a deletecollection request,
+// which are listed in the response object at RequestResponse level.
+func deletedObjects(collection util.ObjectRef, response *runtime.Unknown) ([]util.ObjectRef, error) {
+	if response == nil || len(response.Raw) == 0 {
+		return nil, nil
+	}
+
+	list := &struct {
+		Kind  string           `json:"kind"`
+		Items []map[string]any `json:"items"`
+	}{}
+	if err := json.Unmarshal(response.Raw, list); err != nil {
+		return nil, fmt.Errorf("unmarshal list: %w", err)
+	}
+
+	objects := make([]util.ObjectRef, 0, len(list.Items))
+	for _, item := range list.Items {
+		raw := &unstructured.Unstructured{Object: item}
+		if raw.GetName() == "" {
+			continue
+		}
+
+		objects = append(objects, util.ObjectRef{
+			Cluster:              collection.Cluster,
+			GroupVersionResource: collection.GroupVersionResource,
+			Namespace:            raw.GetNamespace(),
+			Name:                 raw.GetName(),
+			Uid:                  raw.GetUID(),
+			Raw:                  raw,
+		})
+	}
+
+	return objects, nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auditconsumer_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+
+	auditconsumer "github.com/kubewharf/kelemetry/pkg/audit/consumer"
+)
+
+func TestParseRequestUri(t *testing.T) {
+	for _, testCase := range []struct {
+		name   string
+		uri    string
+		expect *auditv1.ObjectReference
+	}{
+		{
+			name:   "NamespacedObject",
+			uri:    "/api/v1/namespaces/default/pods/foo",
+			expect: &auditv1.ObjectReference{APIVersion: "v1", Resource: "pods", Namespace: "default", Name: "foo"},
+		},
+		{
+			name: "Subresource",
+			uri:  "/apis/apps/v1/namespaces/default/deployments/foo/scale?fieldManager=kubectl",
+			expect: &auditv1.ObjectReference{
+				APIGroup:    "apps",
+				APIVersion:  "v1",
+				Resource:    "deployments",
+				Namespace:   "default",
+				Name:        "foo",
+				Subresource: "scale",
+			},
+		},
+		{
+			name:   "NamespacedCollection",
+			uri:    "/api/v1/namespaces/default/configmaps?labelSelector=a%3Db",
+			expect: &auditv1.ObjectReference{APIVersion: "v1", Resource: "configmaps", Namespace: "default"},
+		},
+		{
+			name: "ClusterScopedObject",
+			uri:  "/apis/rbac.authorization.k8s.io/v1/clusterroles/admin",
+			expect: &auditv1.ObjectReference{
+				APIGroup:   "rbac.authorization.k8s.io",
+				APIVersion: "v1",
+				Resource:   "clusterroles",
+				Name:       "admin",
+			},
+		},
+		{
+			name:   "Namespace",
+			uri:    "/api/v1/namespaces/foo",
+			expect: &auditv1.ObjectReference{APIVersion: "v1", Resource: "namespaces", Namespace: "foo", Name: "foo"},
+		},
+		{
+			name: "NamespaceSubresource",
+			uri:  "/api/v1/namespaces/foo/finalize",
+			expect: &auditv1.ObjectReference{
+				APIVersion:  "v1",
+				Resource:    "namespaces",
+				Namespace:   "foo",
+				Name:        "foo",
+				Subresource: "finalize",
+			},
+		},
+		{
+			name:   "LegacyWatch",
+			uri:    "/api/v1/watch/namespaces/default/pods",
+			expect: &auditv1.ObjectReference{APIVersion: "v1", Resource: "pods", Namespace: "default"},
+		},
+		{
+			name: "NonResource",
+			uri:  "/healthz",
+		},
+	} {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			ref, err := auditconsumer.ParseRequestUri(testCase.uri)
+			if testCase.expect == nil {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.expect, ref)
+		})
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auditconsumer
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/utils/clock"
+
+	"github.com/kubewharf/kelemetry/pkg/aggregator"
+	"github.com/kubewharf/kelemetry/pkg/audit"
+)
+
+// readVerbs are the verbs that can be traced with --audit-consumer-read-verbs.
+var readVerbs = sets.NewString(
+	audit.VerbGet,
+	audit.VerbList,
+	audit.VerbWatch,
+)
+
+// readField is the field of the object span that read events are nested under.
+const readField = "read"
+
+// readThrottleInterval is the interval to delete idle read throttle buckets.
+const readThrottleInterval = time.Minute
+
+type readThrottleKey struct {
+	cluster   string
+	userAgent string
+}
+
+// readThrottler maintains a token bucket for read events of each user agent.
+type readThrottler struct {
+	lock    sync.Mutex
+	buckets map[readThrottleKey]*rate.Limiter
+}
+
+type readMetric struct {
+	Cluster string
+	Verb    string
+	Result  string
+}
+
+type readThrottleBucketsMetric struct{}
+
+func (recv *receiver) initReadVerbs() error {
+	for _, verb := range recv.options.readVerbs {
+		if !readVerbs.Has(verb) {
+			return fmt.Errorf("unsupported --audit-consumer-read-verbs %q, must be one of %v", verb, readVerbs.List())
+		}
+	}
+
+	if recv.options.readSampleRatio < 0 || recv.options.readSampleRatio > 1 {
+		return fmt.Errorf("--audit-consumer-read-sample-ratio must be between 0 and 1")
+	}
+
+	if recv.options.readRateLimit > 0 && recv.options.readRateBurst < 1 {
+		return fmt.Errorf("--audit-consumer-read-rate-burst must be positive")
+	}
+
+	recv.readVerbs = sets.NewString(recv.options.readVerbs...)
+	recv.readThrottler.buckets = map[readThrottleKey]*rate.Limiter{}
+	recv.readMetric = recv.metrics.New("audit_consumer_read", &readMetric{})
+	recv.readThrottleBucketsMetric = recv.metrics.New("audit_consumer_read_throttle_buckets", &readThrottleBucketsMetric{})
+
+	return nil
+}
+
+// allowRead determines whether a read event should be traced,
+// applying sampling on the audit ID followed by throttling on the user agent.
+func (recv *receiver) allowRead(message *audit.Message) bool {
+	metric := &readMetric{Cluster: message.Cluster, Verb: message.Verb}
+	// the tags are only evaluated when the deferred function runs, after Result is set
+	defer func() { recv.readMetric.With(metric).Count(1) }()
+
+	if !sampleAuditId(string(message.AuditID), recv.options.readSampleRatio) {
+		metric.Result = "SampledOut"
+		return false
+	}
+
+	if recv.options.readRateLimit > 0 {
+		key := readThrottleKey{cluster: message.Cluster, userAgent: message.UserAgent}
+
+		recv.readThrottler.lock.Lock()
+		defer recv.readThrottler.lock.Unlock()
+
+		bucket, exists := recv.readThrottler.buckets[key]
+		if !exists {
+			bucket = rate.NewLimiter(rate.Limit(recv.options.readRateLimit), recv.options.readRateBurst)
+			recv.readThrottler.buckets[key] = bucket
+		}
+
+		if !bucket.AllowN(recv.clock.Now(), 1) {
+			metric.Result = "Throttled"
+			return false
+		}
+	}
+
+	metric.Result = "Traced"
+	return true
+}
+
+// sampleAuditId deterministically samples the audit ID,
+// so that redeliveries of the same audit event get the same decision.
+func sampleAuditId(auditId string, ratio float64) bool {
+	if ratio >= 1 {
+		return true
+	}
+
+	hasher := fnv.New64a()
+	_, _ = hasher.Write([]byte(auditId))
+	return float64(hasher.Sum64()) < ratio*math.MaxUint64
+}
+
+func (recv *receiver) runReadThrottleGcLoop(timer clock.Timer, stopCh <-chan struct{}) {
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C():
+			timer.Reset(readThrottleInterval)
+			recv.gcReadThrottleBuckets()
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// gcReadThrottleBuckets deletes the buckets that have been refilled,
+// which are equivalent to the new buckets created on the next read event.
+func (recv *receiver) gcReadThrottleBuckets() {
+	now := recv.clock.Now()
+
+	recv.readThrottler.lock.Lock()
+	defer recv.readThrottler.lock.Unlock()
+
+	for key, bucket := range recv.readThrottler.buckets {
+		if bucket.TokensAt(now) >= float64(bucket.Burst()) {
+			delete(recv.readThrottler.buckets, key)
+		}
+	}
+
+	recv.readThrottleBucketsMetric.With(&readThrottleBucketsMetric{}).Gauge(int64(len(recv.readThrottler.buckets)))
+}
+
+// withReadTags adds the query parameters of a read request that affect the returned objects.
+func withReadTags(event *aggregator.Event, requestUri string) *aggregator.Event {
+	parsed, err := url.ParseRequestURI(requestUri)
+	if err != nil {
+		return event
+	}
+
+	query := parsed.Query()
+	for _, param := range []string{"labelSelector", "fieldSelector", "resourceVersion", "limit"} {
+		if value := query.Get(param); value != "" {
+			event = event.WithTag(param, value)
+		}
+	}
+
+	return event
+}
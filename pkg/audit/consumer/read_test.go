@@ -0,0 +1,208 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auditconsumer_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/kubewharf/kelemetry/pkg/audit"
+	"github.com/kubewharf/kelemetry/pkg/util"
+)
+
+// newReadMessage creates a read audit event on an object named after the audit ID.
+func newReadMessage(auditId string, verb string, userAgent string) *audit.Message {
+	message := newMessage(auditId, verb, auditId)
+	message.UserAgent = userAgent
+	return message
+}
+
+func (h *harness) readCount(verb string, result string) int64 {
+	return h.metrics.Get("audit_consumer_read", map[string]string{
+		"cluster": "test",
+		"verb":    verb,
+		"result":  result,
+	}).Int
+}
+
+func (h *harness) sentCount() int {
+	return len(h.aggregator.sentItems())
+}
+
+func TestReadSampling(t *testing.T) {
+	for _, tc := range []struct {
+		ratio    string
+		expectFn func(assert *assert.Assertions, traced int)
+	}{
+		{"0", func(assert *assert.Assertions, traced int) { assert.Equal(0, traced) }},
+		{"0.5", func(assert *assert.Assertions, traced int) {
+			assert.Greater(traced, 25)
+			assert.Less(traced, 75)
+		}},
+		{"1", func(assert *assert.Assertions, traced int) { assert.Equal(100, traced) }},
+	} {
+		tc := tc
+		t.Run(tc.ratio, func(t *testing.T) {
+			assert := assert.New(t)
+
+			h := newHarness(t, &fakeAggregator{},
+				"--audit-consumer-read-verbs=get",
+				"--audit-consumer-read-sample-ratio="+tc.ratio,
+			)
+
+			// each audit event is delivered twice and must get the same sampling decision;
+			// audit IDs are UUIDs, and the hash of shorter IDs is not uniform enough for a small sample
+			for round := 0; round < 2; round++ {
+				for i := 0; i < 100; i++ {
+					auditId := fmt.Sprintf("3f2b%04d-9c1e-4b7a-8d2e-6a5c1f0e%04d", i, i)
+					waitAck(t, h.deliver(t, newReadMessage(auditId, audit.VerbGet, "kubectl/v1.26.0")))
+				}
+			}
+
+			counts := map[string]int{}
+			for _, item := range h.aggregator.sentItems() {
+				counts[item.Object.Name] += 1
+			}
+			for auditId, count := range counts {
+				assert.Equal(2, count, "audit ID %s", auditId)
+			}
+
+			tc.expectFn(assert, len(counts))
+			assert.Equal(int64(len(counts)*2), h.readCount(audit.VerbGet, "Traced"))
+			assert.Equal(int64(200-len(counts)*2), h.readCount(audit.VerbGet, "SampledOut"))
+		})
+	}
+}
+
+func TestReadThrottle(t *testing.T) {
+	assert := assert.New(t)
+
+	h := newHarness(t, &fakeAggregator{},
+		"--audit-consumer-read-verbs=get",
+		"--audit-consumer-read-rate-limit=1",
+		"--audit-consumer-read-rate-burst=2",
+	)
+
+	for i := 0; i < 3; i++ {
+		waitAck(t, h.deliver(t, newReadMessage(fmt.Sprintf("a%d", i), audit.VerbGet, "kubectl/v1.26.0")))
+	}
+	assert.Equal(2, h.sentCount())
+	assert.Equal(int64(1), h.readCount(audit.VerbGet, "Throttled"))
+
+	// other user agents have separate buckets
+	waitAck(t, h.deliver(t, newReadMessage("b", audit.VerbGet, "kube-controller-manager/v1.26.0")))
+	assert.Equal(3, h.sentCount())
+
+	h.clock.Step(time.Second)
+	waitAck(t, h.deliver(t, newReadMessage("a3", audit.VerbGet, "kubectl/v1.26.0")))
+	waitAck(t, h.deliver(t, newReadMessage("a4", audit.VerbGet, "kubectl/v1.26.0")))
+	assert.Equal(4, h.sentCount())
+	assert.Equal(int64(2), h.readCount(audit.VerbGet, "Throttled"))
+	assert.Equal(int64(4), h.readCount(audit.VerbGet, "Traced"))
+}
+
+func TestReadCollection(t *testing.T) {
+	assert := assert.New(t)
+
+	h := newHarness(t, &fakeAggregator{}, "--audit-consumer-read-verbs=list,watch")
+
+	for _, verb := range []string{audit.VerbList, audit.VerbWatch} {
+		message := newReadMessage(verb, verb, "kubectl/v1.26.0")
+		message.ObjectRef.Name = ""
+		message.RequestURI = "/api/v1/namespaces/default/configmaps?labelSelector=app%3Dfoo&limit=10&watch=true"
+		waitAck(t, h.deliver(t, message))
+	}
+
+	sent := h.aggregator.sentItems()
+	if assert.Len(sent, 2) {
+		for i, verb := range []string{audit.VerbList, audit.VerbWatch} {
+			assert.Equal(util.CollectionName, sent[i].Object.Name)
+			assert.Equal("default", sent[i].Object.Namespace)
+			assert.Equal("configmaps", sent[i].Object.Resource)
+			assert.Equal("read", sent[i].Event.Field)
+			assert.Equal("alice "+verb, sent[i].Event.Title)
+			assert.Equal("app=foo", sent[i].Event.Tags["labelSelector"])
+			assert.Equal("10", sent[i].Event.Tags["limit"])
+		}
+	}
+}
+
+func TestReadThrottleGc(t *testing.T) {
+	assert := assert.New(t)
+
+	// a bucket is refilled 100 seconds after its only token is taken
+	h := newHarness(t, &fakeAggregator{},
+		"--audit-consumer-read-verbs=get",
+		"--audit-consumer-read-rate-limit=0.01",
+		"--audit-consumer-read-rate-burst=1",
+	)
+
+	bucketCount := func() int64 {
+		return h.metrics.Get("audit_consumer_read_throttle_buckets", map[string]string{}).Int
+	}
+
+	waitAck(t, h.deliver(t, newReadMessage("a1", audit.VerbGet, "a")))
+	waitAck(t, h.deliver(t, newReadMessage("b1", audit.VerbGet, "b")))
+	assert.Equal(2, h.sentCount())
+
+	// no bucket is full after 60 seconds
+	h.clock.Step(time.Minute)
+	assert.Eventually(func() bool { return bucketCount() == 2 }, time.Second, time.Millisecond)
+
+	waitAck(t, h.deliver(t, newReadMessage("c1", audit.VerbGet, "c")))
+	waitAck(t, h.deliver(t, newReadMessage("b2", audit.VerbGet, "b")))
+	assert.Equal(3, h.sentCount())
+
+	// "a" and "b" are full after 120 seconds, but "c" is only partially refilled
+	h.clock.Step(time.Minute)
+	assert.Eventually(func() bool { return bucketCount() == 1 }, time.Second, time.Millisecond)
+
+	// the bucket of "c" is retained, so it is still throttled
+	waitAck(t, h.deliver(t, newReadMessage("c2", audit.VerbGet, "c")))
+	waitAck(t, h.deliver(t, newReadMessage("a2", audit.VerbGet, "a")))
+	assert.Equal(4, h.sentCount())
+	assert.Equal(int64(2), h.readCount(audit.VerbGet, "Throttled"))
+}
+
+func newLogMessage(auditId string) *audit.Message {
+	message := newMessage(auditId, audit.VerbGet, "foo")
+	message.RequestURI = "/api/v1/namespaces/default/pods/foo/log?container=main"
+	message.ObjectRef.Resource = "pods"
+	message.ObjectRef.Subresource = "log"
+	return message
+}
+
+func TestReadSubresource(t *testing.T) {
+	assert := assert.New(t)
+
+	// subresource reads are not traced unless the read verb is enabled
+	h := newHarness(t, &fakeAggregator{})
+	waitAck(t, h.deliver(t, newLogMessage("a")))
+	assert.Equal(0, h.sentCount())
+
+	// subresource reads are throttled like other reads
+	h = newHarness(t, &fakeAggregator{},
+		"--audit-consumer-read-verbs=get",
+		"--audit-consumer-read-rate-limit=1",
+		"--audit-consumer-read-rate-burst=1",
+	)
+	waitAck(t, h.deliver(t, newLogMessage("b")))
+	waitAck(t, h.deliver(t, newLogMessage("c")))
+	assert.Equal(1, h.sentCount())
+	assert.Equal(int64(1), h.readCount(audit.VerbGet, "Throttled"))
+}
@@ -15,43 +15,215 @@
 package audit
 
 import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"k8s.io/utils/clock"
+
 	"github.com/kubewharf/kelemetry/pkg/aggregator"
 	"github.com/kubewharf/kelemetry/pkg/manager"
+	"github.com/kubewharf/kelemetry/pkg/metrics"
+	"github.com/kubewharf/kelemetry/pkg/util/shutdown"
+	"github.com/kubewharf/kelemetry/pkg/util/zconstants"
 )
 
 func init() {
 	manager.Global.Provide("audit-decorator-list", NewDecoratorList)
 }
 
+// Decorator adds information about an audit message to its trace event.
+//
+// Decorators may run concurrently with each other, so the message must be treated as read-only.
 type Decorator interface {
-	Decorate(message *Message, event *aggregator.Event)
+	// Decorate modifies the event.
+	// ctx is canceled when the deadline for decorating the message is exceeded,
+	// after which any further changes to the event are discarded.
+	Decorate(ctx context.Context, message *Message, event *aggregator.Event)
 }
 
+// DecoratorPriority determines the order of decorators.
+//
+// Decorators with a lower priority run first, and their changes are visible to those with a higher priority.
+// Decorators with the same priority run concurrently on separate copies of the event,
+// and their changes are merged in the order of registration.
+type DecoratorPriority int32
+
+const (
+	// DecoratorPriorityIdentity is the priority of decorators that change the basic information of the event,
+	// such as the title.
+	DecoratorPriorityIdentity DecoratorPriority = 100
+	// DecoratorPriorityContent is the priority of decorators that describe the request and response content.
+	DecoratorPriorityContent DecoratorPriority = 200
+)
+
 type DecoratorList interface {
 	manager.Component
 
-	AddDecorator(decorator Decorator)
+	AddDecorator(name string, priority DecoratorPriority, decorator Decorator)
 
-	Decorate(message *Message, event *aggregator.Event)
+	Decorate(ctx context.Context, message *Message, event *aggregator.Event)
+}
+
+type decoratorListOptions struct {
+	timeout time.Duration
+}
+
+func (options *decoratorListOptions) Setup(fs *pflag.FlagSet) {
+	fs.DurationVar(
+		&options.timeout,
+		"audit-decorator-timeout",
+		time.Second*15,
+		"maximum time to run all decorators for each audit event; changes from decorators that do not complete in time are discarded",
+	)
+}
+
+func (options *decoratorListOptions) EnableFlag() *bool { return nil }
+
+type namedDecorator struct {
+	name      string
+	decorator Decorator
+}
+
+type decoratorGroup struct {
+	priority   DecoratorPriority
+	decorators []namedDecorator
 }
 
 type decoratorList struct {
-	manager.BaseComponent
-	decorators []Decorator
+	options decoratorListOptions
+	logger  logrus.FieldLogger
+	clock   clock.Clock
+	metrics metrics.Client
+
+	// sorted by priority
+	groups          []*decoratorGroup
+	decoratorMetric metrics.Metric
+}
+
+type decoratorMetric struct {
+	Cluster   string
+	Decorator string
+	TimedOut  bool
 }
 
-func NewDecoratorList() DecoratorList {
+func NewDecoratorList(
+	logger logrus.FieldLogger,
+	clock clock.Clock,
+	metrics metrics.Client,
+) DecoratorList {
 	return &decoratorList{
-		decorators: []Decorator{},
+		logger:  logger,
+		clock:   clock,
+		metrics: metrics,
 	}
 }
 
-func (list *decoratorList) AddDecorator(decorator Decorator) {
-	list.decorators = append(list.decorators, decorator)
+func (list *decoratorList) Options() manager.Options {
+	return &list.options
 }
 
-func (list *decoratorList) Decorate(message *Message, event *aggregator.Event) {
-	for _, decorator := range list.decorators {
-		decorator.Decorate(message, event)
+func (list *decoratorList) Init(ctx context.Context) error {
+	if list.options.timeout <= 0 {
+		return fmt.Errorf("--audit-decorator-timeout must be positive")
+	}
+
+	list.decoratorMetric = list.metrics.New("audit_decorator", &decoratorMetric{})
+	return nil
+}
+
+func (list *decoratorList) Start(stopCh <-chan struct{}) error { return nil }
+
+func (list *decoratorList) Close() error { return nil }
+
+func (list *decoratorList) AddDecorator(name string, priority DecoratorPriority, decorator Decorator) {
+	index := sort.Search(len(list.groups), func(i int) bool { return list.groups[i].priority >= priority })
+	if index == len(list.groups) || list.groups[index].priority != priority {
+		list.groups = append(list.groups, nil)
+		copy(list.groups[index+1:], list.groups[index:])
+		list.groups[index] = &decoratorGroup{priority: priority}
+	}
+
+	group := list.groups[index]
+	group.decorators = append(group.decorators, namedDecorator{name: name, decorator: decorator})
+}
+
+func (list *decoratorList) Decorate(ctx context.Context, message *Message, event *aggregator.Event) {
+	ctx, cancelFunc := context.WithTimeout(ctx, list.options.timeout)
+	defer cancelFunc()
+
+	for _, group := range list.groups {
+		if ctx.Err() != nil {
+			event.Log(zconstants.LogTypeKelemetryError, fmt.Sprintf("Decorators with priority %d skipped due to timeout", group.priority))
+			continue
+		}
+
+		list.decorateGroup(ctx, group, message, event)
+	}
+}
+
+func (list *decoratorList) decorateGroup(ctx context.Context, group *decoratorGroup, message *Message, event *aggregator.Event) {
+	base := event.Clone()
+
+	outputs := make([]*aggregator.Event, len(group.decorators))
+	doneChs := make([]chan struct{}, len(group.decorators))
+
+	for i, decorator := range group.decorators {
+		output := base.Clone()
+		doneCh := make(chan struct{})
+		outputs[i] = output
+		doneChs[i] = doneCh
+
+		go func(decorator namedDecorator) {
+			defer shutdown.RecoverPanic(list.logger)
+			defer close(doneCh)
+
+			metric := &decoratorMetric{Cluster: message.Cluster, Decorator: decorator.name}
+			defer list.decoratorMetric.DeferCount(list.clock.Now(), metric)
+
+			decorator.decorator.Decorate(ctx, message, output)
+			metric.TimedOut = ctx.Err() != nil
+		}(decorator)
+	}
+
+	for i, decorator := range group.decorators {
+		select {
+		case <-doneChs[i]:
+		default:
+			select {
+			case <-doneChs[i]:
+			case <-ctx.Done():
+				list.logger.
+					WithField("auditId", message.AuditID).
+					WithField("decorator", decorator.name).
+					Warn("Decorator timed out")
+				event.Log(zconstants.LogTypeKelemetryError, fmt.Sprintf("Decorator %s timed out", decorator.name))
+				continue
+			}
+		}
+
+		mergeEvent(event, base, outputs[i])
+	}
+}
+
+// mergeEvent applies the changes from base to output onto dest.
+// Decorators are only expected to change the title, set tags and append logs.
+func mergeEvent(dest *aggregator.Event, base *aggregator.Event, output *aggregator.Event) {
+	if output.Title != base.Title {
+		dest.Title = output.Title
+	}
+
+	for key, value := range output.Tags {
+		if baseValue, exists := base.Tags[key]; !exists || !reflect.DeepEqual(baseValue, value) {
+			dest.Tags[key] = value
+		}
+	}
+
+	if len(output.Logs) > len(base.Logs) {
+		dest.Logs = append(dest.Logs, output.Logs[len(base.Logs):]...)
 	}
 }
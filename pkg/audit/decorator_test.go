@@ -0,0 +1,147 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"github.com/kubewharf/kelemetry/pkg/aggregator"
+	"github.com/kubewharf/kelemetry/pkg/audit"
+	"github.com/kubewharf/kelemetry/pkg/metrics"
+	"github.com/kubewharf/kelemetry/pkg/util/zconstants"
+)
+
+type funcDecorator func(ctx context.Context, message *audit.Message, event *aggregator.Event)
+
+func (fn funcDecorator) Decorate(ctx context.Context, message *audit.Message, event *aggregator.Event) {
+	fn(ctx, message, event)
+}
+
+func newList(t *testing.T, args ...string) audit.DecoratorList {
+	t.Helper()
+
+	clock := clocktesting.NewFakeClock(time.Unix(1600000000, 0))
+	metricsClient, _ := metrics.NewMock(clock)
+	list := audit.NewDecoratorList(logrus.New(), clock, metricsClient)
+
+	fs := pflag.NewFlagSet("test", pflag.PanicOnError)
+	list.Options().Setup(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := list.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	return list
+}
+
+func TestDecoratorPriority(t *testing.T) {
+	assert := assert.New(t)
+
+	list := newList(t)
+
+	// registered in reverse order of priority
+	list.AddDecorator("content", audit.DecoratorPriorityContent, funcDecorator(
+		func(ctx context.Context, message *audit.Message, event *aggregator.Event) {
+			event.WithTag("seenTitle", event.Title)
+		},
+	))
+	list.AddDecorator("identity", audit.DecoratorPriorityIdentity, funcDecorator(
+		func(ctx context.Context, message *audit.Message, event *aggregator.Event) {
+			event.Title = "renamed"
+		},
+	))
+
+	event := aggregator.NewEvent("spec", "original", time.Time{}, "audit")
+	list.Decorate(context.Background(), &audit.Message{}, event)
+
+	assert.Equal("renamed", event.Title)
+	assert.Equal("renamed", event.Tags["seenTitle"])
+}
+
+func TestDecoratorConcurrentMerge(t *testing.T) {
+	assert := assert.New(t)
+
+	list := newList(t)
+
+	// both decorators must be running at the same time to complete
+	barrier := make(chan struct{})
+	list.AddDecorator("first", audit.DecoratorPriorityContent, funcDecorator(
+		func(ctx context.Context, message *audit.Message, event *aggregator.Event) {
+			barrier <- struct{}{}
+			event.WithTag("first", 1)
+			event.Log("test", "first")
+		},
+	))
+	list.AddDecorator("second", audit.DecoratorPriorityContent, funcDecorator(
+		func(ctx context.Context, message *audit.Message, event *aggregator.Event) {
+			<-barrier
+			event.WithTag("second", 2)
+			event.Log("test", "second")
+		},
+	))
+
+	event := aggregator.NewEvent("spec", "title", time.Time{}, "audit").WithTag("existing", 0).Log("test", "existing")
+	list.Decorate(context.Background(), &audit.Message{}, event)
+
+	assert.Equal(map[string]any{"existing": 0, "first": 1, "second": 2}, event.Tags)
+	if assert.Len(event.Logs, 3) {
+		assert.Equal("existing", event.Logs[0].Message)
+		assert.Equal("first", event.Logs[1].Message)
+		assert.Equal("second", event.Logs[2].Message)
+	}
+}
+
+func TestDecoratorTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	list := newList(t, "--audit-decorator-timeout=50ms")
+
+	list.AddDecorator("slow", audit.DecoratorPriorityIdentity, funcDecorator(
+		func(ctx context.Context, message *audit.Message, event *aggregator.Event) {
+			<-ctx.Done()
+			event.WithTag("slow", true)
+		},
+	))
+	list.AddDecorator("fast", audit.DecoratorPriorityIdentity, funcDecorator(
+		func(ctx context.Context, message *audit.Message, event *aggregator.Event) {
+			event.WithTag("fast", true)
+		},
+	))
+	list.AddDecorator("later", audit.DecoratorPriorityContent, funcDecorator(
+		func(ctx context.Context, message *audit.Message, event *aggregator.Event) {
+			event.WithTag("later", true)
+		},
+	))
+
+	event := aggregator.NewEvent("spec", "title", time.Time{}, "audit")
+	list.Decorate(context.Background(), &audit.Message{}, event)
+
+	assert.Equal(map[string]any{"fast": true}, event.Tags)
+	if assert.Len(event.Logs, 2) {
+		assert.Equal(zconstants.LogTypeKelemetryError, event.Logs[0].Type)
+		assert.Equal("Decorator slow timed out", event.Logs[0].Message)
+		assert.Equal("Decorators with priority 200 skipped due to timeout", event.Logs[1].Message)
+	}
+}
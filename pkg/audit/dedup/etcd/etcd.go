@@ -0,0 +1,173 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	etcdv3 "go.etcd.io/etcd/client/v3"
+	"k8s.io/utils/clock"
+
+	"github.com/kubewharf/kelemetry/pkg/audit/dedup"
+	"github.com/kubewharf/kelemetry/pkg/manager"
+	"github.com/kubewharf/kelemetry/pkg/util/shutdown"
+)
+
+func init() {
+	manager.Global.ProvideMuxImpl("audit-dedup/etcd", NewEtcd, dedup.Deduplicator.Seen)
+}
+
+type etcdOptions struct {
+	endpoints   []string
+	prefix      string
+	dialTimeout time.Duration
+	leaseReuse  time.Duration
+}
+
+func (options *etcdOptions) Setup(fs *pflag.FlagSet) {
+	fs.StringSliceVar(&options.endpoints, "audit-dedup-etcd-endpoints", []string{}, "etcd endpoints")
+	fs.StringVar(&options.prefix, "audit-dedup-etcd-prefix", "/audit-dedup/", "etcd prefix")
+	fs.DurationVar(
+		&options.dialTimeout,
+		"audit-dedup-etcd-dial-timeout",
+		time.Second*10,
+		"dial timeout for audit dedup etcd connection",
+	)
+	fs.DurationVar(
+		&options.leaseReuse,
+		"audit-dedup-etcd-lease-reuse",
+		time.Second*10,
+		"keys marked within this duration share the same lease, so keys may live longer than the TTL by up to this duration",
+	)
+}
+
+func (options *etcdOptions) EnableFlag() *bool { return nil }
+
+// Etcd deduplicates audit events with keys in etcd,
+// so that duplicates consumed by different processes are also detected.
+type Etcd struct {
+	manager.MuxImplBase
+
+	options   etcdOptions
+	logger    logrus.FieldLogger
+	clock     clock.Clock
+	client    *etcdv3.Client
+	deferList *shutdown.DeferList
+
+	leaseLock sync.Mutex
+	leases    map[time.Duration]*sharedLease
+}
+
+type sharedLease struct {
+	id         etcdv3.LeaseID
+	reuseUntil time.Time
+}
+
+var _ dedup.Deduplicator = &Etcd{}
+
+func NewEtcd(
+	logger logrus.FieldLogger,
+	clock clock.Clock,
+) *Etcd {
+	return &Etcd{
+		logger:    logger,
+		clock:     clock,
+		deferList: shutdown.NewDeferList(),
+		leases:    map[time.Duration]*sharedLease{},
+	}
+}
+
+func (_ *Etcd) MuxImplName() (name string, isDefault bool) { return "etcd", false }
+
+func (store *Etcd) Options() manager.Options { return &store.options }
+
+func (store *Etcd) Init(ctx context.Context) error {
+	if len(store.options.endpoints) == 0 {
+		return fmt.Errorf("no etcd endpoints provided")
+	}
+
+	client, err := etcdv3.New(etcdv3.Config{
+		Endpoints:   store.options.endpoints,
+		DialTimeout: store.options.dialTimeout,
+	})
+	if err != nil {
+		return fmt.Errorf("cannot connect to etcd: %w", err)
+	}
+
+	store.deferList.Defer("closing etcd client", client.Close)
+	store.client = client
+
+	return nil
+}
+
+func (store *Etcd) Start(stopCh <-chan struct{}) error { return nil }
+
+func (store *Etcd) Close() error {
+	if name, err := store.deferList.Run(store.logger); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	return nil
+}
+
+func (store *Etcd) Seen(ctx context.Context, key dedup.Key) (bool, error) {
+	resp, err := store.client.KV.Get(ctx, store.options.prefix+key.String(), etcdv3.WithCountOnly())
+	if err != nil {
+		return false, fmt.Errorf("cannot get key: %w", err)
+	}
+
+	return resp.Count > 0, nil
+}
+
+func (store *Etcd) Mark(ctx context.Context, key dedup.Key, ttl time.Duration) error {
+	leaseId, err := store.getLease(ctx, ttl)
+	if err != nil {
+		return err
+	}
+
+	if _, err := store.client.KV.Put(ctx, store.options.prefix+key.String(), "", etcdv3.WithLease(leaseId)); err != nil {
+		return fmt.Errorf("cannot put key: %w", err)
+	}
+
+	return nil
+}
+
+// getLease returns a lease that expires no earlier than ttl from now.
+// Granting a lease for every key is expensive, so leases are shared for the duration of --audit-dedup-etcd-lease-reuse.
+func (store *Etcd) getLease(ctx context.Context, ttl time.Duration) (etcdv3.LeaseID, error) {
+	store.leaseLock.Lock()
+	defer store.leaseLock.Unlock()
+
+	now := store.clock.Now()
+
+	if lease, exists := store.leases[ttl]; exists && now.Before(lease.reuseUntil) {
+		return lease.id, nil
+	}
+
+	leaseSeconds := int64(math.Ceil((ttl + store.options.leaseReuse).Seconds()))
+	resp, err := store.client.Lease.Grant(ctx, leaseSeconds)
+	if err != nil {
+		return 0, fmt.Errorf("cannot create lease: %w", err)
+	}
+
+	store.leases[ttl] = &sharedLease{id: resp.ID, reuseUntil: now.Add(store.options.leaseReuse)}
+	return resp.ID, nil
+}
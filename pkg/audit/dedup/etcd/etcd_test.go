@@ -0,0 +1,77 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build integration
+
+package etcd_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+	"k8s.io/utils/clock"
+
+	"github.com/kubewharf/kelemetry/pkg/audit/dedup"
+	"github.com/kubewharf/kelemetry/pkg/audit/dedup/etcd"
+)
+
+func TestSeenAcrossClients(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, store := testClient(t)
+	_, other := testClient(t)
+
+	key := dedup.Key{Cluster: "test", AuditId: uuid.NewUUID(), Stage: auditv1.StageResponseComplete}
+
+	seen, err := other.Seen(ctx, key)
+	assert.NoError(err)
+	assert.False(seen)
+
+	assert.NoError(store.Mark(ctx, key, time.Minute))
+
+	seen, err = other.Seen(ctx, key)
+	assert.NoError(err)
+	assert.True(seen)
+}
+
+func testClient(t *testing.T) (context.Context, *etcd.Etcd) {
+	comp := etcd.NewEtcd(logrus.New(), clock.RealClock{})
+
+	fs := pflag.NewFlagSet("test", pflag.PanicOnError)
+	comp.Options().Setup(fs)
+	fs.Parse([]string{
+		"--audit-dedup-etcd-endpoints=http://127.0.0.1:2379",
+	})
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Second*10)
+	ch := make(chan struct{})
+
+	if err := comp.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { cancelFunc(); close(ch); comp.Close() })
+
+	if err := comp.Start(ch); err != nil {
+		t.Fatal(err)
+	}
+
+	return ctx, comp
+}
@@ -0,0 +1,124 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dedup detects audit events received more than once,
+// e.g. due to redelivery from the message queue or duplicate webhooks from multiple receivers.
+package dedup
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+	"k8s.io/utils/clock"
+
+	"github.com/kubewharf/kelemetry/pkg/manager"
+	"github.com/kubewharf/kelemetry/pkg/metrics"
+)
+
+func init() {
+	manager.Global.Provide("audit-dedup", newMux)
+}
+
+// Key identifies an audit event.
+type Key struct {
+	Cluster string
+	AuditId types.UID
+	Stage   auditv1.Stage
+}
+
+func (key Key) String() string {
+	return fmt.Sprintf("%s/%s/%s", key.Cluster, key.AuditId, key.Stage)
+}
+
+// Deduplicator remembers the audit events that have been traced.
+//
+// Events are only marked after they are traced successfully,
+// so that an event redelivered after a failed send or a crash is still traced.
+// Concurrent duplicates may both be traced, since duplicate spans are preferred over missing spans.
+type Deduplicator interface {
+	// Seen returns true if the key has been marked within its ttl.
+	Seen(ctx context.Context, key Key) (bool, error)
+	// Mark remembers the key for ttl.
+	Mark(ctx context.Context, key Key, ttl time.Duration) error
+}
+
+type mux struct {
+	*manager.Mux
+	clock   clock.Clock
+	metrics metrics.Client
+
+	seenMetric, markMetric metrics.Metric
+}
+
+type seenMetric struct {
+	Cluster string
+	Result  string
+	Error   metrics.LabeledError
+}
+
+type markMetric struct {
+	Cluster string
+	Error   metrics.LabeledError
+}
+
+func newMux(
+	clock clock.Clock,
+	metrics metrics.Client,
+) Deduplicator {
+	return &mux{
+		Mux:     manager.NewMux("audit-dedup", false),
+		clock:   clock,
+		metrics: metrics,
+	}
+}
+
+func (mux *mux) Init(ctx context.Context) error {
+	mux.seenMetric = mux.metrics.New("audit_dedup_seen", &seenMetric{})
+	mux.markMetric = mux.metrics.New("audit_dedup_mark", &markMetric{})
+
+	return mux.Mux.Init(ctx)
+}
+
+func (mux *mux) Seen(ctx context.Context, key Key) (bool, error) {
+	metric := &seenMetric{Cluster: key.Cluster}
+	defer mux.seenMetric.DeferCount(mux.clock.Now(), metric)
+
+	seen, err := mux.Impl().(Deduplicator).Seen(ctx, key)
+	switch {
+	case err != nil:
+		metric.Result = "Error"
+		metric.Error = metrics.LabelError(err, "Seen")
+	case seen:
+		metric.Result = "Duplicate"
+	default:
+		metric.Result = "New"
+	}
+
+	return seen, err
+}
+
+func (mux *mux) Mark(ctx context.Context, key Key, ttl time.Duration) error {
+	metric := &markMetric{Cluster: key.Cluster}
+	defer mux.markMetric.DeferCount(mux.clock.Now(), metric)
+
+	err := mux.Impl().(Deduplicator).Mark(ctx, key, ttl)
+	if err != nil {
+		metric.Error = metrics.LabelError(err, "Mark")
+	}
+
+	return err
+}
@@ -0,0 +1,131 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"k8s.io/utils/clock"
+
+	"github.com/kubewharf/kelemetry/pkg/audit/dedup"
+	"github.com/kubewharf/kelemetry/pkg/manager"
+	"github.com/kubewharf/kelemetry/pkg/util/shutdown"
+)
+
+func init() {
+	manager.Global.ProvideMuxImpl("audit-dedup/local", NewLocal, dedup.Deduplicator.Seen)
+}
+
+type options struct {
+	trimFrequency time.Duration
+}
+
+func (options *options) Setup(fs *pflag.FlagSet) {
+	fs.DurationVar(
+		&options.trimFrequency,
+		"audit-dedup-local-cleanup-frequency",
+		time.Minute,
+		"frequency to remove expired keys from the audit dedup cache",
+	)
+}
+
+func (options *options) EnableFlag() *bool { return nil }
+
+// Local deduplicates audit events in memory.
+// Only suitable if all duplicates of the same event are consumed by the same process,
+// e.g. redeliveries from the message queue.
+type Local struct {
+	manager.MuxImplBase
+	options options
+
+	logger      logrus.FieldLogger
+	clock       clock.Clock
+	entriesLock sync.Mutex
+	entries     map[dedup.Key]time.Time
+}
+
+var _ dedup.Deduplicator = &Local{}
+
+func NewLocal(
+	logger logrus.FieldLogger,
+	clock clock.Clock,
+) *Local {
+	return &Local{
+		logger:  logger,
+		clock:   clock,
+		entries: map[dedup.Key]time.Time{},
+	}
+}
+
+func (_ *Local) MuxImplName() (name string, isDefault bool) { return "local", true }
+
+func (local *Local) Options() manager.Options { return &local.options }
+
+func (local *Local) Init(ctx context.Context) error { return nil }
+
+func (local *Local) Start(stopCh <-chan struct{}) error {
+	go func() {
+		defer shutdown.RecoverPanic(local.logger)
+		for {
+			select {
+			case <-local.clock.After(local.options.trimFrequency):
+				local.Trim()
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (local *Local) Close() error { return nil }
+
+// Trim removes the expired keys.
+func (local *Local) Trim() {
+	now := local.clock.Now()
+
+	local.entriesLock.Lock()
+	defer local.entriesLock.Unlock()
+
+	for key, expiry := range local.entries {
+		if !expiry.After(now) {
+			delete(local.entries, key)
+		}
+	}
+}
+
+func (local *Local) Seen(ctx context.Context, key dedup.Key) (bool, error) {
+	now := local.clock.Now()
+
+	local.entriesLock.Lock()
+	defer local.entriesLock.Unlock()
+
+	expiry, exists := local.entries[key]
+	return exists && expiry.After(now), nil
+}
+
+func (local *Local) Mark(ctx context.Context, key dedup.Key, ttl time.Duration) error {
+	now := local.clock.Now()
+
+	local.entriesLock.Lock()
+	defer local.entriesLock.Unlock()
+
+	local.entries[key] = now.Add(ttl)
+	return nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"github.com/kubewharf/kelemetry/pkg/audit/dedup"
+	"github.com/kubewharf/kelemetry/pkg/audit/dedup/local"
+)
+
+func seen(t *testing.T, local *local.Local, key dedup.Key) bool {
+	t.Helper()
+
+	seen, err := local.Seen(context.Background(), key)
+	assert.NoError(t, err)
+	return seen
+}
+
+func TestSeenAfterMark(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := clocktesting.NewFakeClock(time.Unix(1600000000, 0))
+	dedupLocal := local.NewLocal(logrus.New(), clock)
+
+	key := dedup.Key{Cluster: "test", AuditId: "a", Stage: auditv1.StageResponseComplete}
+
+	assert.False(seen(t, dedupLocal, key))
+	assert.False(seen(t, dedupLocal, key), "checking a key must not mark it")
+
+	assert.NoError(dedupLocal.Mark(context.Background(), key, time.Minute))
+	assert.True(seen(t, dedupLocal, key))
+
+	// same audit ID in a different cluster or stage is a different event
+	assert.False(seen(t, dedupLocal, dedup.Key{Cluster: "other", AuditId: "a", Stage: auditv1.StageResponseComplete}))
+	assert.False(seen(t, dedupLocal, dedup.Key{Cluster: "test", AuditId: "a", Stage: auditv1.StageResponseStarted}))
+
+	clock.Step(time.Second * 59)
+	assert.True(seen(t, dedupLocal, key))
+
+	clock.Step(time.Second)
+	dedupLocal.Trim()
+	assert.False(seen(t, dedupLocal, key))
+}
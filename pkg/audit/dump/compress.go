@@ -0,0 +1,134 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auditdump
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+type codec struct {
+	ext       string
+	newWriter func(io.Writer) (io.WriteCloser, error)
+	newReader func(io.Reader) (io.ReadCloser, error)
+}
+
+var codecs = map[string]codec{
+	"gzip": {
+		ext:       ".gz",
+		newWriter: func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+		newReader: func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+	},
+	"zstd": {
+		ext:       ".zst",
+		newWriter: func(w io.Writer) (io.WriteCloser, error) { return zstd.NewWriter(w) },
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			decoder, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return decoder.IOReadCloser(), nil
+		},
+	},
+}
+
+// compressFile compresses the file at path into path+codec.ext and deletes the original file.
+func compressFile(path string, codec codec) (err error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("cannot open file to compress: %w", err)
+	}
+	defer src.Close()
+
+	tmpPath := path + codec.ext + ".tmp"
+	dest, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("cannot create compressed file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = dest.Close()
+			_ = os.Remove(tmpPath)
+		}
+	}()
+
+	writer, err := codec.newWriter(dest)
+	if err != nil {
+		return fmt.Errorf("cannot create compressor: %w", err)
+	}
+
+	if _, err := io.Copy(writer, src); err != nil {
+		return fmt.Errorf("cannot compress file: %w", err)
+	}
+
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("cannot flush compressor: %w", err)
+	}
+
+	if err := dest.Sync(); err != nil {
+		return fmt.Errorf("cannot sync compressed file: %w", err)
+	}
+
+	if err := dest.Close(); err != nil {
+		return fmt.Errorf("cannot close compressed file: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, path+codec.ext); err != nil {
+		return fmt.Errorf("cannot commit compressed file: %w", err)
+	}
+
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("cannot remove uncompressed file: %w", err)
+	}
+
+	return nil
+}
+
+// openDumpFile opens a dump file for reading, decompressing it according to its file extension.
+func openDumpFile(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, codec := range codecs {
+		if strings.HasSuffix(path, codec.ext) {
+			reader, err := codec.newReader(file)
+			if err != nil {
+				_ = file.Close()
+				return nil, fmt.Errorf("cannot decompress file: %w", err)
+			}
+
+			return &decompressedFile{ReadCloser: reader, file: file}, nil
+		}
+	}
+
+	return file, nil
+}
+
+type decompressedFile struct {
+	io.ReadCloser
+	file *os.File
+}
+
+func (file *decompressedFile) Close() error {
+	_ = file.ReadCloser.Close()
+	return file.file.Close()
+}
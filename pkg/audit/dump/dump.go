@@ -18,11 +18,16 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
+	"k8s.io/utils/clock"
 
 	"github.com/kubewharf/kelemetry/pkg/audit"
 	auditwebhook "github.com/kubewharf/kelemetry/pkg/audit/webhook"
@@ -34,12 +39,31 @@ func init() {
 	manager.Global.Provide("audit-dump", New)
 }
 
+// rotatedTimeFormat is lexicographically sortable,
+// and rotated files sort before the active file because '-' precedes '.'.
+const rotatedTimeFormat = "20060102T150405.000"
+
 type options struct {
-	target string
+	target         string
+	maxSize        int64
+	rotateInterval time.Duration
+	compression    string
+	syncInterval   time.Duration
+	maxFiles       int
 }
 
 func (options *options) Setup(fs *pflag.FlagSet) {
 	fs.StringVar(&options.target, "audit-dump-file", "", "append received audit events to the specified path (leave empty to disable)")
+	fs.Int64Var(&options.maxSize, "audit-dump-max-size", 0, "rotate the dump file when it exceeds this size in bytes (0 to disable)")
+	fs.DurationVar(&options.rotateInterval, "audit-dump-rotate-interval", 0, "rotate the dump file periodically (0 to disable)")
+	fs.StringVar(
+		&options.compression,
+		"audit-dump-compression",
+		"none",
+		"compression of rotated dump files, one of \"none\", \"gzip\", \"zstd\"",
+	)
+	fs.DurationVar(&options.syncInterval, "audit-dump-sync-interval", time.Second, "interval to fsync the dump file (0 to disable)")
+	fs.IntVar(&options.maxFiles, "audit-dump-max-files", 0, "maximum number of rotated dump files to retain (0 for unlimited)")
 }
 
 func (options *options) EnableFlag() *bool {
@@ -50,20 +74,28 @@ func (options *options) EnableFlag() *bool {
 type dumper struct {
 	options options
 	logger  logrus.FieldLogger
+	clock   clock.Clock
 	webhook auditwebhook.Webhook
-	stream  interface {
-		io.WriteCloser
-		Sync() error
-	}
-	recvCh <-chan *audit.Message
+	codec   *codec
+	recvCh  <-chan *audit.Message
+
+	stream      *os.File
+	size        int64
+	lastRotated time.Time
+
+	wg sync.WaitGroup
+	// retentionLock serializes compression and retention of rotated files.
+	retentionLock sync.Mutex
 }
 
 func New(
 	logger logrus.FieldLogger,
+	clock clock.Clock,
 	webhook auditwebhook.Webhook,
 ) *dumper {
 	return &dumper{
 		logger:  logger,
+		clock:   clock,
 		webhook: webhook,
 	}
 }
@@ -73,21 +105,46 @@ func (dumper *dumper) Options() manager.Options {
 }
 
 func (dumper *dumper) Init(ctx context.Context) (err error) {
+	if dumper.options.compression != "none" {
+		codec, exists := codecs[dumper.options.compression]
+		if !exists {
+			return fmt.Errorf("unsupported --audit-dump-compression %q", dumper.options.compression)
+		}
+		dumper.codec = &codec
+	}
+
+	if err := dumper.open(); err != nil {
+		return err
+	}
+
+	dumper.recvCh = dumper.webhook.AddSubscriber("audit-dump-subscriber")
+
+	return nil
+}
+
+func (dumper *dumper) open() (err error) {
 	dumper.stream, err = os.OpenFile(dumper.options.target, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
 	if err != nil {
 		return fmt.Errorf("cannot open file to dump audit events: %w", err)
 	}
 
-	dumper.recvCh = dumper.webhook.AddSubscriber("audit-dump-subscriber")
+	stat, err := dumper.stream.Stat()
+	if err != nil {
+		return fmt.Errorf("cannot stat dump file: %w", err)
+	}
+	dumper.size = stat.Size()
 
 	return nil
 }
 
 func (dumper *dumper) Start(stopCh <-chan struct{}) error {
+	dumper.wg.Add(1)
 	go func() {
 		defer shutdown.RecoverPanic(dumper.logger)
+		defer dumper.wg.Done()
 
-		flushCh := chan struct{}(nil)
+		flushCh := dumper.tick(dumper.options.syncInterval, stopCh)
+		rotateCh := dumper.tick(dumper.options.rotateInterval, stopCh)
 
 		for {
 			select {
@@ -97,6 +154,10 @@ func (dumper *dumper) Start(stopCh <-chan struct{}) error {
 				if err := dumper.stream.Sync(); err != nil {
 					dumper.logger.WithError(err).Error("Cannot flush file")
 				}
+			case <-rotateCh:
+				if err := dumper.rotate(); err != nil {
+					dumper.logger.WithError(err).Error("Cannot rotate file")
+				}
 			case message, chOpen := <-dumper.recvCh:
 				if !chOpen {
 					return
@@ -105,6 +166,12 @@ func (dumper *dumper) Start(stopCh <-chan struct{}) error {
 				if err := dumper.handleEvent(message); err != nil {
 					dumper.logger.WithError(err).Error("Cannot append message")
 				}
+
+				if dumper.options.maxSize > 0 && dumper.size >= dumper.options.maxSize {
+					if err := dumper.rotate(); err != nil {
+						dumper.logger.WithError(err).Error("Cannot rotate file")
+					}
+				}
 			}
 		}
 	}()
@@ -112,22 +179,169 @@ func (dumper *dumper) Start(stopCh <-chan struct{}) error {
 	return nil
 }
 
+// tick returns a channel that receives a value every interval, or a nil channel if interval is zero.
+func (dumper *dumper) tick(interval time.Duration, stopCh <-chan struct{}) <-chan struct{} {
+	if interval <= 0 {
+		return nil
+	}
+
+	ch := make(chan struct{})
+
+	dumper.wg.Add(1)
+	go func() {
+		defer shutdown.RecoverPanic(dumper.logger)
+		defer dumper.wg.Done()
+
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-dumper.clock.After(interval):
+				select {
+				case ch <- struct{}{}:
+				case <-stopCh:
+					return
+				}
+			}
+		}
+	}()
+
+	return ch
+}
+
 func (dumper *dumper) handleEvent(message *audit.Message) error {
 	buf, err := json.Marshal(message)
 	if err != nil {
 		return fmt.Errorf("cannot reserialize message: %w", err)
 	}
 
-	for _, bytes := range [][]byte{buf, []byte("\n")} {
-		_, err = dumper.stream.Write(bytes)
-		if err != nil {
-			return fmt.Errorf("cannot write to file: %w", err)
+	// write the line in one call so that a crash does not interleave partial lines
+	n, err := dumper.stream.Write(append(buf, '\n'))
+	dumper.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("cannot write to file: %w", err)
+	}
+
+	return nil
+}
+
+func (dumper *dumper) rotate() error {
+	if dumper.size == 0 {
+		return nil
+	}
+
+	if err := dumper.stream.Sync(); err != nil {
+		return fmt.Errorf("cannot flush file before rotation: %w", err)
+	}
+	if err := dumper.stream.Close(); err != nil {
+		return fmt.Errorf("cannot close file before rotation: %w", err)
+	}
+
+	// ensure rotated file names are strictly increasing even if the clock does not advance
+	rotateTime := dumper.clock.Now().UTC().Truncate(time.Millisecond)
+	if !rotateTime.After(dumper.lastRotated) {
+		rotateTime = dumper.lastRotated.Add(time.Millisecond)
+	}
+	dumper.lastRotated = rotateTime
+
+	ext := filepath.Ext(dumper.options.target)
+	rotatedPath := fmt.Sprintf("%s-%s%s", strings.TrimSuffix(dumper.options.target, ext), rotateTime.Format(rotatedTimeFormat), ext)
+
+	renameErr := os.Rename(dumper.options.target, rotatedPath)
+
+	// reopen the file even if rename failed so that subsequent events are not lost
+	if err := dumper.open(); err != nil {
+		return err
+	}
+
+	if renameErr != nil {
+		return fmt.Errorf("cannot rename rotated file: %w", renameErr)
+	}
+
+	dumper.wg.Add(1)
+	go func() {
+		defer shutdown.RecoverPanic(dumper.logger)
+		defer dumper.wg.Done()
+
+		dumper.retentionLock.Lock()
+		defer dumper.retentionLock.Unlock()
+
+		if dumper.codec != nil {
+			if err := compressFile(rotatedPath, *dumper.codec); err != nil {
+				dumper.logger.WithError(err).WithField("path", rotatedPath).Error("Cannot compress rotated file")
+			}
+		}
+
+		if err := dumper.removeExpired(); err != nil {
+			dumper.logger.WithError(err).Error("Cannot remove expired rotated files")
+		}
+	}()
+
+	return nil
+}
+
+// rotatedFiles lists the rotated dump files, including compressed ones, in rotation order.
+func rotatedFiles(target string) ([]string, error) {
+	ext := filepath.Ext(target)
+	prefix := filepath.Base(strings.TrimSuffix(target, ext)) + "-"
+
+	entries, err := os.ReadDir(filepath.Dir(target))
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) || strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+
+		// strip compression suffix before parsing the rotation time
+		stem := name
+		for _, codec := range codecs {
+			stem = strings.TrimSuffix(stem, codec.ext)
+		}
+		if !strings.HasSuffix(stem, ext) {
+			continue
+		}
+		if _, err := time.Parse(rotatedTimeFormat, strings.TrimSuffix(strings.TrimPrefix(stem, prefix), ext)); err != nil {
+			continue
 		}
+
+		paths = append(paths, filepath.Join(filepath.Dir(target), name))
+	}
+
+	sort.Strings(paths)
+	return paths, nil
+}
+
+func (dumper *dumper) removeExpired() error {
+	if dumper.options.maxFiles <= 0 {
+		return nil
+	}
+
+	paths, err := rotatedFiles(dumper.options.target)
+	if err != nil {
+		return err
+	}
+
+	for len(paths) > dumper.options.maxFiles {
+		if err := os.Remove(paths[0]); err != nil {
+			return err
+		}
+		paths = paths[1:]
 	}
 
 	return nil
 }
 
 func (dumper *dumper) Close() error {
+	dumper.wg.Wait()
+
+	if err := dumper.stream.Sync(); err != nil {
+		return fmt.Errorf("cannot flush file: %w", err)
+	}
+
 	return dumper.stream.Close()
 }
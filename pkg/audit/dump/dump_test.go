@@ -0,0 +1,232 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auditdump_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"github.com/kubewharf/kelemetry/pkg/audit"
+	auditdump "github.com/kubewharf/kelemetry/pkg/audit/dump"
+	"github.com/kubewharf/kelemetry/pkg/manager"
+	"github.com/kubewharf/kelemetry/pkg/metrics"
+)
+
+type fakeWebhook struct {
+	manager.BaseComponent
+	ch chan *audit.Message
+
+	lock      sync.Mutex
+	published []*audit.RawMessage
+}
+
+func (webhook *fakeWebhook) AddSubscriber(name string) <-chan *audit.Message       { return webhook.ch }
+func (webhook *fakeWebhook) AddRawSubscriber(name string) <-chan *audit.RawMessage { return nil }
+
+func (webhook *fakeWebhook) Publish(rawMessage *audit.RawMessage) {
+	webhook.lock.Lock()
+	defer webhook.lock.Unlock()
+	webhook.published = append(webhook.published, rawMessage)
+}
+
+func (webhook *fakeWebhook) send(cluster string, auditId string) {
+	webhook.ch <- &audit.Message{Cluster: cluster, Event: auditv1.Event{AuditID: types.UID(auditId)}}
+}
+
+// publishedIds returns the cluster and audit ID of all published events.
+func (webhook *fakeWebhook) publishedIds() []string {
+	webhook.lock.Lock()
+	defer webhook.lock.Unlock()
+
+	ids := []string{}
+	for _, message := range webhook.published {
+		for _, event := range message.Items {
+			ids = append(ids, message.Cluster+"/"+string(event.AuditID))
+		}
+	}
+	return ids
+}
+
+func startComponent(t *testing.T, comp manager.Component, args ...string) (stop func()) {
+	t.Helper()
+
+	fs := pflag.NewFlagSet("test", pflag.PanicOnError)
+	comp.Options().Setup(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := comp.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	stopCh := make(chan struct{})
+	if err := comp.Start(stopCh); err != nil {
+		t.Fatal(err)
+	}
+
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			close(stopCh)
+			assert.Nil(t, comp.Close())
+		})
+	}
+	t.Cleanup(stop)
+	return stop
+}
+
+func startReplay(t *testing.T, clock *clocktesting.FakeClock, args ...string) *fakeWebhook {
+	t.Helper()
+
+	webhook := &fakeWebhook{}
+	metricsClient, _ := metrics.NewMock(clock)
+	startComponent(t, auditdump.NewReplayer(logrus.New(), clock, webhook, metricsClient), args...)
+	return webhook
+}
+
+func listDir(t *testing.T, dir string) []string {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestRotateBySize(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	clock := clocktesting.NewFakeClock(time.Unix(1600000000, 0))
+	webhook := &fakeWebhook{ch: make(chan *audit.Message)}
+
+	stop := startComponent(
+		t,
+		auditdump.New(logrus.New(), clock, webhook),
+		"--audit-dump-file", filepath.Join(dir, "audit.jsonl"),
+		"--audit-dump-max-size=1",
+		"--audit-dump-max-files=2",
+		"--audit-dump-compression=gzip",
+	)
+
+	for _, auditId := range []string{"1", "2", "3", "4"} {
+		webhook.send("a", auditId)
+	}
+	stop()
+
+	// rotation time is incremented for each rotation since the fake clock does not advance
+	assert.Equal([]string{
+		"audit-20200913T122640.002.jsonl.gz",
+		"audit-20200913T122640.003.jsonl.gz",
+		"audit.jsonl",
+	}, listDir(t, dir))
+
+	replayed := startReplay(t, clock, "--audit-replay-files", filepath.Join(dir, "audit*.jsonl*"), "--audit-replay-speed=0")
+	assert.Eventually(func() bool { return len(replayed.publishedIds()) == 2 }, time.Second, time.Millisecond)
+	assert.Equal([]string{"a/3", "a/4"}, replayed.publishedIds())
+}
+
+func TestRotateByInterval(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	clock := clocktesting.NewFakeClock(time.Unix(1600000000, 0))
+	webhook := &fakeWebhook{ch: make(chan *audit.Message)}
+
+	startComponent(
+		t,
+		auditdump.New(logrus.New(), clock, webhook),
+		"--audit-dump-file", filepath.Join(dir, "audit.jsonl"),
+		"--audit-dump-rotate-interval=1m",
+		"--audit-dump-sync-interval=0",
+		"--audit-dump-compression=zstd",
+	)
+
+	webhook.send("a", "1")
+	webhook.send("b", "2")
+
+	assert.Eventually(clock.HasWaiters, time.Second, time.Millisecond)
+	clock.Step(time.Minute)
+
+	rotated := filepath.Join(dir, "audit-20200913T122740.000.jsonl.zst")
+	assert.Eventually(func() bool {
+		_, err := os.Stat(rotated)
+		return err == nil
+	}, time.Second, time.Millisecond)
+
+	replayed := startReplay(t, clock, "--audit-replay-files", rotated, "--audit-replay-speed=0")
+	assert.Eventually(func() bool { return len(replayed.publishedIds()) == 2 }, time.Second, time.Millisecond)
+	assert.Equal([]string{"a/1", "b/2"}, replayed.publishedIds())
+}
+
+func TestReplaySpeed(t *testing.T) {
+	assert := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	baseTime := time.Unix(1500000000, 0)
+
+	lines := []string{}
+	for i, offset := range []time.Duration{0, time.Second * 10, time.Second * 30} {
+		line, err := json.Marshal(&audit.Message{
+			Cluster: "a",
+			Event: auditv1.Event{
+				AuditID:        types.UID(string(rune('1' + i))),
+				StageTimestamp: metav1.NewMicroTime(baseTime.Add(offset)),
+			},
+		})
+		assert.Nil(err)
+		lines = append(lines, string(line))
+	}
+	lines = append(lines, "{malformed")
+	assert.Nil(os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644))
+
+	clock := clocktesting.NewFakeClock(time.Unix(1600000000, 0))
+	replayed := startReplay(t, clock, "--audit-replay-files", path, "--audit-replay-speed=2")
+
+	assert.Eventually(clock.HasWaiters, time.Second, time.Millisecond)
+	assert.Equal([]string{"a/1"}, replayed.publishedIds())
+
+	clock.Step(time.Second * 5)
+	assert.Eventually(func() bool { return len(replayed.publishedIds()) == 2 }, time.Second, time.Millisecond)
+
+	assert.Eventually(clock.HasWaiters, time.Second, time.Millisecond)
+	clock.Step(time.Second * 9)
+	assert.Never(func() bool { return len(replayed.publishedIds()) == 3 }, time.Millisecond*50, time.Millisecond)
+
+	clock.Step(time.Second)
+	assert.Eventually(func() bool { return len(replayed.publishedIds()) == 3 }, time.Second, time.Millisecond)
+	assert.Equal([]string{"a/1", "a/2", "a/3"}, replayed.publishedIds())
+}
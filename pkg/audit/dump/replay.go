@@ -0,0 +1,258 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auditdump
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+	"k8s.io/utils/clock"
+
+	"github.com/kubewharf/kelemetry/pkg/audit"
+	auditwebhook "github.com/kubewharf/kelemetry/pkg/audit/webhook"
+	"github.com/kubewharf/kelemetry/pkg/manager"
+	"github.com/kubewharf/kelemetry/pkg/metrics"
+	"github.com/kubewharf/kelemetry/pkg/util/shutdown"
+)
+
+func init() {
+	manager.Global.Provide("audit-replay", NewReplayer)
+}
+
+type replayOptions struct {
+	files []string
+	speed float64
+}
+
+func (options *replayOptions) Setup(fs *pflag.FlagSet) {
+	fs.StringSliceVar(
+		&options.files,
+		"audit-replay-files",
+		[]string{},
+		"dump files or glob patterns to replay through audit webhook subscribers in lexicographic order, "+
+			"e.g. \"/var/dump/audit*.jsonl*\" replays rotated files before the active file; "+
+			"requires --audit-webhook-enable (leave empty to disable)",
+	)
+	fs.Float64Var(
+		&options.speed,
+		"audit-replay-speed",
+		1,
+		"replay speed relative to the intervals between event stage timestamps (0 to replay as fast as possible)",
+	)
+}
+
+func (options *replayOptions) EnableFlag() *bool {
+	isEnable := len(options.files) > 0
+	return &isEnable
+}
+
+type replayer struct {
+	options replayOptions
+	logger  logrus.FieldLogger
+	clock   clock.Clock
+	webhook auditwebhook.Webhook
+	metrics metrics.Client
+
+	paths       []string
+	eventMetric metrics.Metric
+	wg          sync.WaitGroup
+
+	// the wall time and event time of the first replayed event with a stage timestamp
+	startTime      time.Time
+	firstEventTime time.Time
+}
+
+type replayEventMetric struct {
+	Cluster string
+	Error   metrics.LabeledError
+}
+
+var errReplayStopped = errors.New("replay stopped")
+
+func NewReplayer(
+	logger logrus.FieldLogger,
+	clock clock.Clock,
+	webhook auditwebhook.Webhook,
+	metrics metrics.Client,
+) *replayer {
+	return &replayer{
+		logger:  logger,
+		clock:   clock,
+		webhook: webhook,
+		metrics: metrics,
+	}
+}
+
+func (replayer *replayer) Options() manager.Options {
+	return &replayer.options
+}
+
+func (replayer *replayer) Init(ctx context.Context) error {
+	if replayer.options.speed < 0 {
+		return fmt.Errorf("--audit-replay-speed must not be negative")
+	}
+
+	pathSet := map[string]struct{}{}
+	for _, pattern := range replayer.options.files {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid --audit-replay-files pattern %q: %w", pattern, err)
+		}
+		if len(matches) == 0 {
+			return fmt.Errorf("--audit-replay-files pattern %q does not match any files", pattern)
+		}
+
+		for _, path := range matches {
+			pathSet[path] = struct{}{}
+		}
+	}
+
+	for path := range pathSet {
+		replayer.paths = append(replayer.paths, path)
+	}
+	sort.Strings(replayer.paths)
+
+	replayer.eventMetric = replayer.metrics.New("audit_replay_event", &replayEventMetric{})
+
+	return nil
+}
+
+func (replayer *replayer) Start(stopCh <-chan struct{}) error {
+	replayer.wg.Add(1)
+	go func() {
+		defer shutdown.RecoverPanic(replayer.logger)
+		defer replayer.wg.Done()
+
+		for _, path := range replayer.paths {
+			logger := replayer.logger.WithField("path", path)
+			logger.Info("Replaying audit dump")
+
+			count, err := replayer.replayFile(path, stopCh)
+			if errors.Is(err, errReplayStopped) {
+				return
+			}
+			if err != nil {
+				logger.WithError(err).Error("Cannot replay audit dump")
+			}
+
+			logger.WithField("count", count).Info("Replayed audit dump")
+		}
+
+		replayer.logger.Info("Audit replay completed")
+	}()
+
+	return nil
+}
+
+func (replayer *replayer) replayFile(path string, stopCh <-chan struct{}) (int, error) {
+	file, err := openDumpFile(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	count := 0
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			if replayErr := replayer.replayLine(line, stopCh); replayErr != nil {
+				return count, replayErr
+			}
+			count++
+		}
+
+		if errors.Is(err, io.EOF) {
+			return count, nil
+		}
+		if err != nil {
+			// compressed files may be truncated if the process crashed during compression
+			return count, fmt.Errorf("cannot read dump file: %w", err)
+		}
+	}
+}
+
+func (replayer *replayer) replayLine(line []byte, stopCh <-chan struct{}) error {
+	message := &audit.Message{}
+	if err := json.Unmarshal(line, message); err != nil {
+		metric := &replayEventMetric{Error: metrics.LabelError(err, "Decode")}
+		replayer.eventMetric.With(metric).Count(1)
+		replayer.logger.WithError(err).Warn("Skipping malformed audit dump line")
+		return nil
+	}
+
+	if err := replayer.wait(message.StageTimestamp.Time, stopCh); err != nil {
+		return err
+	}
+
+	replayer.eventMetric.With(&replayEventMetric{Cluster: message.Cluster}).Count(1)
+	replayer.webhook.Publish(&audit.RawMessage{
+		Cluster:    message.Cluster,
+		SourceAddr: message.SourceAddr,
+		EventList:  &auditv1.EventList{Items: []auditv1.Event{message.Event}},
+	})
+
+	return nil
+}
+
+// wait blocks until the scaled offset of eventTime from the first event has elapsed since the replay started.
+func (replayer *replayer) wait(eventTime time.Time, stopCh <-chan struct{}) error {
+	select {
+	case <-stopCh:
+		return errReplayStopped
+	default:
+	}
+
+	if replayer.options.speed == 0 || eventTime.IsZero() {
+		return nil
+	}
+
+	if replayer.firstEventTime.IsZero() {
+		replayer.firstEventTime = eventTime
+		replayer.startTime = replayer.clock.Now()
+		return nil
+	}
+
+	offset := time.Duration(float64(eventTime.Sub(replayer.firstEventTime)) / replayer.options.speed)
+	delay := replayer.startTime.Add(offset).Sub(replayer.clock.Now())
+	if delay <= 0 {
+		return nil
+	}
+
+	select {
+	case <-stopCh:
+		return errReplayStopped
+	case <-replayer.clock.After(delay):
+		return nil
+	}
+}
+
+func (replayer *replayer) Close() error {
+	replayer.wg.Wait()
+	return nil
+}
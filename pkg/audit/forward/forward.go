@@ -15,12 +15,10 @@
 package auditforward
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
-	"net/http"
-	"strings"
+	"path/filepath"
+	"regexp"
 	"sync"
 	"time"
 
@@ -28,7 +26,6 @@ import (
 	"github.com/spf13/pflag"
 	"k8s.io/utils/clock"
 
-	"github.com/kubewharf/kelemetry/pkg/audit"
 	auditwebhook "github.com/kubewharf/kelemetry/pkg/audit/webhook"
 	"github.com/kubewharf/kelemetry/pkg/manager"
 	"github.com/kubewharf/kelemetry/pkg/metrics"
@@ -40,13 +37,49 @@ func init() {
 }
 
 type options struct {
-	forwardUrls map[string]string
-	timeout     time.Duration
+	forwardUrls     map[string]string
+	clusterFilters  map[string]string
+	timeout         time.Duration
+	concurrency     int
+	queueSize       int
+	maxAttempts     int
+	retryBackoff    time.Duration
+	retryMaxBackoff time.Duration
+	spoolDir        string
+	spoolMaxBytes   int64
 }
 
 func (options *options) Setup(fs *pflag.FlagSet) {
 	fs.StringToStringVar(&options.forwardUrls, "audit-forward-url", map[string]string{}, "forward audit messages to these URLs")
+	fs.StringToStringVar(
+		&options.clusterFilters,
+		"audit-forward-cluster-filter",
+		map[string]string{},
+		"only forward audit messages to an upstream if the cluster name fully matches the regular expression for the upstream",
+	)
 	fs.DurationVar(&options.timeout, "audit-forward-timeout", time.Second*30, "forward proxy client timeout")
+	fs.IntVar(&options.concurrency, "audit-forward-concurrency", 4, "maximum number of concurrent requests to each upstream")
+	fs.IntVar(&options.queueSize, "audit-forward-queue-size", 64, "number of event lists buffered in memory for each upstream")
+	fs.IntVar(
+		&options.maxAttempts,
+		"audit-forward-max-attempts",
+		5,
+		"maximum number of attempts to send an event list before it is spooled or dropped (0 to retry forever)",
+	)
+	fs.DurationVar(&options.retryBackoff, "audit-forward-retry-backoff", time.Second, "initial backoff between forward retries")
+	fs.DurationVar(&options.retryMaxBackoff, "audit-forward-retry-max-backoff", time.Minute, "maximum backoff between forward retries")
+	fs.StringVar(
+		&options.spoolDir,
+		"audit-forward-spool-dir",
+		"",
+		"directory to persist event lists that cannot be forwarded after all attempts or during shutdown (empty to drop them)",
+	)
+	fs.Int64Var(
+		&options.spoolMaxBytes,
+		"audit-forward-spool-max-bytes",
+		1<<30,
+		"maximum total size of spooled event lists for each upstream (0 for unlimited)",
+	)
 }
 
 func (options *options) EnableFlag() *bool {
@@ -85,6 +118,22 @@ type proxyMetric struct {
 	Success  bool
 }
 
+type retryMetric struct {
+	Upstream string
+	Cluster  string
+	Reason   string
+}
+
+type dropMetric struct {
+	Upstream string
+	Cluster  string
+	Reason   string
+}
+
+type spoolDepthMetric struct {
+	Upstream string
+}
+
 func (comp *comp) Options() manager.Options {
 	return &comp.options
 }
@@ -92,15 +141,59 @@ func (comp *comp) Options() manager.Options {
 func (comp *comp) Init(ctx context.Context) error {
 	comp.ctx = ctx
 
+	if comp.options.concurrency < 1 {
+		return fmt.Errorf("--audit-forward-concurrency must be positive")
+	}
+
+	for upstreamName := range comp.options.clusterFilters {
+		if _, exists := comp.options.forwardUrls[upstreamName]; !exists {
+			return fmt.Errorf("--audit-forward-cluster-filter contains unknown upstream %q", upstreamName)
+		}
+	}
+
+	metrics := proxyMetrics{
+		proxy: comp.metrics.New("audit_forward_proxy", &proxyMetric{}),
+		retry: comp.metrics.New("audit_forward_retry", &retryMetric{}),
+		drop:  comp.metrics.New("audit_forward_dropped", &dropMetric{}),
+	}
+
 	comp.proxies = make([]*proxy, 0, len(comp.options.forwardUrls))
 	for upstreamName, url := range comp.options.forwardUrls {
+		logger := comp.logger.WithField("url", url).WithField("upstream", upstreamName)
+
+		var clusterFilter *regexp.Regexp
+		if pattern, hasFilter := comp.options.clusterFilters[upstreamName]; hasFilter {
+			var err error
+			clusterFilter, err = regexp.Compile("^(?:" + pattern + ")$")
+			if err != nil {
+				return fmt.Errorf("invalid cluster filter for upstream %q: %w", upstreamName, err)
+			}
+		}
+
+		var spool *spool
+		if comp.options.spoolDir != "" {
+			var err error
+			spool, err = openSpool(filepath.Join(comp.options.spoolDir, upstreamName), comp.options.spoolMaxBytes, comp.clock)
+			if err != nil {
+				return fmt.Errorf("cannot open spool for upstream %q: %w", upstreamName, err)
+			}
+
+			if depth := spool.depth(); depth > 0 {
+				logger.WithField("depth", depth).Info("Resuming spooled event lists")
+			}
+
+			comp.metrics.NewMonitor("audit_forward_spool_depth", &spoolDepthMetric{Upstream: upstreamName}, spool.depth)
+		}
+
 		proxy := newProxy(
-			comp.logger.WithField("url", url).WithField("upstream", upstreamName),
+			logger,
 			comp.clock,
-			comp.metrics.New("audit_forward_proxy", &proxyMetric{}),
+			metrics,
 			&comp.options,
 			upstreamName,
 			url,
+			clusterFilter,
+			spool,
 			comp.webhook.AddRawSubscriber(fmt.Sprintf("audit-forward-%s-subscriber", upstreamName)),
 		)
 		comp.proxies = append(comp.proxies, proxy)
@@ -110,10 +203,8 @@ func (comp *comp) Init(ctx context.Context) error {
 }
 
 func (comp *comp) Start(stopCh <-chan struct{}) error {
-	comp.stopWg.Add(len(comp.proxies))
-
 	for _, proxy := range comp.proxies {
-		go proxy.run(stopCh, &comp.stopWg)
+		proxy.start(stopCh, &comp.stopWg)
 	}
 
 	return nil
@@ -121,98 +212,13 @@ func (comp *comp) Start(stopCh <-chan struct{}) error {
 
 func (comp *comp) Close() error {
 	comp.stopWg.Wait()
-	return nil
-}
-
-type proxy struct {
-	logger       logrus.FieldLogger
-	clock        clock.Clock
-	metric       metrics.Metric
-	upstreamName string
-	url          string
-	subscriber   <-chan *audit.RawMessage
-	client       http.Client
-}
-
-func newProxy(
-	logger logrus.FieldLogger,
-	clock clock.Clock,
-	metric metrics.Metric,
-	options *options,
-	upstreamName string,
-	url string,
-	subscriber <-chan *audit.RawMessage,
-) *proxy {
-	proxy := &proxy{
-		logger:       logger,
-		clock:        clock,
-		metric:       metric,
-		upstreamName: upstreamName,
-		url:          url,
-		subscriber:   subscriber,
-	}
-	proxy.client.Timeout = options.timeout
-	return proxy
-}
-
-func (proxy *proxy) run(stopCh <-chan struct{}, wg *sync.WaitGroup) {
-	defer shutdown.RecoverPanic(proxy.logger)
-	defer wg.Done()
-
-	proxy.logger.Info("Starting audit proxy")
-
-	for {
-		select {
-		case <-stopCh:
-			return
-		case message, chOpen := <-proxy.subscriber:
-			if !chOpen {
-				return
-			}
-
-			go func(message *audit.RawMessage) {
-				defer shutdown.RecoverPanic(proxy.logger)
-
-				if err := proxy.handleEvent(message); err != nil {
-					proxy.logger.WithError(err).Error()
-				}
-			}(message)
-		}
-	}
-}
-
-func (proxy *proxy) handleEvent(message *audit.RawMessage) error {
-	metric := &proxyMetric{
-		Upstream: proxy.upstreamName,
-		Cluster:  message.Cluster,
-	}
-	defer proxy.metric.DeferCount(proxy.clock.Now(), metric)
-
-	jsonBuf, err := json.Marshal(message.EventList)
-	if err != nil {
-		return fmt.Errorf("cannot reserialize EventList: %w", err)
-	}
 
-	url := strings.ReplaceAll(proxy.url, ":cluster", message.Cluster)
-	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(jsonBuf))
-	if err != nil {
-		return fmt.Errorf("cannot create new request: %w", err)
-	}
-
-	req.Header.Add("x-forwarded-for", message.SourceAddr)
-	req.Header.Add("x-kubetrace-webhook-forward", "from-kubetrace")
-	req.Header.Add("content-type", "application/json")
-
-	resp, err := proxy.client.Do(req)
-	if err != nil {
-		return fmt.Errorf("http post error: %w", err)
-	}
-
-	if err := resp.Body.Close(); err != nil {
-		return fmt.Errorf("cannot close post request: %w", err)
+	for _, proxy := range comp.proxies {
+		func() {
+			defer shutdown.RecoverPanic(proxy.logger)
+			proxy.spoolPending()
+		}()
 	}
 
-	metric.Success = true
-
 	return nil
 }
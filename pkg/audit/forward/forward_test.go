@@ -0,0 +1,300 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auditforward_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"github.com/kubewharf/kelemetry/pkg/audit"
+	auditforward "github.com/kubewharf/kelemetry/pkg/audit/forward"
+	"github.com/kubewharf/kelemetry/pkg/manager"
+	"github.com/kubewharf/kelemetry/pkg/metrics"
+)
+
+type fakeWebhook struct {
+	manager.BaseComponent
+	ch chan *audit.RawMessage
+}
+
+func (webhook *fakeWebhook) AddSubscriber(name string) <-chan *audit.Message       { return nil }
+func (webhook *fakeWebhook) AddRawSubscriber(name string) <-chan *audit.RawMessage { return webhook.ch }
+
+func (webhook *fakeWebhook) Publish(rawMessage *audit.RawMessage) {
+	webhook.ch <- rawMessage
+}
+
+func (webhook *fakeWebhook) publish(cluster string) {
+	webhook.Publish(&audit.RawMessage{Cluster: cluster, EventList: &auditv1.EventList{}})
+}
+
+// upstream records the clusters of successful requests.
+type upstream struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	statuses []int
+	received []string
+}
+
+// newUpstream creates an upstream that responds with the given statuses in order, followed by 200 for subsequent requests.
+func newUpstream(t *testing.T, statuses ...int) *upstream {
+	upstream := &upstream{statuses: statuses}
+	upstream.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream.lock.Lock()
+		defer upstream.lock.Unlock()
+
+		status := http.StatusOK
+		if len(upstream.statuses) > 0 {
+			status = upstream.statuses[0]
+			upstream.statuses = upstream.statuses[1:]
+		}
+
+		if status == http.StatusOK {
+			upstream.received = append(upstream.received, strings.TrimPrefix(r.URL.Path, "/"))
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+func (upstream *upstream) fail(statuses ...int) {
+	upstream.lock.Lock()
+	defer upstream.lock.Unlock()
+	upstream.statuses = statuses
+}
+
+func (upstream *upstream) clusters() []string {
+	upstream.lock.Lock()
+	defer upstream.lock.Unlock()
+	return append([]string{}, upstream.received...)
+}
+
+type forwardTest struct {
+	webhook *fakeWebhook
+	clock   *clocktesting.FakeClock
+	metrics *metrics.Mock
+	stop    func()
+}
+
+func startForward(t *testing.T, args ...string) *forwardTest {
+	t.Helper()
+
+	webhook := &fakeWebhook{ch: make(chan *audit.RawMessage)}
+	clock := clocktesting.NewFakeClock(time.Unix(1600000000, 0))
+	metricsClient, metricsMock := metrics.NewMock(clock)
+
+	comp := auditforward.New(logrus.New(), clock, webhook, metricsClient)
+
+	fs := pflag.NewFlagSet("test", pflag.PanicOnError)
+	comp.Options().Setup(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := comp.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	stopCh := make(chan struct{})
+	if err := comp.Start(stopCh); err != nil {
+		t.Fatal(err)
+	}
+
+	test := &forwardTest{webhook: webhook, clock: clock, metrics: metricsMock}
+	var once sync.Once
+	test.stop = func() {
+		once.Do(func() {
+			close(stopCh)
+			assert.Nil(t, comp.Close())
+		})
+	}
+	t.Cleanup(test.stop)
+
+	return test
+}
+
+// stepBackoff advances the clock after a goroutine starts waiting for retry backoff.
+func (test *forwardTest) stepBackoff(t *testing.T, duration time.Duration) {
+	t.Helper()
+	assert.Eventually(t, test.clock.HasWaiters, time.Second, time.Millisecond)
+	test.clock.Step(duration)
+}
+
+func (test *forwardTest) count(name string, tags map[string]string) int64 {
+	return test.metrics.Get(name, tags).Int
+}
+
+func TestRetryServerError(t *testing.T) {
+	assert := assert.New(t)
+
+	upstream := newUpstream(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	test := startForward(t, "--audit-forward-url", "up="+upstream.URL+"/:cluster")
+
+	test.webhook.publish("a")
+	test.stepBackoff(t, time.Second)
+	test.stepBackoff(t, time.Second*2)
+
+	assert.Eventually(func() bool { return len(upstream.clusters()) == 1 }, time.Second, time.Millisecond)
+	assert.Equal([]string{"a"}, upstream.clusters())
+
+	assert.Equal(int64(1), test.count("audit_forward_retry", map[string]string{"upstream": "up", "cluster": "a", "reason": "503"}))
+	assert.Equal(int64(1), test.count("audit_forward_retry", map[string]string{"upstream": "up", "cluster": "a", "reason": "429"}))
+}
+
+func TestRejectClientError(t *testing.T) {
+	assert := assert.New(t)
+
+	upstream := newUpstream(t, http.StatusBadRequest)
+	test := startForward(t, "--audit-forward-url", "up="+upstream.URL+"/:cluster", "--audit-forward-concurrency=1")
+
+	test.webhook.publish("a")
+	test.webhook.publish("b")
+
+	assert.Eventually(func() bool { return len(upstream.clusters()) == 1 }, time.Second, time.Millisecond)
+	assert.Equal([]string{"b"}, upstream.clusters())
+
+	assert.Eventually(func() bool {
+		return test.count("audit_forward_dropped", map[string]string{"upstream": "up", "cluster": "a", "reason": "Rejected"}) == 1
+	}, time.Second, time.Millisecond)
+	assert.False(test.clock.HasWaiters())
+}
+
+func TestDropInvalidRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	// the cluster name is substituted into the URL, and a control character makes it unparsable
+	upstream := newUpstream(t)
+	test := startForward(t, "--audit-forward-url", "up="+upstream.URL+"/:cluster", "--audit-forward-concurrency=1")
+
+	test.webhook.publish("a\x7f")
+	test.webhook.publish("b")
+
+	assert.Eventually(func() bool { return len(upstream.clusters()) == 1 }, time.Second, time.Millisecond)
+	assert.Equal([]string{"b"}, upstream.clusters())
+
+	assert.Eventually(func() bool {
+		return test.count("audit_forward_dropped", map[string]string{"upstream": "up", "cluster": "a\x7f", "reason": "InvalidRequest"}) == 1
+	}, time.Second, time.Millisecond)
+	assert.False(test.clock.HasWaiters())
+}
+
+func TestDropAfterMaxAttempts(t *testing.T) {
+	assert := assert.New(t)
+
+	upstream := newUpstream(t, http.StatusBadGateway, http.StatusBadGateway)
+	test := startForward(t, "--audit-forward-url", "up="+upstream.URL+"/:cluster", "--audit-forward-max-attempts=2")
+
+	test.webhook.publish("a")
+	test.stepBackoff(t, time.Second)
+
+	assert.Eventually(func() bool {
+		return test.count("audit_forward_dropped", map[string]string{"upstream": "up", "cluster": "a", "reason": "RetriesExhausted"}) == 1
+	}, time.Second, time.Millisecond)
+	assert.Empty(upstream.clusters())
+}
+
+func TestSpoolAcrossRestart(t *testing.T) {
+	assert := assert.New(t)
+
+	upstream := newUpstream(t)
+	upstream.fail(http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+
+	spoolDir := t.TempDir()
+	args := []string{
+		"--audit-forward-url", "up=" + upstream.URL + "/:cluster",
+		"--audit-forward-max-attempts=1",
+		"--audit-forward-concurrency=1",
+		"--audit-forward-spool-dir", spoolDir,
+	}
+
+	test := startForward(t, args...)
+
+	// both event lists fail once and are spooled, then the spool drainer fails once and waits for backoff
+	test.webhook.publish("a")
+	test.webhook.publish("b")
+	assert.Eventually(test.clock.HasWaiters, time.Second, time.Millisecond)
+
+	test.stop()
+	entries, err := os.ReadDir(spoolDir + "/up")
+	assert.Nil(err)
+	assert.Len(entries, 2)
+	assert.Empty(upstream.clusters())
+
+	startForward(t, args...)
+	assert.Eventually(func() bool { return len(upstream.clusters()) == 2 }, time.Second, time.Millisecond)
+	assert.Equal([]string{"a", "b"}, upstream.clusters())
+
+	assert.Eventually(func() bool {
+		entries, err := os.ReadDir(spoolDir + "/up")
+		return err == nil && len(entries) == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestUnreadableSpoolFile(t *testing.T) {
+	assert := assert.New(t)
+
+	upstream := newUpstream(t)
+
+	spoolDir := t.TempDir()
+	assert.Nil(os.MkdirAll(filepath.Join(spoolDir, "up"), 0o755))
+	// a corrupted file is removed, but a non-empty directory cannot be removed
+	assert.Nil(os.WriteFile(filepath.Join(spoolDir, "up", "00000000000000000001.json"), []byte("{"), 0o644))
+	assert.Nil(os.MkdirAll(filepath.Join(spoolDir, "up", "00000000000000000002.json", "child"), 0o755))
+	assert.Nil(os.WriteFile(filepath.Join(spoolDir, "up", "00000000000000000003.json"), []byte(`{"cluster":"a","body":{}}`), 0o644))
+
+	test := startForward(t,
+		"--audit-forward-url", "up="+upstream.URL+"/:cluster",
+		"--audit-forward-spool-dir", spoolDir,
+	)
+
+	// the drainer backs off instead of spinning on the file that cannot be removed
+	assert.Eventually(test.clock.HasWaiters, time.Second, time.Millisecond)
+	assert.Empty(upstream.clusters())
+	test.clock.Step(time.Second)
+
+	assert.Eventually(func() bool { return len(upstream.clusters()) == 1 }, time.Second, time.Millisecond)
+	assert.Equal([]string{"a"}, upstream.clusters())
+
+	_, err := os.Stat(filepath.Join(spoolDir, "up", "00000000000000000001.json"))
+	assert.True(os.IsNotExist(err))
+}
+
+func TestClusterFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	upstream := newUpstream(t)
+	test := startForward(t, "--audit-forward-url", "up="+upstream.URL+"/:cluster", "--audit-forward-cluster-filter", "up=prod-.*")
+
+	test.webhook.publish("dev-prod-a")
+	test.webhook.publish("prod-a")
+
+	assert.Eventually(func() bool { return len(upstream.clusters()) == 1 }, time.Second, time.Millisecond)
+	assert.Equal([]string{"prod-a"}, upstream.clusters())
+}
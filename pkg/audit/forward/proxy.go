@@ -0,0 +1,449 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auditforward
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/utils/clock"
+
+	"github.com/kubewharf/kelemetry/pkg/audit"
+	"github.com/kubewharf/kelemetry/pkg/metrics"
+	"github.com/kubewharf/kelemetry/pkg/util/shutdown"
+)
+
+type proxyMetrics struct {
+	proxy metrics.Metric
+	retry metrics.Metric
+	drop  metrics.Metric
+}
+
+// batch is a serialized event list to be forwarded.
+type batch struct {
+	Cluster    string          `json:"cluster"`
+	SourceAddr string          `json:"sourceAddr"`
+	Body       json.RawMessage `json:"body"`
+}
+
+type proxy struct {
+	logger        logrus.FieldLogger
+	clock         clock.Clock
+	metrics       proxyMetrics
+	options       *options
+	upstreamName  string
+	url           string
+	clusterFilter *regexp.Regexp
+	spool         *spool
+	subscriber    <-chan *audit.RawMessage
+	client        http.Client
+	queue         chan *batch
+}
+
+func newProxy(
+	logger logrus.FieldLogger,
+	clock clock.Clock,
+	metrics proxyMetrics,
+	options *options,
+	upstreamName string,
+	url string,
+	clusterFilter *regexp.Regexp,
+	spool *spool,
+	subscriber <-chan *audit.RawMessage,
+) *proxy {
+	proxy := &proxy{
+		logger:        logger,
+		clock:         clock,
+		metrics:       metrics,
+		options:       options,
+		upstreamName:  upstreamName,
+		url:           url,
+		clusterFilter: clusterFilter,
+		spool:         spool,
+		subscriber:    subscriber,
+		queue:         make(chan *batch, options.queueSize),
+	}
+	proxy.client.Timeout = options.timeout
+	return proxy
+}
+
+func (proxy *proxy) start(stopCh <-chan struct{}, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go proxy.run(stopCh, wg)
+
+	for i := 0; i < proxy.options.concurrency; i++ {
+		wg.Add(1)
+		go proxy.work(stopCh, wg)
+	}
+
+	if proxy.spool != nil {
+		wg.Add(1)
+		go proxy.drainSpool(stopCh, wg)
+	}
+}
+
+func (proxy *proxy) run(stopCh <-chan struct{}, wg *sync.WaitGroup) {
+	defer shutdown.RecoverPanic(proxy.logger)
+	defer wg.Done()
+
+	proxy.logger.Info("Starting audit proxy")
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case message, chOpen := <-proxy.subscriber:
+			if !chOpen {
+				return
+			}
+
+			if proxy.clusterFilter != nil && !proxy.clusterFilter.MatchString(message.Cluster) {
+				continue
+			}
+
+			jsonBuf, err := json.Marshal(message.EventList)
+			if err != nil {
+				proxy.logger.WithError(err).Error("cannot reserialize EventList")
+				continue
+			}
+
+			proxy.enqueue(&batch{
+				Cluster:    message.Cluster,
+				SourceAddr: message.SourceAddr,
+				Body:       jsonBuf,
+			}, stopCh)
+		}
+	}
+}
+
+func (proxy *proxy) enqueue(batch *batch, stopCh <-chan struct{}) {
+	select {
+	case proxy.queue <- batch:
+		return
+	default:
+	}
+
+	if proxy.spool != nil {
+		// all workers are busy retrying, probably due to an upstream outage,
+		// so persist the event list instead of accumulating it in memory
+		proxy.spoolOrDrop(batch, "QueueFull")
+		return
+	}
+
+	select {
+	case proxy.queue <- batch:
+	case <-stopCh:
+		proxy.drop(batch, "Shutdown")
+	}
+}
+
+func (proxy *proxy) work(stopCh <-chan struct{}, wg *sync.WaitGroup) {
+	defer shutdown.RecoverPanic(proxy.logger)
+	defer wg.Done()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case batch := <-proxy.queue:
+			proxy.deliver(batch, stopCh)
+		}
+	}
+}
+
+func (proxy *proxy) deliver(batch *batch, stopCh <-chan struct{}) {
+	metric := &proxyMetric{
+		Upstream: proxy.upstreamName,
+		Cluster:  batch.Cluster,
+	}
+	defer proxy.metrics.proxy.DeferCount(proxy.clock.Now(), metric)
+
+	logger := proxy.logger.WithField("cluster", batch.Cluster)
+
+	for attempt := 1; ; attempt++ {
+		err := proxy.send(batch)
+		if err == nil {
+			metric.Success = true
+			return
+		}
+
+		if !isRetryable(err) {
+			logger.WithError(err).Error("cannot forward event list")
+			proxy.drop(batch, dropReason(err))
+			return
+		}
+
+		if proxy.options.maxAttempts > 0 && attempt >= proxy.options.maxAttempts {
+			logger.WithError(err).WithField("attempts", attempt).Warn("cannot forward event list")
+			proxy.spoolOrDrop(batch, "RetriesExhausted")
+			return
+		}
+
+		logger.WithError(err).WithField("attempt", attempt).Debug("retrying forward")
+		proxy.metrics.retry.With(&retryMetric{
+			Upstream: proxy.upstreamName,
+			Cluster:  batch.Cluster,
+			Reason:   retryReason(err),
+		}).Count(1)
+
+		select {
+		case <-stopCh:
+			proxy.spoolOrDrop(batch, "Shutdown")
+			return
+		case <-proxy.clock.After(proxy.backoff(attempt, err)):
+		}
+	}
+}
+
+// drainSpool forwards spooled event lists in the order they were spooled.
+func (proxy *proxy) drainSpool(stopCh <-chan struct{}, wg *sync.WaitGroup) {
+	defer shutdown.RecoverPanic(proxy.logger)
+	defer wg.Done()
+
+	attempt := 0
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		default:
+		}
+
+		name, batch, err := proxy.spool.peek()
+		if err != nil {
+			if removeErr := proxy.spool.remove(name); removeErr != nil {
+				proxy.logger.WithError(err).WithField("removeError", removeErr).Error("cannot remove unreadable spooled event list")
+
+				// avoid spinning on a spool directory that cannot be modified
+				attempt++
+				select {
+				case <-stopCh:
+					return
+				case <-proxy.clock.After(proxy.backoff(attempt, removeErr)):
+				}
+				continue
+			}
+
+			proxy.logger.WithError(err).Error("dropped unreadable spooled event list")
+			continue
+		}
+
+		if batch == nil {
+			select {
+			case <-stopCh:
+				return
+			case <-proxy.spool.notify:
+			}
+			continue
+		}
+
+		startTime := proxy.clock.Now()
+		err = proxy.send(batch)
+
+		if err != nil && isRetryable(err) {
+			attempt++
+			proxy.metrics.retry.With(&retryMetric{
+				Upstream: proxy.upstreamName,
+				Cluster:  batch.Cluster,
+				Reason:   retryReason(err),
+			}).Count(1)
+
+			select {
+			case <-stopCh:
+				return
+			case <-proxy.clock.After(proxy.backoff(attempt, err)):
+			}
+			continue
+		}
+
+		attempt = 0
+
+		if err != nil {
+			proxy.logger.WithError(err).WithField("cluster", batch.Cluster).Error("cannot forward spooled event list")
+			proxy.drop(batch, dropReason(err))
+		} else {
+			proxy.metrics.proxy.DeferCount(startTime, &proxyMetric{
+				Upstream: proxy.upstreamName,
+				Cluster:  batch.Cluster,
+				Success:  true,
+			})
+		}
+
+		if err := proxy.spool.remove(name); err != nil {
+			proxy.logger.WithError(err).Error("cannot remove spooled event list")
+		}
+	}
+}
+
+// spoolPending persists event lists remaining in the queue during shutdown.
+func (proxy *proxy) spoolPending() {
+	for {
+		select {
+		case batch := <-proxy.queue:
+			proxy.spoolOrDrop(batch, "Shutdown")
+		default:
+			return
+		}
+	}
+}
+
+func (proxy *proxy) spoolOrDrop(batch *batch, reason string) {
+	if proxy.spool == nil {
+		proxy.drop(batch, reason)
+		return
+	}
+
+	if err := proxy.spool.write(batch); err != nil {
+		proxy.logger.WithError(err).WithField("cluster", batch.Cluster).Error("cannot spool event list")
+
+		reason = "SpoolError"
+		if errors.Is(err, errSpoolFull) {
+			reason = "SpoolFull"
+		}
+		proxy.drop(batch, reason)
+	}
+}
+
+func (proxy *proxy) drop(batch *batch, reason string) {
+	proxy.metrics.drop.With(&dropMetric{
+		Upstream: proxy.upstreamName,
+		Cluster:  batch.Cluster,
+		Reason:   reason,
+	}).Count(1)
+}
+
+func (proxy *proxy) send(batch *batch) error {
+	url := strings.ReplaceAll(proxy.url, ":cluster", batch.Cluster)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(batch.Body))
+	if err != nil {
+		// a malformed URL does not get better with retries
+		return fmt.Errorf("cannot create new request: %w", err)
+	}
+
+	req.Header.Add("x-forwarded-for", batch.SourceAddr)
+	req.Header.Add("x-kubetrace-webhook-forward", "from-kubetrace")
+	req.Header.Add("content-type", "application/json")
+
+	resp, err := proxy.client.Do(req)
+	if err != nil {
+		return &networkError{err: fmt.Errorf("http post error: %w", err)}
+	}
+
+	// drain a bounded amount of the response so that the connection can be reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if err := resp.Body.Close(); err != nil {
+		return &networkError{err: fmt.Errorf("cannot close post request: %w", err)}
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &statusError{
+			code:       resp.StatusCode,
+			retryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	}
+
+	return nil
+}
+
+func (proxy *proxy) backoff(attempt int, err error) time.Duration {
+	backoff := proxy.options.retryBackoff
+	for i := 1; i < attempt && backoff < proxy.options.retryMaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	statusErr := &statusError{}
+	if errors.As(err, &statusErr) && statusErr.retryAfter > backoff {
+		backoff = statusErr.retryAfter
+	}
+
+	if backoff > proxy.options.retryMaxBackoff {
+		backoff = proxy.options.retryMaxBackoff
+	}
+
+	return backoff
+}
+
+type statusError struct {
+	code       int
+	retryAfter time.Duration
+}
+
+func (err *statusError) Error() string {
+	return fmt.Sprintf("upstream responded with status %d", err.code)
+}
+
+// networkError is an error from the transport, after the request was successfully constructed.
+type networkError struct {
+	err error
+}
+
+func (err *networkError) Error() string { return err.err.Error() }
+
+func (err *networkError) Unwrap() error { return err.err }
+
+// isRetryable returns true for network errors, 429 and 5xx responses.
+// Other errors, such as failure to construct the request, are not retryable.
+func isRetryable(err error) bool {
+	networkErr := &networkError{}
+	if errors.As(err, &networkErr) {
+		return true
+	}
+
+	statusErr := &statusError{}
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+
+	return statusErr.code == http.StatusTooManyRequests || statusErr.code >= 500
+}
+
+func retryReason(err error) string {
+	statusErr := &statusError{}
+	if errors.As(err, &statusErr) {
+		return strconv.Itoa(statusErr.code)
+	}
+
+	return "Network"
+}
+
+func dropReason(err error) string {
+	statusErr := &statusError{}
+	if errors.As(err, &statusErr) {
+		return "Rejected"
+	}
+
+	return "InvalidRequest"
+}
+
+// parseRetryAfter only supports the delay-seconds format of Retry-After.
+func parseRetryAfter(value string) time.Duration {
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+
+	return time.Duration(seconds) * time.Second
+}
@@ -0,0 +1,186 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auditforward
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"k8s.io/utils/clock"
+)
+
+var errSpoolFull = errors.New("spool size limit exceeded")
+
+// spool persists event lists of an upstream on disk, one file per event list.
+// Files are named by a strictly increasing timestamp, so the lexicographic order is the spooling order.
+type spool struct {
+	dir      string
+	maxBytes int64
+	clock    clock.Clock
+	// notify receives a value when a new file is spooled.
+	notify chan struct{}
+
+	lock      sync.Mutex
+	files     []spoolFile
+	size      int64
+	lastNanos int64
+}
+
+type spoolFile struct {
+	name string
+	size int64
+}
+
+func openSpool(dir string, maxBytes int64, clock clock.Clock) (*spool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("cannot create spool directory: %w", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read spool directory: %w", err)
+	}
+
+	spool := &spool{
+		dir:      dir,
+		maxBytes: maxBytes,
+		clock:    clock,
+		notify:   make(chan struct{}, 1),
+	}
+
+	// ReadDir returns entries sorted by name
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".tmp") {
+			// incomplete write before the last shutdown
+			if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+				return nil, fmt.Errorf("cannot remove incomplete spool file: %w", err)
+			}
+			continue
+		}
+
+		nanos, err := strconv.ParseInt(strings.TrimSuffix(entry.Name(), ".json"), 10, 64)
+		if err != nil || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("cannot stat spool file: %w", err)
+		}
+
+		spool.files = append(spool.files, spoolFile{name: entry.Name(), size: info.Size()})
+		spool.size += info.Size()
+		spool.lastNanos = nanos
+	}
+
+	return spool, nil
+}
+
+func (spool *spool) write(batch *batch) error {
+	content, err := json.Marshal(batch)
+	if err != nil {
+		return fmt.Errorf("cannot encode spool file: %w", err)
+	}
+
+	spool.lock.Lock()
+	defer spool.lock.Unlock()
+
+	if spool.maxBytes > 0 && spool.size+int64(len(content)) > spool.maxBytes {
+		return errSpoolFull
+	}
+
+	nanos := spool.clock.Now().UnixNano()
+	if nanos <= spool.lastNanos {
+		nanos = spool.lastNanos + 1
+	}
+
+	name := fmt.Sprintf("%020d.json", nanos)
+	path := filepath.Join(spool.dir, name)
+
+	if err := os.WriteFile(path+".tmp", content, 0o644); err != nil {
+		return fmt.Errorf("cannot write spool file: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("cannot commit spool file: %w", err)
+	}
+
+	spool.files = append(spool.files, spoolFile{name: name, size: int64(len(content))})
+	spool.size += int64(len(content))
+	spool.lastNanos = nanos
+
+	select {
+	case spool.notify <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// peek reads the oldest spooled event list.
+// Returns a nil batch if the spool is empty.
+// Unreadable files are reported as an error together with their name,
+// and the caller is responsible for removing them.
+func (spool *spool) peek() (string, *batch, error) {
+	spool.lock.Lock()
+	if len(spool.files) == 0 {
+		spool.lock.Unlock()
+		return "", nil, nil
+	}
+	name := spool.files[0].name
+	spool.lock.Unlock()
+
+	content, err := os.ReadFile(filepath.Join(spool.dir, name))
+	if err == nil {
+		batch := &batch{}
+		if err = json.Unmarshal(content, batch); err == nil {
+			return name, batch, nil
+		}
+	}
+
+	return name, nil, fmt.Errorf("cannot read spool file %q: %w", name, err)
+}
+
+// remove deletes the oldest spooled event list, which must be the file returned from peek.
+func (spool *spool) remove(name string) error {
+	spool.lock.Lock()
+	defer spool.lock.Unlock()
+
+	if len(spool.files) == 0 || spool.files[0].name != name {
+		return fmt.Errorf("spool file %q is not the oldest file", name)
+	}
+
+	spool.size -= spool.files[0].size
+	spool.files = spool.files[1:]
+
+	// even if the file cannot be deleted, it is skipped until the next restart to avoid retrying it indefinitely
+	if err := os.Remove(filepath.Join(spool.dir, name)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot remove spool file: %w", err)
+	}
+
+	return nil
+}
+
+func (spool *spool) depth() int64 {
+	spool.lock.Lock()
+	defer spool.lock.Unlock()
+
+	return int64(len(spool.files))
+}
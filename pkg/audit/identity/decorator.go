@@ -0,0 +1,158 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package identity decorates audit events with friendly names of the requesting users.
+package identity
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/kubewharf/kelemetry/pkg/aggregator"
+	"github.com/kubewharf/kelemetry/pkg/audit"
+	"github.com/kubewharf/kelemetry/pkg/k8s"
+	"github.com/kubewharf/kelemetry/pkg/manager"
+)
+
+const configMapRulesKey = "rules.json"
+
+func init() {
+	manager.Global.Provide("audit-identity-decorator", NewDecorator)
+}
+
+type options struct {
+	enable             bool
+	configMapName      string
+	configMapNamespace string
+}
+
+func (options *options) Setup(fs *pflag.FlagSet) {
+	fs.BoolVar(&options.enable, "audit-identity-decorator-enable", false, "enable mapping requesting users to friendly names")
+	fs.StringVar(
+		&options.configMapName,
+		"audit-identity-decorator-config-map-name",
+		"kelemetry-identity-config",
+		"name of the ConfigMap in the target cluster containing the identity rules in the key "+configMapRulesKey,
+	)
+	fs.StringVar(
+		&options.configMapNamespace,
+		"audit-identity-decorator-config-map-namespace",
+		"default",
+		"namespace of the ConfigMap containing the identity rules",
+	)
+}
+
+func (options *options) EnableFlag() *bool { return &options.enable }
+
+type decorator struct {
+	options options
+	logger  logrus.FieldLogger
+	clients k8s.Clients
+	list    audit.DecoratorList
+
+	configMapInformer informers.SharedInformerFactory
+	recorder          record.EventRecorder
+
+	rulesMutex sync.RWMutex
+	rules      Rules
+}
+
+var _ = func() manager.Component { return &decorator{} }
+
+func NewDecorator(
+	logger logrus.FieldLogger,
+	clients k8s.Clients,
+	list audit.DecoratorList,
+) *decorator {
+	return &decorator{
+		logger:  logger,
+		clients: clients,
+		list:    list,
+	}
+}
+
+func (decorator *decorator) Options() manager.Options {
+	return &decorator.options
+}
+
+func (decorator *decorator) Init(ctx context.Context) error {
+	decorator.configMapInformer = decorator.clients.TargetCluster().NewInformerFactory(
+		informers.WithNamespace(decorator.options.configMapNamespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", decorator.options.configMapName).String()
+		}),
+	)
+	_, err := decorator.configMapInformer.Core().V1().ConfigMaps().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj any) { decorator.setRules(obj.(*corev1.ConfigMap)) },
+		UpdateFunc: func(oldObj, newObj any) { decorator.setRules(newObj.(*corev1.ConfigMap)) },
+		DeleteFunc: func(obj any) { decorator.setRules(nil) },
+	})
+	if err != nil {
+		// should not happen during startup
+		return fmt.Errorf("cannot add ConfigMap event handler: %w", err)
+	}
+
+	decorator.recorder = decorator.clients.TargetCluster().EventRecorder("kelemetry-identity-decorator")
+
+	decorator.list.AddDecorator("identity", audit.DecoratorPriorityIdentity, decorator)
+
+	return nil
+}
+
+func (decorator *decorator) Start(stopCh <-chan struct{}) error {
+	decorator.configMapInformer.Start(stopCh)
+	return nil
+}
+
+func (decorator *decorator) Close() error { return nil }
+
+func (decorator *decorator) setRules(cm *corev1.ConfigMap) {
+	var rules Rules
+	if cm != nil {
+		if content, hasRules := cm.Data[configMapRulesKey]; hasRules {
+			var err error
+			rules, err = ParseRules([]byte(content))
+			if err != nil {
+				decorator.logger.WithError(err).Error("Invalid identity rules")
+				decorator.recorder.Eventf(cm, corev1.EventTypeWarning, "InvalidConfig", err.Error())
+			} else {
+				decorator.logger.WithField("rules", len(rules)).Info("Reloaded identity rules")
+			}
+		}
+	}
+
+	decorator.rulesMutex.Lock()
+	defer decorator.rulesMutex.Unlock()
+	decorator.rules = rules
+}
+
+func (decorator *decorator) getRules() Rules {
+	decorator.rulesMutex.RLock()
+	defer decorator.rulesMutex.RUnlock()
+	return decorator.rules
+}
+
+func (decorator *decorator) Decorate(ctx context.Context, message *audit.Message, event *aggregator.Event) {
+	decorator.getRules().Decorate(message, event)
+}
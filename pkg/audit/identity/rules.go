@@ -0,0 +1,179 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package identity
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+
+	"github.com/kubewharf/kelemetry/pkg/aggregator"
+	"github.com/kubewharf/kelemetry/pkg/audit"
+)
+
+// ruleSpec is the JSON format of a rule in the ConfigMap.
+type ruleSpec struct {
+	// Name is the friendly name of the identity, e.g. "ReplicaSet controller".
+	Name string `json:"name"`
+	// Team is the team owning the identity, if any.
+	Team string `json:"team"`
+	// Username, Group and UserAgent are regexp patterns matched against the requesting user.
+	// Empty patterns match everything, but each rule must have at least one pattern.
+	// Submatches of Username can be referenced in Name and Team in the form `$1` or `${name}`.
+	Username  string `json:"username"`
+	Group     string `json:"group"`
+	UserAgent string `json:"userAgent"`
+}
+
+// Rule maps the matching users to a friendly name.
+type Rule struct {
+	name      string
+	team      string
+	username  *regexp.Regexp
+	group     *regexp.Regexp
+	userAgent *regexp.Regexp
+}
+
+// Rules is an ordered list of rules, where the first matching rule takes effect.
+type Rules []*Rule
+
+// Identity is the result of a matched rule.
+type Identity struct {
+	Name string
+	Team string
+}
+
+// ParseRules parses a JSON array of rules.
+func ParseRules(content []byte) (Rules, error) {
+	specs := []ruleSpec{}
+	if err := json.Unmarshal(content, &specs); err != nil {
+		return nil, fmt.Errorf("rules must be a JSON array: %w", err)
+	}
+
+	rules := make(Rules, 0, len(specs))
+	for i, spec := range specs {
+		if spec.Name == "" {
+			return nil, fmt.Errorf("rule #%d has no name", i)
+		}
+		if spec.Username == "" && spec.Group == "" && spec.UserAgent == "" {
+			return nil, fmt.Errorf("rule %q must match at least one of username, group or userAgent", spec.Name)
+		}
+
+		rule := &Rule{name: spec.Name, team: spec.Team}
+		for _, pattern := range []struct {
+			field  string
+			source string
+			dest   **regexp.Regexp
+		}{
+			{field: "username", source: spec.Username, dest: &rule.username},
+			{field: "group", source: spec.Group, dest: &rule.group},
+			{field: "userAgent", source: spec.UserAgent, dest: &rule.userAgent},
+		} {
+			if pattern.source == "" {
+				continue
+			}
+
+			regex, err := regexp.Compile(pattern.source)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q has invalid %s pattern: %w", spec.Name, pattern.field, err)
+			}
+			*pattern.dest = regex
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// Match returns the identity of the first rule matching the user, or nil if no rules match.
+func (rules Rules) Match(user authenticationv1.UserInfo, userAgent string) *Identity {
+	for _, rule := range rules {
+		if identity := rule.match(user, userAgent); identity != nil {
+			return identity
+		}
+	}
+
+	return nil
+}
+
+func (rule *Rule) match(user authenticationv1.UserInfo, userAgent string) *Identity {
+	if rule.userAgent != nil && !rule.userAgent.MatchString(userAgent) {
+		return nil
+	}
+
+	if rule.group != nil {
+		hasGroup := false
+		for _, group := range user.Groups {
+			if rule.group.MatchString(group) {
+				hasGroup = true
+				break
+			}
+		}
+		if !hasGroup {
+			return nil
+		}
+	}
+
+	if rule.username == nil {
+		return &Identity{Name: rule.name, Team: rule.team}
+	}
+
+	submatches := rule.username.FindStringSubmatchIndex(user.Username)
+	if submatches == nil {
+		return nil
+	}
+
+	expand := func(template string) string {
+		return string(rule.username.ExpandString(nil, template, user.Username, submatches))
+	}
+	return &Identity{Name: expand(rule.name), Team: expand(rule.team)}
+}
+
+// Decorate adds the identity of the requesting user to an audit event.
+//
+// The username prefix in the event title is replaced with the friendly name of the matched rule.
+// The impersonation chain and authentication groups are tagged even if no rules match.
+func (rules Rules) Decorate(message *audit.Message, event *aggregator.Event) {
+	user := message.User
+	if message.ImpersonatedUser != nil {
+		event.WithTag("impersonationChain", fmt.Sprintf("%s -> %s", message.User.Username, message.ImpersonatedUser.Username))
+		if username, _ := event.Tags["username"].(string); username == message.ImpersonatedUser.Username {
+			// the title displays the impersonated user unless the consumer ignores impersonation
+			user = *message.ImpersonatedUser
+		}
+	}
+
+	if len(user.Groups) > 0 {
+		event.WithTag("authGroups", strings.Join(user.Groups, ","))
+	}
+
+	identity := rules.Match(user, message.UserAgent)
+	if identity == nil {
+		return
+	}
+
+	event.WithTag("component", identity.Name)
+	if identity.Team != "" {
+		event.WithTag("team", identity.Team)
+	}
+
+	if strings.HasPrefix(event.Title, user.Username+" ") {
+		event.Title = identity.Name + strings.TrimPrefix(event.Title, user.Username)
+	}
+}
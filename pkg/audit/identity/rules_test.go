@@ -0,0 +1,146 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package identity_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+
+	"github.com/kubewharf/kelemetry/pkg/aggregator"
+	"github.com/kubewharf/kelemetry/pkg/audit"
+	"github.com/kubewharf/kelemetry/pkg/audit/identity"
+)
+
+const testRules = `[
+	{"name": "ReplicaSet controller", "team": "kube", "username": "^system:serviceaccount:kube-system:replicaset-controller$"},
+	{"name": "${team} CI", "team": "${team}", "username": "^system:serviceaccount:(?P<team>team-[a-z]+):ci$"},
+	{"name": "kubectl user", "group": "^developers$", "userAgent": "^kubectl/"}
+]`
+
+func parseRules(t *testing.T) identity.Rules {
+	t.Helper()
+
+	rules, err := identity.ParseRules([]byte(testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rules
+}
+
+func TestMatch(t *testing.T) {
+	rules := parseRules(t)
+
+	for _, testCase := range []struct {
+		name      string
+		user      authenticationv1.UserInfo
+		userAgent string
+		expect    *identity.Identity
+	}{
+		{
+			name:   "Exact",
+			user:   authenticationv1.UserInfo{Username: "system:serviceaccount:kube-system:replicaset-controller"},
+			expect: &identity.Identity{Name: "ReplicaSet controller", Team: "kube"},
+		},
+		{
+			name:   "Expand",
+			user:   authenticationv1.UserInfo{Username: "system:serviceaccount:team-foo:ci"},
+			expect: &identity.Identity{Name: "team-foo CI", Team: "team-foo"},
+		},
+		{
+			name:      "GroupAndUserAgent",
+			user:      authenticationv1.UserInfo{Username: "alice", Groups: []string{"system:authenticated", "developers"}},
+			userAgent: "kubectl/v1.26.0 (linux/amd64)",
+			expect:    &identity.Identity{Name: "kubectl user"},
+		},
+		{
+			name:      "UserAgentMismatch",
+			user:      authenticationv1.UserInfo{Username: "alice", Groups: []string{"developers"}},
+			userAgent: "curl/7.0",
+		},
+		{
+			name: "NoMatch",
+			user: authenticationv1.UserInfo{Username: "system:serviceaccount:kube-system:default"},
+		},
+	} {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			assert.Equal(t, testCase.expect, rules.Match(testCase.user, testCase.userAgent))
+		})
+	}
+}
+
+func TestParseInvalidRules(t *testing.T) {
+	for _, content := range []string{
+		`{}`,
+		`[{"username": "^foo$"}]`,
+		`[{"name": "foo"}]`,
+		`[{"name": "foo", "group": "("}]`,
+	} {
+		_, err := identity.ParseRules([]byte(content))
+		assert.Error(t, err, content)
+	}
+}
+
+func TestDecorate(t *testing.T) {
+	assert := assert.New(t)
+
+	rules := parseRules(t)
+
+	message := &audit.Message{
+		Cluster: "test",
+		Event: auditv1.Event{
+			Verb: audit.VerbUpdate,
+			User: authenticationv1.UserInfo{Username: "admin", Groups: []string{"system:masters"}},
+			ImpersonatedUser: &authenticationv1.UserInfo{
+				Username: "system:serviceaccount:kube-system:replicaset-controller",
+				Groups:   []string{"system:serviceaccounts", "system:serviceaccounts:kube-system"},
+			},
+		},
+	}
+	event := aggregator.NewEvent("spec", "system:serviceaccount:kube-system:replicaset-controller update", time.Time{}, "audit").
+		WithTag("username", "system:serviceaccount:kube-system:replicaset-controller")
+
+	rules.Decorate(message, event)
+
+	assert.Equal("ReplicaSet controller update", event.Title)
+	assert.Equal("ReplicaSet controller", event.Tags["component"])
+	assert.Equal("kube", event.Tags["team"])
+	assert.Equal("admin -> system:serviceaccount:kube-system:replicaset-controller", event.Tags["impersonationChain"])
+	assert.Equal("system:serviceaccounts,system:serviceaccounts:kube-system", event.Tags["authGroups"])
+}
+
+func TestDecorateWithoutRules(t *testing.T) {
+	assert := assert.New(t)
+
+	message := &audit.Message{
+		Cluster: "test",
+		Event: auditv1.Event{
+			Verb: audit.VerbCreate,
+			User: authenticationv1.UserInfo{Username: "alice", Groups: []string{"developers"}},
+		},
+	}
+	event := aggregator.NewEvent("spec", "alice create", time.Time{}, "audit").WithTag("username", "alice")
+
+	identity.Rules(nil).Decorate(message, event)
+
+	assert.Equal("alice create", event.Title)
+	assert.Equal("developers", event.Tags["authGroups"])
+	assert.NotContains(event.Tags, "component")
+	assert.NotContains(event.Tags, "impersonationChain")
+}
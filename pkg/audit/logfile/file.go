@@ -0,0 +1,340 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auditlogfile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+
+	"github.com/kubewharf/kelemetry/pkg/audit"
+	"github.com/kubewharf/kelemetry/pkg/metrics"
+)
+
+// fingerprintSize is the maximum number of bytes at the start of a file used to identify it.
+// Audit log lines are much longer than this, so different files almost never share the same fingerprint.
+const fingerprintSize = 1024
+
+// position identifies a file and an offset in it.
+// Files are identified by the checksum of their first bytes instead of inode numbers,
+// so that a rotation while the process is down is detected on all platforms.
+type position struct {
+	Offset            int64  `json:"offset"`
+	FingerprintLength int64  `json:"fingerprintLength"`
+	Fingerprint       uint32 `json:"fingerprint"`
+}
+
+type checkpoint map[string]position
+
+func readCheckpoint(path string) (checkpoint, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return checkpoint{}, nil
+		}
+
+		return nil, fmt.Errorf("cannot read checkpoint: %w", err)
+	}
+
+	checkpoint := checkpoint{}
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return nil, fmt.Errorf("cannot parse checkpoint %q: %w", path, err)
+	}
+
+	return checkpoint, nil
+}
+
+func (checkpoint checkpoint) write(path string) error {
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return fmt.Errorf("cannot marshal checkpoint: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("cannot create checkpoint directory: %w", err)
+	}
+
+	// write to a temporary file first so that a crash never leaves a truncated checkpoint
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o600); err != nil {
+		return fmt.Errorf("cannot write checkpoint: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("cannot rename checkpoint: %w", err)
+	}
+
+	return nil
+}
+
+// fingerprint computes the checksum of the first length bytes of file.
+// Returns false if the file is shorter than length.
+func fingerprint(file *os.File, length int64) (uint32, bool, error) {
+	buf := make([]byte, length)
+	if _, err := file.ReadAt(buf, 0); err != nil {
+		if errors.Is(err, io.EOF) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+
+	return crc32.ChecksumIEEE(buf), true, nil
+}
+
+// fileTailer follows a single audit log file path.
+type fileTailer struct {
+	tailer  *tailer
+	logger  logrus.FieldLogger
+	path    string
+	cluster string
+
+	// checkpoint is the position loaded from the checkpoint file, used when the file is first opened.
+	checkpoint    position
+	hasCheckpoint bool
+
+	// opened is true after the path has been checked for the first time.
+	opened bool
+	file   *os.File
+	// offset is the offset after the last complete line read from file.
+	offset int64
+}
+
+// poll reads all complete lines appended since the last poll.
+// Returns true if the offset has changed.
+func (ft *fileTailer) poll() (changed bool, err error) {
+	if ft.file == nil {
+		opened, err := ft.open()
+		if err != nil || !opened {
+			return false, err
+		}
+		changed = true
+	}
+
+	offsetBefore := ft.offset
+	if err := ft.readAvailable(); err != nil {
+		return changed || ft.offset != offsetBefore, err
+	}
+
+	rotated, err := ft.checkRotation()
+	if err != nil {
+		return changed || ft.offset != offsetBefore, err
+	}
+
+	if rotated {
+		// lines may have been appended to the old file between the last read and the rotation
+		if err := ft.readAvailable(); err != nil {
+			return true, err
+		}
+
+		ft.logger.WithField("offset", ft.offset).Info("Audit log file rotated, following the new file")
+		ft.close()
+		if _, err := ft.open(); err != nil {
+			return true, err
+		}
+		return true, nil
+	}
+
+	return changed || ft.offset != offsetBefore, nil
+}
+
+// open opens the file at path and seeks to the checkpoint if it refers to the same file.
+// Returns false if the file does not exist yet.
+func (ft *fileTailer) open() (bool, error) {
+	file, err := os.Open(ft.path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			// the whole file is new when it is created later
+			ft.opened = true
+			return false, nil
+		}
+		return false, fmt.Errorf("cannot open audit log file: %w", err)
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return false, fmt.Errorf("cannot stat audit log file: %w", err)
+	}
+
+	ft.file = file
+	ft.offset = 0
+
+	if ft.hasCheckpoint {
+		// only use the checkpoint for the first opened file
+		ft.hasCheckpoint = false
+
+		sum, ok, err := fingerprint(file, ft.checkpoint.FingerprintLength)
+		if err != nil {
+			return true, fmt.Errorf("cannot read audit log file: %w", err)
+		}
+
+		if ok && sum == ft.checkpoint.Fingerprint && ft.checkpoint.Offset <= stat.Size() {
+			ft.offset = ft.checkpoint.Offset
+			ft.logger.WithField("offset", ft.offset).Info("Resuming audit log file from checkpoint")
+		} else {
+			ft.logger.Warn("Audit log file was rotated or truncated since the last checkpoint, reading from start")
+		}
+	} else if !ft.opened && !ft.tailer.options.readFromStart {
+		// only follow new events in files that existed before startup
+		ft.offset = ft.completeLinesUntil(stat.Size())
+	}
+
+	ft.opened = true
+
+	return true, nil
+}
+
+// completeLinesUntil returns the offset after the last newline before size,
+// so that following starts from the beginning of a line.
+func (ft *fileTailer) completeLinesUntil(size int64) int64 {
+	start := size - fingerprintSize
+	if start < 0 {
+		start = 0
+	}
+
+	buf := make([]byte, size-start)
+	if _, err := ft.file.ReadAt(buf, start); err != nil {
+		return size
+	}
+
+	newline := bytes.LastIndexByte(buf, '\n')
+	if newline == -1 {
+		return size
+	}
+	return start + int64(newline) + 1
+}
+
+// readAvailable publishes all complete lines after the current offset.
+func (ft *fileTailer) readAvailable() error {
+	reader := bufio.NewReaderSize(io.NewSectionReader(ft.file, ft.offset, math.MaxInt64-ft.offset), 64*1024)
+
+	events := []auditv1.Event{}
+	flush := func() {
+		if len(events) == 0 {
+			return
+		}
+
+		ft.tailer.webhook.Publish(&audit.RawMessage{
+			Cluster:   ft.cluster,
+			EventList: &auditv1.EventList{Items: events},
+		})
+		events = []auditv1.Event{}
+	}
+	defer flush()
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				// incomplete lines are read again in the next poll
+				return nil
+			}
+			return fmt.Errorf("cannot read audit log file: %w", err)
+		}
+
+		ft.offset += int64(len(line))
+
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		metric := &eventMetric{Cluster: ft.cluster}
+		event := auditv1.Event{}
+		if err := json.Unmarshal(line, &event); err != nil {
+			metric.Error = metrics.LabelError(err, "Decode")
+			ft.tailer.eventMetric.With(metric).Count(1)
+			ft.logger.WithError(err).WithField("offset", ft.offset).Warn("Skipping malformed audit log line")
+			continue
+		}
+		ft.tailer.eventMetric.With(metric).Count(1)
+
+		events = append(events, event)
+		if len(events) >= ft.tailer.options.batchSize {
+			flush()
+		}
+	}
+}
+
+// checkRotation returns true if the path now refers to a different file.
+// If the same file was truncated, reading restarts from the beginning.
+func (ft *fileTailer) checkRotation() (bool, error) {
+	pathStat, err := os.Stat(ft.path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			// the file was renamed but the new file is not created yet
+			return false, nil
+		}
+		return false, fmt.Errorf("cannot stat audit log file: %w", err)
+	}
+
+	fileStat, err := ft.file.Stat()
+	if err != nil {
+		return false, fmt.Errorf("cannot stat opened audit log file: %w", err)
+	}
+
+	if !os.SameFile(pathStat, fileStat) {
+		return true, nil
+	}
+
+	if fileStat.Size() < ft.offset {
+		ft.logger.WithField("offset", ft.offset).WithField("size", fileStat.Size()).Warn("Audit log file truncated, reading from start")
+		ft.offset = 0
+	}
+
+	return false, nil
+}
+
+// position returns the current position for checkpointing.
+// Returns false if no file is open.
+func (ft *fileTailer) position() (position, bool) {
+	if ft.file == nil {
+		return position{}, false
+	}
+
+	length := ft.offset
+	if length > fingerprintSize {
+		length = fingerprintSize
+	}
+
+	sum, _, err := fingerprint(ft.file, length)
+	if err != nil {
+		ft.logger.WithError(err).Warn("cannot compute audit log file fingerprint")
+		return position{}, false
+	}
+
+	return position{
+		Offset:            ft.offset,
+		FingerprintLength: length,
+		Fingerprint:       sum,
+	}, true
+}
+
+func (ft *fileTailer) close() {
+	if ft.file != nil {
+		_ = ft.file.Close()
+		ft.file = nil
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package auditlogfile reads audit events from the JSON-lines audit log files written by apiservers
+// for clusters that cannot be configured with an audit webhook backend.
+//
+// Events are published to the subscribers of the audit webhook component as if they were received from the webhook,
+// so --audit-webhook-enable is required even if no apiserver sends events to the webhook.
+package auditlogfile
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"k8s.io/utils/clock"
+
+	auditwebhook "github.com/kubewharf/kelemetry/pkg/audit/webhook"
+	"github.com/kubewharf/kelemetry/pkg/manager"
+	"github.com/kubewharf/kelemetry/pkg/metrics"
+	"github.com/kubewharf/kelemetry/pkg/util/shutdown"
+)
+
+func init() {
+	manager.Global.Provide("audit-log-file", New)
+}
+
+type options struct {
+	files          map[string]string
+	checkpointPath string
+	pollInterval   time.Duration
+	batchSize      int
+	readFromStart  bool
+}
+
+func (options *options) Setup(fs *pflag.FlagSet) {
+	fs.StringToStringVar(
+		&options.files,
+		"audit-log-file-paths",
+		map[string]string{},
+		"audit log files to tail, mapped to the cluster name of the apiserver writing each file, "+
+			"e.g. /var/log/kube-apiserver/audit.log=my-cluster (leave empty to disable)",
+	)
+	fs.StringVar(
+		&options.checkpointPath,
+		"audit-log-file-checkpoint",
+		"audit-log-file-checkpoint.json",
+		"path to persist the read offset of each audit log file",
+	)
+	fs.DurationVar(&options.pollInterval, "audit-log-file-poll-interval", time.Second, "interval to check audit log files for new events")
+	fs.IntVar(&options.batchSize, "audit-log-file-batch-size", 100, "maximum number of events in each event list sent to raw subscribers")
+	fs.BoolVar(
+		&options.readFromStart,
+		"audit-log-file-read-from-start",
+		false,
+		"read existing events in audit log files without a checkpoint instead of only following new events",
+	)
+}
+
+func (options *options) EnableFlag() *bool {
+	isEnable := len(options.files) > 0
+	return &isEnable
+}
+
+type tailer struct {
+	options options
+	logger  logrus.FieldLogger
+	clock   clock.Clock
+	metrics metrics.Client
+	webhook auditwebhook.Webhook
+
+	eventMetric metrics.Metric
+	files       []*fileTailer
+	wg          sync.WaitGroup
+}
+
+type eventMetric struct {
+	Cluster string
+	Error   metrics.LabeledError
+}
+
+func New(
+	logger logrus.FieldLogger,
+	clock clock.Clock,
+	metrics metrics.Client,
+	webhook auditwebhook.Webhook,
+) *tailer {
+	return &tailer{
+		logger:  logger,
+		clock:   clock,
+		metrics: metrics,
+		webhook: webhook,
+	}
+}
+
+func (tailer *tailer) Options() manager.Options {
+	return &tailer.options
+}
+
+func (tailer *tailer) Init(ctx context.Context) error {
+	if tailer.options.batchSize <= 0 {
+		return fmt.Errorf("--audit-log-file-batch-size must be positive")
+	}
+
+	tailer.eventMetric = tailer.metrics.New("audit_log_file_event", &eventMetric{})
+
+	checkpoint, err := readCheckpoint(tailer.options.checkpointPath)
+	if err != nil {
+		return err
+	}
+
+	paths := make([]string, 0, len(tailer.options.files))
+	for path := range tailer.options.files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		position, hasCheckpoint := checkpoint[path]
+		tailer.files = append(tailer.files, &fileTailer{
+			tailer:        tailer,
+			logger:        tailer.logger.WithField("path", path),
+			path:          path,
+			cluster:       tailer.options.files[path],
+			checkpoint:    position,
+			hasCheckpoint: hasCheckpoint,
+		})
+	}
+
+	return nil
+}
+
+func (tailer *tailer) Start(stopCh <-chan struct{}) error {
+	tailer.wg.Add(1)
+	go func() {
+		defer tailer.wg.Done()
+		defer shutdown.RecoverPanic(tailer.logger)
+
+		for {
+			tailer.poll()
+
+			select {
+			case <-stopCh:
+				return
+			case <-tailer.clock.After(tailer.options.pollInterval):
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (tailer *tailer) poll() {
+	changed := false
+	for _, file := range tailer.files {
+		fileChanged, err := file.poll()
+		if err != nil {
+			file.logger.WithError(err).Error("cannot read audit log file")
+		}
+		changed = changed || fileChanged
+	}
+
+	if changed {
+		if err := tailer.writeCheckpoint(); err != nil {
+			tailer.logger.WithError(err).Error("cannot write audit log file checkpoint")
+		}
+	}
+}
+
+func (tailer *tailer) writeCheckpoint() error {
+	checkpoint := checkpoint{}
+	for _, file := range tailer.files {
+		if position, ok := file.position(); ok {
+			checkpoint[file.path] = position
+		}
+	}
+
+	return checkpoint.write(tailer.options.checkpointPath)
+}
+
+func (tailer *tailer) Close() error {
+	tailer.wg.Wait()
+
+	for _, file := range tailer.files {
+		file.close()
+	}
+
+	return nil
+}
@@ -0,0 +1,238 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auditlogfile_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/types"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"github.com/kubewharf/kelemetry/pkg/audit"
+	auditlogfile "github.com/kubewharf/kelemetry/pkg/audit/logfile"
+	"github.com/kubewharf/kelemetry/pkg/manager"
+	"github.com/kubewharf/kelemetry/pkg/metrics"
+)
+
+type fakeWebhook struct {
+	manager.BaseComponent
+
+	lock     sync.Mutex
+	messages []*audit.RawMessage
+}
+
+func (webhook *fakeWebhook) AddSubscriber(name string) <-chan *audit.Message       { return nil }
+func (webhook *fakeWebhook) AddRawSubscriber(name string) <-chan *audit.RawMessage { return nil }
+
+func (webhook *fakeWebhook) Publish(rawMessage *audit.RawMessage) {
+	webhook.lock.Lock()
+	defer webhook.lock.Unlock()
+
+	webhook.messages = append(webhook.messages, rawMessage)
+}
+
+// auditIds returns the cluster and audit ID of all published events.
+func (webhook *fakeWebhook) auditIds() []string {
+	webhook.lock.Lock()
+	defer webhook.lock.Unlock()
+
+	ids := []string{}
+	for _, message := range webhook.messages {
+		for _, event := range message.Items {
+			ids = append(ids, message.Cluster+"/"+string(event.AuditID))
+		}
+	}
+	return ids
+}
+
+func appendEvents(t *testing.T, path string, auditIds ...string) {
+	t.Helper()
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	assert.Nil(t, err)
+	defer file.Close()
+
+	for _, auditId := range auditIds {
+		line, err := json.Marshal(auditv1.Event{AuditID: types.UID(auditId), Verb: "update"})
+		assert.Nil(t, err)
+		_, err = file.Write(append(line, '\n'))
+		assert.Nil(t, err)
+	}
+}
+
+type testTailer struct {
+	t       *testing.T
+	clock   *clocktesting.FakeClock
+	webhook *fakeWebhook
+	stopCh  chan struct{}
+	closer  func() error
+}
+
+func startTailer(t *testing.T, clock *clocktesting.FakeClock, args ...string) *testTailer {
+	t.Helper()
+
+	metricsClient, _ := metrics.NewMock(clock)
+	webhook := &fakeWebhook{}
+	tailer := auditlogfile.New(logrus.New(), clock, metricsClient, webhook)
+
+	fs := pflag.NewFlagSet("test", pflag.PanicOnError)
+	tailer.Options().Setup(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tailer.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	stopCh := make(chan struct{})
+	if err := tailer.Start(stopCh); err != nil {
+		t.Fatal(err)
+	}
+
+	// wait for the initial poll
+	assert.Eventually(t, clock.HasWaiters, time.Second, time.Millisecond)
+
+	return &testTailer{t: t, clock: clock, webhook: webhook, stopCh: stopCh, closer: tailer.Close}
+}
+
+// expect polls until the published events match expected.
+func (tt *testTailer) expect(expected ...string) {
+	tt.t.Helper()
+
+	assert.Eventually(tt.t, func() bool {
+		if tt.clock.HasWaiters() {
+			tt.clock.Step(time.Second)
+		}
+		return len(tt.webhook.auditIds()) >= len(expected)
+	}, time.Second*5, time.Millisecond)
+	assert.Equal(tt.t, expected, tt.webhook.auditIds())
+}
+
+func (tt *testTailer) stop() {
+	close(tt.stopCh)
+	assert.Nil(tt.t, tt.closer())
+}
+
+func TestFollowRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+	appendEvents(t, path, "old")
+
+	clock := clocktesting.NewFakeClock(time.Unix(1600000000, 0))
+	tailer := startTailer(t, clock,
+		"--audit-log-file-paths="+path+"=test",
+		"--audit-log-file-checkpoint="+filepath.Join(dir, "checkpoint.json"),
+	)
+	defer tailer.stop()
+
+	// existing events are skipped without --audit-log-file-read-from-start
+	appendEvents(t, path, "a", "b")
+	tailer.expect("test/a", "test/b")
+
+	// the apiserver renames the current file and starts a new one
+	appendEvents(t, path, "c")
+	assert.Nil(t, os.Rename(path, filepath.Join(dir, "audit-2020.log")))
+	appendEvents(t, path, "d")
+	tailer.expect("test/a", "test/b", "test/c", "test/d")
+}
+
+func TestResumeFromCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+	args := []string{
+		"--audit-log-file-paths=" + path + "=test",
+		"--audit-log-file-checkpoint=" + filepath.Join(dir, "checkpoint.json"),
+		"--audit-log-file-read-from-start",
+		"--audit-log-file-batch-size=2",
+	}
+	appendEvents(t, path, "a", "b", "c")
+
+	clock := clocktesting.NewFakeClock(time.Unix(1600000000, 0))
+	tailer := startTailer(t, clock, args...)
+	tailer.expect("test/a", "test/b", "test/c")
+	assert.Len(t, tailer.webhook.messages, 2)
+	tailer.stop()
+
+	appendEvents(t, path, "d")
+
+	tailer = startTailer(t, clock, args...)
+	defer tailer.stop()
+	tailer.expect("test/d")
+}
+
+func TestCheckpointOfRotatedFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+	args := []string{
+		"--audit-log-file-paths=" + path + "=test",
+		"--audit-log-file-checkpoint=" + filepath.Join(dir, "checkpoint.json"),
+	}
+	appendEvents(t, path, "old")
+
+	clock := clocktesting.NewFakeClock(time.Unix(1600000000, 0))
+	tailer := startTailer(t, clock, args...)
+	appendEvents(t, path, "a")
+	tailer.expect("test/a")
+	tailer.stop()
+
+	// rotated while the tailer is down
+	assert.Nil(t, os.Rename(path, filepath.Join(dir, "audit-2020.log")))
+	appendEvents(t, path, "b", "c")
+
+	tailer = startTailer(t, clock, args...)
+	defer tailer.stop()
+	tailer.expect("test/b", "test/c")
+}
+
+func TestIncompleteLine(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+
+	clock := clocktesting.NewFakeClock(time.Unix(1600000000, 0))
+	tailer := startTailer(t, clock,
+		"--audit-log-file-paths="+path+"=test",
+		"--audit-log-file-checkpoint="+filepath.Join(dir, "checkpoint.json"),
+	)
+	defer tailer.stop()
+
+	line, err := json.Marshal(auditv1.Event{AuditID: "a"})
+	assert.Nil(t, err)
+
+	// the file does not exist at startup, so it is read from the start
+	file, err := os.Create(path)
+	assert.Nil(t, err)
+	defer file.Close()
+
+	_, err = file.Write(line[:10])
+	assert.Nil(t, err)
+	clock.Step(time.Second)
+	assert.Eventually(t, clock.HasWaiters, time.Second, time.Millisecond)
+	assert.Empty(t, tailer.webhook.auditIds())
+
+	_, err = file.Write(append(line[10:], '\n'))
+	assert.Nil(t, err)
+	tailer.expect("test/a")
+}
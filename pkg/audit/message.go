@@ -34,8 +34,12 @@ type ClusterOnlyMessage struct {
 }
 
 const (
-	VerbCreate = "create"
-	VerbUpdate = "update"
-	VerbDelete = "delete"
-	VerbPatch  = "patch"
+	VerbCreate           = "create"
+	VerbUpdate           = "update"
+	VerbDelete           = "delete"
+	VerbDeleteCollection = "deletecollection"
+	VerbPatch            = "patch"
+	VerbGet              = "get"
+	VerbList             = "list"
+	VerbWatch            = "watch"
 )
@@ -0,0 +1,77 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mq
+
+import "sync"
+
+// AckTracker computes the offset to commit for a partition
+// from messages that may be acknowledged out of order.
+type AckTracker struct {
+	lock    sync.Mutex
+	pending []*trackedMessage
+	commit  func(nextOffset int64)
+}
+
+type trackedMessage struct {
+	offset int64
+	acked  bool
+}
+
+// NewAckTracker creates an AckTracker.
+// commit is called with the offset after the last committed message
+// whenever the oldest pending messages have all been acknowledged.
+// Calls to commit are serialized and have increasing offsets.
+func NewAckTracker(commit func(nextOffset int64)) *AckTracker {
+	return &AckTracker{commit: commit}
+}
+
+// Track registers a message to be acknowledged.
+// Messages must be tracked in the order of their offsets.
+// Returns the function to acknowledge the message, which has no effect after the first call.
+func (tracker *AckTracker) Track(offset int64) (ack func()) {
+	message := &trackedMessage{offset: offset}
+
+	tracker.lock.Lock()
+	tracker.pending = append(tracker.pending, message)
+	tracker.lock.Unlock()
+
+	return func() {
+		tracker.lock.Lock()
+		defer tracker.lock.Unlock()
+
+		message.acked = true
+
+		var nextOffset int64
+		advanced := false
+		for len(tracker.pending) > 0 && tracker.pending[0].acked {
+			nextOffset = tracker.pending[0].offset + 1
+			tracker.pending[0] = nil
+			tracker.pending = tracker.pending[1:]
+			advanced = true
+		}
+
+		if advanced {
+			tracker.commit(nextOffset)
+		}
+	}
+}
+
+// Pending returns the number of tracked messages that are not committed yet.
+func (tracker *AckTracker) Pending() int {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	return len(tracker.pending)
+}
@@ -0,0 +1,58 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mq_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/kubewharf/kelemetry/pkg/audit/mq"
+)
+
+func TestAckOutOfOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	commits := []int64{}
+	tracker := mq.NewAckTracker(func(nextOffset int64) { commits = append(commits, nextOffset) })
+
+	// offsets may have gaps, e.g. due to Kafka compaction
+	ack10 := tracker.Track(10)
+	ack11 := tracker.Track(11)
+	ack13 := tracker.Track(13)
+
+	ack13()
+	assert.Empty(commits, "13 must not be committed before 10 and 11")
+
+	ack11()
+	assert.Empty(commits)
+
+	ack10()
+	assert.Equal([]int64{14}, commits)
+	assert.Equal(0, tracker.Pending())
+
+	ack14 := tracker.Track(14)
+	ack15 := tracker.Track(15)
+	ack14()
+	assert.Equal([]int64{14, 15}, commits)
+
+	// repeated acknowledgements have no effect
+	ack14()
+	assert.Equal([]int64{14, 15}, commits)
+	assert.Equal(1, tracker.Pending())
+
+	ack15()
+	assert.Equal([]int64{14, 15, 16}, commits)
+}
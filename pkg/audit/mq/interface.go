@@ -59,4 +59,11 @@ func (mux *mux) CreateConsumer(group ConsumerGroup, partition PartitionId, handl
 	return mux.Impl().(Queue).CreateConsumer(group, partition, handler)
 }
 
-type MessageHandler func(fieldLogger logrus.FieldLogger, key []byte, value []byte)
+// MessageHandler handles a message consumed from a partition.
+//
+// ack must be called exactly once after the message has been completely handled,
+// either before the handler returns or later from another goroutine.
+// A message is only committed after it and all previous messages in the partition have been acknowledged,
+// so messages that are never acknowledged are redelivered after restart.
+// The handler should block while it cannot accept more messages.
+type MessageHandler func(fieldLogger logrus.FieldLogger, key []byte, value []byte, ack func())
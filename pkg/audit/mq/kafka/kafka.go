@@ -0,0 +1,420 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package kafka implements mq.Queue with a Kafka topic.
+//
+// Each kelemetry consumer partition consumes the Kafka partition with the same ID.
+// Partitions are assigned statically through --audit-consumer-partition
+// instead of Kafka group rebalancing,
+// but offsets are committed to the Kafka consumer group with the same name as the mq.ConsumerGroup.
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+
+	"github.com/kubewharf/kelemetry/pkg/audit/mq"
+	"github.com/kubewharf/kelemetry/pkg/manager"
+	"github.com/kubewharf/kelemetry/pkg/metrics"
+	"github.com/kubewharf/kelemetry/pkg/util/shutdown"
+)
+
+func init() {
+	manager.Global.ProvideMuxImpl("mq/kafka", NewKafka, mq.Queue.CreateProducer)
+}
+
+type kafkaOptions struct {
+	brokers        []string
+	topic          string
+	clientId       string
+	version        string
+	initialOffset  string
+	commitInterval time.Duration
+	requiredAcks   string
+	compression    string
+	dialTimeout    time.Duration
+}
+
+func (options *kafkaOptions) Setup(fs *pflag.FlagSet) {
+	fs.StringSliceVar(&options.brokers, "mq-kafka-brokers", []string{"127.0.0.1:9092"}, "addresses of Kafka bootstrap brokers")
+	fs.StringVar(&options.topic, "mq-kafka-topic", "kelemetry-audit", "Kafka topic to produce and consume audit events")
+	fs.StringVar(&options.clientId, "mq-kafka-client-id", "kelemetry", "client ID sent to Kafka brokers")
+	fs.StringVar(&options.version, "mq-kafka-version", "", "Kafka protocol version to use, e.g. \"2.8.0\" (leave empty for sarama default)")
+	fs.StringVar(
+		&options.initialOffset,
+		"mq-kafka-initial-offset",
+		"newest",
+		"offset to start consuming from if the consumer group has not committed any offset (\"newest\" or \"oldest\")",
+	)
+	fs.DurationVar(&options.commitInterval, "mq-kafka-commit-interval", time.Second, "interval to commit consumed offsets")
+	fs.StringVar(
+		&options.requiredAcks,
+		"mq-kafka-required-acks",
+		"all",
+		"acknowledgements required for produced messages (\"none\", \"local\" or \"all\")",
+	)
+	fs.StringVar(
+		&options.compression,
+		"mq-kafka-compression",
+		"none",
+		"compression codec for produced messages (\"none\", \"gzip\", \"snappy\", \"lz4\" or \"zstd\")",
+	)
+	fs.DurationVar(&options.dialTimeout, "mq-kafka-dial-timeout", time.Second*30, "timeout for connecting to Kafka brokers")
+}
+
+func (options *kafkaOptions) EnableFlag() *bool { return nil }
+
+// KafkaQueue is an mq.Queue backed by a Kafka topic.
+type KafkaQueue struct {
+	manager.MuxImplBase
+
+	options   kafkaOptions
+	logger    logrus.FieldLogger
+	metrics   metrics.Client
+	deferList *shutdown.DeferList
+
+	client    sarama.Client
+	producer  *kafkaProducer
+	consumers []*kafkaConsumer
+}
+
+type lagMetric struct {
+	ConsumerGroup mq.ConsumerGroup
+	Partition     mq.PartitionId
+}
+
+func NewKafka(
+	logger logrus.FieldLogger,
+	metrics metrics.Client,
+) *KafkaQueue {
+	return &KafkaQueue{
+		logger:    logger,
+		metrics:   metrics,
+		deferList: shutdown.NewDeferList(),
+	}
+}
+
+func (_ *KafkaQueue) MuxImplName() (name string, isDefault bool) { return "kafka", false }
+
+func (q *KafkaQueue) Options() manager.Options { return &q.options }
+
+func (q *KafkaQueue) Init(ctx context.Context) error {
+	config, err := q.newConfig()
+	if err != nil {
+		return fmt.Errorf("invalid option: %w", err)
+	}
+
+	client, err := sarama.NewClient(q.options.brokers, config)
+	if err != nil {
+		return fmt.Errorf("cannot connect to Kafka: %w", err)
+	}
+	q.client = client
+	q.deferList.Defer("closing Kafka client", client.Close)
+
+	return nil
+}
+
+func (q *KafkaQueue) newConfig() (*sarama.Config, error) {
+	config := sarama.NewConfig()
+	config.ClientID = q.options.clientId
+	config.Net.DialTimeout = q.options.dialTimeout
+
+	if q.options.version != "" {
+		version, err := sarama.ParseKafkaVersion(q.options.version)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --mq-kafka-version: %w", err)
+		}
+		config.Version = version
+	}
+
+	switch q.options.initialOffset {
+	case "newest":
+		config.Consumer.Offsets.Initial = sarama.OffsetNewest
+	case "oldest":
+		config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	default:
+		return nil, fmt.Errorf("unsupported --mq-kafka-initial-offset %q", q.options.initialOffset)
+	}
+
+	config.Consumer.Offsets.AutoCommit.Enable = true
+	config.Consumer.Offsets.AutoCommit.Interval = q.options.commitInterval
+	config.Consumer.Return.Errors = true
+
+	switch q.options.requiredAcks {
+	case "none":
+		config.Producer.RequiredAcks = sarama.NoResponse
+	case "local":
+		config.Producer.RequiredAcks = sarama.WaitForLocal
+	case "all":
+		config.Producer.RequiredAcks = sarama.WaitForAll
+	default:
+		return nil, fmt.Errorf("unsupported --mq-kafka-required-acks %q", q.options.requiredAcks)
+	}
+
+	switch q.options.compression {
+	case "none":
+		config.Producer.Compression = sarama.CompressionNone
+	case "gzip":
+		config.Producer.Compression = sarama.CompressionGZIP
+	case "snappy":
+		config.Producer.Compression = sarama.CompressionSnappy
+	case "lz4":
+		config.Producer.Compression = sarama.CompressionLZ4
+	case "zstd":
+		config.Producer.Compression = sarama.CompressionZSTD
+	default:
+		return nil, fmt.Errorf("unsupported --mq-kafka-compression %q", q.options.compression)
+	}
+
+	// messages with the same partition key are always sent to the same partition
+	config.Producer.Partitioner = sarama.NewHashPartitioner
+	config.Producer.Return.Successes = true // required by SyncProducer
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+func (q *KafkaQueue) Start(stopCh <-chan struct{}) error {
+	if len(q.consumers) == 0 {
+		return nil
+	}
+
+	partitions, err := q.client.Partitions(q.options.topic)
+	if err != nil {
+		return fmt.Errorf("cannot fetch partitions of topic %q: %w", q.options.topic, err)
+	}
+
+	numPartitions := mq.PartitionId(len(partitions))
+	for _, consumer := range q.consumers {
+		if consumer.partition >= numPartitions {
+			return fmt.Errorf(
+				"topic %q only has %d partitions, cannot consume partition %d",
+				q.options.topic,
+				numPartitions,
+				consumer.partition,
+			)
+		}
+	}
+
+	saramaConsumer, err := sarama.NewConsumerFromClient(q.client)
+	if err != nil {
+		return fmt.Errorf("cannot create Kafka consumer: %w", err)
+	}
+	q.deferList.Defer("closing Kafka consumer", saramaConsumer.Close)
+
+	offsetManagers := map[mq.ConsumerGroup]sarama.OffsetManager{}
+	for _, consumer := range q.consumers {
+		offsetManager, exists := offsetManagers[consumer.group]
+		if !exists {
+			offsetManager, err = sarama.NewOffsetManagerFromClient(string(consumer.group), q.client)
+			if err != nil {
+				return fmt.Errorf("cannot create offset manager for consumer group %q: %w", consumer.group, err)
+			}
+			offsetManagers[consumer.group] = offsetManager
+			// offset managers flush the last marked offsets when closed
+			q.deferList.Defer(fmt.Sprintf("closing offset manager for %q", consumer.group), offsetManager.Close)
+		}
+
+		if err := consumer.start(stopCh, saramaConsumer, offsetManager); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (q *KafkaQueue) Close() error {
+	for _, consumer := range q.consumers {
+		consumer.wg.Wait()
+	}
+
+	if name, err := q.deferList.Run(q.logger); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	return nil
+}
+
+func (q *KafkaQueue) CreateProducer() (mq.Producer, error) {
+	if q.producer == nil {
+		syncProducer, err := sarama.NewSyncProducerFromClient(q.client)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create Kafka producer: %w", err)
+		}
+
+		q.deferList.Defer("closing Kafka producer", syncProducer.Close)
+		q.producer = &kafkaProducer{
+			topic:    q.options.topic,
+			producer: syncProducer,
+		}
+	}
+
+	return q.producer, nil
+}
+
+type kafkaProducer struct {
+	topic    string
+	producer sarama.SyncProducer
+}
+
+func (producer *kafkaProducer) Send(partitionKey []byte, value []byte) error {
+	message := &sarama.ProducerMessage{
+		Topic: producer.topic,
+		Value: sarama.ByteEncoder(value),
+	}
+	if partitionKey != nil {
+		message.Key = sarama.ByteEncoder(partitionKey)
+	}
+
+	if _, _, err := producer.producer.SendMessage(message); err != nil {
+		return fmt.Errorf("cannot produce Kafka message: %w", err)
+	}
+
+	return nil
+}
+
+func (q *KafkaQueue) CreateConsumer(group mq.ConsumerGroup, partition mq.PartitionId, handler mq.MessageHandler) (mq.Consumer, error) {
+	for _, consumer := range q.consumers {
+		if consumer.group == group && consumer.partition == partition {
+			return nil, fmt.Errorf("consumer for %q/%d requested multiple times", group, partition)
+		}
+	}
+
+	consumer := &kafkaConsumer{
+		logger:    q.logger.WithField("submod", "consumer").WithField("group", string(group)).WithField("partition", int32(partition)),
+		topic:     q.options.topic,
+		group:     group,
+		partition: partition,
+		handler:   handler,
+	}
+	q.metrics.NewMonitor("audit_mq_kafka_lag", &lagMetric{
+		ConsumerGroup: group,
+		Partition:     partition,
+	}, consumer.lag)
+	q.consumers = append(q.consumers, consumer)
+
+	return consumer, nil
+}
+
+type kafkaConsumer struct {
+	logger    logrus.FieldLogger
+	topic     string
+	group     mq.ConsumerGroup
+	partition mq.PartitionId
+	handler   mq.MessageHandler
+	wg        sync.WaitGroup
+
+	partitionConsumer atomic.Pointer[sarama.PartitionConsumer]
+	nextOffset        int64 // accessed atomically
+}
+
+func (consumer *kafkaConsumer) start(stopCh <-chan struct{}, saramaConsumer sarama.Consumer, offsetManager sarama.OffsetManager) error {
+	offsets, err := offsetManager.ManagePartition(consumer.topic, int32(consumer.partition))
+	if err != nil {
+		return fmt.Errorf("cannot manage offsets of partition %d: %w", consumer.partition, err)
+	}
+
+	nextOffset, _ := offsets.NextOffset()
+
+	partitionConsumer, err := saramaConsumer.ConsumePartition(consumer.topic, int32(consumer.partition), nextOffset)
+	if err != nil {
+		offsets.AsyncClose()
+		return fmt.Errorf("cannot consume partition %d: %w", consumer.partition, err)
+	}
+
+	if nextOffset >= 0 {
+		atomic.StoreInt64(&consumer.nextOffset, nextOffset)
+	} else {
+		// the offset is resolved by the broker, so lag is counted from the first received message
+		atomic.StoreInt64(&consumer.nextOffset, partitionConsumer.HighWaterMarkOffset())
+	}
+	consumer.partitionConsumer.Store(&partitionConsumer)
+
+	consumer.wg.Add(1)
+	go func() {
+		defer consumer.wg.Done()
+		defer shutdown.RecoverPanic(consumer.logger)
+
+		defer func() {
+			if err := partitionConsumer.Close(); err != nil {
+				consumer.logger.WithError(err).Error("cannot close partition consumer")
+			}
+			if err := offsets.Close(); err != nil {
+				consumer.logger.WithError(err).Error("cannot close partition offset manager")
+			}
+		}()
+
+		consumeErrors := partitionConsumer.Errors()
+		commitErrors := offsets.Errors()
+
+		// only commit the offset after the message and all previous messages have been handled
+		tracker := mq.NewAckTracker(func(nextOffset int64) {
+			offsets.MarkOffset(nextOffset, "")
+			atomic.StoreInt64(&consumer.nextOffset, nextOffset)
+		})
+
+		for {
+			select {
+			case message, chOpen := <-partitionConsumer.Messages():
+				if !chOpen {
+					return
+				}
+
+				ack := tracker.Track(message.Offset)
+				consumer.handler(consumer.logger.WithField("offset", message.Offset), message.Key, message.Value, ack)
+			case err, chOpen := <-consumeErrors:
+				if !chOpen {
+					consumeErrors = nil
+					continue
+				}
+				consumer.logger.WithError(err).Error("Kafka consumer error")
+			case err, chOpen := <-commitErrors:
+				if !chOpen {
+					commitErrors = nil
+					continue
+				}
+				consumer.logger.WithError(err).Error("Kafka offset commit error")
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// lag returns the number of messages in the partition that have not been acknowledged yet.
+func (consumer *kafkaConsumer) lag() int64 {
+	partitionConsumer := consumer.partitionConsumer.Load()
+	if partitionConsumer == nil {
+		return 0
+	}
+
+	lag := (*partitionConsumer).HighWaterMarkOffset() - atomic.LoadInt64(&consumer.nextOffset)
+	if lag < 0 {
+		return 0
+	}
+
+	return lag
+}
@@ -0,0 +1,212 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kafka_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/utils/clock"
+
+	"github.com/kubewharf/kelemetry/pkg/audit/mq"
+	"github.com/kubewharf/kelemetry/pkg/audit/mq/kafka"
+	"github.com/kubewharf/kelemetry/pkg/metrics"
+)
+
+const (
+	topic         = "kelemetry-audit"
+	numPartitions = 3
+)
+
+// newBroker starts an in-process broker serving the Kafka protocol with the extra handlers returned by makeHandlers.
+func newBroker(t *testing.T, makeHandlers func(broker *sarama.MockBroker) map[string]sarama.MockResponse) *sarama.MockBroker {
+	t.Helper()
+
+	broker := sarama.NewMockBroker(t, 1)
+	t.Cleanup(broker.Close)
+
+	var handlers map[string]sarama.MockResponse
+	if makeHandlers != nil {
+		handlers = makeHandlers(broker)
+	}
+
+	metadata := sarama.NewMockMetadataResponse(t).SetBroker(broker.Addr(), broker.BrokerID())
+	for partition := int32(0); partition < numPartitions; partition++ {
+		metadata = metadata.SetLeader(topic, partition, broker.BrokerID())
+	}
+
+	handlerMap := map[string]sarama.MockResponse{"MetadataRequest": metadata}
+	for name, handler := range handlers {
+		handlerMap[name] = handler
+	}
+	broker.SetHandlerByMap(handlerMap)
+
+	return broker
+}
+
+func newQueue(t *testing.T, broker *sarama.MockBroker) *kafka.KafkaQueue {
+	t.Helper()
+
+	metricsClient, _ := metrics.NewMock(clock.RealClock{})
+	queue := kafka.NewKafka(logrus.New(), metricsClient)
+
+	fs := pflag.NewFlagSet("test", pflag.PanicOnError)
+	queue.Options().Setup(fs)
+	if err := fs.Parse([]string{
+		"--mq-kafka-brokers=" + broker.Addr(),
+		"--mq-kafka-topic=" + topic,
+		"--mq-kafka-initial-offset=oldest",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := queue.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	return queue
+}
+
+func TestProducePartitionByKey(t *testing.T) {
+	assert := assert.New(t)
+
+	key := []byte("test/pods/default/foo")
+	partitioner := sarama.NewHashPartitioner(topic)
+	expectedPartition, err := partitioner.Partition(&sarama.ProducerMessage{Key: sarama.ByteEncoder(key)}, numPartitions)
+	assert.Nil(err)
+
+	// reject messages sent to any other partition; v3 is the produce request version sarama uses by default
+	produce := sarama.NewMockProduceResponse(t).SetVersion(3)
+	for partition := int32(0); partition < numPartitions; partition++ {
+		if partition != expectedPartition {
+			produce = produce.SetError(topic, partition, sarama.ErrMessageSizeTooLarge)
+		}
+	}
+
+	broker := newBroker(t, func(*sarama.MockBroker) map[string]sarama.MockResponse {
+		return map[string]sarama.MockResponse{"ProduceRequest": produce}
+	})
+	queue := newQueue(t, broker)
+	defer func() { assert.Nil(queue.Close()) }()
+
+	producer, err := queue.CreateProducer()
+	assert.Nil(err)
+
+	for i := 0; i < 5; i++ {
+		assert.Nil(producer.Send(key, []byte("value")))
+	}
+}
+
+func TestProduceError(t *testing.T) {
+	assert := assert.New(t)
+
+	produce := sarama.NewMockProduceResponse(t).SetVersion(3)
+	for partition := int32(0); partition < numPartitions; partition++ {
+		produce = produce.SetError(topic, partition, sarama.ErrMessageSizeTooLarge)
+	}
+
+	broker := newBroker(t, func(*sarama.MockBroker) map[string]sarama.MockResponse {
+		return map[string]sarama.MockResponse{"ProduceRequest": produce}
+	})
+	queue := newQueue(t, broker)
+	defer func() { assert.Nil(queue.Close()) }()
+
+	producer, err := queue.CreateProducer()
+	assert.Nil(err)
+	assert.NotNil(producer.Send([]byte("key"), []byte("value")))
+}
+
+func TestConsumeFromCommittedOffset(t *testing.T) {
+	assert := assert.New(t)
+
+	const group = "kelemetry-consumer"
+
+	fetch := sarama.NewMockFetchResponse(t, 1)
+	for offset, value := range []string{"a", "b", "c"} {
+		fetch = fetch.SetMessageWithKey(topic, 1, int64(offset), sarama.StringEncoder("key"), sarama.StringEncoder(value))
+	}
+	fetch = fetch.SetHighWaterMark(topic, 1, 3)
+
+	broker := newBroker(t, func(broker *sarama.MockBroker) map[string]sarama.MockResponse {
+		return map[string]sarama.MockResponse{
+			"OffsetRequest": sarama.NewMockOffsetResponse(t).
+				SetOffset(topic, 1, sarama.OffsetOldest, 0).
+				SetOffset(topic, 1, sarama.OffsetNewest, 3),
+			"FetchRequest": fetch,
+			"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+				SetCoordinator(sarama.CoordinatorGroup, group, broker),
+			"OffsetFetchRequest": sarama.NewMockOffsetFetchResponse(t).
+				SetOffset(group, topic, 1, 1, "", sarama.ErrNoError),
+			"OffsetCommitRequest": sarama.NewMockOffsetCommitResponse(t),
+		}
+	})
+	queue := newQueue(t, broker)
+
+	received := make(chan string, 3)
+	_, err := queue.CreateConsumer(group, 1, func(fieldLogger logrus.FieldLogger, key []byte, value []byte, ack func()) {
+		assert.Equal("key", string(key))
+		received <- string(value)
+		ack()
+	})
+	assert.Nil(err)
+
+	_, err = queue.CreateConsumer(group, 1, func(logrus.FieldLogger, []byte, []byte, func()) {})
+	assert.NotNil(err, "duplicate consumers should be rejected")
+
+	stopCh := make(chan struct{})
+	assert.Nil(queue.Start(stopCh))
+
+	for _, expected := range []string{"b", "c"} {
+		select {
+		case value := <-received:
+			assert.Equal(expected, value)
+		case <-time.After(time.Second * 10):
+			t.Fatalf("timeout waiting for message %q", expected)
+		}
+	}
+
+	close(stopCh)
+	assert.Nil(queue.Close())
+
+	committed := int64(-1)
+	for _, rr := range broker.History() {
+		if request, ok := rr.Request.(*sarama.OffsetCommitRequest); ok {
+			if offset, _, err := request.Offset(topic, 1); err == nil {
+				committed = offset
+			}
+		}
+	}
+	assert.Equal(int64(3), committed)
+}
+
+func TestConsumeUnknownPartition(t *testing.T) {
+	assert := assert.New(t)
+
+	broker := newBroker(t, nil)
+	queue := newQueue(t, broker)
+	defer func() { assert.Nil(queue.Close()) }()
+
+	_, err := queue.CreateConsumer("group", mq.PartitionId(numPartitions), func(logrus.FieldLogger, []byte, []byte, func()) {})
+	assert.Nil(err)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	assert.NotNil(queue.Start(stopCh))
+}
@@ -207,7 +207,8 @@ func (consumer *localConsumer) start(stopCh <-chan struct{}) {
 					return
 				}
 
-				consumer.handler(consumer.logger.WithField("offset", message.offset), message.key, message.value)
+				// messages are not persisted, so there is nothing to commit
+				consumer.handler(consumer.logger.WithField("offset", message.offset), message.key, message.value, func() {})
 			case <-stopCh:
 				return
 			}
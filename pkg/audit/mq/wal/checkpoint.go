@@ -0,0 +1,83 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/kubewharf/kelemetry/pkg/audit/mq"
+)
+
+// checkpoint maps each consumer group and partition to the offset of the next message to consume.
+type checkpoint map[mq.ConsumerGroup]map[string]int64
+
+func readCheckpoint(path string) (checkpoint, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return checkpoint{}, nil
+		}
+
+		return nil, fmt.Errorf("cannot read checkpoint: %w", err)
+	}
+
+	checkpoint := checkpoint{}
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return nil, fmt.Errorf("cannot parse checkpoint %q: %w", path, err)
+	}
+
+	return checkpoint, nil
+}
+
+func (checkpoint checkpoint) get(group mq.ConsumerGroup, partition mq.PartitionId) (int64, bool) {
+	offset, exists := checkpoint[group][strconv.Itoa(int(partition))]
+	return offset, exists
+}
+
+func (checkpoint checkpoint) set(group mq.ConsumerGroup, partition mq.PartitionId, offset int64) {
+	if _, exists := checkpoint[group]; !exists {
+		checkpoint[group] = map[string]int64{}
+	}
+
+	checkpoint[group][strconv.Itoa(int(partition))] = offset
+}
+
+func (checkpoint checkpoint) write(path string) error {
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return fmt.Errorf("cannot marshal checkpoint: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("cannot create checkpoint directory: %w", err)
+	}
+
+	// write to a temporary file first so that a crash never leaves a truncated checkpoint
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o600); err != nil {
+		return fmt.Errorf("cannot write checkpoint: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("cannot rename checkpoint: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,471 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const segmentSuffix = ".wal"
+
+// A record is encoded as
+//
+//	crc32 (4 bytes) | offset (8 bytes) | key length (4 bytes) | value length (4 bytes) | key | value
+//
+// where the checksum covers everything after itself, and a key length of -1 indicates a nil key.
+const recordHeaderSize = 4 + 8 + 4 + 4
+
+var errCorruptRecord = errors.New("corrupt record")
+
+type record struct {
+	offset int64
+	key    []byte
+	value  []byte
+}
+
+func (record *record) size() int64 {
+	return recordHeaderSize + int64(len(record.key)) + int64(len(record.value))
+}
+
+func (record *record) encode() []byte {
+	buf := make([]byte, record.size())
+
+	binary.BigEndian.PutUint64(buf[4:], uint64(record.offset))
+	keyLength := int32(-1)
+	if record.key != nil {
+		keyLength = int32(len(record.key))
+	}
+	binary.BigEndian.PutUint32(buf[12:], uint32(keyLength))
+	binary.BigEndian.PutUint32(buf[16:], uint32(len(record.value)))
+	copy(buf[recordHeaderSize:], record.key)
+	copy(buf[recordHeaderSize+len(record.key):], record.value)
+
+	binary.BigEndian.PutUint32(buf[0:], crc32.ChecksumIEEE(buf[4:]))
+
+	return buf
+}
+
+// readRecord reads the next record from reader.
+// Returns io.EOF if there are no more bytes, or errCorruptRecord if the record is truncated or corrupted.
+func readRecord(reader io.Reader) (*record, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, errCorruptRecord
+		}
+		return nil, err
+	}
+
+	keyLength := int32(binary.BigEndian.Uint32(header[12:]))
+	valueLength := binary.BigEndian.Uint32(header[16:])
+	if keyLength < -1 || valueLength > 1<<30 {
+		return nil, errCorruptRecord
+	}
+
+	payloadLength := int(valueLength)
+	if keyLength > 0 {
+		payloadLength += int(keyLength)
+	}
+	payload := make([]byte, payloadLength)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, errCorruptRecord
+		}
+		return nil, err
+	}
+
+	hasher := crc32.NewIEEE()
+	_, _ = hasher.Write(header[4:]) // hash.Write is infallible
+	_, _ = hasher.Write(payload)
+	if hasher.Sum32() != binary.BigEndian.Uint32(header[0:]) {
+		return nil, errCorruptRecord
+	}
+
+	record := &record{offset: int64(binary.BigEndian.Uint64(header[4:]))}
+	if keyLength >= 0 {
+		record.key = payload[:keyLength]
+		record.value = payload[keyLength:]
+	} else {
+		record.value = payload
+	}
+
+	return record, nil
+}
+
+// segment is a file containing the records with offsets in [baseOffset, endOffset).
+type segment struct {
+	baseOffset int64
+	endOffset  int64
+	size       int64
+	path       string
+}
+
+// partitionLog is the sequence of segments of a partition.
+// Only the last segment is appended to.
+type partitionLog struct {
+	logger       logrus.FieldLogger
+	dir          string
+	segmentSize  int64
+	maxSize      int64
+	syncOnAppend bool
+
+	lock     sync.Mutex
+	segments []*segment
+	active   *os.File
+	size     int64
+	// notify is closed and replaced whenever new records are appended.
+	notify chan struct{}
+}
+
+// openPartitionLog loads the existing segments in dir.
+// The tail of the last segment is truncated if it was not completely written.
+func openPartitionLog(logger logrus.FieldLogger, dir string, segmentSize int64, maxSize int64, syncOnAppend bool) (*partitionLog, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("cannot create partition directory: %w", err)
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read partition directory: %w", err)
+	}
+
+	log := &partitionLog{
+		logger:       logger,
+		dir:          dir,
+		segmentSize:  segmentSize,
+		maxSize:      maxSize,
+		syncOnAppend: syncOnAppend,
+		notify:       make(chan struct{}),
+	}
+
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), segmentSuffix) {
+			continue
+		}
+
+		baseOffset, err := strconv.ParseInt(strings.TrimSuffix(file.Name(), segmentSuffix), 10, 64)
+		if err != nil {
+			logger.WithField("file", file.Name()).Warn("Ignoring unrecognized file in partition directory")
+			continue
+		}
+
+		log.segments = append(log.segments, &segment{
+			baseOffset: baseOffset,
+			path:       filepath.Join(dir, file.Name()),
+		})
+	}
+
+	sort.Slice(log.segments, func(i, j int) bool { return log.segments[i].baseOffset < log.segments[j].baseOffset })
+
+	for i, segment := range log.segments {
+		if err := log.scanSegment(segment, i == len(log.segments)-1); err != nil {
+			return nil, err
+		}
+		log.size += segment.size
+	}
+
+	if len(log.segments) == 0 {
+		if err := log.roll(0); err != nil {
+			return nil, err
+		}
+	} else {
+		last := log.segments[len(log.segments)-1]
+		active, err := os.OpenFile(last.path, os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open segment %q: %w", last.path, err)
+		}
+		log.active = active
+	}
+
+	return log, nil
+}
+
+// scanSegment computes the end offset and size of a segment.
+func (log *partitionLog) scanSegment(segment *segment, isLast bool) error {
+	file, err := os.Open(segment.path)
+	if err != nil {
+		return fmt.Errorf("cannot open segment %q: %w", segment.path, err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	segment.endOffset = segment.baseOffset
+
+	for {
+		record, err := readRecord(reader)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+
+			if errors.Is(err, errCorruptRecord) && isLast {
+				// the process crashed while appending to the active segment
+				log.logger.WithField("segment", segment.path).WithField("size", segment.size).Warn("Truncating incomplete tail of segment")
+				if err := os.Truncate(segment.path, segment.size); err != nil {
+					return fmt.Errorf("cannot truncate segment %q: %w", segment.path, err)
+				}
+				return nil
+			}
+
+			return fmt.Errorf("cannot read segment %q at byte %d: %w", segment.path, segment.size, err)
+		}
+
+		if record.offset != segment.endOffset {
+			return fmt.Errorf(
+				"segment %q has offset %d at byte %d, expected %d",
+				segment.path,
+				record.offset,
+				segment.size,
+				segment.endOffset,
+			)
+		}
+
+		segment.endOffset += 1
+		segment.size += record.size()
+	}
+}
+
+// roll closes the active segment and starts a new one at baseOffset.
+// Must be called with log.lock held.
+func (log *partitionLog) roll(baseOffset int64) error {
+	if log.active != nil {
+		if err := log.active.Close(); err != nil {
+			return fmt.Errorf("cannot close segment: %w", err)
+		}
+		log.active = nil
+	}
+
+	path := filepath.Join(log.dir, fmt.Sprintf("%020d%s", baseOffset, segmentSuffix))
+	active, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("cannot create segment: %w", err)
+	}
+
+	log.active = active
+	log.segments = append(log.segments, &segment{
+		baseOffset: baseOffset,
+		endOffset:  baseOffset,
+		path:       path,
+	})
+
+	return nil
+}
+
+// append writes a new record with the next offset.
+// Returns the number of unconsumed messages dropped to stay within the disk limit.
+// countUnconsumed is called with each dropped segment and returns the number of unconsumed messages in it.
+func (log *partitionLog) append(key []byte, value []byte, countUnconsumed func(dropped *segment) int64) (dropped int64, err error) {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+
+	last := log.segments[len(log.segments)-1]
+	record := &record{offset: last.endOffset, key: key, value: value}
+	buf := record.encode()
+
+	if last.size > 0 && last.size+int64(len(buf)) > log.segmentSize {
+		if err := log.roll(last.endOffset); err != nil {
+			return 0, err
+		}
+		last = log.segments[len(log.segments)-1]
+	}
+
+	if log.maxSize > 0 {
+		for log.size+int64(len(buf)) > log.maxSize && len(log.segments) > 1 {
+			oldest := log.segments[0]
+			if err := log.removeOldest(); err != nil {
+				return dropped, err
+			}
+			dropped += countUnconsumed(oldest)
+		}
+	}
+
+	if _, err := log.active.Write(buf); err != nil {
+		// truncate the partial write so that subsequent records remain readable
+		if truncateErr := log.active.Truncate(last.size); truncateErr != nil {
+			log.logger.WithError(truncateErr).Error("cannot truncate partially written record")
+		}
+		return dropped, fmt.Errorf("cannot append record: %w", err)
+	}
+
+	if log.syncOnAppend {
+		if err := log.active.Sync(); err != nil {
+			return dropped, fmt.Errorf("cannot sync segment: %w", err)
+		}
+	}
+
+	last.endOffset += 1
+	last.size += int64(len(buf))
+	log.size += int64(len(buf))
+
+	close(log.notify)
+	log.notify = make(chan struct{})
+
+	return dropped, nil
+}
+
+// removeOldest deletes the oldest segment, which must not be the active segment.
+// Must be called with log.lock held.
+func (log *partitionLog) removeOldest() error {
+	oldest := log.segments[0]
+	if err := os.Remove(oldest.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("cannot delete segment %q: %w", oldest.path, err)
+	}
+
+	log.segments = log.segments[1:]
+	log.size -= oldest.size
+
+	return nil
+}
+
+// truncateBefore deletes all inactive segments that only contain offsets before offset.
+func (log *partitionLog) truncateBefore(offset int64) error {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+
+	for len(log.segments) > 1 && log.segments[0].endOffset <= offset {
+		if err := log.removeOldest(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// bounds returns the offset of the oldest record on disk and the offset of the next record to be appended.
+func (log *partitionLog) bounds() (firstOffset int64, nextOffset int64) {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+
+	return log.segments[0].baseOffset, log.segments[len(log.segments)-1].endOffset
+}
+
+func (log *partitionLog) diskUsage() int64 {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+
+	return log.size
+}
+
+func (log *partitionLog) close() error {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+
+	return log.active.Close()
+}
+
+// logReader reads records sequentially from a partitionLog.
+type logReader struct {
+	log *partitionLog
+
+	offset  int64
+	segment *segment
+	file    *os.File
+	reader  *bufio.Reader
+	// position is the number of bytes of segment consumed by reader.
+	position int64
+}
+
+// next returns the next record, or a channel that is closed when more records are available.
+// If the next offset has been dropped due to the disk limit, reading skips to the oldest available record.
+func (reader *logReader) next() (*record, <-chan struct{}, error) {
+	reader.log.lock.Lock()
+
+	var target *segment
+	for _, segment := range reader.log.segments {
+		if reader.offset < segment.endOffset {
+			target = segment
+			break
+		}
+	}
+
+	if target == nil {
+		notify := reader.log.notify
+		reader.log.lock.Unlock()
+		return nil, notify, nil
+	}
+
+	// size is only safe to read with the lock held; records beyond it may be partially written
+	targetSize := target.size
+	reader.log.lock.Unlock()
+
+	if reader.offset < target.baseOffset {
+		reader.offset = target.baseOffset
+	}
+
+	if target != reader.segment {
+		if err := reader.open(target); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for {
+		if reader.position >= targetSize {
+			return nil, nil, fmt.Errorf("offset %d not found in segment %q", reader.offset, target.path)
+		}
+
+		record, err := readRecord(reader.reader)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot read segment %q: %w", target.path, err)
+		}
+		reader.position += record.size()
+
+		if record.offset < reader.offset {
+			// seeking to the offset after opening a segment
+			continue
+		}
+
+		reader.offset = record.offset + 1
+		return record, nil, nil
+	}
+}
+
+func (reader *logReader) open(segment *segment) error {
+	reader.close()
+
+	file, err := os.Open(segment.path)
+	if err != nil {
+		return fmt.Errorf("cannot open segment %q: %w", segment.path, err)
+	}
+
+	reader.segment = segment
+	reader.file = file
+	reader.reader = bufio.NewReader(file)
+	reader.position = 0
+	return nil
+}
+
+func (reader *logReader) close() {
+	if reader.file != nil {
+		_ = reader.file.Close()
+		reader.file = nil
+		reader.segment = nil
+	}
+}
@@ -0,0 +1,453 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package wal implements mq.Queue with a write-ahead log on local disk.
+//
+// Each partition is stored as a sequence of segment files under <dir>/<partition>.
+// The next offset of each consumer group is persisted in <dir>/checkpoint.json,
+// so unconsumed messages are replayed after restart.
+// Segments are deleted after all consumer groups have consumed them,
+// or when the partition exceeds its share of the disk limit, in which case the oldest messages are dropped.
+package wal
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"k8s.io/utils/clock"
+
+	"github.com/kubewharf/kelemetry/pkg/audit/mq"
+	"github.com/kubewharf/kelemetry/pkg/manager"
+	"github.com/kubewharf/kelemetry/pkg/metrics"
+	"github.com/kubewharf/kelemetry/pkg/util/shutdown"
+)
+
+func init() {
+	manager.Global.ProvideMuxImpl("mq/wal", NewWal, mq.Queue.CreateProducer)
+}
+
+type walOptions struct {
+	dir                string
+	partitions         int32
+	partitionByObject  bool
+	segmentSize        int64
+	maxDiskBytes       int64
+	checkpointInterval time.Duration
+	syncOnAppend       bool
+}
+
+func (options *walOptions) Setup(fs *pflag.FlagSet) {
+	fs.StringVar(&options.dir, "mq-wal-dir", "mq-wal", "directory to store message queue segments and consumer checkpoints")
+	fs.Int32Var(
+		&options.partitions,
+		"mq-wal-partitions",
+		5,
+		"number of partitions; consumers may only consume partitions between 0 and this value (exclusive)",
+	)
+	fs.BoolVar(
+		&options.partitionByObject,
+		"mq-wal-partition-by-object",
+		false,
+		"Whether to partition events of the same object to the same worker",
+	)
+	fs.Int64Var(&options.segmentSize, "mq-wal-segment-size", 64<<20, "maximum size of each segment file in bytes")
+	fs.Int64Var(
+		&options.maxDiskBytes,
+		"mq-wal-max-disk-bytes",
+		0,
+		"maximum total size of all segments in bytes, split evenly among partitions; "+
+			"the oldest segments are dropped even if they are not consumed yet (0 for unlimited)",
+	)
+	fs.DurationVar(&options.checkpointInterval, "mq-wal-checkpoint-interval", time.Second, "interval to persist consumer offsets")
+	fs.BoolVar(&options.syncOnAppend, "mq-wal-sync", false, "fsync after every message to survive node crashes (slow)")
+}
+
+func (options *walOptions) EnableFlag() *bool { return nil }
+
+// WalQueue is an mq.Queue persisted to local disk.
+// The directory must not be shared between processes.
+type WalQueue struct {
+	manager.MuxImplBase
+
+	options   walOptions
+	logger    logrus.FieldLogger
+	clock     clock.Clock
+	metrics   metrics.Client
+	deferList *shutdown.DeferList
+
+	droppedMetric metrics.Metric
+
+	producer   *walProducer
+	consumers  map[mq.ConsumerGroup]map[mq.PartitionId]*walConsumer
+	partitions []*partitionLog
+	wg         sync.WaitGroup
+}
+
+type lagMetric struct {
+	ConsumerGroup mq.ConsumerGroup
+	Partition     mq.PartitionId
+}
+
+type partitionMetric struct {
+	Partition mq.PartitionId
+}
+
+func NewWal(
+	logger logrus.FieldLogger,
+	clock clock.Clock,
+	metrics metrics.Client,
+) *WalQueue {
+	return &WalQueue{
+		logger:    logger,
+		clock:     clock,
+		metrics:   metrics,
+		deferList: shutdown.NewDeferList(),
+		consumers: map[mq.ConsumerGroup]map[mq.PartitionId]*walConsumer{},
+	}
+}
+
+func (_ *WalQueue) MuxImplName() (name string, isDefault bool) { return "wal", false }
+
+func (q *WalQueue) Options() manager.Options { return &q.options }
+
+func (q *WalQueue) Init(ctx context.Context) error {
+	if q.options.segmentSize <= 0 {
+		return fmt.Errorf("--mq-wal-segment-size must be positive")
+	}
+
+	if q.options.partitions <= 0 {
+		return fmt.Errorf("--mq-wal-partitions must be positive")
+	}
+
+	q.droppedMetric = q.metrics.New("audit_mq_wal_dropped", &partitionMetric{})
+
+	return nil
+}
+
+func (q *WalQueue) Start(stopCh <-chan struct{}) error {
+	numPartitions := int(q.options.partitions)
+
+	var maxPartitionSize int64
+	if q.options.maxDiskBytes > 0 {
+		maxPartitionSize = q.options.maxDiskBytes / int64(numPartitions)
+		if maxPartitionSize < q.options.segmentSize*2 {
+			return fmt.Errorf(
+				"--mq-wal-max-disk-bytes must allow at least two segments per partition (%d bytes)",
+				q.options.segmentSize*2*int64(numPartitions),
+			)
+		}
+	}
+
+	checkpoint, err := readCheckpoint(q.checkpointPath())
+	if err != nil {
+		return err
+	}
+
+	q.partitions = make([]*partitionLog, numPartitions)
+	for partition := range q.partitions {
+		partitionId := mq.PartitionId(partition)
+		log, err := openPartitionLog(
+			q.logger.WithField("partition", partition),
+			filepath.Join(q.options.dir, strconv.Itoa(partition)),
+			q.options.segmentSize,
+			maxPartitionSize,
+			q.options.syncOnAppend,
+		)
+		if err != nil {
+			return fmt.Errorf("cannot open partition %d: %w", partition, err)
+		}
+		q.partitions[partition] = log
+		q.deferList.Defer(fmt.Sprintf("closing partition %d", partition), log.close)
+
+		q.metrics.NewMonitor("audit_mq_wal_disk_usage", &partitionMetric{Partition: partitionId}, log.diskUsage)
+
+		firstOffset, nextOffset := log.bounds()
+		for group, consumers := range q.consumers {
+			consumer, exists := consumers[partitionId]
+			if !exists {
+				continue
+			}
+
+			offset, hasCheckpoint := checkpoint.get(group, partitionId)
+			if !hasCheckpoint || offset < firstOffset {
+				offset = firstOffset
+			}
+			if offset > nextOffset {
+				consumer.logger.WithField("checkpoint", offset).WithField("nextOffset", nextOffset).
+					Warn("Checkpoint is ahead of the log, resetting to the end of the log")
+				offset = nextOffset
+			}
+
+			consumer.log.Store(log)
+			atomic.StoreInt64(&consumer.committed, offset)
+
+			if offset < nextOffset {
+				consumer.logger.WithField("count", nextOffset-offset).Info("Replaying unconsumed messages")
+			}
+		}
+	}
+
+	// wait for consumers to stop so that the final checkpoint includes all acknowledged messages
+	q.deferList.Defer("writing final checkpoint", func() error {
+		q.wg.Wait()
+		return q.checkpoint()
+	})
+
+	for _, consumers := range q.consumers {
+		for _, consumer := range consumers {
+			consumer.start(stopCh, &q.wg)
+		}
+	}
+
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+		defer shutdown.RecoverPanic(q.logger)
+
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-q.clock.After(q.options.checkpointInterval):
+				if err := q.checkpoint(); err != nil {
+					q.logger.WithError(err).Error("cannot write checkpoint")
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (q *WalQueue) Close() error {
+	if name, err := q.deferList.Run(q.logger); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	return nil
+}
+
+func (q *WalQueue) checkpointPath() string {
+	return filepath.Join(q.options.dir, "checkpoint.json")
+}
+
+// checkpoint persists the committed offsets of all consumers,
+// then deletes segments that have been consumed by all consumer groups.
+func (q *WalQueue) checkpoint() error {
+	checkpoint := checkpoint{}
+	for group, consumers := range q.consumers {
+		for partition, consumer := range consumers {
+			checkpoint.set(group, partition, atomic.LoadInt64(&consumer.committed))
+		}
+	}
+
+	if err := checkpoint.write(q.checkpointPath()); err != nil {
+		return err
+	}
+
+	for partition, log := range q.partitions {
+		minCommitted, hasConsumer := q.minCommitted(mq.PartitionId(partition))
+		if !hasConsumer {
+			// retain the messages for consumers in future runs
+			continue
+		}
+
+		if err := log.truncateBefore(minCommitted); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// minCommitted returns the offset before which all messages in the partition
+// have been consumed by all consumer groups consuming the partition.
+// hasConsumer is false if no consumer group consumes the partition in this process.
+func (q *WalQueue) minCommitted(partition mq.PartitionId) (minOffset int64, hasConsumer bool) {
+	for _, consumers := range q.consumers {
+		consumer, exists := consumers[partition]
+		if !exists {
+			continue
+		}
+
+		committed := atomic.LoadInt64(&consumer.committed)
+		if !hasConsumer || committed < minOffset {
+			minOffset = committed
+		}
+		hasConsumer = true
+	}
+	return minOffset, hasConsumer
+}
+
+func (q *WalQueue) CreateProducer() (mq.Producer, error) {
+	if q.producer == nil {
+		q.producer = &walProducer{queue: q}
+	}
+
+	return q.producer, nil
+}
+
+type walProducer struct {
+	queue *WalQueue
+}
+
+func (producer *walProducer) Send(partitionKey []byte, value []byte) error {
+	numPartitions := int32(len(producer.queue.partitions))
+	if numPartitions == 0 {
+		return fmt.Errorf("wal queue is not started")
+	}
+
+	var partition int32
+	if producer.queue.options.partitionByObject && partitionKey != nil {
+		keyHasher := fnv.New32()
+		_, _ = keyHasher.Write(partitionKey) // fnv.Write is infallible
+		hash := keyHasher.Sum32()
+		partition = int32(hash % uint32(numPartitions))
+	} else {
+		partition = rand.Int31n(numPartitions)
+	}
+
+	partitionId := mq.PartitionId(partition)
+
+	dropped, err := producer.queue.partitions[partition].append(partitionKey, value, func(dropped *segment) int64 {
+		// count the messages in the dropped segment not yet consumed by the slowest consumer group
+		firstUnconsumed, _ := producer.queue.minCommitted(partitionId)
+		if firstUnconsumed < dropped.baseOffset {
+			firstUnconsumed = dropped.baseOffset
+		}
+		if firstUnconsumed > dropped.endOffset {
+			return 0
+		}
+		return dropped.endOffset - firstUnconsumed
+	})
+	if dropped > 0 {
+		producer.queue.logger.WithField("partition", partition).WithField("count", dropped).
+			Warn("Dropped unconsumed messages due to disk limit")
+		producer.queue.droppedMetric.With(&partitionMetric{Partition: partitionId}).Count(dropped)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot append to partition %d: %w", partition, err)
+	}
+
+	return nil
+}
+
+func (q *WalQueue) CreateConsumer(group mq.ConsumerGroup, partition mq.PartitionId, handler mq.MessageHandler) (mq.Consumer, error) {
+	if partition < 0 || int32(partition) >= q.options.partitions {
+		return nil, fmt.Errorf("partition %d is out of range, --mq-wal-partitions is %d", partition, q.options.partitions)
+	}
+
+	if _, exists := q.consumers[group]; !exists {
+		q.consumers[group] = map[mq.PartitionId]*walConsumer{}
+	}
+
+	if _, exists := q.consumers[group][partition]; exists {
+		return nil, fmt.Errorf("consumer for %q/%d requested multiple times", group, partition)
+	}
+
+	consumer := &walConsumer{
+		clock:   q.clock,
+		logger:  q.logger.WithField("submod", "consumer").WithField("group", string(group)).WithField("partition", int32(partition)),
+		handler: handler,
+	}
+	q.metrics.NewMonitor("audit_mq_wal_lag", &lagMetric{
+		ConsumerGroup: group,
+		Partition:     partition,
+	}, consumer.lag)
+	q.consumers[group][partition] = consumer
+	return consumer, nil
+}
+
+type walConsumer struct {
+	clock   clock.Clock
+	logger  logrus.FieldLogger
+	handler mq.MessageHandler
+	log     atomic.Pointer[partitionLog]
+
+	// committed is the offset of the first message not acknowledged yet, accessed atomically.
+	committed int64
+}
+
+func (consumer *walConsumer) start(stopCh <-chan struct{}, wg *sync.WaitGroup) {
+	reader := &logReader{log: consumer.log.Load(), offset: atomic.LoadInt64(&consumer.committed)}
+
+	// only commit the offset after the message and all previous messages have been handled
+	tracker := mq.NewAckTracker(func(nextOffset int64) {
+		atomic.StoreInt64(&consumer.committed, nextOffset)
+	})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer shutdown.RecoverPanic(consumer.logger)
+		defer reader.close()
+
+		for {
+			select {
+			case <-stopCh:
+				return
+			default:
+			}
+
+			record, notify, err := reader.next()
+			if err != nil {
+				consumer.logger.WithError(err).Error("cannot read message, retrying in 1 second")
+				reader.close()
+				select {
+				case <-stopCh:
+					return
+				case <-consumer.clock.After(time.Second):
+				}
+				continue
+			}
+
+			if record == nil {
+				select {
+				case <-stopCh:
+					return
+				case <-notify:
+				}
+				continue
+			}
+
+			ack := tracker.Track(record.offset)
+			consumer.handler(consumer.logger.WithField("offset", record.offset), record.key, record.value, ack)
+		}
+	}()
+}
+
+// lag returns the number of messages in the partition that have not been acknowledged yet.
+func (consumer *walConsumer) lag() int64 {
+	log := consumer.log.Load()
+	if log == nil {
+		return 0
+	}
+
+	_, nextOffset := log.bounds()
+	lag := nextOffset - atomic.LoadInt64(&consumer.committed)
+	if lag < 0 {
+		return 0
+	}
+
+	return lag
+}
@@ -0,0 +1,405 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal_test
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"github.com/kubewharf/kelemetry/pkg/audit/mq"
+	"github.com/kubewharf/kelemetry/pkg/audit/mq/wal"
+	"github.com/kubewharf/kelemetry/pkg/metrics"
+)
+
+// 40-byte values produce 60-byte records, so a 64-byte segment only fits one record.
+const smallSegmentArgs = "--mq-wal-segment-size=64"
+
+func value(name string) []byte {
+	return []byte(name + strings.Repeat(".", 40-len(name)))
+}
+
+func newQueue(t *testing.T, clock *clocktesting.FakeClock, dir string, args ...string) *wal.WalQueue {
+	t.Helper()
+
+	metricsClient, _ := metrics.NewMock(clock)
+	queue := wal.NewWal(logrus.New(), clock, metricsClient)
+
+	fs := pflag.NewFlagSet("test", pflag.PanicOnError)
+	queue.Options().Setup(fs)
+	if err := fs.Parse(append([]string{"--mq-wal-dir=" + dir, "--mq-wal-partitions=1"}, args...)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := queue.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	return queue
+}
+
+// recorder is a message handler that blocks on the messages listed in blockOn until release is closed.
+type recorder struct {
+	received chan string
+	blockOn  map[string]bool
+	release  chan struct{}
+}
+
+func newRecorder(blockOn ...string) *recorder {
+	recorder := &recorder{
+		received: make(chan string, 100),
+		blockOn:  map[string]bool{},
+		release:  make(chan struct{}),
+	}
+	for _, name := range blockOn {
+		recorder.blockOn[name] = true
+	}
+	return recorder
+}
+
+func (recorder *recorder) handle(fieldLogger logrus.FieldLogger, key []byte, value []byte, ack func()) {
+	name := strings.TrimRight(string(value), ".")
+	recorder.received <- name
+	if recorder.blockOn[name] {
+		<-recorder.release
+	}
+	ack()
+}
+
+func (recorder *recorder) expect(t *testing.T, names ...string) {
+	t.Helper()
+
+	for _, name := range names {
+		select {
+		case received := <-recorder.received:
+			assert.Equal(t, name, received)
+		case <-time.After(time.Second * 5):
+			t.Fatalf("timeout waiting for message %q", name)
+		}
+	}
+}
+
+func send(t *testing.T, queue *wal.WalQueue, names ...string) {
+	t.Helper()
+
+	producer, err := queue.CreateProducer()
+	assert.Nil(t, err)
+	for _, name := range names {
+		assert.Nil(t, producer.Send(nil, value(name)))
+	}
+}
+
+func countSegments(t *testing.T, dir string) int {
+	t.Helper()
+
+	files, err := os.ReadDir(filepath.Join(dir, "0"))
+	assert.Nil(t, err)
+	return len(files)
+}
+
+func TestReplayAfterRestart(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := clocktesting.NewFakeClock(time.Unix(1600000000, 0))
+	dir := t.TempDir()
+
+	queue := newQueue(t, clock, dir)
+	recorder := newRecorder("b")
+	_, err := queue.CreateConsumer("group", 0, recorder.handle)
+	assert.Nil(err)
+
+	stopCh := make(chan struct{})
+	assert.Nil(queue.Start(stopCh))
+
+	send(t, queue, "a", "b", "c")
+	recorder.expect(t, "a", "b")
+
+	// "b" is committed after it is acknowledged, but "c" is not handled before stopping
+	close(stopCh)
+	close(recorder.release)
+	assert.Nil(queue.Close())
+
+	queue = newQueue(t, clock, dir)
+	recorder = newRecorder()
+	_, err = queue.CreateConsumer("group", 0, recorder.handle)
+	assert.Nil(err)
+
+	stopCh = make(chan struct{})
+	assert.Nil(queue.Start(stopCh))
+	defer func() {
+		close(stopCh)
+		assert.Nil(queue.Close())
+	}()
+
+	send(t, queue, "d")
+	recorder.expect(t, "c", "d")
+}
+
+func TestReplayUnacknowledged(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := clocktesting.NewFakeClock(time.Unix(1600000000, 0))
+	dir := t.TempDir()
+
+	queue := newQueue(t, clock, dir)
+	received := make(chan string, 10)
+	_, err := queue.CreateConsumer("group", 0, func(fieldLogger logrus.FieldLogger, key []byte, value []byte, ack func()) {
+		name := strings.TrimRight(string(value), ".")
+		received <- name
+		// "b" is never acknowledged, so neither "b" nor the acknowledged "c" can be committed
+		if name != "b" {
+			ack()
+		}
+	})
+	assert.Nil(err)
+
+	stopCh := make(chan struct{})
+	assert.Nil(queue.Start(stopCh))
+
+	send(t, queue, "a", "b", "c")
+	for _, expected := range []string{"a", "b", "c"} {
+		select {
+		case name := <-received:
+			assert.Equal(expected, name)
+		case <-time.After(time.Second * 5):
+			t.Fatalf("timeout waiting for message %q", expected)
+		}
+	}
+
+	close(stopCh)
+	assert.Nil(queue.Close())
+
+	queue = newQueue(t, clock, dir)
+	recorder := newRecorder()
+	_, err = queue.CreateConsumer("group", 0, recorder.handle)
+	assert.Nil(err)
+
+	stopCh = make(chan struct{})
+	assert.Nil(queue.Start(stopCh))
+	defer func() {
+		close(stopCh)
+		assert.Nil(queue.Close())
+	}()
+
+	recorder.expect(t, "b", "c")
+}
+
+func TestRecoverIncompleteRecord(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := clocktesting.NewFakeClock(time.Unix(1600000000, 0))
+	dir := t.TempDir()
+
+	queue := newQueue(t, clock, dir)
+	recorder := newRecorder("a")
+	_, err := queue.CreateConsumer("group", 0, recorder.handle)
+	assert.Nil(err)
+
+	stopCh := make(chan struct{})
+	assert.Nil(queue.Start(stopCh))
+	send(t, queue, "a", "b")
+	recorder.expect(t, "a")
+	close(stopCh)
+	close(recorder.release)
+	assert.Nil(queue.Close())
+
+	// simulate a crash in the middle of appending a record
+	segmentPath := filepath.Join(dir, "0", "00000000000000000000.wal")
+	file, err := os.OpenFile(segmentPath, os.O_WRONLY|os.O_APPEND, 0)
+	assert.Nil(err)
+	_, err = file.Write([]byte{1, 2, 3, 4, 5})
+	assert.Nil(err)
+	assert.Nil(file.Close())
+
+	queue = newQueue(t, clock, dir)
+	recorder = newRecorder()
+	_, err = queue.CreateConsumer("group", 0, recorder.handle)
+	assert.Nil(err)
+
+	stopCh = make(chan struct{})
+	assert.Nil(queue.Start(stopCh))
+	defer func() {
+		close(stopCh)
+		assert.Nil(queue.Close())
+	}()
+
+	send(t, queue, "c")
+	recorder.expect(t, "b", "c")
+}
+
+func TestDeleteConsumedSegments(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := clocktesting.NewFakeClock(time.Unix(1600000000, 0))
+	dir := t.TempDir()
+
+	queue := newQueue(t, clock, dir, smallSegmentArgs)
+	fast := newRecorder()
+	_, err := queue.CreateConsumer("fast", 0, fast.handle)
+	assert.Nil(err)
+	slow := newRecorder("a")
+	_, err = queue.CreateConsumer("slow", 0, slow.handle)
+	assert.Nil(err)
+
+	stopCh := make(chan struct{})
+	assert.Nil(queue.Start(stopCh))
+	defer func() {
+		close(stopCh)
+		assert.Nil(queue.Close())
+	}()
+
+	send(t, queue, "a", "b", "c")
+	fast.expect(t, "a", "b", "c")
+	slow.expect(t, "a")
+
+	// segments are retained until all consumer groups have consumed them
+	assert.Eventually(clock.HasWaiters, time.Second, time.Millisecond)
+	clock.Step(time.Second)
+	assert.Eventually(clock.HasWaiters, time.Second, time.Millisecond)
+	assert.Equal(3, countSegments(t, dir))
+
+	close(slow.release)
+	slow.expect(t, "b", "c")
+
+	// the active segment is never deleted
+	assert.Eventually(func() bool {
+		clock.Step(time.Second)
+		return countSegments(t, dir) == 1
+	}, time.Second*5, time.Millisecond*10)
+}
+
+func TestDiskLimitDropsOldest(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := clocktesting.NewFakeClock(time.Unix(1600000000, 0))
+	dir := t.TempDir()
+
+	queue := newQueue(t, clock, dir, smallSegmentArgs, "--mq-wal-max-disk-bytes=128")
+	recorder := newRecorder("a")
+	_, err := queue.CreateConsumer("group", 0, recorder.handle)
+	assert.Nil(err)
+
+	stopCh := make(chan struct{})
+	assert.Nil(queue.Start(stopCh))
+	defer func() {
+		close(stopCh)
+		assert.Nil(queue.Close())
+	}()
+
+	send(t, queue, "a")
+	recorder.expect(t, "a")
+
+	send(t, queue, "b", "c", "d", "e")
+	assert.Equal(2, countSegments(t, dir))
+
+	// "b" and "c" were dropped before they were consumed
+	close(recorder.release)
+	recorder.expect(t, "d", "e")
+}
+
+func TestPartitionOutOfRange(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := clocktesting.NewFakeClock(time.Unix(1600000000, 0))
+	queue := newQueue(t, clock, t.TempDir(), "--mq-wal-partitions=2")
+
+	handler := func(logrus.FieldLogger, []byte, []byte, func()) {}
+	_, err := queue.CreateConsumer("group", 2, handler)
+	assert.NotNil(err)
+	_, err = queue.CreateConsumer("group", -1, handler)
+	assert.NotNil(err)
+}
+
+func TestNonContiguousPartitions(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := clocktesting.NewFakeClock(time.Unix(1600000000, 0))
+	queue := newQueue(t, clock, t.TempDir(), "--mq-wal-partitions=5", "--mq-wal-partition-by-object")
+
+	recorders := map[mq.PartitionId]*recorder{}
+	for _, partition := range []mq.PartitionId{3, 4} {
+		recorders[partition] = newRecorder()
+		_, err := queue.CreateConsumer("group", partition, recorders[partition].handle)
+		assert.Nil(err)
+	}
+
+	stopCh := make(chan struct{})
+	assert.Nil(queue.Start(stopCh))
+	defer func() {
+		close(stopCh)
+		assert.Nil(queue.Close())
+	}()
+
+	producer, err := queue.CreateProducer()
+	assert.Nil(err)
+	for _, partition := range []mq.PartitionId{3, 4} {
+		name := fmt.Sprintf("p%d", partition)
+		assert.Nil(producer.Send(keyForPartition(partition, 5), value(name)))
+		recorders[partition].expect(t, name)
+	}
+}
+
+// keyForPartition finds a partition key that the producer assigns to the partition.
+func keyForPartition(partition mq.PartitionId, numPartitions uint32) []byte {
+	for i := 0; ; i++ {
+		key := []byte(fmt.Sprint(i))
+		hasher := fnv.New32()
+		_, _ = hasher.Write(key)
+		if hasher.Sum32()%numPartitions == uint32(partition) {
+			return key
+		}
+	}
+}
+
+func TestProduceWithoutConsumers(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := clocktesting.NewFakeClock(time.Unix(1600000000, 0))
+	dir := t.TempDir()
+
+	queue := newQueue(t, clock, dir)
+	stopCh := make(chan struct{})
+	assert.Nil(queue.Start(stopCh))
+
+	send(t, queue, "a", "b")
+
+	// messages are retained for consumers in future runs
+	close(stopCh)
+	assert.Nil(queue.Close())
+
+	queue = newQueue(t, clock, dir)
+	recorder := newRecorder()
+	_, err := queue.CreateConsumer("group", 0, recorder.handle)
+	assert.Nil(err)
+
+	stopCh = make(chan struct{})
+	assert.Nil(queue.Start(stopCh))
+	defer func() {
+		close(stopCh)
+		assert.Nil(queue.Close())
+	}()
+
+	recorder.expect(t, "a", "b")
+}
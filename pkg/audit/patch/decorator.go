@@ -0,0 +1,220 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package patch decorates patch audit events with the changes intended by the request body.
+package patch
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"k8s.io/utils/clock"
+
+	"github.com/kubewharf/kelemetry/pkg/aggregator"
+	"github.com/kubewharf/kelemetry/pkg/audit"
+	"github.com/kubewharf/kelemetry/pkg/manager"
+	"github.com/kubewharf/kelemetry/pkg/metrics"
+	"github.com/kubewharf/kelemetry/pkg/util/zconstants"
+)
+
+func init() {
+	manager.Global.Provide("audit-patch-decorator", NewDecorator)
+}
+
+type options struct {
+	enable         bool
+	redact         string
+	maxChanges     int
+	maxValueLength int
+}
+
+func (options *options) Setup(fs *pflag.FlagSet) {
+	fs.BoolVar(&options.enable, "audit-patch-decorator-enable", false, "enable decoding request bodies of patch audit events")
+	fs.StringVar(
+		&options.redact,
+		"audit-patch-decorator-redact-pattern",
+		"^/v1/secrets/",
+		"patch bodies are not displayed for objects matching this regexp pattern in the form g/v/r/ns/name",
+	)
+	fs.IntVar(&options.maxChanges, "audit-patch-decorator-max-changes", 100, "maximum number of changes displayed for each patch")
+	fs.IntVar(
+		&options.maxValueLength,
+		"audit-patch-decorator-max-value-length",
+		256,
+		"values longer than this number of bytes are truncated",
+	)
+}
+
+func (options *options) EnableFlag() *bool { return &options.enable }
+
+type decorator struct {
+	options options
+	logger  logrus.FieldLogger
+	clock   clock.Clock
+	list    audit.DecoratorList
+	metrics metrics.Client
+
+	redactRegex *regexp.Regexp
+	patchMetric metrics.Metric
+}
+
+var _ = func() manager.Component { return &decorator{} }
+
+type patchMetric struct {
+	Cluster   string
+	PatchType Type
+	Error     metrics.LabeledError
+}
+
+func NewDecorator(
+	logger logrus.FieldLogger,
+	clock clock.Clock,
+	list audit.DecoratorList,
+	metrics metrics.Client,
+) *decorator {
+	return &decorator{
+		logger:  logger,
+		clock:   clock,
+		list:    list,
+		metrics: metrics,
+	}
+}
+
+func (decorator *decorator) Options() manager.Options {
+	return &decorator.options
+}
+
+func (decorator *decorator) Init(ctx context.Context) (err error) {
+	decorator.redactRegex, err = regexp.Compile(decorator.options.redact)
+	if err != nil {
+		return fmt.Errorf("cannot compile --audit-patch-decorator-redact-pattern value: %w", err)
+	}
+
+	if decorator.options.maxChanges < 1 {
+		return fmt.Errorf("--audit-patch-decorator-max-changes must be positive")
+	}
+
+	decorator.list.AddDecorator("patch", audit.DecoratorPriorityContent, decorator)
+	decorator.patchMetric = decorator.metrics.New("audit_patch_decorator", &patchMetric{})
+	return nil
+}
+
+func (decorator *decorator) Start(stopCh <-chan struct{}) error { return nil }
+
+func (decorator *decorator) Close() error { return nil }
+
+func (decorator *decorator) Decorate(ctx context.Context, message *audit.Message, event *aggregator.Event) {
+	if message.Verb != audit.VerbPatch || message.ObjectRef == nil {
+		return
+	}
+
+	metric := &patchMetric{Cluster: message.Cluster}
+	defer decorator.patchMetric.DeferCount(decorator.clock.Now(), metric)
+
+	if err := decorator.tryDecorate(message, event, metric); err != nil {
+		decorator.logger.WithField("auditId", message.AuditID).WithError(err).Debug("Cannot decode patch")
+		event.Log(zconstants.LogTypeKelemetryError, err.Error())
+		metric.Error = err
+	}
+}
+
+func (decorator *decorator) tryDecorate(message *audit.Message, event *aggregator.Event, metric *patchMetric) metrics.LabeledError {
+	query := url.Values{}
+	if parsed, err := url.ParseRequestURI(message.RequestURI); err == nil {
+		query = parsed.Query()
+	}
+
+	fieldManager := query.Get("fieldManager")
+	if fieldManager != "" {
+		event.WithTag("fieldManager", fieldManager)
+	}
+
+	if message.RequestObject == nil || len(message.RequestObject.Raw) == 0 {
+		// the audit level of this event does not include the request body
+		return nil
+	}
+
+	patchType, err := InferType(message.RequestObject.Raw, message.RequestObject.ContentType, fieldManager != "")
+	if err != nil {
+		return metrics.LabelError(err, "InferType")
+	}
+	metric.PatchType = patchType
+	event.WithTag("patchType", string(patchType))
+
+	if patchType == TypeApply {
+		event.WithTag("force", query.Get("force") == "true")
+	}
+
+	attrs := []string{"patchType", string(patchType)}
+	if fieldManager != "" {
+		attrs = append(attrs, "fieldManager", fieldManager)
+	}
+
+	if decorator.isRedacted(message) {
+		// redaction is intended behavior, so it is not logged as an error
+		event.Log(zconstants.LogTypeObjectPatch, "Sensitive patch content has been redacted", attrs...)
+		return nil
+	}
+
+	changes, err := Parse(message.RequestObject.Raw, patchType)
+	if err != nil {
+		return metrics.LabelError(err, "Parse")
+	}
+
+	lines := make([]string, 0, len(changes))
+	for i, change := range changes {
+		if i == decorator.options.maxChanges {
+			lines = append(lines, fmt.Sprintf("... %d more changes", len(changes)-i))
+			break
+		}
+
+		change.Value = decorator.truncate(change.Value)
+		lines = append(lines, change.String())
+	}
+
+	event.Log(zconstants.LogTypeObjectPatch, strings.Join(lines, "\n"), attrs...)
+
+	return nil
+}
+
+func (decorator *decorator) isRedacted(message *audit.Message) bool {
+	gvrnn := fmt.Sprintf(
+		"%s/%s/%s/%s/%s",
+		message.ObjectRef.APIGroup,
+		message.ObjectRef.APIVersion,
+		message.ObjectRef.Resource,
+		message.ObjectRef.Namespace,
+		message.ObjectRef.Name,
+	)
+	return decorator.redactRegex.MatchString(gvrnn)
+}
+
+func (decorator *decorator) truncate(value string) string {
+	if decorator.options.maxValueLength <= 0 || len(value) <= decorator.options.maxValueLength {
+		return value
+	}
+
+	// do not split a multi-byte character
+	cut := decorator.options.maxValueLength
+	for cut > 0 && !utf8.RuneStart(value[cut]) {
+		cut--
+	}
+	return value[:cut] + "..."
+}
@@ -0,0 +1,269 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package patch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Type is the type of a patch request.
+type Type string
+
+const (
+	TypeJson      Type = "json"
+	TypeMerge     Type = "merge"
+	TypeStrategic Type = "strategic"
+	TypeApply     Type = "apply"
+)
+
+var contentTypes = map[types.PatchType]Type{
+	types.JSONPatchType:           TypeJson,
+	types.MergePatchType:          TypeMerge,
+	types.StrategicMergePatchType: TypeStrategic,
+	types.ApplyPatchType:          TypeApply,
+}
+
+// Strategic merge patch directives, see
+// https://github.com/kubernetes/community/blob/master/contributors/devel/sig-api-machinery/strategic-merge-patch.md
+const (
+	directivePatch                     = "$patch"
+	directiveRetainKeys                = "$retainKeys"
+	directiveSetElementOrderPrefix     = "$setElementOrder/"
+	directiveDeleteFromPrimitivePrefix = "$deleteFromPrimitiveList/"
+)
+
+// Change is a single change intended by a patch.
+type Change struct {
+	// Op is the operation, which is the JSON patch operation for JSON patches,
+	// "set" or "delete" for merge patches (or the $patch directive for strategic merge patches),
+	// and "apply" for fields claimed by server-side apply.
+	Op string
+	// Path is the dot-separated path of the changed field.
+	Path string
+	// Value is the JSON-encoded value of the change, if any.
+	Value string
+	// From is the source path of JSON patch move and copy operations.
+	From string
+}
+
+func (change Change) String() string {
+	switch {
+	case change.From != "":
+		return fmt.Sprintf("%s %s -> %s", change.Op, change.From, change.Path)
+	case change.Op == "test":
+		return fmt.Sprintf("%s %s == %s", change.Op, change.Path, change.Value)
+	case change.Value != "":
+		return fmt.Sprintf("%s %s = %s", change.Op, change.Path, change.Value)
+	default:
+		return fmt.Sprintf("%s %s", change.Op, change.Path)
+	}
+}
+
+// InferType determines the type of a patch.
+//
+// Audit events record patch bodies with a generic JSON content type,
+// so unless contentType is a patch type, the type is inferred from the body:
+// arrays are JSON patches, objects containing strategic merge directives are strategic merge patches,
+// and objects with apiVersion and kind are apply patches if a field manager is specified.
+// Strategic merge patches without directives are indistinguishable from merge patches and reported as the latter.
+func InferType(body []byte, contentType string, hasFieldManager bool) (Type, error) {
+	if ty, exists := contentTypes[types.PatchType(contentType)]; exists {
+		return ty, nil
+	}
+
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		return TypeJson, nil
+	}
+
+	object := map[string]any{}
+	if err := json.Unmarshal(trimmed, &object); err != nil {
+		return "", fmt.Errorf("patch is neither an array nor an object: %w", err)
+	}
+
+	if hasFieldManager && object["apiVersion"] != nil && object["kind"] != nil {
+		return TypeApply, nil
+	}
+
+	if hasDirective(object) {
+		return TypeStrategic, nil
+	}
+
+	return TypeMerge, nil
+}
+
+func hasDirective(value any) bool {
+	switch value := value.(type) {
+	case map[string]any:
+		for key, child := range value {
+			if strings.HasPrefix(key, "$") || hasDirective(child) {
+				return true
+			}
+		}
+	case []any:
+		for _, child := range value {
+			if hasDirective(child) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Parse returns the changes intended by a patch in a deterministic order.
+func Parse(body []byte, ty Type) ([]Change, error) {
+	switch ty {
+	case TypeJson:
+		return parseJsonPatch(body)
+	case TypeMerge, TypeStrategic, TypeApply:
+		object := map[string]any{}
+		if err := json.Unmarshal(body, &object); err != nil {
+			return nil, fmt.Errorf("cannot decode %s patch: %w", ty, err)
+		}
+
+		if ty == TypeApply {
+			// identity of the applied object is not a claimed field
+			delete(object, "apiVersion")
+			delete(object, "kind")
+			if metadata, ok := object["metadata"].(map[string]any); ok {
+				delete(metadata, "name")
+				delete(metadata, "namespace")
+				if len(metadata) == 0 {
+					delete(object, "metadata")
+				}
+			}
+		}
+
+		changes := []Change{}
+		walkObject(ty, "", object, &changes)
+		return changes, nil
+	default:
+		return nil, fmt.Errorf("unknown patch type %q", ty)
+	}
+}
+
+type jsonPatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+func parseJsonPatch(body []byte) ([]Change, error) {
+	ops := []jsonPatchOp{}
+	if err := json.Unmarshal(body, &ops); err != nil {
+		return nil, fmt.Errorf("cannot decode json patch: %w", err)
+	}
+
+	changes := make([]Change, 0, len(ops))
+	for _, op := range ops {
+		change := Change{Op: op.Op, Path: pointerToPath(op.Path)}
+		if op.From != "" {
+			change.From = pointerToPath(op.From)
+		}
+		if len(op.Value) > 0 {
+			compacted := &bytes.Buffer{}
+			if err := json.Compact(compacted, op.Value); err != nil {
+				return nil, fmt.Errorf("invalid value in json patch: %w", err)
+			}
+			change.Value = compacted.String()
+		}
+		changes = append(changes, change)
+	}
+
+	return changes, nil
+}
+
+// pointerToPath converts a JSON pointer to the dot-separated path format used in object diffs.
+func pointerToPath(pointer string) string {
+	segments := strings.Split(strings.TrimPrefix(pointer, "/"), "/")
+	for i, segment := range segments {
+		segments[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(segment)
+	}
+	return strings.Join(segments, ".")
+}
+
+func joinPath(parent string, key string) string {
+	if parent == "" {
+		return key
+	}
+	return parent + "." + key
+}
+
+func walkObject(ty Type, path string, object map[string]any, changes *[]Change) {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := object[key]
+
+		if ty == TypeStrategic {
+			switch {
+			case key == directivePatch:
+				*changes = append(*changes, Change{Op: fmt.Sprint(value), Path: path})
+				continue
+			case key == directiveRetainKeys, strings.HasPrefix(key, directiveSetElementOrderPrefix):
+				// ordering and retention hints do not change any values
+				continue
+			case strings.HasPrefix(key, directiveDeleteFromPrimitivePrefix):
+				*changes = append(*changes, Change{
+					Op:    "remove",
+					Path:  joinPath(path, strings.TrimPrefix(key, directiveDeleteFromPrimitivePrefix)),
+					Value: encodeValue(value),
+				})
+				continue
+			}
+		}
+
+		walkValue(ty, joinPath(path, key), value, changes)
+	}
+}
+
+func walkValue(ty Type, path string, value any, changes *[]Change) {
+	if object, isObject := value.(map[string]any); isObject && len(object) > 0 {
+		walkObject(ty, path, object, changes)
+		return
+	}
+
+	if value == nil && ty != TypeApply {
+		*changes = append(*changes, Change{Op: "delete", Path: path})
+		return
+	}
+
+	// lists are displayed as a whole since merge keys are not known without the schema
+	op := "set"
+	if ty == TypeApply {
+		op = "apply"
+	}
+	*changes = append(*changes, Change{Op: op, Path: path, Value: encodeValue(value)})
+}
+
+func encodeValue(value any) string {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(encoded)
+}
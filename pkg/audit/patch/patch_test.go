@@ -0,0 +1,219 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package patch_test
+
+import (
+	"context"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/runtime"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"github.com/kubewharf/kelemetry/pkg/aggregator"
+	"github.com/kubewharf/kelemetry/pkg/audit"
+	"github.com/kubewharf/kelemetry/pkg/audit/patch"
+	"github.com/kubewharf/kelemetry/pkg/metrics"
+	"github.com/kubewharf/kelemetry/pkg/util/zconstants"
+)
+
+func TestInferType(t *testing.T) {
+	for _, testCase := range []struct {
+		name            string
+		body            string
+		contentType     string
+		hasFieldManager bool
+		expect          patch.Type
+	}{
+		{name: "JsonPatch", body: ` [{"op":"remove","path":"/a"}]`, expect: patch.TypeJson},
+		{name: "MergePatch", body: `{"spec":{"replicas":3}}`, expect: patch.TypeMerge},
+		{name: "StrategicDirective", body: `{"spec":{"$setElementOrder/containers":[{"name":"a"}]}}`, expect: patch.TypeStrategic},
+		{name: "Apply", body: `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"a"}}`, hasFieldManager: true, expect: patch.TypeApply},
+		{name: "ApplyWithoutFieldManager", body: `{"apiVersion":"v1","kind":"Pod"}`, expect: patch.TypeMerge},
+		{name: "ContentType", body: `{"spec":{}}`, contentType: "application/strategic-merge-patch+json", expect: patch.TypeStrategic},
+	} {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			ty, err := patch.InferType([]byte(testCase.body), testCase.contentType, testCase.hasFieldManager)
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.expect, ty)
+		})
+	}
+}
+
+func parse(t *testing.T, body string, ty patch.Type) []string {
+	t.Helper()
+
+	changes, err := patch.Parse([]byte(body), ty)
+	assert.NoError(t, err)
+
+	lines := []string{}
+	for _, change := range changes {
+		lines = append(lines, change.String())
+	}
+	return lines
+}
+
+func TestParseJsonPatch(t *testing.T) {
+	assert.Equal(t, []string{
+		`replace spec.replicas = 3`,
+		`remove metadata.annotations.example.com/foo`,
+		`move spec.a -> spec.b`,
+		`test spec.c == {"d":1}`,
+	}, parse(t, `[
+		{"op":"replace","path":"/spec/replicas","value":3},
+		{"op":"remove","path":"/metadata/annotations/example.com~1foo"},
+		{"op":"move","from":"/spec/a","path":"/spec/b"},
+		{"op":"test","path":"/spec/c","value":{ "d": 1 }}
+	]`, patch.TypeJson))
+}
+
+func TestParseMergePatch(t *testing.T) {
+	assert.Equal(t, []string{
+		`delete metadata.labels.a`,
+		`set metadata.labels.b = "c"`,
+		`set spec.containers = [{"image":"nginx","name":"main"}]`,
+		`set spec.template = {}`,
+	}, parse(t, `{
+		"metadata":{"labels":{"b":"c","a":null}},
+		"spec":{"template":{},"containers":[{"name":"main","image":"nginx"}]}
+	}`, patch.TypeMerge))
+}
+
+func TestParseStrategicMergePatch(t *testing.T) {
+	assert.Equal(t, []string{
+		`remove metadata.finalizers = ["a"]`,
+		`replace spec.selector`,
+		`set spec.selector.matchLabels.x = "y"`,
+	}, parse(t, `{
+		"$setElementOrder/containers":[{"name":"main"}],
+		"metadata":{"$deleteFromPrimitiveList/finalizers":["a"]},
+		"spec":{"selector":{"$patch":"replace","matchLabels":{"x":"y"}}}
+	}`, patch.TypeStrategic))
+}
+
+func TestParseApply(t *testing.T) {
+	assert.Equal(t, []string{
+		`apply metadata.labels.app = "foo"`,
+		`apply spec.replicas = 2`,
+	}, parse(t, `{
+		"apiVersion":"apps/v1","kind":"Deployment",
+		"metadata":{"name":"foo","namespace":"default","labels":{"app":"foo"}},
+		"spec":{"replicas":2}
+	}`, patch.TypeApply))
+}
+
+func newDecorator(t *testing.T, args ...string) audit.DecoratorList {
+	t.Helper()
+
+	clock := clocktesting.NewFakeClock(time.Unix(1600000000, 0))
+	metricsClient, _ := metrics.NewMock(clock)
+	list := audit.NewDecoratorList(logrus.New(), clock, metricsClient)
+	decorator := patch.NewDecorator(logrus.New(), clock, list, metricsClient)
+
+	fs := pflag.NewFlagSet("test", pflag.PanicOnError)
+	list.Options().Setup(fs)
+	decorator.Options().Setup(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := list.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := decorator.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	return list
+}
+
+func newPatchMessage(resource string, requestUri string, body string) *audit.Message {
+	return &audit.Message{
+		Cluster: "test",
+		Event: auditv1.Event{
+			Verb:          audit.VerbPatch,
+			RequestURI:    requestUri,
+			ObjectRef:     &auditv1.ObjectReference{APIVersion: "v1", Resource: resource, Namespace: "default", Name: "foo"},
+			RequestObject: &runtime.Unknown{Raw: []byte(body), ContentType: runtime.ContentTypeJSON},
+		},
+	}
+}
+
+func TestDecorateApply(t *testing.T) {
+	assert := assert.New(t)
+
+	list := newDecorator(t, "--audit-patch-decorator-max-changes=1", "--audit-patch-decorator-max-value-length=4")
+
+	event := aggregator.NewEvent("spec", "test", time.Time{}, "audit")
+	list.Decorate(context.Background(), newPatchMessage(
+		"configmaps",
+		"/api/v1/namespaces/default/configmaps/foo?fieldManager=ctrl&force=true",
+		`{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"foo"},"data":{"a":"long value","b":"c"}}`,
+	), event)
+
+	assert.Equal("apply", event.Tags["patchType"])
+	assert.Equal("ctrl", event.Tags["fieldManager"])
+	assert.Equal(true, event.Tags["force"])
+
+	if assert.Len(event.Logs, 1) {
+		assert.Equal(zconstants.LogTypeObjectPatch, event.Logs[0].Type)
+		assert.Equal("apply data.a = \"lon...\n... 1 more changes", event.Logs[0].Message)
+		assert.Equal([][2]string{{"patchType", "apply"}, {"fieldManager", "ctrl"}}, event.Logs[0].Attrs)
+	}
+}
+
+func TestDecorateRedacted(t *testing.T) {
+	assert := assert.New(t)
+
+	list := newDecorator(t)
+
+	event := aggregator.NewEvent("spec", "test", time.Time{}, "audit")
+	list.Decorate(context.Background(), newPatchMessage(
+		"secrets",
+		"/api/v1/namespaces/default/secrets/foo",
+		`{"data":{"password":"aHVudGVyMg=="}}`,
+	), event)
+
+	assert.Equal("merge", event.Tags["patchType"])
+	if assert.Len(event.Logs, 1) {
+		assert.Equal(zconstants.LogTypeObjectPatch, event.Logs[0].Type)
+		assert.NotContains(event.Logs[0].Message, "aHVudGVyMg==")
+	}
+}
+
+func TestDecorateTruncateUtf8(t *testing.T) {
+	assert := assert.New(t)
+
+	// the JSON string value starts with a quote, so the limit falls within the second byte of "é"
+	list := newDecorator(t, "--audit-patch-decorator-max-value-length=3")
+
+	event := aggregator.NewEvent("spec", "test", time.Time{}, "audit")
+	list.Decorate(context.Background(), newPatchMessage(
+		"configmaps",
+		"/api/v1/namespaces/default/configmaps/foo",
+		`{"data":{"a":"hé"}}`,
+	), event)
+
+	if assert.Len(event.Logs, 1) {
+		assert.Equal("set data.a = \"h...", event.Logs[0].Message)
+		assert.True(utf8.ValidString(event.Logs[0].Message))
+	}
+}
@@ -0,0 +1,312 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subresource
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	"github.com/kubewharf/kelemetry/pkg/audit"
+)
+
+// maxCommandTitleLength is the maximum length of an exec command displayed in the event title.
+// The full command is always available in the tags.
+const maxCommandTitleLength = 64
+
+var builtinHandlers = map[Key]Handler{
+	{Group: "", Resource: "pods", Subresource: "binding"}: &funcHandler{
+		verbs:  sets.NewString(audit.VerbCreate),
+		handle: handleBinding,
+	},
+	{Group: "", Resource: "pods", Subresource: "eviction"}: &funcHandler{
+		verbs:  sets.NewString(audit.VerbCreate),
+		handle: handleEviction,
+	},
+	{Group: "", Resource: "pods", Subresource: "exec"}: &funcHandler{
+		verbs:  sets.NewString(audit.VerbCreate, audit.VerbGet),
+		handle: handleExec,
+	},
+	{Group: "", Resource: "pods", Subresource: "attach"}: &funcHandler{
+		verbs:  sets.NewString(audit.VerbCreate, audit.VerbGet),
+		handle: handleAttach,
+	},
+	{Group: "", Resource: "pods", Subresource: "portforward"}: &funcHandler{
+		verbs:  sets.NewString(audit.VerbCreate, audit.VerbGet),
+		handle: handlePortForward,
+	},
+	{Group: "", Resource: "pods", Subresource: "log"}: &funcHandler{
+		verbs:  sets.NewString(audit.VerbGet),
+		handle: handleLog,
+	},
+	{Group: "", Resource: "pods", Subresource: "ephemeralcontainers"}: &funcHandler{
+		verbs:  sets.NewString(audit.VerbUpdate, audit.VerbPatch),
+		handle: handleEphemeralContainers,
+	},
+	{Group: "", Resource: "serviceaccounts", Subresource: "token"}: &funcHandler{
+		verbs:  sets.NewString(audit.VerbCreate),
+		handle: handleToken,
+	},
+	{Group: Any, Resource: Any, Subresource: "scale"}: &funcHandler{
+		verbs:  sets.NewString(audit.VerbUpdate, audit.VerbPatch),
+		handle: handleScale,
+	},
+}
+
+type funcHandler struct {
+	verbs  sets.String
+	handle func(message *audit.Message) (*Result, error)
+}
+
+func (handler *funcHandler) Verbs() sets.String { return handler.verbs }
+
+func (handler *funcHandler) Handle(message *audit.Message) (*Result, error) {
+	return handler.handle(message)
+}
+
+// decodeObject decodes a request or response object.
+// Returns false if the object is not available at the audit level of the event.
+func decodeObject(object *runtime.Unknown, into any) (bool, error) {
+	if object == nil || len(object.Raw) == 0 {
+		return false, nil
+	}
+
+	if err := json.Unmarshal(object.Raw, into); err != nil {
+		return false, fmt.Errorf("cannot decode object: %w", err)
+	}
+
+	return true, nil
+}
+
+func parseQuery(message *audit.Message) url.Values {
+	parsed, err := url.ParseRequestURI(message.RequestURI)
+	if err != nil {
+		return url.Values{}
+	}
+
+	return parsed.Query()
+}
+
+func isSuccess(message *audit.Message) bool {
+	return message.ResponseStatus == nil || message.ResponseStatus.Code < 300
+}
+
+func handleBinding(message *audit.Message) (*Result, error) {
+	binding := &corev1.Binding{}
+	if ok, err := decodeObject(message.RequestObject, binding); !ok {
+		return &Result{Field: "spec", Title: "bind"}, err
+	}
+
+	return &Result{
+		Field: "spec",
+		Title: fmt.Sprintf("bind to node %s", binding.Target.Name),
+		Tags:  map[string]any{"node": binding.Target.Name},
+	}, nil
+}
+
+func handleEviction(message *audit.Message) (*Result, error) {
+	result := &Result{Field: "deletion", Title: "evict", Tags: map[string]any{}}
+
+	switch {
+	case isSuccess(message):
+		result.Tags["evictionResult"] = "Evicted"
+	case message.ResponseStatus.Code == http.StatusTooManyRequests:
+		// the eviction API returns 429 if it would violate a PodDisruptionBudget
+		result.Tags["evictionResult"] = "DisruptionBudget"
+		result.Tags["evictionMessage"] = message.ResponseStatus.Message
+	default:
+		result.Tags["evictionResult"] = "Failed"
+		result.Tags["evictionMessage"] = message.ResponseStatus.Message
+	}
+
+	eviction := &policyv1.Eviction{}
+	ok, err := decodeObject(message.RequestObject, eviction)
+	if ok && eviction.DeleteOptions != nil && eviction.DeleteOptions.GracePeriodSeconds != nil {
+		result.Tags["gracePeriodSeconds"] = *eviction.DeleteOptions.GracePeriodSeconds
+	}
+
+	return result, err
+}
+
+func handleExec(message *audit.Message) (*Result, error) {
+	query := parseQuery(message)
+	command := strings.Join(query["command"], " ")
+
+	title := "exec"
+	if command != "" {
+		titleCommand := command
+		if len(titleCommand) > maxCommandTitleLength {
+			titleCommand = titleCommand[:maxCommandTitleLength] + "..."
+		}
+		title = fmt.Sprintf("exec %s", titleCommand)
+	}
+
+	return &Result{
+		Field: "access",
+		Title: title,
+		Tags: map[string]any{
+			"command":   command,
+			"container": query.Get("container"),
+			"tty":       query.Get("tty") == "true",
+			"stdin":     query.Get("stdin") == "true",
+		},
+	}, nil
+}
+
+func handleAttach(message *audit.Message) (*Result, error) {
+	query := parseQuery(message)
+
+	return &Result{
+		Field: "access",
+		Title: "attach",
+		Tags: map[string]any{
+			"container": query.Get("container"),
+			"tty":       query.Get("tty") == "true",
+			"stdin":     query.Get("stdin") == "true",
+		},
+	}, nil
+}
+
+func handlePortForward(message *audit.Message) (*Result, error) {
+	// ports are only available in the query for websocket requests;
+	// SPDY requests specify the ports in stream headers that are not audited.
+	ports := parseQuery(message)["ports"]
+
+	title := "port-forward"
+	if len(ports) > 0 {
+		title = fmt.Sprintf("port-forward %s", strings.Join(ports, ","))
+	}
+
+	return &Result{
+		Field: "access",
+		Title: title,
+		Tags:  map[string]any{"ports": strings.Join(ports, ",")},
+	}, nil
+}
+
+func handleLog(message *audit.Message) (*Result, error) {
+	query := parseQuery(message)
+
+	title := "read logs"
+	if query.Get("follow") == "true" {
+		title = "follow logs"
+	}
+
+	return &Result{
+		Field: "access",
+		Title: title,
+		Tags: map[string]any{
+			"container": query.Get("container"),
+			"previous":  query.Get("previous") == "true",
+		},
+	}, nil
+}
+
+func handleEphemeralContainers(message *audit.Message) (*Result, error) {
+	result := &Result{Field: "spec", Title: "update ephemeral containers"}
+
+	// the response is the whole pod after the update, which is more reliable than a patch request
+	pod := &corev1.Pod{}
+	ok, err := decodeObject(message.ResponseObject, pod)
+	if !ok || pod.Kind != "Pod" {
+		pod = &corev1.Pod{}
+		ok, err = decodeObject(message.RequestObject, pod)
+	}
+	if !ok {
+		return result, err
+	}
+
+	names := []string{}
+	images := []string{}
+	for _, container := range pod.Spec.EphemeralContainers {
+		names = append(names, container.Name)
+		images = append(images, container.Image)
+	}
+
+	result.Tags = map[string]any{
+		"ephemeralContainers": strings.Join(names, ","),
+		"images":              strings.Join(images, ","),
+	}
+
+	return result, nil
+}
+
+func handleToken(message *audit.Message) (*Result, error) {
+	result := &Result{Field: "token", Title: "request token"}
+
+	// only decode the request; the response contains the issued token
+	tokenRequest := &authenticationv1.TokenRequest{}
+	if ok, err := decodeObject(message.RequestObject, tokenRequest); !ok {
+		return result, err
+	}
+
+	result.Tags = map[string]any{
+		"audiences": strings.Join(tokenRequest.Spec.Audiences, ","),
+	}
+	if tokenRequest.Spec.ExpirationSeconds != nil {
+		result.Tags["expirationSeconds"] = *tokenRequest.Spec.ExpirationSeconds
+	}
+	if ref := tokenRequest.Spec.BoundObjectRef; ref != nil {
+		boundObject := fmt.Sprintf("%s/%s", ref.Kind, ref.Name)
+		result.Title = fmt.Sprintf("request token for %s", boundObject)
+		result.Tags["boundObject"] = boundObject
+	}
+
+	return result, nil
+}
+
+func handleScale(message *audit.Message) (*Result, error) {
+	result := &Result{Field: "spec", Title: "scale"}
+
+	var replicas *int32
+
+	if isSuccess(message) {
+		scale := &autoscalingv1.Scale{}
+		if ok, err := decodeObject(message.ResponseObject, scale); err != nil {
+			return result, err
+		} else if ok {
+			replicas = &scale.Spec.Replicas
+		}
+	}
+
+	if replicas == nil {
+		// both update requests and merge patches have the form of a Scale object;
+		// JSON patches fail to decode and are ignored.
+		scale := &struct {
+			Spec struct {
+				Replicas *int32 `json:"replicas"`
+			} `json:"spec"`
+		}{}
+		if ok, _ := decodeObject(message.RequestObject, scale); ok {
+			replicas = scale.Spec.Replicas
+		}
+	}
+
+	if replicas != nil {
+		result.Title = fmt.Sprintf("scale to %d replicas", *replicas)
+		result.Tags = map[string]any{"replicas": *replicas}
+	}
+
+	return result, nil
+}
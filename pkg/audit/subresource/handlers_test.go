@@ -0,0 +1,153 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subresource_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+
+	"github.com/kubewharf/kelemetry/pkg/audit"
+	"github.com/kubewharf/kelemetry/pkg/audit/subresource"
+)
+
+func newMessage(verb string, group string, resource string, subresource string) *audit.Message {
+	return &audit.Message{
+		Cluster: "test",
+		Event: auditv1.Event{
+			Verb: verb,
+			ObjectRef: &auditv1.ObjectReference{
+				APIGroup:    group,
+				Resource:    resource,
+				Namespace:   "default",
+				Name:        "foo",
+				Subresource: subresource,
+			},
+			ResponseStatus: &metav1.Status{Code: http.StatusOK},
+		},
+	}
+}
+
+func handle(t *testing.T, message *audit.Message) *subresource.Result {
+	t.Helper()
+
+	handler := subresource.NewRegistry().Lookup(message)
+	if !assert.NotNil(t, handler) {
+		t.FailNow()
+	}
+
+	result, err := handler.Handle(message)
+	assert.NoError(t, err)
+	return result
+}
+
+type fakeHandler struct{}
+
+func (fakeHandler) Verbs() sets.String { return sets.NewString(audit.VerbUpdate) }
+
+func (fakeHandler) Handle(message *audit.Message) (*subresource.Result, error) {
+	return &subresource.Result{Title: "fake"}, nil
+}
+
+func TestLookup(t *testing.T) {
+	assert := assert.New(t)
+
+	registry := subresource.NewRegistry()
+	assert.Nil(registry.Lookup(newMessage(audit.VerbUpdate, "apps", "deployments", "")))
+	assert.Nil(registry.Lookup(newMessage(audit.VerbUpdate, "", "pods", "status")))
+	assert.Nil(registry.Lookup(newMessage(audit.VerbDelete, "", "pods", "binding")), "verb is not handled")
+	assert.NotNil(registry.Lookup(newMessage(audit.VerbUpdate, "apps", "deployments", "scale")))
+
+	registry.AddHandler(subresource.Key{Group: "apps", Resource: "deployments", Subresource: "scale"}, fakeHandler{})
+	assert.Equal(fakeHandler{}, registry.Lookup(newMessage(audit.VerbUpdate, "apps", "deployments", "scale")))
+	assert.Nil(registry.Lookup(newMessage(audit.VerbPatch, "apps", "deployments", "scale")), "specific handler takes precedence")
+	assert.NotNil(registry.Lookup(newMessage(audit.VerbPatch, "apps", "statefulsets", "scale")))
+}
+
+func TestBinding(t *testing.T) {
+	message := newMessage(audit.VerbCreate, "", "pods", "binding")
+	message.RequestObject = &runtime.Unknown{Raw: []byte(`{"kind":"Binding","target":{"kind":"Node","name":"node-1"}}`)}
+
+	result := handle(t, message)
+	assert.Equal(t, "spec", result.Field)
+	assert.Equal(t, "bind to node node-1", result.Title)
+	assert.Equal(t, "node-1", result.Tags["node"])
+}
+
+func TestEvictionBlocked(t *testing.T) {
+	message := newMessage(audit.VerbCreate, "", "pods", "eviction")
+	message.ResponseStatus = &metav1.Status{
+		Code:    http.StatusTooManyRequests,
+		Message: "Cannot evict pod as it would violate the pod's disruption budget.",
+	}
+	message.RequestObject = &runtime.Unknown{Raw: []byte(`{"kind":"Eviction","deleteOptions":{"gracePeriodSeconds":30}}`)}
+
+	result := handle(t, message)
+	assert.Equal(t, "deletion", result.Field)
+	assert.Equal(t, "DisruptionBudget", result.Tags["evictionResult"])
+	assert.Equal(t, int64(30), result.Tags["gracePeriodSeconds"])
+}
+
+func TestScale(t *testing.T) {
+	assert := assert.New(t)
+
+	message := newMessage(audit.VerbUpdate, "apps", "deployments", "scale")
+	message.ResponseObject = &runtime.Unknown{Raw: []byte(`{"kind":"Scale","spec":{"replicas":3},"status":{"replicas":1}}`)}
+	result := handle(t, message)
+	assert.Equal("scale to 3 replicas", result.Title)
+	assert.Equal(int32(3), result.Tags["replicas"])
+
+	message = newMessage(audit.VerbPatch, "apps", "deployments", "scale")
+	message.RequestObject = &runtime.Unknown{Raw: []byte(`{"spec":{"replicas":5}}`)}
+	result = handle(t, message)
+	assert.Equal("scale to 5 replicas", result.Title)
+
+	message = newMessage(audit.VerbPatch, "apps", "deployments", "scale")
+	message.RequestObject = &runtime.Unknown{Raw: []byte(`[{"op":"replace","path":"/spec/replicas","value":5}]`)}
+	result = handle(t, message)
+	assert.Equal("scale", result.Title)
+}
+
+func TestExec(t *testing.T) {
+	message := newMessage(audit.VerbCreate, "", "pods", "exec")
+	message.RequestURI = "/api/v1/namespaces/default/pods/foo/exec?command=sh&command=-c&command=date&container=main&stdin=true&tty=true"
+
+	result := handle(t, message)
+	assert.Equal(t, "access", result.Field)
+	assert.Equal(t, "exec sh -c date", result.Title)
+	assert.Equal(t, "main", result.Tags["container"])
+	assert.Equal(t, true, result.Tags["tty"])
+}
+
+func TestToken(t *testing.T) {
+	message := newMessage(audit.VerbCreate, "", "serviceaccounts", "token")
+	message.RequestObject = &runtime.Unknown{Raw: []byte(
+		`{"kind":"TokenRequest","spec":{"audiences":["api"],"expirationSeconds":3600,"boundObjectRef":{"kind":"Pod","name":"bar"}}}`,
+	)}
+	message.ResponseObject = &runtime.Unknown{Raw: []byte(`{"kind":"TokenRequest","status":{"token":"secret"}}`)}
+
+	result := handle(t, message)
+	assert.Equal(t, "request token for Pod/bar", result.Title)
+	assert.Equal(t, map[string]any{
+		"audiences":         "api",
+		"expirationSeconds": int64(3600),
+		"boundObject":       "Pod/bar",
+	}, result.Tags)
+}
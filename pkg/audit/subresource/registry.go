@@ -0,0 +1,111 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package subresource decodes audit events on well-known subresources,
+// whose meaning is carried in the request object instead of the object itself.
+package subresource
+
+import (
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	"github.com/kubewharf/kelemetry/pkg/audit"
+	"github.com/kubewharf/kelemetry/pkg/manager"
+)
+
+func init() {
+	manager.Global.Provide("audit-subresource-registry", NewRegistry)
+}
+
+// Any matches all groups or resources in a Key.
+const Any = "*"
+
+// Key identifies the subresource decoded by a Handler.
+type Key struct {
+	Group       string
+	Resource    string
+	Subresource string
+}
+
+// Result describes how an audit event on a subresource is presented in the trace.
+type Result struct {
+	// Field is the nesting field of the object span that the event is placed under.
+	// Defaults to the field determined by the verb if empty.
+	Field string
+	// Title replaces the verb and subresource in the event title if nonempty.
+	Title string
+	// Tags are added to the event.
+	Tags map[string]any
+}
+
+type Handler interface {
+	// Verbs returns the verbs of the requests decoded by this handler.
+	// Requests with these verbs are traced even if the audit consumer does not trace the verb otherwise.
+	Verbs() sets.String
+
+	// Handle decodes the request of the audit event.
+	Handle(message *audit.Message) (*Result, error)
+}
+
+type Registry interface {
+	manager.Component
+
+	// AddHandler registers a handler for a subresource.
+	// Handlers for a specific group and resource take precedence over handlers for Any.
+	AddHandler(key Key, handler Handler)
+
+	// Lookup returns the handler for the subresource and verb of the audit event, or nil if there is none.
+	Lookup(message *audit.Message) Handler
+}
+
+type registry struct {
+	manager.BaseComponent
+	handlers map[Key]Handler
+}
+
+func NewRegistry() Registry {
+	registry := &registry{
+		handlers: map[Key]Handler{},
+	}
+
+	for key, handler := range builtinHandlers {
+		registry.AddHandler(key, handler)
+	}
+
+	return registry
+}
+
+func (registry *registry) AddHandler(key Key, handler Handler) {
+	registry.handlers[key] = handler
+}
+
+func (registry *registry) Lookup(message *audit.Message) Handler {
+	if message.ObjectRef == nil || message.ObjectRef.Subresource == "" {
+		return nil
+	}
+
+	for _, key := range []Key{
+		{Group: message.ObjectRef.APIGroup, Resource: message.ObjectRef.Resource, Subresource: message.ObjectRef.Subresource},
+		{Group: Any, Resource: Any, Subresource: message.ObjectRef.Subresource},
+	} {
+		if handler, exists := registry.handlers[key]; exists {
+			if handler.Verbs().Has(message.Verb) {
+				return handler
+			}
+
+			return nil
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,133 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/spf13/pflag"
+
+	"github.com/kubewharf/kelemetry/pkg/manager"
+)
+
+func init() {
+	manager.Global.Provide("audit-webhook-auth", New)
+}
+
+type options struct {
+	required          bool
+	clientCommonNames map[string]string
+}
+
+func (options *options) Setup(fs *pflag.FlagSet) {
+	fs.BoolVar(
+		&options.required,
+		"audit-webhook-auth-required",
+		false,
+		"reject audit webhook requests without a bearer token or a verified client certificate",
+	)
+	fs.StringToStringVar(
+		&options.clientCommonNames,
+		"audit-webhook-auth-client-cn",
+		map[string]string{},
+		"map of verified HTTPS client certificate common names to cluster names, e.g. kube-apiserver-a=cluster-a "+
+			"(requires --http-tls-client-ca)",
+	)
+}
+
+func (options *options) EnableFlag() *bool { return nil }
+
+// Authenticator identifies the cluster that sent an audit webhook request.
+type Authenticator interface {
+	manager.Component
+
+	// Authenticate returns the cluster name associated with the credentials of the request.
+	// Returns an empty string if the request has no credentials and authentication is not required.
+	// Returns an *Error if the request must be rejected.
+	Authenticate(req *http.Request) (cluster string, err error)
+}
+
+// Error is an authentication failure.
+type Error struct {
+	// Status is the HTTP status code to respond with.
+	Status int
+	// Reason is a short identifier of the failure for metrics.
+	Reason  string
+	Message string
+}
+
+func (err *Error) Error() string {
+	return fmt.Sprintf("%s: %s", err.Reason, err.Message)
+}
+
+type authenticator struct {
+	options options
+	tokens  TokenStore
+}
+
+func New(tokens TokenStore) Authenticator {
+	return &authenticator{
+		tokens: tokens,
+	}
+}
+
+func (auth *authenticator) Options() manager.Options {
+	return &auth.options
+}
+
+func (auth *authenticator) Init(ctx context.Context) error { return nil }
+
+func (auth *authenticator) Start(stopCh <-chan struct{}) error { return nil }
+
+func (auth *authenticator) Close() error { return nil }
+
+func (auth *authenticator) Authenticate(req *http.Request) (string, error) {
+	if header := req.Header.Get("Authorization"); header != "" {
+		if !strings.HasPrefix(header, "Bearer ") {
+			return "", &Error{Status: http.StatusUnauthorized, Reason: "UnsupportedScheme", Message: "only bearer tokens are supported"}
+		}
+
+		cluster, found := auth.tokens.Lookup(strings.TrimSpace(strings.TrimPrefix(header, "Bearer ")))
+		if !found {
+			return "", &Error{Status: http.StatusUnauthorized, Reason: "InvalidToken", Message: "unknown bearer token"}
+		}
+
+		return cluster, nil
+	}
+
+	// VerifiedChains is only populated if the certificate is signed by --http-tls-client-ca
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 && len(req.TLS.VerifiedChains[0]) > 0 {
+		commonName := req.TLS.VerifiedChains[0][0].Subject.CommonName
+		cluster, found := auth.options.clientCommonNames[commonName]
+		if !found {
+			return "", &Error{
+				Status:  http.StatusForbidden,
+				Reason:  "UnknownClientCert",
+				Message: fmt.Sprintf("client certificate %q is not mapped to any cluster", commonName),
+			}
+		}
+
+		return cluster, nil
+	}
+
+	if auth.options.required {
+		return "", &Error{Status: http.StatusUnauthorized, Reason: "Unauthenticated", Message: "credentials are required"}
+	}
+
+	return "", nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/kubewharf/kelemetry/pkg/audit/webhook/auth"
+	"github.com/kubewharf/kelemetry/pkg/audit/webhook/auth/file"
+	"github.com/kubewharf/kelemetry/pkg/audit/webhook/auth/secret"
+)
+
+func newAuthenticator(t *testing.T, args ...string) auth.Authenticator {
+	t.Helper()
+
+	tokens := &auth.TokenSet{}
+	tokens.Replace(map[string]string{"token-a": "cluster-a"})
+
+	authenticator := auth.New(tokens)
+	fs := pflag.NewFlagSet("test", pflag.PanicOnError)
+	authenticator.Options().Setup(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+
+	return authenticator
+}
+
+func withClientCert(req *http.Request, commonName string) *http.Request {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: commonName}}
+	req.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+		VerifiedChains:   [][]*x509.Certificate{{cert}},
+	}
+	return req
+}
+
+func assertStatus(assert *assert.Assertions, err error, status int, reason string) {
+	authErr := &auth.Error{}
+	if assert.True(errors.As(err, &authErr)) {
+		assert.Equal(status, authErr.Status)
+		assert.Equal(reason, authErr.Reason)
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	assert := assert.New(t)
+	authenticator := newAuthenticator(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/audit", nil)
+	req.Header.Set("Authorization", "Bearer token-a")
+	cluster, err := authenticator.Authenticate(req)
+	assert.Nil(err)
+	assert.Equal("cluster-a", cluster)
+
+	req.Header.Set("Authorization", "Bearer token-b")
+	_, err = authenticator.Authenticate(req)
+	assertStatus(assert, err, http.StatusUnauthorized, "InvalidToken")
+
+	req.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+	_, err = authenticator.Authenticate(req)
+	assertStatus(assert, err, http.StatusUnauthorized, "UnsupportedScheme")
+}
+
+func TestClientCert(t *testing.T) {
+	assert := assert.New(t)
+	authenticator := newAuthenticator(t, "--audit-webhook-auth-client-cn=apiserver-b=cluster-b")
+
+	cluster, err := authenticator.Authenticate(withClientCert(httptest.NewRequest(http.MethodPost, "/audit", nil), "apiserver-b"))
+	assert.Nil(err)
+	assert.Equal("cluster-b", cluster)
+
+	_, err = authenticator.Authenticate(withClientCert(httptest.NewRequest(http.MethodPost, "/audit", nil), "apiserver-c"))
+	assertStatus(assert, err, http.StatusForbidden, "UnknownClientCert")
+}
+
+func TestAnonymous(t *testing.T) {
+	assert := assert.New(t)
+
+	cluster, err := newAuthenticator(t).Authenticate(httptest.NewRequest(http.MethodPost, "/audit", nil))
+	assert.Nil(err)
+	assert.Empty(cluster)
+
+	_, err = newAuthenticator(t, "--audit-webhook-auth-required").Authenticate(httptest.NewRequest(http.MethodPost, "/audit", nil))
+	assertStatus(assert, err, http.StatusUnauthorized, "Unauthenticated")
+}
+
+func TestParseTokenFile(t *testing.T) {
+	assert := assert.New(t)
+
+	tokens, err := file.ParseTokens([]byte("# comment\ntoken-a,cluster-a\n\n token-b , cluster-b \n"))
+	assert.Nil(err)
+	assert.Equal(map[string]string{"token-a": "cluster-a", "token-b": "cluster-b"}, tokens)
+
+	_, err = file.ParseTokens([]byte("token-a\n"))
+	assert.NotNil(err)
+
+	_, err = file.ParseTokens([]byte("token-a,cluster-a\ntoken-a,cluster-b\n"))
+	assert.NotNil(err)
+}
+
+func TestParseSecret(t *testing.T) {
+	assert := assert.New(t)
+
+	tokens := secret.ParseSecret(map[string][]byte{
+		"cluster-a": []byte("token-a1\ntoken-a2\n"),
+		"cluster-b": []byte("token-b"),
+	})
+	assert.Equal(map[string]string{"token-a1": "cluster-a", "token-a2": "cluster-a", "token-b": "cluster-b"}, tokens)
+}
@@ -0,0 +1,168 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"k8s.io/utils/clock"
+
+	"github.com/kubewharf/kelemetry/pkg/audit/webhook/auth"
+	"github.com/kubewharf/kelemetry/pkg/manager"
+	"github.com/kubewharf/kelemetry/pkg/util/shutdown"
+)
+
+func init() {
+	manager.Global.ProvideMuxImpl("audit-webhook-token-store/file", NewFileStore, auth.TokenStore.Lookup)
+}
+
+type options struct {
+	path           string
+	reloadInterval time.Duration
+}
+
+func (options *options) Setup(fs *pflag.FlagSet) {
+	fs.StringVar(
+		&options.path,
+		"audit-webhook-token-file",
+		"",
+		"file of audit webhook bearer tokens, one \"token,cluster\" pair per line (leave empty to only accept client certificates)",
+	)
+	fs.DurationVar(&options.reloadInterval, "audit-webhook-token-file-reload-interval", time.Minute, "interval to reload the token file")
+}
+
+func (options *options) EnableFlag() *bool { return nil }
+
+// FileStore reads bearer tokens from a local file, which can be mounted from a Secret.
+type FileStore struct {
+	manager.MuxImplBase
+	auth.TokenSet
+
+	options options
+	logger  logrus.FieldLogger
+	clock   clock.Clock
+
+	lastContent []byte
+}
+
+var _ auth.TokenStore = &FileStore{}
+
+func NewFileStore(logger logrus.FieldLogger, clock clock.Clock) *FileStore {
+	return &FileStore{
+		logger: logger,
+		clock:  clock,
+	}
+}
+
+func (_ *FileStore) MuxImplName() (name string, isDefault bool) { return "file", true }
+
+func (store *FileStore) Options() manager.Options { return &store.options }
+
+func (store *FileStore) Init(ctx context.Context) error {
+	if store.options.path == "" {
+		return nil
+	}
+
+	return store.reload()
+}
+
+func (store *FileStore) Start(stopCh <-chan struct{}) error {
+	if store.options.path == "" {
+		return nil
+	}
+
+	go func() {
+		defer shutdown.RecoverPanic(store.logger)
+
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-store.clock.After(store.options.reloadInterval):
+				if err := store.reload(); err != nil {
+					// keep using the previous tokens
+					store.logger.WithError(err).Error("cannot reload token file")
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (store *FileStore) Close() error { return nil }
+
+func (store *FileStore) reload() error {
+	content, err := os.ReadFile(store.options.path)
+	if err != nil {
+		return fmt.Errorf("cannot read token file: %w", err)
+	}
+
+	if store.lastContent != nil && bytes.Equal(content, store.lastContent) {
+		return nil
+	}
+
+	tokens, err := ParseTokens(content)
+	if err != nil {
+		return fmt.Errorf("invalid token file: %w", err)
+	}
+
+	store.Replace(tokens)
+	store.lastContent = content
+	store.logger.WithField("count", len(tokens)).Info("Loaded audit webhook tokens")
+
+	return nil
+}
+
+// ParseTokens parses lines of "token,cluster" pairs into a map of tokens to cluster names.
+// Empty lines and lines starting with "#" are ignored.
+func ParseTokens(content []byte) (map[string]string, error) {
+	tokens := map[string]string{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		token, cluster, ok := strings.Cut(line, ",")
+		token = strings.TrimSpace(token)
+		cluster = strings.TrimSpace(cluster)
+		if !ok || token == "" || cluster == "" {
+			return nil, fmt.Errorf("line %d is not in the format \"token,cluster\"", lineNo)
+		}
+
+		if _, exists := tokens[token]; exists {
+			return nil, fmt.Errorf("line %d contains a duplicate token", lineNo)
+		}
+
+		tokens[token] = cluster
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
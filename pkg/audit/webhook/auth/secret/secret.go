@@ -0,0 +1,135 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package secret
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/kubewharf/kelemetry/pkg/audit/webhook/auth"
+	"github.com/kubewharf/kelemetry/pkg/k8s"
+	"github.com/kubewharf/kelemetry/pkg/manager"
+)
+
+func init() {
+	manager.Global.ProvideMuxImpl("audit-webhook-token-store/secret", NewSecretStore, auth.TokenStore.Lookup)
+}
+
+type options struct {
+	namespace string
+	name      string
+}
+
+func (options *options) Setup(fs *pflag.FlagSet) {
+	fs.StringVar(&options.namespace, "audit-webhook-token-secret-namespace", "default", "namespace of the audit webhook token Secret")
+	fs.StringVar(
+		&options.name,
+		"audit-webhook-token-secret-name",
+		"kelemetry-audit-webhook-tokens",
+		"name of the audit webhook token Secret in the target cluster; "+
+			"each data key is a cluster name, and each line of the value is a bearer token for that cluster",
+	)
+}
+
+func (options *options) EnableFlag() *bool { return nil }
+
+// SecretStore watches bearer tokens in a Secret of the target cluster.
+type SecretStore struct {
+	manager.MuxImplBase
+	auth.TokenSet
+
+	options options
+	logger  logrus.FieldLogger
+	clients k8s.Clients
+
+	informerFactory informers.SharedInformerFactory
+}
+
+var _ auth.TokenStore = &SecretStore{}
+
+func NewSecretStore(logger logrus.FieldLogger, clients k8s.Clients) *SecretStore {
+	return &SecretStore{
+		logger:  logger,
+		clients: clients,
+	}
+}
+
+func (_ *SecretStore) MuxImplName() (name string, isDefault bool) { return "secret", false }
+
+func (store *SecretStore) Options() manager.Options { return &store.options }
+
+func (store *SecretStore) Init(ctx context.Context) error {
+	store.informerFactory = store.clients.TargetCluster().NewInformerFactory(
+		informers.WithNamespace(store.options.namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", store.options.name).String()
+		}),
+	)
+	_, err := store.informerFactory.Core().V1().Secrets().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj any) { store.setSecret(obj.(*corev1.Secret)) },
+		UpdateFunc: func(oldObj, newObj any) { store.setSecret(newObj.(*corev1.Secret)) },
+		DeleteFunc: func(obj any) { store.setSecret(nil) },
+	})
+	if err != nil {
+		// should not happen during startup
+		return fmt.Errorf("cannot add Secret event handler: %w", err)
+	}
+
+	return nil
+}
+
+func (store *SecretStore) Start(stopCh <-chan struct{}) error {
+	store.informerFactory.Start(stopCh)
+	// reject requests until tokens are loaded instead of treating them as unauthenticated
+	store.informerFactory.WaitForCacheSync(stopCh)
+	return nil
+}
+
+func (store *SecretStore) Close() error { return nil }
+
+func (store *SecretStore) setSecret(secret *corev1.Secret) {
+	var data map[string][]byte
+	if secret != nil {
+		data = secret.Data
+	}
+
+	tokens := ParseSecret(data)
+	store.Replace(tokens)
+	store.logger.WithField("count", len(tokens)).Info("Loaded audit webhook tokens")
+}
+
+// ParseSecret converts Secret data of cluster names to newline-separated tokens into a map of tokens to cluster names.
+func ParseSecret(data map[string][]byte) map[string]string {
+	tokens := map[string]string{}
+	for cluster, value := range data {
+		for _, token := range strings.Split(string(value), "\n") {
+			token = strings.TrimSpace(token)
+			if token != "" {
+				tokens[token] = cluster
+			}
+		}
+	}
+
+	return tokens
+}
@@ -0,0 +1,72 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"crypto/sha256"
+	"sync/atomic"
+
+	"github.com/kubewharf/kelemetry/pkg/manager"
+)
+
+func init() {
+	manager.Global.Provide("audit-webhook-token-store", newTokenStore)
+}
+
+// TokenStore maps bearer tokens to cluster names.
+type TokenStore interface {
+	Lookup(token string) (cluster string, found bool)
+}
+
+type mux struct {
+	*manager.Mux
+}
+
+func newTokenStore() TokenStore {
+	return &mux{
+		Mux: manager.NewMux("audit-webhook-token-store", false),
+	}
+}
+
+func (mux *mux) Lookup(token string) (string, bool) {
+	return mux.Impl().(TokenStore).Lookup(token)
+}
+
+// TokenSet is a TokenStore that can be atomically replaced.
+// The zero value contains no tokens.
+type TokenSet struct {
+	// tokens is keyed by the hash of each token so that lookup time does not depend on the token prefix.
+	tokens atomic.Pointer[map[[sha256.Size]byte]string]
+}
+
+// Replace replaces all tokens with the given map of tokens to cluster names.
+func (set *TokenSet) Replace(tokens map[string]string) {
+	hashed := make(map[[sha256.Size]byte]string, len(tokens))
+	for token, cluster := range tokens {
+		hashed[sha256.Sum256([]byte(token))] = cluster
+	}
+
+	set.tokens.Store(&hashed)
+}
+
+func (set *TokenSet) Lookup(token string) (string, bool) {
+	tokens := set.tokens.Load()
+	if tokens == nil || token == "" {
+		return "", false
+	}
+
+	cluster, found := (*tokens)[sha256.Sum256([]byte(token))]
+	return cluster, found
+}
@@ -0,0 +1,198 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cidr resolves cluster names by matching the client address against CIDR ranges in a config file.
+//
+// The config file is a JSON object mapping cluster names to lists of CIDR ranges, e.g.
+//
+//	{"cluster-a": ["10.0.0.0/16", "fd00:a::/64"], "cluster-b": ["10.1.0.1"]}
+//
+// If multiple ranges contain the client address, the most specific range is used.
+package cidr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"k8s.io/utils/clock"
+
+	"github.com/kubewharf/kelemetry/pkg/audit/webhook/clustername"
+	"github.com/kubewharf/kelemetry/pkg/manager"
+	"github.com/kubewharf/kelemetry/pkg/util/shutdown"
+)
+
+func init() {
+	manager.Global.Provide("cluster-name-cidr", NewCidrSource)
+}
+
+type options struct {
+	file           string
+	reloadInterval time.Duration
+}
+
+func (options *options) Setup(fs *pflag.FlagSet) {
+	fs.StringVar(
+		&options.file,
+		"cluster-name-cidr-file",
+		"",
+		"JSON file mapping cluster names to lists of CIDR ranges of their apiservers (enables the \"cidr\" cluster name resolver)",
+	)
+	fs.DurationVar(&options.reloadInterval, "cluster-name-cidr-reload-interval", time.Second*30, "interval to reload the CIDR file")
+}
+
+func (options *options) EnableFlag() *bool {
+	isEnable := options.file != ""
+	return &isEnable
+}
+
+type rule struct {
+	ipNet   *net.IPNet
+	cluster string
+}
+
+// CidrSource is the "cidr" cluster name resolver.
+type CidrSource struct {
+	options  options
+	logger   logrus.FieldLogger
+	clock    clock.Clock
+	resolver clustername.Resolver
+
+	rules       atomic.Pointer[[]rule]
+	lastContent []byte
+}
+
+var _ clustername.Source = &CidrSource{}
+
+func NewCidrSource(logger logrus.FieldLogger, clock clock.Clock, resolver clustername.Resolver) *CidrSource {
+	return &CidrSource{
+		logger:   logger,
+		clock:    clock,
+		resolver: resolver,
+	}
+}
+
+func (source *CidrSource) Options() manager.Options {
+	return &source.options
+}
+
+func (source *CidrSource) Init(ctx context.Context) error {
+	if err := source.reload(); err != nil {
+		return err
+	}
+
+	source.resolver.AddSource("cidr", source)
+	return nil
+}
+
+func (source *CidrSource) Start(stopCh <-chan struct{}) error {
+	go func() {
+		defer shutdown.RecoverPanic(source.logger)
+
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-source.clock.After(source.options.reloadInterval):
+				if err := source.reload(); err != nil {
+					// keep using the previous rules
+					source.logger.WithError(err).Error("cannot reload CIDR file")
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (source *CidrSource) Close() error { return nil }
+
+func (source *CidrSource) reload() error {
+	content, err := os.ReadFile(source.options.file)
+	if err != nil {
+		return fmt.Errorf("cannot read CIDR file: %w", err)
+	}
+
+	if source.lastContent != nil && bytes.Equal(content, source.lastContent) {
+		return nil
+	}
+
+	rules, err := parseRules(content)
+	if err != nil {
+		return fmt.Errorf("invalid CIDR file: %w", err)
+	}
+
+	source.rules.Store(&rules)
+	source.lastContent = content
+	source.logger.WithField("count", len(rules)).Info("Loaded cluster name CIDR rules")
+
+	return nil
+}
+
+func parseRules(content []byte) ([]rule, error) {
+	clusters := map[string][]string{}
+	if err := json.Unmarshal(content, &clusters); err != nil {
+		return nil, err
+	}
+
+	rules := []rule{}
+	owners := map[string]string{}
+
+	for cluster, cidrs := range clusters {
+		set, err := clustername.ParseCidrSet(cidrs)
+		if err != nil {
+			return nil, fmt.Errorf("invalid range for cluster %q: %w", cluster, err)
+		}
+
+		for _, ipNet := range set {
+			if owner, exists := owners[ipNet.String()]; exists && owner != cluster {
+				return nil, fmt.Errorf("range %s is assigned to both %q and %q", ipNet, owner, cluster)
+			}
+			owners[ipNet.String()] = cluster
+
+			rules = append(rules, rule{ipNet: ipNet, cluster: cluster})
+		}
+	}
+
+	// match the most specific range first
+	sort.SliceStable(rules, func(i, j int) bool {
+		iOnes, _ := rules[i].ipNet.Mask.Size()
+		jOnes, _ := rules[j].ipNet.Mask.Size()
+		return iOnes > jOnes
+	})
+
+	return rules, nil
+}
+
+func (source *CidrSource) Resolve(req *clustername.Request) (string, bool) {
+	if req.ClientIP == nil {
+		return "", false
+	}
+
+	for _, rule := range *source.rules.Load() {
+		if rule.ipNet.Contains(req.ClientIP) {
+			return rule.cluster, true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,142 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cidr_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"github.com/kubewharf/kelemetry/pkg/audit/webhook/clustername"
+	"github.com/kubewharf/kelemetry/pkg/audit/webhook/clustername/cidr"
+	"github.com/kubewharf/kelemetry/pkg/manager"
+)
+
+type fakeResolver struct {
+	manager.BaseComponent
+	sources map[string]clustername.Source
+}
+
+func (resolver *fakeResolver) AddSource(name string, source clustername.Source) {
+	resolver.sources[name] = source
+}
+
+func (resolver *fakeResolver) Resolve(req *http.Request) string { panic("unused") }
+
+func newSource(t *testing.T, content string) (*cidr.CidrSource, *clocktesting.FakeClock, string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "cidr.json")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	clock := clocktesting.NewFakeClock(time.Unix(1600000000, 0))
+	resolver := &fakeResolver{sources: map[string]clustername.Source{}}
+	source := cidr.NewCidrSource(logrus.New(), clock, resolver)
+
+	fs := pflag.NewFlagSet("test", pflag.PanicOnError)
+	source.Options().Setup(fs)
+	if err := fs.Parse([]string{"--cluster-name-cidr-file", path}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := source.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	assert.Same(t, source, resolver.sources["cidr"])
+
+	return source, clock, path
+}
+
+func resolve(source clustername.Source, remoteAddr string) (string, bool) {
+	req := httptest.NewRequest(http.MethodPost, "/audit", nil)
+	req.RemoteAddr = remoteAddr
+	return source.Resolve(clustername.NewRequest(req, nil))
+}
+
+func TestMostSpecificRange(t *testing.T) {
+	assert := assert.New(t)
+
+	source, _, _ := newSource(t, `{"a": ["10.0.0.0/16", "fd00::/64"], "b": ["10.0.1.0/24"], "c": ["10.0.1.1"]}`)
+
+	for remoteAddr, expected := range map[string]string{
+		"10.0.2.1:443":   "a",
+		"[fd00::1]:443":  "a",
+		"10.0.1.2:443":   "b",
+		"10.0.1.1:443":   "c",
+		"10.1.0.1:443":   "",
+		"[fd01::1]:443":  "",
+		"not-an-address": "",
+	} {
+		cluster, found := resolve(source, remoteAddr)
+		assert.Equal(expected != "", found, remoteAddr)
+		assert.Equal(expected, cluster, remoteAddr)
+	}
+}
+
+func TestDuplicateRange(t *testing.T) {
+	assert := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "cidr.json")
+	assert.Nil(os.WriteFile(path, []byte(`{"a": ["10.0.0.0/16"], "b": ["10.0.0.0/16"]}`), 0o644))
+
+	source := cidr.NewCidrSource(logrus.New(), clocktesting.NewFakeClock(time.Unix(1600000000, 0)), &fakeResolver{})
+	fs := pflag.NewFlagSet("test", pflag.PanicOnError)
+	source.Options().Setup(fs)
+	assert.Nil(fs.Parse([]string{"--cluster-name-cidr-file", path}))
+
+	assert.NotNil(source.Init(context.Background()))
+}
+
+func TestReload(t *testing.T) {
+	assert := assert.New(t)
+
+	source, clock, path := newSource(t, `{"a": ["10.0.0.0/16"]}`)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	assert.Nil(source.Start(stopCh))
+
+	cluster, _ := resolve(source, "10.0.0.1:443")
+	assert.Equal("a", cluster)
+
+	assert.Nil(os.WriteFile(path, []byte(`{"b": ["10.0.0.0/16"]}`), 0o644))
+	assert.Eventually(clock.HasWaiters, time.Second, time.Millisecond)
+	clock.Step(time.Second * 30)
+
+	assert.Eventually(func() bool {
+		cluster, _ := resolve(source, "10.0.0.1:443")
+		return cluster == "b"
+	}, time.Second, time.Millisecond)
+
+	// invalid content keeps the previous rules
+	assert.Nil(os.WriteFile(path, []byte(`{"c": ["invalid"]}`), 0o644))
+	assert.Eventually(clock.HasWaiters, time.Second, time.Millisecond)
+	clock.Step(time.Second * 30)
+	assert.Eventually(clock.HasWaiters, time.Second, time.Millisecond)
+
+	cluster, _ = resolve(source, "10.0.0.1:443")
+	assert.Equal("b", cluster)
+}
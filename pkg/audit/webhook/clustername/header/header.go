@@ -0,0 +1,85 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package header
+
+import (
+	"context"
+	"strings"
+
+	"github.com/spf13/pflag"
+
+	"github.com/kubewharf/kelemetry/pkg/audit/webhook/clustername"
+	"github.com/kubewharf/kelemetry/pkg/manager"
+)
+
+func init() {
+	manager.Global.Provide("cluster-name-header", NewHeaderSource)
+}
+
+type options struct {
+	header string
+}
+
+func (options *options) Setup(fs *pflag.FlagSet) {
+	fs.StringVar(
+		&options.header,
+		"cluster-name-header",
+		"",
+		"HTTP header containing the cluster name, only trusted if the request is sent from --cluster-name-trusted-proxies "+
+			"(enables the \"header\" cluster name resolver)",
+	)
+}
+
+func (options *options) EnableFlag() *bool {
+	isEnable := options.header != ""
+	return &isEnable
+}
+
+// HeaderSource is the "header" cluster name resolver.
+type HeaderSource struct {
+	options  options
+	resolver clustername.Resolver
+}
+
+var _ clustername.Source = &HeaderSource{}
+
+func NewHeaderSource(resolver clustername.Resolver) *HeaderSource {
+	return &HeaderSource{
+		resolver: resolver,
+	}
+}
+
+func (source *HeaderSource) Options() manager.Options {
+	return &source.options
+}
+
+func (source *HeaderSource) Init(ctx context.Context) error {
+	source.resolver.AddSource("header", source)
+	return nil
+}
+
+func (source *HeaderSource) Start(stopCh <-chan struct{}) error { return nil }
+
+func (source *HeaderSource) Close() error { return nil }
+
+func (source *HeaderSource) Resolve(req *clustername.Request) (string, bool) {
+	if !req.Proxied {
+		// the header may be forged by the client
+		return "", false
+	}
+
+	cluster := strings.TrimSpace(req.Header.Get(source.options.header))
+	return cluster, cluster != ""
+}
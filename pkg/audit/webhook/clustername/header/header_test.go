@@ -0,0 +1,96 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package header_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"github.com/kubewharf/kelemetry/pkg/audit/webhook/clustername"
+	"github.com/kubewharf/kelemetry/pkg/audit/webhook/clustername/header"
+	"github.com/kubewharf/kelemetry/pkg/manager"
+	"github.com/kubewharf/kelemetry/pkg/metrics"
+)
+
+func newResolver(t *testing.T) clustername.Resolver {
+	t.Helper()
+
+	metricsClient, _ := metrics.NewMock(clocktesting.NewFakeClock(time.Unix(1600000000, 0)))
+	resolver := clustername.NewResolver(metricsClient)
+	source := header.NewHeaderSource(resolver)
+
+	fs := pflag.NewFlagSet("test", pflag.PanicOnError)
+	resolver.Options().Setup(fs)
+	source.Options().Setup(fs)
+	if err := fs.Parse([]string{
+		"--cluster-name-resolver=header,address",
+		"--cluster-name-trusted-proxies=10.0.0.0/24",
+		"--cluster-name-header=X-Cluster-Name",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, comp := range []manager.Component{resolver, source} {
+		if err := comp.Init(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := resolver.Start(make(chan struct{})); err != nil {
+		t.Fatal(err)
+	}
+
+	return resolver
+}
+
+func newRequest(remoteAddr string, cluster string, forwardedFor string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/audit", nil)
+	req.RemoteAddr = remoteAddr
+	if cluster != "" {
+		req.Header.Set("X-Cluster-Name", cluster)
+	}
+	if forwardedFor != "" {
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+	}
+	return req
+}
+
+func TestHeaderFromTrustedProxy(t *testing.T) {
+	assert := assert.New(t)
+
+	resolver := newResolver(t)
+	assert.Equal("prod", resolver.Resolve(newRequest("10.0.0.5:443", " prod ", "192.168.0.1")))
+}
+
+func TestHeaderFromUntrustedClient(t *testing.T) {
+	assert := assert.New(t)
+
+	// both headers may be forged by the client
+	resolver := newResolver(t)
+	assert.Equal("192.168.0.1", resolver.Resolve(newRequest("192.168.0.1:443", "prod", "172.16.0.1")))
+}
+
+func TestForwardedForWithoutHeader(t *testing.T) {
+	assert := assert.New(t)
+
+	resolver := newResolver(t)
+	assert.Equal("192.168.0.1", resolver.Resolve(newRequest("10.0.0.5:443", "", "172.16.0.1, 192.168.0.1, 10.0.0.6")))
+}
@@ -15,27 +15,154 @@
 package clustername
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/spf13/pflag"
+
 	"github.com/kubewharf/kelemetry/pkg/manager"
+	"github.com/kubewharf/kelemetry/pkg/metrics"
 )
 
 func init() {
-	manager.Global.Provide("cluster-name", newResolver)
+	manager.Global.Provide("cluster-name", NewResolver)
+}
+
+type options struct {
+	chain          []string
+	legacyChain    string
+	trustedProxies []string
+}
+
+func (options *options) Setup(fs *pflag.FlagSet) {
+	fs.StringSliceVar(
+		&options.chain,
+		"cluster-name-resolver",
+		[]string{"address"},
+		"cluster name resolvers to try in order, where the first resolver that recognizes the request determines the cluster name. "+
+			"The client address is used if no resolver recognizes the request. "+
+			"Possible values are \"address\", \"cidr\", \"header\" and \"tls-subject\".",
+	)
+	fs.StringVar(&options.legacyChain, "cluster-name", "", "alias of --cluster-name-resolver with a single resolver")
+	_ = fs.MarkDeprecated("cluster-name", "use --cluster-name-resolver instead")
+	fs.StringSliceVar(
+		&options.trustedProxies,
+		"cluster-name-trusted-proxies",
+		[]string{},
+		"CIDR ranges of proxies trusted to set the X-Forwarded-For header and the cluster name header",
+	)
+}
+
+func (options *options) EnableFlag() *bool { return nil }
+
+// Source resolves the cluster name of audit webhook requests with a specific strategy.
+type Source interface {
+	// Resolve returns false if the request is not recognized by this source,
+	// in which case the next source in --cluster-name-resolver is tried.
+	Resolve(req *Request) (cluster string, found bool)
 }
 
 type Resolver interface {
-	Resolve(ip string) string
+	manager.Component
+
+	// AddSource registers a source that can be referenced in --cluster-name-resolver.
+	// Must be called during Init.
+	AddSource(name string, source Source)
+
+	// Resolve returns the cluster name of an audit webhook request.
+	Resolve(req *http.Request) string
 }
 
-type mux struct {
-	*manager.Mux
+type namedSource struct {
+	name   string
+	source Source
 }
 
-func newResolver() Resolver {
-	return &mux{
-		Mux: manager.NewMux("cluster-name-resolver", false),
+type resolver struct {
+	options options
+	metrics metrics.Client
+
+	trustedProxies CidrSet
+	sources        map[string]Source
+	chain          []namedSource
+	resolveMetric  metrics.Metric
+}
+
+type resolveMetric struct {
+	Resolver string
+}
+
+func NewResolver(metrics metrics.Client) Resolver {
+	return &resolver{
+		metrics: metrics,
+		sources: map[string]Source{},
 	}
 }
 
-func (mux *mux) Resolve(ip string) string {
-	return mux.Impl().(Resolver).Resolve(ip)
+func (resolver *resolver) Options() manager.Options {
+	return &resolver.options
+}
+
+func (resolver *resolver) Init(ctx context.Context) error {
+	if resolver.options.legacyChain != "" {
+		if len(resolver.options.chain) != 1 || resolver.options.chain[0] != "address" {
+			return fmt.Errorf("--cluster-name cannot be used together with --cluster-name-resolver")
+		}
+
+		resolver.options.chain = []string{resolver.options.legacyChain}
+	}
+
+	trustedProxies, err := ParseCidrSet(resolver.options.trustedProxies)
+	if err != nil {
+		return fmt.Errorf("invalid --cluster-name-trusted-proxies: %w", err)
+	}
+	resolver.trustedProxies = trustedProxies
+
+	resolver.resolveMetric = resolver.metrics.New("cluster_name_resolve", &resolveMetric{})
+
+	resolver.AddSource("address", addressSource{})
+
+	return nil
+}
+
+func (resolver *resolver) Start(stopCh <-chan struct{}) error {
+	// sources are added during Init, so the chain can only be validated after all components are initialized
+	for _, name := range resolver.options.chain {
+		source, exists := resolver.sources[name]
+		if !exists {
+			return fmt.Errorf("cluster name resolver %q does not exist or is not enabled", name)
+		}
+
+		resolver.chain = append(resolver.chain, namedSource{name: name, source: source})
+	}
+
+	return nil
+}
+
+func (resolver *resolver) Close() error { return nil }
+
+func (resolver *resolver) AddSource(name string, source Source) {
+	resolver.sources[name] = source
+}
+
+func (resolver *resolver) Resolve(httpReq *http.Request) string {
+	req := NewRequest(httpReq, resolver.trustedProxies)
+
+	for _, source := range resolver.chain {
+		if cluster, found := source.source.Resolve(req); found {
+			resolver.resolveMetric.With(&resolveMetric{Resolver: source.name}).Count(1)
+			return cluster
+		}
+	}
+
+	resolver.resolveMetric.With(&resolveMetric{Resolver: "fallback"}).Count(1)
+	return req.ClientAddr()
+}
+
+// addressSource uses the client address as the cluster name.
+type addressSource struct{}
+
+func (addressSource) Resolve(req *Request) (string, bool) {
+	return req.ClientAddr(), true
 }
@@ -0,0 +1,82 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clustername_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"github.com/kubewharf/kelemetry/pkg/audit/webhook/clustername"
+	"github.com/kubewharf/kelemetry/pkg/metrics"
+)
+
+type fixedSource string
+
+func (source fixedSource) Resolve(req *clustername.Request) (string, bool) {
+	return string(source), true
+}
+
+func newResolver(t *testing.T, args ...string) (clustername.Resolver, error) {
+	t.Helper()
+
+	metricsClient, _ := metrics.NewMock(clocktesting.NewFakeClock(time.Unix(1600000000, 0)))
+	resolver := clustername.NewResolver(metricsClient)
+
+	fs := pflag.NewFlagSet("test", pflag.PanicOnError)
+	resolver.Options().Setup(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := resolver.Init(context.Background()); err != nil {
+		return nil, err
+	}
+	resolver.AddSource("fixed", fixedSource("prod"))
+	if err := resolver.Start(make(chan struct{})); err != nil {
+		return nil, err
+	}
+
+	return resolver, nil
+}
+
+func TestDefaultResolver(t *testing.T) {
+	assert := assert.New(t)
+
+	resolver, err := newResolver(t)
+	if assert.Nil(err) {
+		req := httptest.NewRequest(http.MethodPost, "/audit", nil)
+		req.RemoteAddr = "192.168.0.1:443"
+		assert.Equal("192.168.0.1", resolver.Resolve(req))
+	}
+}
+
+func TestDeprecatedClusterNameFlag(t *testing.T) {
+	assert := assert.New(t)
+
+	resolver, err := newResolver(t, "--cluster-name=fixed")
+	if assert.Nil(err) {
+		assert.Equal("prod", resolver.Resolve(httptest.NewRequest(http.MethodPost, "/audit", nil)))
+	}
+
+	_, err = newResolver(t, "--cluster-name=fixed", "--cluster-name-resolver=header")
+	assert.NotNil(err)
+}
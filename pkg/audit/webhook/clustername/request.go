@@ -0,0 +1,134 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clustername
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Request is an audit webhook request with the client address resolved.
+type Request struct {
+	*http.Request
+
+	// ClientIP is the address of the apiserver sending the request.
+	// If the request is sent from a trusted proxy, this is the last address in X-Forwarded-For not belonging to a trusted proxy.
+	// Nil if the address cannot be parsed.
+	ClientIP net.IP
+
+	// Proxied is true if the request is sent from a trusted proxy,
+	// in which case headers set by the proxy can be trusted.
+	Proxied bool
+
+	peerHost string
+}
+
+// NewRequest resolves the client address of a request sent through the given trusted proxies.
+func NewRequest(httpReq *http.Request, trustedProxies CidrSet) *Request {
+	peerHost, _, err := net.SplitHostPort(httpReq.RemoteAddr)
+	if err != nil {
+		peerHost = httpReq.RemoteAddr
+	}
+
+	req := &Request{
+		Request:  httpReq,
+		ClientIP: net.ParseIP(peerHost),
+		peerHost: peerHost,
+	}
+
+	if req.ClientIP == nil || !trustedProxies.Contains(req.ClientIP) {
+		return req
+	}
+
+	req.Proxied = true
+
+	var forwarded []string
+	for _, header := range httpReq.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+
+	// each proxy appends the address of its peer, so only the addresses after the last untrusted hop are reliable
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if ip == nil {
+			break
+		}
+
+		req.ClientIP = ip
+		if !trustedProxies.Contains(ip) {
+			break
+		}
+	}
+
+	return req
+}
+
+// ClientAddr returns the string form of ClientIP,
+// or the raw peer address if it cannot be parsed.
+func (req *Request) ClientAddr() string {
+	if req.ClientIP == nil {
+		return req.peerHost
+	}
+
+	return req.ClientIP.String()
+}
+
+// CidrSet is a list of CIDR ranges.
+type CidrSet []*net.IPNet
+
+// ParseCidrSet parses a list of CIDR ranges.
+// Plain IP addresses are accepted as single-address ranges.
+func ParseCidrSet(cidrs []string) (CidrSet, error) {
+	set := make(CidrSet, 0, len(cidrs))
+
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", cidr)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+
+			set = append(set, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+
+		set = append(set, ipNet)
+	}
+
+	return set, nil
+}
+
+func (set CidrSet) Contains(ip net.IP) bool {
+	for _, ipNet := range set {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
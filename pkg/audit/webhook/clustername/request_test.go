@@ -0,0 +1,74 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clustername_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/kubewharf/kelemetry/pkg/audit/webhook/clustername"
+)
+
+func newRequest(t *testing.T, remoteAddr string, forwardedFor ...string) *clustername.Request {
+	t.Helper()
+
+	trustedProxies, err := clustername.ParseCidrSet([]string{"10.0.0.0/24", "10.0.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	httpReq := httptest.NewRequest(http.MethodPost, "/audit", nil)
+	httpReq.RemoteAddr = remoteAddr
+	for _, header := range forwardedFor {
+		httpReq.Header.Add("X-Forwarded-For", header)
+	}
+
+	return clustername.NewRequest(httpReq, trustedProxies)
+}
+
+func TestDirectRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	req := newRequest(t, "192.168.0.1:443", "172.16.0.1")
+	assert.False(req.Proxied)
+	assert.Equal("192.168.0.1", req.ClientAddr())
+}
+
+func TestTrustedProxy(t *testing.T) {
+	assert := assert.New(t)
+
+	req := newRequest(t, "10.0.0.5:443", "172.16.0.1, 192.168.0.1", "10.0.1.1")
+	assert.True(req.Proxied)
+	assert.Equal("192.168.0.1", req.ClientAddr())
+}
+
+func TestTrustedProxyWithoutForwardedFor(t *testing.T) {
+	assert := assert.New(t)
+
+	req := newRequest(t, "10.0.0.5:443")
+	assert.True(req.Proxied)
+	assert.Equal("10.0.0.5", req.ClientAddr())
+}
+
+func TestMalformedForwardedFor(t *testing.T) {
+	assert := assert.New(t)
+
+	req := newRequest(t, "10.0.0.5:443", "192.168.0.1, garbage, 10.0.0.6")
+	assert.True(req.Proxied)
+	assert.Equal("10.0.0.6", req.ClientAddr())
+}
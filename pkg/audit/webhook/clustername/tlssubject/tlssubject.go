@@ -0,0 +1,108 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tlssubject
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/spf13/pflag"
+
+	"github.com/kubewharf/kelemetry/pkg/audit/webhook/clustername"
+	"github.com/kubewharf/kelemetry/pkg/manager"
+)
+
+func init() {
+	manager.Global.Provide("cluster-name-tls-subject", NewTlsSubjectSource)
+}
+
+type options struct {
+	pattern string
+}
+
+func (options *options) Setup(fs *pflag.FlagSet) {
+	fs.StringVar(
+		&options.pattern,
+		"cluster-name-tls-subject-pattern",
+		"",
+		"regular expression matched against the RFC 2253 subject of verified HTTPS client certificates, "+
+			"where the named group \"cluster\" is the cluster name, e.g. \"^CN=kube-apiserver,O=(?P<cluster>[^,]+)$\" "+
+			"(requires --http-tls-client-ca; enables the \"tls-subject\" cluster name resolver)",
+	)
+}
+
+func (options *options) EnableFlag() *bool {
+	isEnable := options.pattern != ""
+	return &isEnable
+}
+
+// TlsSubjectSource is the "tls-subject" cluster name resolver.
+type TlsSubjectSource struct {
+	options  options
+	resolver clustername.Resolver
+
+	pattern    *regexp.Regexp
+	groupIndex int
+}
+
+var _ clustername.Source = &TlsSubjectSource{}
+
+func NewTlsSubjectSource(resolver clustername.Resolver) *TlsSubjectSource {
+	return &TlsSubjectSource{
+		resolver: resolver,
+	}
+}
+
+func (source *TlsSubjectSource) Options() manager.Options {
+	return &source.options
+}
+
+func (source *TlsSubjectSource) Init(ctx context.Context) error {
+	pattern, err := regexp.Compile(source.options.pattern)
+	if err != nil {
+		return fmt.Errorf("invalid --cluster-name-tls-subject-pattern: %w", err)
+	}
+
+	groupIndex := pattern.SubexpIndex("cluster")
+	if groupIndex == -1 {
+		return fmt.Errorf("--cluster-name-tls-subject-pattern must contain a group named \"cluster\"")
+	}
+
+	source.pattern = pattern
+	source.groupIndex = groupIndex
+
+	source.resolver.AddSource("tls-subject", source)
+	return nil
+}
+
+func (source *TlsSubjectSource) Start(stopCh <-chan struct{}) error { return nil }
+
+func (source *TlsSubjectSource) Close() error { return nil }
+
+func (source *TlsSubjectSource) Resolve(req *clustername.Request) (string, bool) {
+	// VerifiedChains is only populated if the certificate is signed by --http-tls-client-ca
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+
+	subject := req.TLS.VerifiedChains[0][0].Subject.String()
+	match := source.pattern.FindStringSubmatch(subject)
+	if match == nil || match[source.groupIndex] == "" {
+		return "", false
+	}
+
+	return match[source.groupIndex], true
+}
@@ -0,0 +1,115 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tlssubject_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/kubewharf/kelemetry/pkg/audit/webhook/clustername"
+	"github.com/kubewharf/kelemetry/pkg/audit/webhook/clustername/tlssubject"
+	"github.com/kubewharf/kelemetry/pkg/manager"
+)
+
+type fakeResolver struct {
+	manager.BaseComponent
+	sources map[string]clustername.Source
+}
+
+func (resolver *fakeResolver) AddSource(name string, source clustername.Source) {
+	resolver.sources[name] = source
+}
+
+func (resolver *fakeResolver) Resolve(req *http.Request) string { panic("unused") }
+
+func newSource(t *testing.T, pattern string) (clustername.Source, error) {
+	t.Helper()
+
+	resolver := &fakeResolver{sources: map[string]clustername.Source{}}
+	source := tlssubject.NewTlsSubjectSource(resolver)
+
+	fs := pflag.NewFlagSet("test", pflag.PanicOnError)
+	source.Options().Setup(fs)
+	if err := fs.Parse([]string{"--cluster-name-tls-subject-pattern", pattern}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := source.Init(context.Background()); err != nil {
+		return nil, err
+	}
+
+	return resolver.sources["tls-subject"], nil
+}
+
+func resolve(source clustername.Source, state *tls.ConnectionState) (string, bool) {
+	req := httptest.NewRequest(http.MethodPost, "/audit", nil)
+	req.TLS = state
+	return source.Resolve(clustername.NewRequest(req, nil))
+}
+
+func verified(subject pkix.Name) *tls.ConnectionState {
+	cert := &x509.Certificate{Subject: subject}
+	return &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+		VerifiedChains:   [][]*x509.Certificate{{cert}},
+	}
+}
+
+func TestSubjectMatch(t *testing.T) {
+	assert := assert.New(t)
+
+	source, err := newSource(t, "^CN=kube-apiserver,O=(?P<cluster>[^,]+)$")
+	if !assert.Nil(err) {
+		return
+	}
+
+	cluster, found := resolve(source, verified(pkix.Name{CommonName: "kube-apiserver", Organization: []string{"prod"}}))
+	assert.True(found)
+	assert.Equal("prod", cluster)
+
+	_, found = resolve(source, verified(pkix.Name{CommonName: "kubectl", Organization: []string{"prod"}}))
+	assert.False(found)
+}
+
+func TestUnverifiedCertificate(t *testing.T) {
+	assert := assert.New(t)
+
+	source, err := newSource(t, "^CN=kube-apiserver,O=(?P<cluster>[^,]+)$")
+	if !assert.Nil(err) {
+		return
+	}
+
+	// certificates are only verified if --http-tls-client-ca is set
+	state := verified(pkix.Name{CommonName: "kube-apiserver", Organization: []string{"prod"}})
+	state.VerifiedChains = nil
+	_, found := resolve(source, state)
+	assert.False(found)
+
+	_, found = resolve(source, nil)
+	assert.False(found)
+}
+
+func TestPatternWithoutClusterGroup(t *testing.T) {
+	_, err := newSource(t, "^CN=kube-apiserver,O=([^,]+)$")
+	assert.NotNil(t, err)
+}
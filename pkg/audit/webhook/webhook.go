@@ -15,9 +15,14 @@
 package auditwebhook
 
 import (
+	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
@@ -26,8 +31,9 @@ import (
 	"k8s.io/utils/clock"
 
 	"github.com/kubewharf/kelemetry/pkg/audit"
+	"github.com/kubewharf/kelemetry/pkg/audit/webhook/auth"
 	"github.com/kubewharf/kelemetry/pkg/audit/webhook/clustername"
-	"github.com/kubewharf/kelemetry/pkg/http"
+	pkghttp "github.com/kubewharf/kelemetry/pkg/http"
 	"github.com/kubewharf/kelemetry/pkg/manager"
 	"github.com/kubewharf/kelemetry/pkg/metrics"
 	"github.com/kubewharf/kelemetry/pkg/util/channel"
@@ -38,12 +44,88 @@ func init() {
 	manager.Global.Provide("audit-webhook", New)
 }
 
+type overflowPolicy string
+
+const (
+	// overflowPolicyBlock blocks the publisher until the subscriber has space.
+	overflowPolicyBlock overflowPolicy = "block"
+	// overflowPolicyDropOldest discards the oldest queued message of the subscriber.
+	overflowPolicyDropOldest overflowPolicy = "drop-oldest"
+	// overflowPolicyReject responds to webhook requests with HTTP 429 so that the apiserver retries later.
+	// Messages from other audit sources block instead, since they have no client to retry.
+	overflowPolicyReject overflowPolicy = "reject"
+)
+
+var overflowPolicies = []overflowPolicy{overflowPolicyBlock, overflowPolicyDropOldest, overflowPolicyReject}
+
+// errSubscriberFull is returned when a subscriber with the reject policy does not have space for a request.
+var errSubscriberFull = errors.New("subscriber queue is full")
+
 type options struct {
-	enable bool
+	enable       bool
+	maxBodyBytes int64
+
+	subscriberCapacity         int
+	subscriberCapacities       map[string]int
+	subscriberOverflowPolicy   string
+	subscriberOverflowPolicies map[string]string
+	subscriberRejectRetryAfter int
 }
 
 func (options *options) Setup(fs *pflag.FlagSet) {
 	fs.BoolVar(&options.enable, "audit-webhook-enable", false, "enable audit webhook")
+	fs.Int64Var(
+		&options.maxBodyBytes,
+		"audit-webhook-max-body-bytes",
+		64<<20,
+		"maximum size of an audit webhook request body in bytes, both before and after decompression",
+	)
+	fs.IntVar(
+		&options.subscriberCapacity,
+		"audit-webhook-subscriber-capacity",
+		0,
+		"maximum number of messages buffered for each webhook subscriber; 0 for unbounded",
+	)
+	fs.StringToIntVar(
+		&options.subscriberCapacities,
+		"audit-webhook-subscriber-capacity-overrides",
+		map[string]int{},
+		"override --audit-webhook-subscriber-capacity for the specified subscribers, keyed by subscriber name",
+	)
+	fs.StringVar(
+		&options.subscriberOverflowPolicy,
+		"audit-webhook-subscriber-overflow-policy",
+		string(overflowPolicyReject),
+		fmt.Sprintf("action when a webhook subscriber is full, one of %q", overflowPolicies),
+	)
+	fs.StringToStringVar(
+		&options.subscriberOverflowPolicies,
+		"audit-webhook-subscriber-overflow-policy-overrides",
+		map[string]string{},
+		"override --audit-webhook-subscriber-overflow-policy for the specified subscribers, keyed by subscriber name",
+	)
+	fs.IntVar(
+		&options.subscriberRejectRetryAfter,
+		"audit-webhook-subscriber-reject-retry-after",
+		1,
+		"value of the Retry-After header in seconds when a request is rejected due to a full subscriber",
+	)
+}
+
+func (options *options) capacity(name string) int {
+	if capacity, exists := options.subscriberCapacities[name]; exists {
+		return capacity
+	}
+
+	return options.subscriberCapacity
+}
+
+func (options *options) overflowPolicy(name string) overflowPolicy {
+	if policy, exists := options.subscriberOverflowPolicies[name]; exists {
+		return overflowPolicy(policy)
+	}
+
+	return overflowPolicy(options.subscriberOverflowPolicy)
 }
 
 func (options *options) EnableFlag() *bool { return &options.enable }
@@ -52,12 +134,19 @@ type Webhook interface {
 	manager.Component
 
 	// AddSubscriber registers a new event handler.
-	// Handlers must consume all events, otherwise this would leak memory.
+	// Handlers should consume all events promptly,
+	// otherwise the queue grows until the capacity of the subscriber and the overflow policy takes effect.
 	AddSubscriber(name string) <-chan *audit.Message
 
 	// AddRawSubscriber registers a new event list handler.
-	// Handlers must consume all event lists, otherwise this would leak memory.
+	// Handlers should consume all event lists promptly,
+	// otherwise the queue grows until the capacity of the subscriber and the overflow policy takes effect.
 	AddRawSubscriber(name string) <-chan *audit.RawMessage
+
+	// Publish sends an event list received from another audit source to all subscribers,
+	// as if it was received from the webhook.
+	// Publish blocks while any subscriber with the block or reject policy is full.
+	Publish(rawMessage *audit.RawMessage)
 }
 
 type webhook struct {
@@ -66,22 +155,29 @@ type webhook struct {
 	clock               clock.Clock
 	metrics             metrics.Client
 	clusterNameResolver clustername.Resolver
-	server              http.Server
+	authenticator       auth.Authenticator
+	server              pkghttp.Server
 
 	ctx            context.Context
 	requestMetric  metrics.Metric
 	sendRateMetric metrics.Metric
+	dropMetric     metrics.Metric
+	rejectMetric   metrics.Metric
+	blockMetric    metrics.Metric
+
 	subscribers    []namedQueue[*audit.Message]
 	rawSubscribers []namedQueue[*audit.RawMessage]
 }
 
 type namedQueue[T any] struct {
-	name  string
-	queue *channel.UnboundedQueue[T]
+	name   string
+	policy overflowPolicy
+	queue  *channel.BoundedQueue[T]
 }
 
 type requestMetric struct {
 	Cluster string
+	Error   metrics.LabeledError
 }
 
 type queueMetricTags struct {
@@ -93,13 +189,15 @@ func New(
 	clock clock.Clock,
 	metrics metrics.Client,
 	clusterNameResolver clustername.Resolver,
-	server http.Server,
+	authenticator auth.Authenticator,
+	server pkghttp.Server,
 ) Webhook {
 	return &webhook{
 		logger:              logger,
 		clock:               clock,
 		metrics:             metrics,
 		clusterNameResolver: clusterNameResolver,
+		authenticator:       authenticator,
 		server:              server,
 	}
 }
@@ -109,9 +207,21 @@ func (webhook *webhook) Options() manager.Options {
 }
 
 func (webhook *webhook) Init(ctx context.Context) error {
+	if err := validateOverflowPolicy(webhook.options.subscriberOverflowPolicy); err != nil {
+		return fmt.Errorf("invalid --audit-webhook-subscriber-overflow-policy: %w", err)
+	}
+	for name, policy := range webhook.options.subscriberOverflowPolicies {
+		if err := validateOverflowPolicy(policy); err != nil {
+			return fmt.Errorf("invalid --audit-webhook-subscriber-overflow-policy-overrides for %q: %w", name, err)
+		}
+	}
+
 	webhook.ctx = ctx
 	webhook.requestMetric = webhook.metrics.New("audit_webhook_request", &requestMetric{})
 	webhook.sendRateMetric = webhook.metrics.New("audit_webhook_send_rate", &queueMetricTags{})
+	webhook.dropMetric = webhook.metrics.New("audit_webhook_subscriber_drop", &queueMetricTags{})
+	webhook.rejectMetric = webhook.metrics.New("audit_webhook_subscriber_reject", &queueMetricTags{})
+	webhook.blockMetric = webhook.metrics.New("audit_webhook_subscriber_block", &queueMetricTags{})
 
 	webhook.server.Routes().POST("/audit", webhook.handleRequest)
 	webhook.server.Routes().POST("/audit/:cluster", webhook.handleRequest)
@@ -119,6 +229,16 @@ func (webhook *webhook) Init(ctx context.Context) error {
 	return nil
 }
 
+func validateOverflowPolicy(policy string) error {
+	for _, known := range overflowPolicies {
+		if overflowPolicy(policy) == known {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown overflow policy %q", policy)
+}
+
 func (webhook *webhook) handleRequest(ctx *gin.Context) {
 	logger := webhook.logger.WithField("source", ctx.Request.RemoteAddr)
 	defer shutdown.RecoverPanic(logger)
@@ -131,55 +251,239 @@ func (webhook *webhook) handleRequest(ctx *gin.Context) {
 }
 
 func (webhook *webhook) handle(ctx *gin.Context, logger logrus.FieldLogger, metric *requestMetric) error {
+	authCluster, err := webhook.authenticator.Authenticate(ctx.Request)
+	if err != nil {
+		authErr := &auth.Error{}
+		if !errors.As(err, &authErr) {
+			return reject(ctx, metric, http.StatusInternalServerError, "Authenticate", err)
+		}
+
+		if authErr.Status == http.StatusUnauthorized {
+			ctx.Header("WWW-Authenticate", "Bearer")
+		}
+		return reject(ctx, metric, authErr.Status, authErr.Reason, err)
+	}
+
 	cluster := ctx.Param("cluster")
+	if authCluster != "" {
+		if cluster != "" && cluster != authCluster {
+			err := fmt.Errorf("credentials for cluster %q cannot send events of cluster %q", authCluster, cluster)
+			return reject(ctx, metric, http.StatusForbidden, "ClusterMismatch", err)
+		}
+		cluster = authCluster
+	}
 	if cluster == "" {
-		cluster = webhook.clusterNameResolver.Resolve(ctx.ClientIP())
+		cluster = webhook.clusterNameResolver.Resolve(ctx.Request)
 	}
 
 	metric.Cluster = cluster
 	logger = logger.WithField("cluster", cluster)
 
-	postData, err := ctx.GetRawData()
+	postData, err := webhook.readBody(ctx, metric)
 	if err != nil {
-		return fmt.Errorf("cannot read POST data: %w", err)
+		return err
 	}
 
 	eventList := &auditv1.EventList{}
 	err = json.Unmarshal(postData, eventList)
 	if err != nil {
-		return fmt.Errorf("cannot decode POST data: %w", err)
+		return reject(ctx, metric, http.StatusBadRequest, "Decode", fmt.Errorf("cannot decode POST data: %w", err))
 	}
 
 	logger.WithField("itemCount", len(eventList.Items)).Debug("Received EventList")
 
-	// TODO optimize these loops to reduce memory usage
-
-	rawMessage := &audit.RawMessage{
+	err = webhook.publish(ctx.Request.Context(), &audit.RawMessage{
 		Cluster:    cluster,
 		SourceAddr: ctx.ClientIP(),
 		EventList:  eventList,
+	}, true)
+	if err != nil {
+		if errors.Is(err, errSubscriberFull) {
+			ctx.Header("Retry-After", fmt.Sprint(webhook.options.subscriberRejectRetryAfter))
+			return reject(ctx, metric, http.StatusTooManyRequests, "SubscriberFull", err)
+		}
+
+		return reject(ctx, metric, http.StatusServiceUnavailable, "Publish", err)
+	}
+
+	return nil
+}
+
+// readBody reads the request body, decompressing it if necessary.
+func (webhook *webhook) readBody(ctx *gin.Context, metric *requestMetric) ([]byte, error) {
+	maxBytes := webhook.options.maxBodyBytes
+
+	var reader io.Reader = http.MaxBytesReader(ctx.Writer, ctx.Request.Body, maxBytes)
+
+	switch encoding := ctx.GetHeader("Content-Encoding"); encoding {
+	case "", "identity":
+	case "gzip":
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, reject(ctx, metric, http.StatusBadRequest, "Decompress", fmt.Errorf("cannot decompress POST data: %w", err))
+		}
+		defer gzipReader.Close()
+
+		// limit the decompressed size as well to avoid decompression bombs
+		reader = io.LimitReader(gzipReader, maxBytes+1)
+	default:
+		err := fmt.Errorf("unsupported Content-Encoding %q", encoding)
+		return nil, reject(ctx, metric, http.StatusUnsupportedMediaType, "UnsupportedEncoding", err)
+	}
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		maxBytesErr := &http.MaxBytesError{}
+		if errors.As(err, &maxBytesErr) {
+			err := fmt.Errorf("POST data exceeds %d bytes", maxBytes)
+			return nil, reject(ctx, metric, http.StatusRequestEntityTooLarge, "TooLarge", err)
+		}
+
+		return nil, reject(ctx, metric, http.StatusBadRequest, "ReadBody", fmt.Errorf("cannot read POST data: %w", err))
+	}
+
+	if int64(len(data)) > maxBytes {
+		err := fmt.Errorf("decompressed POST data exceeds %d bytes", maxBytes)
+		return nil, reject(ctx, metric, http.StatusRequestEntityTooLarge, "TooLarge", err)
+	}
+
+	return data, nil
+}
+
+// reject responds to the request with an error status and labels the request metric.
+func reject(ctx *gin.Context, metric *requestMetric, status int, reason string, err error) error {
+	metric.Error = metrics.LabelError(err, reason)
+	return ctx.AbortWithError(status, err)
+}
+
+func (webhook *webhook) Publish(rawMessage *audit.RawMessage) {
+	if err := webhook.publish(webhook.ctx, rawMessage, false); err != nil {
+		webhook.logger.WithError(err).WithField("cluster", rawMessage.Cluster).Warn("Audit events not delivered to all subscribers")
+	}
+}
+
+// publish sends rawMessage to all subscribers.
+//
+// Space is reserved in all subscribers before sending to any of them,
+// so that the message is either delivered to all subscribers or none of them.
+//
+// If canReject is true, errSubscriberFull is returned without sending to any subscriber
+// if a subscriber with the reject policy does not have space for the message.
+// Otherwise, subscribers with the reject policy block like those with the block policy.
+//
+// An error is also returned if ctx is canceled while blocking.
+func (webhook *webhook) publish(ctx context.Context, rawMessage *audit.RawMessage, canReject bool) (err error) {
+	itemCount := len(rawMessage.Items)
+
+	reservations := []func(){}
+	defer func() {
+		if err != nil {
+			for _, unreserve := range reservations {
+				unreserve()
+			}
+		}
+	}()
+
+	// reserve the subscribers that reject first, so that the request is rejected without waiting for other subscribers
+	if canReject {
+		full := []string{}
+		for _, ch := range webhook.rawSubscribers {
+			if ch.policy == overflowPolicyReject {
+				reservations, full = tryReserve(ch, 1, reservations, full)
+			}
+		}
+		for _, ch := range webhook.subscribers {
+			if ch.policy == overflowPolicyReject {
+				reservations, full = tryReserve(ch, itemCount, reservations, full)
+			}
+		}
+
+		if len(full) > 0 {
+			for _, name := range full {
+				webhook.rejectMetric.With(&queueMetricTags{Name: name}).Count(1)
+			}
+
+			return fmt.Errorf("%w: %s", errSubscriberFull, strings.Join(full, ", "))
+		}
+	}
+
+	// no lock is held while blocking, so concurrent requests are not serialized behind a full subscriber
+	for _, ch := range webhook.rawSubscribers {
+		if ch.policy == overflowPolicyBlock || (ch.policy == overflowPolicyReject && !canReject) {
+			if reservations, err = reserve(ctx, webhook, ch, 1, reservations); err != nil {
+				return err
+			}
+		}
+	}
+	for _, ch := range webhook.subscribers {
+		if ch.policy == overflowPolicyBlock || (ch.policy == overflowPolicyReject && !canReject) {
+			if reservations, err = reserve(ctx, webhook, ch, itemCount, reservations); err != nil {
+				return err
+			}
+		}
 	}
+
+	// all sends below are non-blocking
+
 	for _, ch := range webhook.rawSubscribers {
-		webhook.sendRateMetric.With(&queueMetricTags{Name: ch.name}).Count(1)
-		ch.queue.Send(rawMessage)
+		sendToQueue(webhook, ch, rawMessage)
 	}
 
-	for _, auditEvent := range eventList.Items {
+	// TODO optimize these loops to reduce memory usage
+
+	for _, auditEvent := range rawMessage.Items {
 		message := &audit.Message{
-			Cluster:    cluster,
-			SourceAddr: ctx.ClientIP(),
+			Cluster:    rawMessage.Cluster,
+			SourceAddr: rawMessage.SourceAddr,
 			Event:      auditEvent,
 		}
 
 		for _, ch := range webhook.subscribers {
-			webhook.sendRateMetric.With(&queueMetricTags{Name: ch.name}).Count(1)
-			ch.queue.Send(message)
+			sendToQueue(webhook, ch, message)
 		}
 	}
 
 	return nil
 }
 
+// tryReserve reserves space for n items in the subscriber,
+// appending the release function to reservations on success or the subscriber name to full on failure.
+func tryReserve[T any](ch namedQueue[T], n int, reservations []func(), full []string) ([]func(), []string) {
+	if !ch.queue.TryReserve(n) {
+		return reservations, append(full, ch.name)
+	}
+
+	return append(reservations, func() { ch.queue.Unreserve(n) }), full
+}
+
+// reserve reserves space for n items in the subscriber, blocking until it has space or ctx is canceled,
+// and appends the release function to reservations.
+func reserve[T any](ctx context.Context, webhook *webhook, ch namedQueue[T], n int, reservations []func()) ([]func(), error) {
+	if !ch.queue.TryReserve(n) {
+		defer webhook.blockMetric.DeferCount(webhook.clock.Now(), &queueMetricTags{Name: ch.name})
+		if err := ch.queue.Reserve(ctx, n); err != nil {
+			return reservations, fmt.Errorf("subscriber %q is full: %w", ch.name, err)
+		}
+	}
+
+	return append(reservations, func() { ch.queue.Unreserve(n) }), nil
+}
+
+// sendToQueue sends an item to the subscriber, which must have space reserved unless it uses the drop-oldest policy.
+func sendToQueue[T any](webhook *webhook, ch namedQueue[T], item T) {
+	tags := &queueMetricTags{Name: ch.name}
+	webhook.sendRateMetric.With(tags).Count(1)
+
+	if ch.policy == overflowPolicyDropOldest {
+		if ch.queue.SendDropOldest(item) {
+			webhook.dropMetric.With(tags).Count(1)
+		}
+		return
+	}
+
+	ch.queue.SendReserved(item)
+}
+
 func (webhook *webhook) Start(stopCh <-chan struct{}) error { return nil }
 
 func (webhook *webhook) Close() error {
@@ -195,17 +499,22 @@ func (webhook *webhook) Close() error {
 }
 
 func (webhook *webhook) AddSubscriber(name string) <-chan *audit.Message {
-	queue := channel.NewUnboundedQueue[*audit.Message](1)
-	queue.InitMetricLoop(webhook.metrics, "audit_webhook_subscriber_lag", &queueMetricTags{Name: name})
-
-	webhook.subscribers = append(webhook.subscribers, namedQueue[*audit.Message]{name: name, queue: queue})
-	return queue.Receiver()
+	ch := newNamedQueue[*audit.Message](webhook, name)
+	webhook.subscribers = append(webhook.subscribers, ch)
+	return ch.queue.Receiver()
 }
 
 func (webhook *webhook) AddRawSubscriber(name string) <-chan *audit.RawMessage {
-	queue := channel.NewUnboundedQueue[*audit.RawMessage](1)
-	queue.InitMetricLoop(webhook.metrics, "audit_webhook_subscriber_lag", &queueMetricTags{Name: name})
+	ch := newNamedQueue[*audit.RawMessage](webhook, name)
+	webhook.rawSubscribers = append(webhook.rawSubscribers, ch)
+	return ch.queue.Receiver()
+}
+
+func newNamedQueue[T any](webhook *webhook, name string) namedQueue[T] {
+	queue := channel.NewBoundedQueue[T](webhook.options.capacity(name))
+	tags := &queueMetricTags{Name: name}
+	queue.InitMetricLoop(webhook.metrics, "audit_webhook_subscriber_lag", tags)
+	webhook.metrics.NewMonitor("audit_webhook_subscriber_depth", tags, func() int64 { return int64(queue.Length()) })
 
-	webhook.rawSubscribers = append(webhook.rawSubscribers, namedQueue[*audit.RawMessage]{name: name, queue: queue})
-	return queue.Receiver()
+	return namedQueue[T]{name: name, policy: webhook.options.overflowPolicy(name), queue: queue}
 }
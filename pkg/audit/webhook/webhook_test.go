@@ -0,0 +1,364 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auditwebhook_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/types"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"github.com/kubewharf/kelemetry/pkg/audit"
+	auditwebhook "github.com/kubewharf/kelemetry/pkg/audit/webhook"
+	"github.com/kubewharf/kelemetry/pkg/audit/webhook/auth"
+	"github.com/kubewharf/kelemetry/pkg/audit/webhook/clustername"
+	"github.com/kubewharf/kelemetry/pkg/manager"
+	"github.com/kubewharf/kelemetry/pkg/metrics"
+)
+
+// fakeServer routes requests to a gin engine without listening on a port.
+type fakeServer struct {
+	manager.BaseComponent
+	engine *gin.Engine
+}
+
+func (server *fakeServer) Routes() gin.IRoutes { return server.engine }
+
+type webhookTest struct {
+	webhook auditwebhook.Webhook
+	server  *fakeServer
+	metrics *metrics.Mock
+}
+
+// newWebhook creates a webhook where the bearer token "token-a" belongs to "cluster-a".
+// subscribe is called before the webhook serves any request.
+func newWebhook(t *testing.T, subscribe func(webhook auditwebhook.Webhook), args ...string) *webhookTest {
+	t.Helper()
+
+	gin.SetMode(gin.TestMode)
+
+	logger := logrus.New()
+	clock := clocktesting.NewFakeClock(time.Unix(1600000000, 0))
+	metricsClient, metricsMock := metrics.NewMock(clock)
+
+	tokens := &auth.TokenSet{}
+	tokens.Replace(map[string]string{"token-a": "cluster-a"})
+
+	server := &fakeServer{engine: gin.New()}
+	resolver := clustername.NewResolver(metricsClient)
+	authenticator := auth.New(tokens)
+	webhook := auditwebhook.New(logger, clock, metricsClient, resolver, authenticator, server)
+
+	fs := pflag.NewFlagSet("test", pflag.PanicOnError)
+	for _, comp := range []manager.Component{resolver, authenticator, webhook} {
+		comp.Options().Setup(fs)
+	}
+	if err := fs.Parse(append([]string{"--audit-webhook-enable"}, args...)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, comp := range []manager.Component{resolver, authenticator, webhook} {
+		if err := comp.Init(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	subscribe(webhook)
+
+	stopCh := make(chan struct{})
+	for _, comp := range []manager.Component{resolver, authenticator, webhook} {
+		if err := comp.Start(stopCh); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		close(stopCh)
+		assert.Nil(t, webhook.Close())
+	})
+
+	return &webhookTest{webhook: webhook, server: server, metrics: metricsMock}
+}
+
+func newEventList(t *testing.T, auditIds ...string) []byte {
+	t.Helper()
+
+	eventList := &auditv1.EventList{}
+	for _, auditId := range auditIds {
+		eventList.Items = append(eventList.Items, auditv1.Event{AuditID: types.UID(auditId), Verb: audit.VerbUpdate})
+	}
+
+	data, err := json.Marshal(eventList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func gzipData(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	writer := gzip.NewWriter(buf)
+	if _, err := writer.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// post serves a webhook request, where headers are given as alternating keys and values.
+func (test *webhookTest) post(ctx context.Context, path string, body []byte, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body)).WithContext(ctx)
+	req.RemoteAddr = "192.168.0.1:443"
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+
+	recorder := httptest.NewRecorder()
+	test.server.engine.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func receive[T any](t *testing.T, ch <-chan T) T {
+	t.Helper()
+
+	select {
+	case item := <-ch:
+		return item
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout waiting for message")
+		panic("unreachable")
+	}
+}
+
+func TestGzipBody(t *testing.T) {
+	assert := assert.New(t)
+
+	var raw <-chan *audit.RawMessage
+	test := newWebhook(t, func(webhook auditwebhook.Webhook) { raw = webhook.AddRawSubscriber("raw") })
+
+	resp := test.post(context.Background(), "/audit/cluster-a", gzipData(t, newEventList(t, "1", "2")), "Content-Encoding", "gzip")
+	assert.Equal(http.StatusOK, resp.Code)
+
+	message := receive(t, raw)
+	assert.Equal("cluster-a", message.Cluster)
+	assert.Len(message.Items, 2)
+}
+
+func TestInvalidBody(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		args    []string
+		body    func(t *testing.T) []byte
+		headers []string
+		status  int
+	}{
+		{
+			name:    "UnsupportedEncoding",
+			body:    func(t *testing.T) []byte { return newEventList(t, "1") },
+			headers: []string{"Content-Encoding", "br"},
+			status:  http.StatusUnsupportedMediaType,
+		},
+		{
+			name:    "InvalidGzip",
+			body:    func(t *testing.T) []byte { return newEventList(t, "1") },
+			headers: []string{"Content-Encoding", "gzip"},
+			status:  http.StatusBadRequest,
+		},
+		{
+			name:   "TooLarge",
+			args:   []string{"--audit-webhook-max-body-bytes=64"},
+			body:   func(t *testing.T) []byte { return newEventList(t, "1", "2", "3") },
+			status: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name: "GzipBomb",
+			args: []string{"--audit-webhook-max-body-bytes=4096"},
+			body: func(t *testing.T) []byte {
+				// whitespace is valid JSON, but the decompressed body exceeds the limit although the compressed body does not
+				compressed := gzipData(t, bytes.Repeat([]byte{' '}, 1<<20))
+				if len(compressed) > 4096 {
+					t.Fatalf("compressed body has %d bytes", len(compressed))
+				}
+				return compressed
+			},
+			headers: []string{"Content-Encoding", "gzip"},
+			status:  http.StatusRequestEntityTooLarge,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			var raw <-chan *audit.RawMessage
+			test := newWebhook(t, func(webhook auditwebhook.Webhook) { raw = webhook.AddRawSubscriber("raw") }, tc.args...)
+
+			resp := test.post(context.Background(), "/audit/cluster-a", tc.body(t), tc.headers...)
+			assert.Equal(tc.status, resp.Code)
+
+			select {
+			case <-raw:
+				t.Fatal("rejected request must not be published")
+			case <-time.After(time.Millisecond * 10):
+			}
+		})
+	}
+}
+
+func TestBearerTokenCluster(t *testing.T) {
+	assert := assert.New(t)
+
+	var raw <-chan *audit.RawMessage
+	test := newWebhook(t, func(webhook auditwebhook.Webhook) { raw = webhook.AddRawSubscriber("raw") })
+
+	// the cluster is determined by the token if the path does not specify it
+	resp := test.post(context.Background(), "/audit", newEventList(t, "1"), "Authorization", "Bearer token-a")
+	assert.Equal(http.StatusOK, resp.Code)
+	assert.Equal("cluster-a", receive(t, raw).Cluster)
+
+	// a token cannot send events of another cluster
+	resp = test.post(context.Background(), "/audit/cluster-b", newEventList(t, "2"), "Authorization", "Bearer token-a")
+	assert.Equal(http.StatusForbidden, resp.Code)
+
+	resp = test.post(context.Background(), "/audit/cluster-a", newEventList(t, "3"), "Authorization", "Bearer token-b")
+	assert.Equal(http.StatusUnauthorized, resp.Code)
+	assert.Equal("Bearer", resp.Header().Get("WWW-Authenticate"))
+
+	select {
+	case <-raw:
+		t.Fatal("rejected request must not be published")
+	case <-time.After(time.Millisecond * 10):
+	}
+}
+
+// postUntil posts event lists until the response status is not 200, returning the number of accepted requests.
+// Each subscriber has one message in flight to the receiver, so a subscriber with capacity 1 is full after at most 2 requests.
+func (test *webhookTest) postUntil(t *testing.T, timeout time.Duration) (int, *httptest.ResponseRecorder) {
+	t.Helper()
+
+	for accepted := 0; accepted < 3; accepted++ {
+		ctx, cancelFunc := context.WithTimeout(context.Background(), timeout)
+		resp := test.post(ctx, "/audit/cluster-a", newEventList(t, "1"))
+		cancelFunc()
+
+		if resp.Code != http.StatusOK {
+			return accepted, resp
+		}
+	}
+
+	t.Fatal("subscriber never becomes full")
+	panic("unreachable")
+}
+
+// assertReceived asserts that exactly count messages are received from ch.
+func assertReceived[T any](t *testing.T, ch <-chan T, count int) {
+	t.Helper()
+
+	for i := 0; i < count; i++ {
+		receive(t, ch)
+	}
+
+	select {
+	case <-ch:
+		t.Fatalf("received more than %d messages", count)
+	case <-time.After(time.Millisecond * 10):
+	}
+}
+
+func TestRejectFullSubscriber(t *testing.T) {
+	assert := assert.New(t)
+
+	var large, small <-chan *audit.RawMessage
+	test := newWebhook(t, func(webhook auditwebhook.Webhook) {
+		// the space reserved in "large" must be released when "small" is full
+		large = webhook.AddRawSubscriber("large")
+		small = webhook.AddRawSubscriber("small")
+	},
+		"--audit-webhook-subscriber-capacity=10",
+		"--audit-webhook-subscriber-capacity-overrides=small=1",
+		"--audit-webhook-subscriber-overflow-policy=reject",
+		"--audit-webhook-subscriber-reject-retry-after=5",
+	)
+
+	accepted, resp := test.postUntil(t, time.Second*5)
+	assert.Equal(http.StatusTooManyRequests, resp.Code)
+	assert.Equal("5", resp.Header().Get("Retry-After"))
+
+	// more rejections than the capacity of "large"
+	for i := 0; i < 20; i++ {
+		assert.Equal(http.StatusTooManyRequests, test.post(context.Background(), "/audit/cluster-a", newEventList(t, "1")).Code)
+	}
+	assert.Equal(int64(21), test.metrics.Get("audit_webhook_subscriber_reject", map[string]string{"name": "small"}).Int)
+	assert.Equal(int64(0), test.metrics.Get("audit_webhook_subscriber_reject", map[string]string{"name": "large"}).Int)
+
+	go func() {
+		for range small {
+		}
+	}()
+
+	assert.Eventually(func() bool {
+		return test.post(context.Background(), "/audit/cluster-a", newEventList(t, "1")).Code == http.StatusOK
+	}, time.Second*5, time.Millisecond)
+	assertReceived(t, large, accepted+1)
+}
+
+func TestCancelBlockedRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	var large, small <-chan *audit.RawMessage
+	test := newWebhook(t, func(webhook auditwebhook.Webhook) {
+		// the space reserved in "large" must be released when the request is canceled while blocking on "small"
+		large = webhook.AddRawSubscriber("large")
+		small = webhook.AddRawSubscriber("small")
+	},
+		"--audit-webhook-subscriber-capacity=10",
+		"--audit-webhook-subscriber-capacity-overrides=small=1",
+		"--audit-webhook-subscriber-overflow-policy=reject",
+		"--audit-webhook-subscriber-overflow-policy-overrides=small=block",
+	)
+
+	accepted, resp := test.postUntil(t, time.Millisecond*20)
+	assert.Equal(http.StatusServiceUnavailable, resp.Code)
+
+	// more cancellations than the capacity of "large"
+	for i := 0; i < 20; i++ {
+		ctx, cancelFunc := context.WithCancel(context.Background())
+		cancelFunc()
+		assert.Equal(http.StatusServiceUnavailable, test.post(ctx, "/audit/cluster-a", newEventList(t, "1")).Code)
+	}
+
+	go func() {
+		for range small {
+		}
+	}()
+
+	// the request blocks until "small" has space
+	assert.Equal(http.StatusOK, test.post(context.Background(), "/audit/cluster-a", newEventList(t, "1")).Code)
+	assertReceived(t, large, accepted+1)
+}
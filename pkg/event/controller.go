@@ -33,6 +33,7 @@ import (
 	"k8s.io/utils/clock"
 
 	"github.com/kubewharf/kelemetry/pkg/aggregator"
+	"github.com/kubewharf/kelemetry/pkg/aggregator/deadletter"
 	"github.com/kubewharf/kelemetry/pkg/filter"
 	"github.com/kubewharf/kelemetry/pkg/k8s"
 	"github.com/kubewharf/kelemetry/pkg/k8s/discovery"
@@ -61,6 +62,7 @@ type options struct {
 	configMapName         string
 	configMapNamespace    string
 	workerCount           int
+	batchSize             int
 }
 
 func (options *options) Setup(fs *pflag.FlagSet) {
@@ -94,6 +96,12 @@ func (options *options) Setup(fs *pflag.FlagSet) {
 		8,
 		"number of worker counts",
 	)
+	fs.IntVar(
+		&options.batchSize,
+		"event-informer-batch-size",
+		100,
+		"maximum number of pending events sent to the aggregator together by each worker",
+	)
 	options.electorOptions.SetupOptions(
 		fs,
 		"event-informer",
@@ -109,6 +117,7 @@ type controller struct {
 	logger         logrus.FieldLogger
 	clock          clock.Clock
 	aggregator     aggregator.Aggregator
+	deadLetter     deadletter.Queue
 	clients        k8s.Clients
 	filter         filter.Filter
 	metrics        metrics.Client
@@ -131,6 +140,7 @@ func New(
 	logger logrus.FieldLogger,
 	clock clock.Clock,
 	aggregator aggregator.Aggregator,
+	deadLetter deadletter.Queue,
 	clients k8s.Clients,
 	discoveryCache discovery.DiscoveryCache,
 	filter filter.Filter,
@@ -140,6 +150,7 @@ func New(
 		logger:            logger,
 		clock:             clock,
 		aggregator:        aggregator,
+		deadLetter:        deadLetter,
 		clients:           clients,
 		discoveryCache:    discoveryCache,
 		filter:            filter,
@@ -238,14 +249,31 @@ func (ctrl *controller) runLeader(stopCh <-chan struct{}) {
 			<-startReadyCh
 
 			for {
+				var batch []*corev1.Event
+
 				select {
 				case event := <-addCh:
-					ctrl.handleEvent(event)
+					batch = append(batch, event)
 				case event := <-replaceCh:
-					ctrl.handleEvent(event)
+					batch = append(batch, event)
 				case <-stopCh:
 					return
 				}
+
+				// take all events that are immediately available without waiting for more
+			drain:
+				for len(batch) < ctrl.options.batchSize {
+					select {
+					case event := <-addCh:
+						batch = append(batch, event)
+					case event := <-replaceCh:
+						batch = append(batch, event)
+					default:
+						break drain
+					}
+				}
+
+				ctrl.handleEvents(batch)
 			}
 		}(workerId)
 	}
@@ -257,10 +285,57 @@ func (ctrl *controller) runLeader(stopCh <-chan struct{}) {
 	ctrl.syncConfigMap(startReadyCh, stopCh)
 }
 
-func (ctrl *controller) handleEvent(event *corev1.Event) {
+type pendingEvent struct {
+	logger    logrus.FieldLogger
+	metric    *eventHandleMetric
+	startTime time.Time
+	item      aggregator.BatchItem
+}
+
+func (ctrl *controller) handleEvents(events []*corev1.Event) {
+	batch := make([]*pendingEvent, 0, len(events))
+	for _, event := range events {
+		if pending := ctrl.prepareEvent(event); pending != nil {
+			batch = append(batch, pending)
+		}
+	}
+
+	if len(batch) == 0 {
+		return
+	}
+
+	items := make([]aggregator.BatchItem, len(batch))
+	for i, pending := range batch {
+		items[i] = pending.item
+	}
+
+	ctx, cancelFunc := context.WithCancel(ctrl.ctx)
+	defer cancelFunc()
+
+	errs := ctrl.aggregator.SendBatch(ctx, items)
+
+	for i, pending := range batch {
+		if errs[i] != nil {
+			pending.logger.WithError(errs[i]).Error("Cannot send trace")
+			pending.metric.Error = metrics.LabelError(errs[i], "SendTrace")
+
+			if err := ctrl.deadLetter.Push(ctx, items[i], errs[i]); err != nil {
+				pending.logger.WithError(err).Error("Cannot push to dead-letter queue")
+			}
+		} else {
+			pending.logger.Debug("Send")
+		}
+
+		ctrl.eventHandleMetric.DeferCount(pending.startTime, pending.metric)
+	}
+}
+
+// prepareEvent returns the aggregator event for a Kubernetes event,
+// or nil if the event should not be sent, in which case the handle metric is already reported.
+func (ctrl *controller) prepareEvent(event *corev1.Event) (pending *pendingEvent) {
 	isLeader := atomic.LoadUint32(&ctrl.isLeader)
 	if isLeader == 0 {
-		return
+		return nil
 	}
 
 	metric := &eventHandleMetric{
@@ -268,7 +343,12 @@ func (ctrl *controller) handleEvent(event *corev1.Event) {
 		Version: event.InvolvedObject.GroupVersionKind().Version,
 		Kind:    event.InvolvedObject.Kind,
 	}
-	defer ctrl.eventHandleMetric.DeferCount(ctrl.clock.Now(), metric)
+	startTime := ctrl.clock.Now()
+	defer func() {
+		if pending == nil {
+			ctrl.eventHandleMetric.DeferCount(startTime, metric)
+		}
+	}()
 
 	logger := ctrl.logger.WithField("event", event.Name).WithField("subject", event.InvolvedObject)
 
@@ -282,17 +362,17 @@ func (ctrl *controller) handleEvent(event *corev1.Event) {
 		metric.TimestampType = ""
 		metric.Error = metrics.MakeLabeledError("InferTimestamp")
 		logger.WithField("object", event).Warn("cannot infer timestamp")
-		return
+		return nil
 	}
 
 	if eventTime.Before(ctrl.lastEventTime) {
 		metric.Error = metrics.MakeLabeledError("BeforeRestart")
-		return
+		return nil
 	}
 
 	if ctrl.clock.Since(eventTime) > 5*time.Minute {
 		metric.Error = metrics.MakeLabeledError("EventTooOld")
-		return
+		return nil
 	}
 
 	logger = logger.WithField("eventTime", eventTime)
@@ -307,7 +387,7 @@ func (ctrl *controller) handleEvent(event *corev1.Event) {
 
 	if !ctrl.filter.TestGvk(clusterName, event.InvolvedObject.GroupVersionKind()) {
 		metric.Error = metrics.MakeLabeledError("Filtered")
-		return
+		return nil
 	}
 
 	aggregatorEvent := aggregator.NewEvent("status", event.Reason, eventTime, "event").
@@ -319,13 +399,13 @@ func (ctrl *controller) handleEvent(event *corev1.Event) {
 	if err != nil {
 		logger.WithError(err).Error("cannot init discovery cache for target cluster")
 		metric.Error = metrics.MakeLabeledError("invalid cluster")
-		return
+		return nil
 	}
 	gvr, found := cdc.LookupResource(event.InvolvedObject.GroupVersionKind())
 	if !found {
 		logger.WithField("gvk", event.InvolvedObject.GroupVersionKind()).Error("unknown gvk")
 		metric.Error = metrics.MakeLabeledError("UnknownGVK")
-		return
+		return nil
 	}
 
 	metric.Resource = gvr.Resource
@@ -336,22 +416,21 @@ func (ctrl *controller) handleEvent(event *corev1.Event) {
 		Resource: gvr.Resource,
 	}).Histogram(ctrl.clock.Since(eventTime).Nanoseconds())
 
-	ctx, cancelFunc := context.WithCancel(ctrl.ctx)
-	defer cancelFunc()
-
-	if err := ctrl.aggregator.Send(ctx, util.ObjectRef{
-		Cluster:              clusterName,
-		GroupVersionResource: gvr,
-		Namespace:            event.InvolvedObject.Namespace,
-		Name:                 event.InvolvedObject.Name,
-		Uid:                  event.InvolvedObject.UID,
-	}, aggregatorEvent, nil); err != nil {
-		logger.WithError(err).Error("Cannot send trace")
-		metric.Error = metrics.LabelError(err, "SendTrace")
-		return
+	return &pendingEvent{
+		logger:    logger,
+		metric:    metric,
+		startTime: startTime,
+		item: aggregator.BatchItem{
+			Object: util.ObjectRef{
+				Cluster:              clusterName,
+				GroupVersionResource: gvr,
+				Namespace:            event.InvolvedObject.Namespace,
+				Name:                 event.InvolvedObject.Name,
+				Uid:                  event.InvolvedObject.UID,
+			},
+			Event: aggregatorEvent,
+		},
 	}
-
-	logger.Debug("Send")
 }
 
 func (ctrl *controller) syncConfigMap(startReadyCh chan<- struct{}, stopCh <-chan struct{}) {
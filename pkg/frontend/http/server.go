@@ -23,8 +23,10 @@ import (
 	"github.com/jaegertracing/jaeger/storage/spanstore"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/utils/clock"
 
+	"github.com/kubewharf/kelemetry/pkg/aggregator/window"
 	"github.com/kubewharf/kelemetry/pkg/frontend/clusterlist"
 	jaegerreader "github.com/kubewharf/kelemetry/pkg/frontend/reader"
 	tfconfig "github.com/kubewharf/kelemetry/pkg/frontend/tf/config"
@@ -57,6 +59,7 @@ type server struct {
 	spanReader       jaegerreader.Interface
 	clusterList      clusterlist.Lister
 	transformConfigs tfconfig.Provider
+	windows          window.Config
 
 	ctx           context.Context
 	requestMetric metrics.Metric
@@ -74,6 +77,7 @@ func NewRedirectServer(
 	spanReader jaegerreader.Interface,
 	clusterList clusterlist.Lister,
 	transformConfigs tfconfig.Provider,
+	windows window.Config,
 ) *server {
 	return &server{
 		logger:           logger,
@@ -83,6 +87,7 @@ func NewRedirectServer(
 		spanReader:       spanReader,
 		clusterList:      clusterList,
 		transformConfigs: transformConfigs,
+		windows:          windows,
 	}
 }
 
@@ -117,6 +122,7 @@ func (server *server) Start(stopCh <-chan struct{}) error { return nil }
 
 func (server *server) handleGet(ctx *gin.Context, metric *requestMetric) (code int, err error) {
 	cluster := ctx.Query("cluster")
+	group := ctx.Query("group")
 	resource := ctx.Query("resource")
 	namespace := ctx.Query("namespace")
 	name := ctx.Query("name")
@@ -150,13 +156,29 @@ func (server *server) handleGet(ctx *gin.Context, metric *requestMetric) (code i
 	if namespace != "" {
 		tags["namespace"] = namespace
 	}
+	if group != "" {
+		tags["group"] = group
+	}
+
+	var spanWindow window.Window
+	if group != "" {
+		spanWindow = server.windows.Get(schema.GroupResource{Group: group, Resource: resource})
+	} else {
+		// overrides keyed by "group/resource" only match if the group is specified
+		spanWindow, err = server.windows.GetAnyGroup(resource)
+		if err != nil {
+			metric.Error = metrics.MakeLabeledError("AmbiguousGroup")
+			return 400, err
+		}
+	}
+	windowStart := spanWindow.Start(timestamp)
 
 	parameters := &spanstore.TraceQueryParameters{
 		ServiceName:   server.transformConfigs.DefaultName(),
 		OperationName: cluster,
 		Tags:          tags,
-		StartTimeMin:  timestamp.Truncate(time.Minute * 30),
-		StartTimeMax:  timestamp.Truncate(time.Minute * 30).Add(time.Minute * 30),
+		StartTimeMin:  windowStart,
+		StartTimeMax:  windowStart.Add(spanWindow.SpanTtl),
 	}
 	traceIDs, err := server.spanReader.FindTraceIDs(context.Background(), parameters)
 	if err != nil {
@@ -25,7 +25,9 @@ import (
 	"github.com/jaegertracing/jaeger/storage/spanstore"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 
+	"github.com/kubewharf/kelemetry/pkg/aggregator/window"
 	jaegerbackend "github.com/kubewharf/kelemetry/pkg/frontend/backend"
 	"github.com/kubewharf/kelemetry/pkg/frontend/clusterlist"
 	transform "github.com/kubewharf/kelemetry/pkg/frontend/tf"
@@ -57,6 +59,7 @@ type spanReader struct {
 	clusterList      clusterlist.Lister
 	transformer      *transform.Transformer
 	transformConfigs tfconfig.Provider
+	windows          window.Config
 }
 
 func newSpanReader(
@@ -66,6 +69,7 @@ func newSpanReader(
 	clusterList clusterlist.Lister,
 	transformer *transform.Transformer,
 	transformConfigs tfconfig.Provider,
+	windows window.Config,
 ) Interface {
 	return &spanReader{
 		logger:           logger,
@@ -74,6 +78,7 @@ func newSpanReader(
 		clusterList:      clusterList,
 		transformer:      transformer,
 		transformConfigs: transformConfigs,
+		windows:          windows,
 	}
 }
 
@@ -128,6 +133,28 @@ func (reader *spanReader) FindTraceIDs(ctx context.Context, query *spanstore.Tra
 }
 
 func (reader *spanReader) FindTraces(ctx context.Context, query *spanstore.TraceQueryParameters) ([]*model.Trace, error) {
+	if !query.StartTimeMin.IsZero() {
+		// object spans start at the beginning of their window,
+		// so spans intersecting with the query range may start before StartTimeMin.
+		var spanWindow window.Window
+		if resource, hasResource := query.Tags["resource"]; hasResource {
+			if group, hasGroup := query.Tags["group"]; hasGroup {
+				spanWindow = reader.windows.Get(schema.GroupResource{Group: group, Resource: resource})
+			} else if anyGroupWindow, err := reader.windows.GetAnyGroup(resource); err == nil {
+				spanWindow = anyGroupWindow
+			} else {
+				// the group is ambiguous, so search with the longest window to include spans of all groups
+				spanWindow = reader.windows.Max()
+			}
+		} else {
+			spanWindow = reader.windows.Max()
+		}
+
+		queryCopy := *query
+		queryCopy.StartTimeMin = spanWindow.Start(query.StartTimeMin)
+		query = &queryCopy
+	}
+
 	thumbnails, err := reader.backend.List(ctx, query)
 	if err != nil {
 		return nil, err
@@ -171,6 +171,7 @@ func getCollapseStep() tfconfig.Step {
 		LogTypeMapping: map[zconstants.LogType]string{
 			zconstants.LogTypeEventMessage:   "message",
 			zconstants.LogTypeObjectSnapshot: "snapshot",
+			zconstants.LogTypeObjectPatch:    "patch",
 			zconstants.LogTypeRealError:      "error",
 			zconstants.LogTypeRealVerbose:    "",
 			zconstants.LogTypeKelemetryError: "_debug",
@@ -16,10 +16,13 @@ package http
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"os"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -43,8 +46,9 @@ type options struct {
 	address string
 	port    uint16
 
-	cert string
-	key  string
+	cert     string
+	key      string
+	clientCa string
 
 	readTimeout       time.Duration
 	readHeaderTimeout time.Duration
@@ -55,6 +59,12 @@ func (options *options) Setup(fs *pflag.FlagSet) {
 	fs.Uint16Var(&options.port, "http-port", 8080, "HTTP server port")
 	fs.StringVar(&options.cert, "http-tls-cert", "", "HTTP server TLS certificate (leave empty to disable HTTPS)")
 	fs.StringVar(&options.key, "http-tls-key", "", "HTTP server TLS key (leave empty to disable HTTPS)")
+	fs.StringVar(
+		&options.clientCa,
+		"http-tls-client-ca",
+		"",
+		"CA bundle to verify HTTPS client certificates if presented (leave empty to ignore client certificates)",
+	)
 	fs.DurationVar(&options.readTimeout, "http-read-timeout", 0, "HTTP server timeout for reading requests")
 	fs.DurationVar(
 		&options.readHeaderTimeout,
@@ -103,6 +113,25 @@ func (server *server) Start(stopCh <-chan struct{}) error {
 	}
 	server.server = hs
 
+	if server.options.clientCa != "" {
+		caData, err := os.ReadFile(server.options.clientCa)
+		if err != nil {
+			return fmt.Errorf("cannot read client CA bundle: %w", err)
+		}
+
+		clientCas := x509.NewCertPool()
+		if !clientCas.AppendCertsFromPEM(caData) {
+			return fmt.Errorf("no certificates found in client CA bundle %q", server.options.clientCa)
+		}
+
+		// client certificates are optional so that endpoints without authentication remain accessible
+		hs.TLSConfig = &tls.Config{
+			ClientCAs:  clientCas,
+			ClientAuth: tls.VerifyClientCertIfGiven,
+			MinVersion: tls.VersionTLS12,
+		}
+	}
+
 	listener, err := net.Listen("tcp", hs.Addr)
 	if err != nil {
 		return fmt.Errorf("cannot listen on %s: %w", hs.Addr, err)
@@ -16,19 +16,37 @@
 package kelemetry_pkg
 
 import (
+	_ "github.com/kubewharf/kelemetry/pkg/aggregator/deadletter/api"
+	_ "github.com/kubewharf/kelemetry/pkg/aggregator/deadletter/local"
+	_ "github.com/kubewharf/kelemetry/pkg/aggregator/spancache/bolt"
 	_ "github.com/kubewharf/kelemetry/pkg/aggregator/spancache/etcd"
 	_ "github.com/kubewharf/kelemetry/pkg/aggregator/spancache/local"
+	_ "github.com/kubewharf/kelemetry/pkg/aggregator/spancache/redis"
+	_ "github.com/kubewharf/kelemetry/pkg/aggregator/tracer/file"
 	_ "github.com/kubewharf/kelemetry/pkg/aggregator/tracer/otel"
 	_ "github.com/kubewharf/kelemetry/pkg/annotationlinker"
 	_ "github.com/kubewharf/kelemetry/pkg/audit"
 	_ "github.com/kubewharf/kelemetry/pkg/audit/consumer"
+	_ "github.com/kubewharf/kelemetry/pkg/audit/dedup/etcd"
+	_ "github.com/kubewharf/kelemetry/pkg/audit/dedup/local"
 	_ "github.com/kubewharf/kelemetry/pkg/audit/dump"
 	_ "github.com/kubewharf/kelemetry/pkg/audit/forward"
+	_ "github.com/kubewharf/kelemetry/pkg/audit/identity"
+	_ "github.com/kubewharf/kelemetry/pkg/audit/logfile"
+	_ "github.com/kubewharf/kelemetry/pkg/audit/mq/kafka"
 	_ "github.com/kubewharf/kelemetry/pkg/audit/mq/local"
+	_ "github.com/kubewharf/kelemetry/pkg/audit/mq/wal"
+	_ "github.com/kubewharf/kelemetry/pkg/audit/patch"
 	_ "github.com/kubewharf/kelemetry/pkg/audit/producer"
+	_ "github.com/kubewharf/kelemetry/pkg/audit/subresource"
 	_ "github.com/kubewharf/kelemetry/pkg/audit/webhook"
+	_ "github.com/kubewharf/kelemetry/pkg/audit/webhook/auth"
+	_ "github.com/kubewharf/kelemetry/pkg/audit/webhook/auth/file"
+	_ "github.com/kubewharf/kelemetry/pkg/audit/webhook/auth/secret"
 	_ "github.com/kubewharf/kelemetry/pkg/audit/webhook/clustername"
-	_ "github.com/kubewharf/kelemetry/pkg/audit/webhook/clustername/address"
+	_ "github.com/kubewharf/kelemetry/pkg/audit/webhook/clustername/cidr"
+	_ "github.com/kubewharf/kelemetry/pkg/audit/webhook/clustername/header"
+	_ "github.com/kubewharf/kelemetry/pkg/audit/webhook/clustername/tlssubject"
 	_ "github.com/kubewharf/kelemetry/pkg/diff/api"
 	_ "github.com/kubewharf/kelemetry/pkg/diff/cache/etcd"
 	_ "github.com/kubewharf/kelemetry/pkg/diff/cache/local"
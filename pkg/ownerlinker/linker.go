@@ -91,7 +91,7 @@ func (ctrl *Controller) Close() error {
 	return nil
 }
 
-func (ctrl *Controller) Lookup(ctx context.Context, object util.ObjectRef) *util.ObjectRef {
+func (ctrl *Controller) Lookup(ctx context.Context, object util.ObjectRef) []linker.Relation {
 	raw := object.Raw
 
 	logger := ctrl.logger.WithField("object", object)
@@ -113,39 +113,45 @@ func (ctrl *Controller) Lookup(ctx context.Context, object util.ObjectRef) *util
 		}
 	}
 
+	relations := []linker.Relation{}
+
 	for _, owner := range raw.GetOwnerReferences() {
+		groupVersion, err := schema.ParseGroupVersion(owner.APIVersion)
+		if err != nil {
+			logger.WithError(err).Warn("invalid owner apiVersion")
+			continue
+		}
+
+		gvk := groupVersion.WithKind(owner.Kind)
+		cdc, err := ctrl.discoveryCache.ForCluster(object.Cluster)
+		if err != nil {
+			logger.WithError(err).Error("cannot access cluster from object reference")
+			continue
+		}
+
+		gvr, exists := cdc.LookupResource(gvk)
+		if !exists {
+			logger.WithField("gvk", gvk).Warn("Object contains owner reference of unknown GVK")
+			continue
+		}
+
+		ref := util.ObjectRef{
+			Cluster:              object.Cluster, // inherited from the same cluster
+			GroupVersionResource: gvr,
+			Namespace:            object.Namespace,
+			Name:                 owner.Name,
+			Uid:                  owner.UID,
+		}
+
 		if owner.Controller != nil && *owner.Controller {
-			groupVersion, err := schema.ParseGroupVersion(owner.APIVersion)
-			if err != nil {
-				logger.WithError(err).Warn("invalid owner apiVersion")
-				continue
-			}
-
-			gvk := groupVersion.WithKind(owner.Kind)
-			cdc, err := ctrl.discoveryCache.ForCluster(object.Cluster)
-			if err != nil {
-				logger.WithError(err).Error("cannot access cluster from object reference")
-				continue
-			}
-
-			gvr, exists := cdc.LookupResource(gvk)
-			if !exists {
-				logger.WithField("gvk", gvk).Warn("Object contains owner reference of unknown GVK")
-				continue
-			}
-
-			ret := &util.ObjectRef{
-				Cluster:              object.Cluster, // inherited from the same cluster
-				GroupVersionResource: gvr,
-				Namespace:            object.Namespace,
-				Name:                 owner.Name,
-				Uid:                  owner.UID,
-			}
-			logger.WithField("owner", ret).Debug("Resolved owner")
-
-			return ret
+			logger.WithField("owner", ref).Debug("Resolved owner")
+			// the controller is the primary parent, so it must precede other owners
+			relations = append([]linker.Relation{{Object: ref, Role: linker.RoleParent, Type: "owner"}}, relations...)
+		} else {
+			logger.WithField("owner", ref).Debug("Resolved non-controller owner")
+			relations = append(relations, linker.Relation{Object: ref, Role: linker.RoleLink, Type: "owner"})
 		}
 	}
 
-	return nil
+	return relations
 }
@@ -15,6 +15,7 @@
 package channel
 
 import (
+	"context"
 	"math"
 	"sync"
 
@@ -39,7 +40,7 @@ func NewUnboundedQueue[T any](initialCapacity int) *UnboundedQueue[T] {
 	receiver := make(chan T)
 	stopCh := make(chan struct{}, 1)
 
-	go receiverLoop(deque, notifier, receiver, stopCh)
+	go receiverLoop(deque, notifier, receiver, stopCh, nil)
 
 	return &UnboundedQueue[T]{
 		deque:    deque,
@@ -80,13 +81,19 @@ func (uq *UnboundedQueue[T]) Send(obj T) {
 	}
 }
 
-func receiverLoop[T any](deque *Deque[T], notifier <-chan struct{}, receiver chan<- T, stopCh <-chan struct{}) {
+// receiverLoop moves items from deque to receiver.
+// onPop is called whenever an item is removed from the deque, if non-nil.
+func receiverLoop[T any](deque *Deque[T], notifier <-chan struct{}, receiver chan<- T, stopCh <-chan struct{}, onPop func()) {
 	defer shutdown.RecoverPanic(logrus.New())
 
 	for {
 		item, hasItem := deque.PopFront()
 
 		if hasItem {
+			if onPop != nil {
+				onPop()
+			}
+
 			select {
 			case <-stopCh:
 				// queue stopped, close the receiver
@@ -115,6 +122,224 @@ func receiverLoop[T any](deque *Deque[T], notifier <-chan struct{}, receiver cha
 	}
 }
 
+// BoundedQueue is a channel with a maximum number of buffered items.
+//
+// The item currently being received is not counted towards the capacity.
+// Space can be reserved in advance so that multiple items can be sent
+// after checking that all of them fit, without holding any lock in between.
+type BoundedQueue[T any] struct {
+	deque    *Deque[T]
+	capacity int
+	// reserved is the number of slots reserved by TryReserve or Reserve but not sent yet, guarded by deque.lock.
+	reserved int
+	notifier chan<- struct{}
+	receiver <-chan T
+	stopCh   chan<- struct{}
+
+	spaceLock sync.Mutex
+	// spaceCh is closed and replaced when space may have become available, if spaceWaited is true.
+	spaceCh     chan struct{}
+	spaceWaited bool
+}
+
+// NewBoundedQueue creates a new BoundedQueue with the specified capacity.
+// The queue is unbounded if capacity is not positive.
+func NewBoundedQueue[T any](capacity int) *BoundedQueue[T] {
+	initialCapacity := 1
+	if capacity > 0 && capacity < 1024 {
+		// the deque expands when it has no free slot, so preallocate one more slot than the capacity
+		initialCapacity = capacity + 1
+	}
+
+	deque := NewDeque[T](initialCapacity)
+	notifier := make(chan struct{}, 1)
+	receiver := make(chan T)
+	stopCh := make(chan struct{}, 1)
+
+	bq := &BoundedQueue[T]{
+		deque:    deque,
+		capacity: capacity,
+		notifier: notifier,
+		receiver: receiver,
+		stopCh:   stopCh,
+		spaceCh:  make(chan struct{}),
+	}
+
+	go receiverLoop(deque, notifier, receiver, stopCh, bq.signalSpace)
+
+	return bq
+}
+
+// Receiver returns the channel that can be used for receiving from this BoundedQueue.
+func (bq *BoundedQueue[T]) Receiver() <-chan T {
+	return bq.receiver
+}
+
+func (bq *BoundedQueue[T]) Close() {
+	bq.stopCh <- struct{}{}
+}
+
+func (bq *BoundedQueue[T]) Length() int {
+	return bq.deque.Len()
+}
+
+func (bq *BoundedQueue[T]) Capacity() int {
+	return bq.capacity
+}
+
+func (bq *BoundedQueue[T]) InitMetricLoop(metricsClient metrics.Client, metricName string, tags any) {
+	metricsClient.NewMonitor(metricName, tags, func() int64 { return int64(bq.deque.GetAndResetLength()) })
+}
+
+// lockedHasSpace returns true if n more items can be sent without exceeding the capacity.
+// An empty queue always has space, so that batches larger than the capacity can still be sent eventually.
+func (bq *BoundedQueue[T]) lockedHasSpace(n int) bool {
+	if bq.capacity <= 0 {
+		return true
+	}
+
+	used := bq.deque.lockedLen() + bq.reserved
+	return used == 0 || used+n <= bq.capacity
+}
+
+// HasSpace returns true if n more items can be sent without exceeding the capacity.
+// An empty queue always has space, so that batches larger than the capacity can still be sent eventually.
+func (bq *BoundedQueue[T]) HasSpace(n int) bool {
+	bq.deque.lock.Lock()
+	defer bq.deque.lock.Unlock()
+
+	return bq.lockedHasSpace(n)
+}
+
+// TrySend sends an item to the queue if it is not full.
+// Returns false if the item was not sent.
+func (bq *BoundedQueue[T]) TrySend(obj T) bool {
+	bq.deque.lock.Lock()
+	if !bq.lockedHasSpace(1) {
+		bq.deque.lock.Unlock()
+		return false
+	}
+	bq.deque.LockedPushBack(obj)
+	bq.deque.lock.Unlock()
+
+	bq.notify()
+	return true
+}
+
+// Send sends an item to the queue, blocking until the queue is not full or ctx is canceled.
+func (bq *BoundedQueue[T]) Send(ctx context.Context, obj T) error {
+	for {
+		spaceCh := bq.waitSpace()
+		if bq.TrySend(obj) {
+			return nil
+		}
+
+		select {
+		case <-spaceCh:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// TryReserve reserves space for n items if the queue has space for them.
+// Returns false if nothing was reserved.
+//
+// Each reserved slot must be either sent with SendReserved or released with Unreserve.
+func (bq *BoundedQueue[T]) TryReserve(n int) bool {
+	bq.deque.lock.Lock()
+	defer bq.deque.lock.Unlock()
+
+	if !bq.lockedHasSpace(n) {
+		return false
+	}
+
+	bq.reserved += n
+	return true
+}
+
+// Reserve reserves space for n items, blocking until the queue has space for them or ctx is canceled.
+func (bq *BoundedQueue[T]) Reserve(ctx context.Context, n int) error {
+	for {
+		spaceCh := bq.waitSpace()
+		if bq.TryReserve(n) {
+			return nil
+		}
+
+		select {
+		case <-spaceCh:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Unreserve releases n slots reserved with TryReserve or Reserve without sending any items.
+func (bq *BoundedQueue[T]) Unreserve(n int) {
+	bq.deque.lock.Lock()
+	bq.reserved -= n
+	bq.deque.lock.Unlock()
+
+	bq.signalSpace()
+}
+
+// SendReserved sends an item to the queue using a slot reserved with TryReserve or Reserve.
+// It never blocks.
+func (bq *BoundedQueue[T]) SendReserved(obj T) {
+	bq.deque.lock.Lock()
+	bq.reserved -= 1
+	bq.deque.LockedPushBack(obj)
+	bq.deque.lock.Unlock()
+
+	bq.notify()
+}
+
+// SendDropOldest sends an item to the queue, dropping the oldest item if the queue is full.
+// Returns true if an item was dropped.
+func (bq *BoundedQueue[T]) SendDropOldest(obj T) bool {
+	bq.deque.lock.Lock()
+	dropped := false
+	if bq.capacity > 0 && bq.deque.lockedLen()+bq.reserved >= bq.capacity {
+		_, dropped = bq.deque.LockedPopFront()
+	}
+	bq.deque.LockedPushBack(obj)
+	bq.deque.lock.Unlock()
+
+	bq.notify()
+	return dropped
+}
+
+// waitSpace returns a channel that is closed when space may have become available.
+// It must be called before checking for space, otherwise the signal may be missed.
+func (bq *BoundedQueue[T]) waitSpace() <-chan struct{} {
+	bq.spaceLock.Lock()
+	defer bq.spaceLock.Unlock()
+
+	bq.spaceWaited = true
+	return bq.spaceCh
+}
+
+// signalSpace wakes up all goroutines waiting for space.
+func (bq *BoundedQueue[T]) signalSpace() {
+	bq.spaceLock.Lock()
+	defer bq.spaceLock.Unlock()
+
+	if bq.spaceWaited {
+		close(bq.spaceCh)
+		bq.spaceCh = make(chan struct{})
+		bq.spaceWaited = false
+	}
+}
+
+func (bq *BoundedQueue[T]) notify() {
+	select {
+	case bq.notifier <- struct{}{}:
+		// notified the receiver goroutine
+	default:
+		// no goroutine is receiving, but notifier is already nonempty anyway
+	}
+}
+
 // Deque is a typical double-ended queue implemented through a ring buffer.
 //
 // All operations on Deque locks on its own mutex, so all operations are concurrency-safe.
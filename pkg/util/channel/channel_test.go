@@ -15,7 +15,9 @@
 package channel_test
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
@@ -53,3 +55,122 @@ func TestOverflow(t *testing.T) {
 		assert.Equal(i, v.(int)-1)
 	}
 }
+
+func TestBoundedDropOldest(t *testing.T) {
+	assert := assert.New(t)
+
+	bq := channel.NewBoundedQueue[int](2)
+	defer bq.Close()
+
+	assert.True(bq.TrySend(1))
+	// wait for the first item to be moved out of the queue for receiving
+	assert.Eventually(func() bool { return bq.Length() == 0 }, time.Second, time.Millisecond)
+
+	assert.True(bq.TrySend(2))
+	assert.True(bq.TrySend(3))
+	assert.False(bq.HasSpace(1))
+	assert.False(bq.TrySend(4))
+	assert.True(bq.SendDropOldest(4))
+	assert.Equal(2, bq.Length())
+
+	assert.Equal(1, <-bq.Receiver())
+	assert.Equal(3, <-bq.Receiver())
+	assert.Equal(4, <-bq.Receiver())
+}
+
+func TestBoundedBlock(t *testing.T) {
+	assert := assert.New(t)
+
+	bq := channel.NewBoundedQueue[int](1)
+	defer bq.Close()
+
+	assert.True(bq.TrySend(1))
+	assert.Eventually(func() bool { return bq.Length() == 0 }, time.Second, time.Millisecond)
+	assert.True(bq.TrySend(2))
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancelFunc()
+	assert.ErrorIs(bq.Send(ctx, 3), context.DeadlineExceeded)
+
+	sendErrCh := make(chan error, 1)
+	go func() {
+		sendErrCh <- bq.Send(context.Background(), 3)
+	}()
+
+	assert.Equal(1, <-bq.Receiver())
+	assert.NoError(<-sendErrCh)
+	assert.Equal(2, <-bq.Receiver())
+	assert.Equal(3, <-bq.Receiver())
+}
+
+func TestBoundedHasSpaceForLargeBatch(t *testing.T) {
+	assert := assert.New(t)
+
+	bq := channel.NewBoundedQueue[int](2)
+	defer bq.Close()
+
+	// an empty queue always accepts a batch, otherwise batches larger than the capacity could never be sent
+	assert.True(bq.HasSpace(5))
+}
+
+func TestBoundedReserve(t *testing.T) {
+	assert := assert.New(t)
+
+	bq := channel.NewBoundedQueue[int](3)
+	defer bq.Close()
+
+	assert.True(bq.TrySend(1))
+	assert.Eventually(func() bool { return bq.Length() == 0 }, time.Second, time.Millisecond)
+
+	// reserved slots count towards the capacity
+	assert.True(bq.TryReserve(2))
+	assert.False(bq.TryReserve(2))
+	assert.True(bq.TrySend(2))
+	assert.False(bq.TrySend(3))
+
+	bq.Unreserve(1)
+	assert.True(bq.TrySend(3))
+	bq.SendReserved(4)
+	assert.False(bq.HasSpace(1))
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancelFunc()
+	assert.ErrorIs(bq.Reserve(ctx, 1), context.DeadlineExceeded)
+
+	assert.Equal(1, <-bq.Receiver())
+	assert.Equal(2, <-bq.Receiver())
+	assert.Equal(3, <-bq.Receiver())
+	assert.Equal(4, <-bq.Receiver())
+}
+
+func TestBoundedReserveWakesAllWaiters(t *testing.T) {
+	assert := assert.New(t)
+
+	bq := channel.NewBoundedQueue[int](2)
+	defer bq.Close()
+
+	assert.True(bq.TryReserve(2))
+
+	reserveErrCh := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			reserveErrCh <- bq.Reserve(context.Background(), 1)
+		}()
+	}
+
+	// both waiters are woken up by releasing the slots at once
+	bq.Unreserve(2)
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-reserveErrCh:
+			assert.NoError(err)
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for reservation")
+		}
+	}
+
+	bq.SendReserved(1)
+	bq.SendReserved(2)
+	assert.Equal(1, <-bq.Receiver())
+	assert.Equal(2, <-bq.Receiver())
+}
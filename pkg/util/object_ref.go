@@ -23,6 +23,11 @@ import (
 	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
 )
 
+// CollectionName is the pseudo object name of a resource collection in a namespace,
+// used for collection-scoped requests such as list and watch.
+// It is not a valid object name, so it never conflicts with a real object.
+const CollectionName = "*"
+
 type ObjectRef struct {
 	Cluster string
 
@@ -35,6 +35,12 @@ const TraceSource = Prefix + "traceSource"
 // Logs without this attribute will not have special treatment.
 const LogTypeAttr = Prefix + "logType"
 
+// The role of the related object in a span link, either "parent" or "link".
+const LinkRole = Prefix + "linkRole"
+
+// Describes the relation represented by a span link, e.g. "owner".
+const LinkType = Prefix + "linkType"
+
 type LogType string
 
 const (
@@ -43,6 +49,7 @@ const (
 	LogTypeKelemetryError LogType = "kelemetryError"
 	LogTypeObjectSnapshot LogType = "audit/objectSnapshot"
 	LogTypeObjectDiff     LogType = "audit/objectDiff"
+	LogTypeObjectPatch    LogType = "audit/objectPatch"
 	LogTypeEventMessage   LogType = "event/message"
 )
 